@@ -0,0 +1,156 @@
+package wal
+
+import (
+	"os"
+	"sync"
+)
+
+// writeBuffer is a Storage that collects appends in memory and writes them
+// to the underlying storage in one call once Config.WriteBufferSize bytes
+// have built up, or on Sync or Close. Reads overlay the buffered bytes on
+// what the storage holds, and Stat counts them, so to the rest of the WAL
+// the buffer is invisible: an entry is readable as soon as it is indexed.
+// Only another process, or a crash, can tell that it has not reached the
+// file yet.
+//
+// Only writes extending the buffered run are buffered; any other write, such
+// as AppendReader completing a header, flushes first and then goes straight
+// through. A writeBuffer is safe for concurrent use; reads only exclude
+// writes, not each other.
+type writeBuffer struct {
+	Storage
+	mu   sync.RWMutex
+	buf  []byte
+	off  int64 // storage offset of buf[0]
+	size int
+}
+
+// bufferWrites wraps f in a writeBuffer if Config.WriteBufferSize asks for
+// one. Read-only WALs write nothing and get f back.
+func (w *WAL) bufferWrites(f Storage) Storage {
+	if w.config.WriteBufferSize <= 0 || w.readOnly {
+		return f
+	}
+	return &writeBuffer{Storage: f, buf: make([]byte, 0, w.config.WriteBufferSize), size: w.config.WriteBufferSize}
+}
+
+func (b *writeBuffer) WriteAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.buf) == 0 {
+		b.off = off
+	}
+	if off == b.off+int64(len(b.buf)) {
+		if len(b.buf)+len(p) > b.size {
+			if err := b.flush(); err != nil {
+				return 0, err
+			}
+			b.off = off
+		}
+		if len(p) < b.size {
+			b.buf = append(b.buf, p...)
+			return len(p), nil
+		}
+	} else if err := b.flush(); err != nil {
+		return 0, err
+	}
+	return b.Storage.WriteAt(p, off)
+}
+
+func (b *writeBuffer) ReadAt(p []byte, off int64) (int, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	end := off + int64(len(p))
+	bufEnd := b.off + int64(len(b.buf))
+	if len(b.buf) == 0 || end <= b.off || off >= bufEnd {
+		return b.Storage.ReadAt(p, off)
+	}
+
+	n := 0
+	if off < b.off {
+		m, err := b.Storage.ReadAt(p[:b.off-off], off)
+		if err != nil {
+			return m, err
+		}
+		n = m
+	}
+	n += copy(p[n:], b.buf[off+int64(n)-b.off:])
+	if n == len(p) {
+		return n, nil
+	}
+	// Past the buffer lies whatever the storage has there, such as
+	// preallocated space.
+	m, err := b.Storage.ReadAt(p[n:], bufEnd)
+	return n + m, err
+}
+
+// Truncate cuts the buffered run too, so a failed append can be rolled back
+// without flushing the entries before it.
+func (b *writeBuffer) Truncate(size int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if bufEnd := b.off + int64(len(b.buf)); len(b.buf) > 0 && size < bufEnd {
+		b.buf = b.buf[:max(size-b.off, 0)]
+		return b.Storage.Truncate(min(size, b.off))
+	}
+	return b.Storage.Truncate(size)
+}
+
+func (b *writeBuffer) Sync() error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	return b.Storage.Sync()
+}
+
+func (b *writeBuffer) Close() error {
+	err := b.Flush()
+	if cerr := b.Storage.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (b *writeBuffer) Stat() (os.FileInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	stat, err := b.Storage.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if bufEnd := b.off + int64(len(b.buf)); len(b.buf) > 0 && bufEnd > stat.Size() {
+		return bufferedFileInfo{stat, bufEnd}, nil
+	}
+	return stat, nil
+}
+
+// Flush writes out the buffered bytes.
+func (b *writeBuffer) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flush()
+}
+
+// flush is Flush with b.mu held. Whatever part of the buffer a failed write
+// did not get out stays buffered, so no appended entry is dropped.
+func (b *writeBuffer) flush() error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+	n, err := b.Storage.WriteAt(b.buf, b.off)
+	if err != nil {
+		b.buf = append(b.buf[:0], b.buf[n:]...)
+		b.off += int64(n)
+		return err
+	}
+	b.buf = b.buf[:0]
+	return nil
+}
+
+// bufferedFileInfo reports the size of a file including its buffered tail.
+type bufferedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi bufferedFileInfo) Size() int64 { return fi.size }
@@ -0,0 +1,167 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func TestWriteBuffer(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+	config := &Config{MaxEntrySize: DefaultMaxEntrySize, WriteBufferSize: 256}
+
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	var want [][]byte
+	for i := 1; i <= 3; i++ {
+		data := []byte(fmt.Sprintf("entry %d", i))
+		want = append(want, data)
+		w.Append(data)
+	}
+
+	// The entries are only in memory, but this process reads them.
+	if stat, _ := os.Stat(walPath); stat.Size() != WALFileHeaderSize {
+		t.Errorf("Expected nothing past the header on disk yet, got %d bytes", stat.Size())
+	}
+	if got, err := w.GetEntry(2); err != nil || string(got) != "entry 2" {
+		t.Errorf("Expected entry 2 from the buffer, got %q, %v", got, err)
+	}
+	if all, err := w.ReadAll(); err != nil || !reflect.DeepEqual(all, want) {
+		t.Errorf("Expected %q from ReadAll, got %q, %v", want, all, err)
+	}
+
+	if err := w.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	if stat, _ := os.Stat(walPath); stat.Size() != w.offset {
+		t.Errorf("Expected Sync to flush up to %d, got %d bytes", w.offset, stat.Size())
+	}
+
+	// An entry larger than the buffer goes straight to the file, after
+	// what was buffered before it.
+	w.Append([]byte("entry 4"))
+	large := []byte(strings.Repeat("x", 300))
+	want = append(want, []byte("entry 4"), large)
+	w.Append(large)
+	if stat, _ := os.Stat(walPath); stat.Size() != w.offset {
+		t.Errorf("Expected the large entry written through to %d, got %d bytes", w.offset, stat.Size())
+	}
+
+	// AppendReader rewrites its header once the payload is in.
+	w.AppendReader(strings.NewReader("streamed"), 8)
+	want = append(want, []byte("streamed"))
+	w.Append([]byte("entry 7"))
+	w.Append([]byte("entry 8"))
+	if err := w.TruncateFromIndex(8); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	want = append(want, []byte("entry 7"))
+	w.Close()
+
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	if all, err := w2.ReadAll(); err != nil || !reflect.DeepEqual(all, want) {
+		t.Errorf("Expected Close to flush %q, got %q, %v", want, all, err)
+	}
+}
+
+func TestWriteBufferDiskFull(t *testing.T) {
+	s := &fullStorage{limit: 1 << 20}
+	config := &Config{MaxEntrySize: DefaultMaxEntrySize, WriteBufferSize: 64}
+	w, err := NewWithStorage(s, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.Sync()
+	s.limit = w.offset + 20
+
+	// Appends succeed into the buffer until flushing it runs out of space.
+	var appended int
+	for {
+		err := w.Append([]byte(fmt.Sprintf("entry %d", appended+1)))
+		if err != nil {
+			if !errors.Is(err, ErrDiskFull) || !errors.Is(err, syscall.ENOSPC) {
+				t.Fatalf("Expected ErrDiskFull, got %v", err)
+			}
+			break
+		}
+		appended++
+	}
+	if appended == 0 || w.LastIndex() != uint64(appended) {
+		t.Fatalf("Expected the appends before the failure kept, got %d of %d", w.LastIndex(), appended)
+	}
+	if err := w.Sync(); err == nil {
+		t.Error("Expected Sync to fail while the disk is full")
+	}
+
+	// None of the accepted entries is lost once there is space again.
+	s.limit = 1 << 20
+	if err := w.Sync(); err != nil {
+		t.Fatalf("Failed to sync after freeing space: %v", err)
+	}
+	w.Close()
+	w2, err := NewWithStorage(s, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	if w2.LastIndex() != uint64(appended) {
+		t.Errorf("Expected %d entries after recovery, got %d", appended, w2.LastIndex())
+	}
+}
+
+func TestWriteBufferConcurrentReads(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, WriteBufferSize: 256})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	const n = 200
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// Whatever is indexed reads back whole, buffered or not.
+				last := w.LastIndex()
+				for i := last; i > 0 && i+5 > last; i-- {
+					data, err := w.GetEntry(i)
+					if err != nil || string(data) != fmt.Sprintf("entry %03d", i) {
+						t.Errorf("Expected entry %d, got %q, %v", i, data, err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	for i := 1; i <= n; i++ {
+		if err := w.Append([]byte(fmt.Sprintf("entry %03d", i))); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
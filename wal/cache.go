@@ -0,0 +1,128 @@
+package wal
+
+import (
+	"container/list"
+	"sync"
+)
+
+// entryCache is a fixed-size LRU of entry payloads keyed by index. A nil
+// *entryCache is a valid, always-empty cache, used when Config.CacheSize is
+// zero.
+//
+// Payloads are copied in and out, so neither Append callers nor GetEntry
+// callers can modify what the cache holds.
+type entryCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List // front is most recently used
+	items map[uint64]*list.Element
+
+	// gen counts invalidations. A reader that looked an entry up in the
+	// index before an invalidation must not cache what it read, since the
+	// index may since have been reused for different data.
+	gen uint64
+}
+
+type cacheItem struct {
+	index uint64
+	data  []byte
+}
+
+func newEntryCache(size int) *entryCache {
+	if size <= 0 {
+		return nil
+	}
+	return &entryCache{size: size, ll: list.New(), items: make(map[uint64]*list.Element)}
+}
+
+func (c *entryCache) get(index uint64) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[index]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return append([]byte(nil), el.Value.(*cacheItem).data...), true
+}
+
+// generation returns the current invalidation count, to be passed to
+// addIfCurrent. Callers must hold indexMu so the result matches the index
+// they consult.
+func (c *entryCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// add caches data for a just-appended entry. Callers must hold writeMu,
+// which excludes truncation.
+func (c *entryCache) add(index uint64, data []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.insert(index, data)
+}
+
+// addIfCurrent caches data read from disk unless the cache was invalidated
+// after gen.
+func (c *entryCache) addIfCurrent(index uint64, data []byte, gen uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen == c.gen {
+		c.insert(index, data)
+	}
+}
+
+func (c *entryCache) insert(index uint64, data []byte) {
+	data = append([]byte(nil), data...)
+	if el, ok := c.items[index]; ok {
+		el.Value.(*cacheItem).data = data
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[index] = c.ll.PushFront(&cacheItem{index: index, data: data})
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheItem).index)
+	}
+}
+
+// removeFrom drops every entry at or after index. Callers must hold indexMu
+// for writing.
+func (c *entryCache) removeFrom(index uint64) {
+	c.remove(func(i uint64) bool { return i >= index })
+}
+
+// removeBefore drops every entry before index. Callers must hold indexMu for
+// writing.
+func (c *entryCache) removeBefore(index uint64) {
+	c.remove(func(i uint64) bool { return i < index })
+}
+
+func (c *entryCache) remove(match func(uint64) bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for i, el := range c.items {
+		if match(i) {
+			c.ll.Remove(el)
+			delete(c.items, i)
+		}
+	}
+}
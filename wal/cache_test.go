@@ -0,0 +1,113 @@
+package wal
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheHitsAndMisses(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, CacheSize: 2})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 3; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %d", i+1)))
+	}
+
+	// Entries 2 and 3 came from Append; entry 1 was evicted.
+	for _, index := range []uint64{3, 2, 1, 1} {
+		data, err := w.GetEntry(index)
+		if err != nil {
+			t.Fatalf("Failed to get entry %d: %v", index, err)
+		}
+		if want := fmt.Sprintf("entry %d", index); string(data) != want {
+			t.Errorf("Expected %s, got %s", want, data)
+		}
+	}
+	m := w.Metrics()
+	if m.CacheHits != 3 || m.CacheMisses != 1 {
+		t.Errorf("Expected 3 hits and 1 miss, got %d and %d", m.CacheHits, m.CacheMisses)
+	}
+}
+
+func TestCacheCopiesData(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, CacheSize: 4})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	data := []byte("entry 1")
+	w.Append(data)
+	data[0] = 'X'
+
+	got, _ := w.GetEntry(1)
+	got[1] = 'X'
+	again, _ := w.GetEntry(1)
+	if string(again) != "entry 1" {
+		t.Errorf("Expected cached entry 1 to be unaffected, got %s", again)
+	}
+}
+
+func TestCacheInvalidatedOnTruncate(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, CacheSize: 8})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 3; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %d", i+1)))
+	}
+	if err := w.TruncateFromIndex(2); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	if _, err := w.GetEntry(3); err == nil {
+		t.Error("Expected error for truncated entry 3")
+	}
+
+	w.Append([]byte("entry 2b"))
+	data, err := w.GetEntry(2)
+	if err != nil {
+		t.Fatalf("Failed to get entry: %v", err)
+	}
+	if string(data) != "entry 2b" {
+		t.Errorf("Expected entry 2b, got %s", data)
+	}
+
+	if err := w.TruncateBefore(2); err != nil {
+		t.Fatalf("Failed to truncate before: %v", err)
+	}
+	if _, err := w.GetEntry(1); err == nil {
+		t.Error("Expected error for head-truncated entry 1")
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	w.Append([]byte("entry 1"))
+	w.GetEntry(1)
+	if m := w.Metrics(); m.CacheHits != 0 || m.CacheMisses != 0 {
+		t.Errorf("Expected no cache activity, got %d hits and %d misses", m.CacheHits, m.CacheMisses)
+	}
+}
@@ -0,0 +1,119 @@
+package wal
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sync/atomic"
+)
+
+// Checkpoint file layout:
+//
+//	[0:4]   magic "WCKP"
+//	[4:8]   checkpoint format version
+//	[8:16]  index passed to SetCheckpoint
+//	[16:20] CRC32 of everything above
+//
+// The checkpoint is the caller's marker, typically the last index its state
+// machine applied; the WAL only stores it. It is unrelated to the index
+// checkpoints of Config.PersistIndex.
+
+// SetCheckpoint durably records index as the checkpoint, replacing any
+// earlier one; Checkpoint returns it, in this process or after a restart.
+// index may be anywhere up to the last index ever appended, and 0 clears the
+// checkpoint. Truncating the log does not move it, but Reset clears it.
+func (w *WAL) SetCheckpoint(index uint64) error {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if w.storageBacked {
+		return errNoSidecars("SetCheckpoint")
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+
+	if last := w.nextIndex - 1; index > last {
+		return fmt.Errorf("checkpoint %d is past the last index %d", index, last)
+	}
+	if err := w.writeCheckpointFile(index); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	atomic.StoreUint64(&w.checkpointIndex, index)
+	return nil
+}
+
+// Checkpoint returns the index last passed to SetCheckpoint, or 0 if none
+// was set.
+func (w *WAL) Checkpoint() (uint64, error) {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return 0, ErrWALClosed
+	}
+	return atomic.LoadUint64(&w.checkpointIndex), nil
+}
+
+func (w *WAL) writeCheckpointFile(index uint64) error {
+	buf := make([]byte, CheckpointFileSize)
+	byteOrder.PutUint32(buf[0:4], CheckpointMagicNumber)
+	byteOrder.PutUint32(buf[4:8], CheckpointVersion)
+	byteOrder.PutUint64(buf[8:16], index)
+	byteOrder.PutUint32(buf[16:20], crc32.ChecksumIEEE(buf[:16]))
+
+	tmpPath := w.checkpointPath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, w.config.fileMode())
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, w.checkpointPath); err != nil {
+		return err
+	}
+	return w.syncDir()
+}
+
+// loadCheckpointFile sets w.checkpointIndex from the checkpoint file, if any.
+func (w *WAL) loadCheckpointFile() error {
+	w.checkpointIndex = 0
+	if w.storageBacked {
+		return nil
+	}
+
+	buf, err := os.ReadFile(w.checkpointPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(buf) != CheckpointFileSize ||
+		byteOrder.Uint32(buf[0:4]) != CheckpointMagicNumber ||
+		byteOrder.Uint32(buf[4:8]) != CheckpointVersion ||
+		crc32.ChecksumIEEE(buf[:16]) != byteOrder.Uint32(buf[16:20]) {
+		return ErrCorruptedWAL
+	}
+	w.checkpointIndex = byteOrder.Uint64(buf[8:16])
+	return nil
+}
+
+func (w *WAL) removeCheckpointFile() error {
+	if err := os.Remove(w.checkpointPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointSurvivesRestart(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		w.Append([]byte("entry"))
+	}
+	if cp, err := w.Checkpoint(); err != nil || cp != 0 {
+		t.Errorf("Expected no checkpoint, got %d, %v", cp, err)
+	}
+	if err := w.SetCheckpoint(6); err == nil {
+		t.Error("Expected error for a checkpoint past the last index")
+	}
+	if err := w.SetCheckpoint(3); err != nil {
+		t.Fatalf("Failed to set checkpoint: %v", err)
+	}
+	w.TruncateFromIndex(2)
+	w.Close()
+
+	w2, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	if cp, err := w2.Checkpoint(); err != nil || cp != 3 {
+		t.Errorf("Expected checkpoint 3 after restart, got %d, %v", cp, err)
+	}
+	if err := w2.Reset(); err != nil {
+		t.Fatalf("Failed to reset: %v", err)
+	}
+	if cp, _ := w2.Checkpoint(); cp != 0 {
+		t.Errorf("Expected Reset to clear the checkpoint, got %d", cp)
+	}
+	w2.Close()
+
+	w3, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer w3.Close()
+	if cp, _ := w3.Checkpoint(); cp != 0 {
+		t.Errorf("Expected no checkpoint after Reset and restart, got %d", cp)
+	}
+}
+
+func TestCheckpointCorrupted(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.Append([]byte("entry"))
+	w.SetCheckpoint(1)
+	w.Close()
+
+	buf, _ := os.ReadFile(walPath + ".ckpt")
+	buf[15] ^= 0xFF
+	os.WriteFile(walPath+".ckpt", buf, 0644)
+
+	if _, err := New(walPath); err != ErrCorruptedWAL {
+		t.Errorf("Expected ErrCorruptedWAL, got %v", err)
+	}
+}
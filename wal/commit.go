@@ -0,0 +1,177 @@
+package wal
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Group commit: with Config.SyncInterval set, a background goroutine calls
+// Sync at that cadence, so many Appends share one fsync. Append still only
+// hands the entry to the OS; callers that need durability wait for it with
+// WaitForSync.
+
+func (w *WAL) startSyncLoop() {
+	w.stopSync = make(chan struct{})
+	w.syncDone = make(chan struct{})
+	go w.syncLoop(w.config.SyncInterval)
+}
+
+func (w *WAL) syncLoop(interval time.Duration) {
+	defer close(w.syncDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stopSync:
+			return
+		case <-ticker.C:
+			if w.syncedThrough() < w.LastIndex() {
+				// Errors reach waiters through markSynced.
+				w.Sync()
+			}
+		}
+	}
+}
+
+// stopSyncLoop stops the background committer, if any, and waits for it to
+// exit.
+func (w *WAL) stopSyncLoop() {
+	if w.stopSync == nil {
+		return
+	}
+	close(w.stopSync)
+	<-w.syncDone
+}
+
+// markSynced records the outcome of a Sync that covered every entry up to
+// index and wakes WaitForSync callers.
+func (w *WAL) markSynced(index uint64, err error) {
+	w.syncMu.Lock()
+	if err == nil && index > w.syncedIndex {
+		w.syncedIndex = index
+	}
+	w.syncErr = err
+	w.syncMu.Unlock()
+	w.syncCond.Broadcast()
+}
+
+// resetSynced lowers the synced watermark after entries from index onwards
+// were truncated, so re-appended entries aren't mistaken for durable ones.
+func (w *WAL) resetSynced(index uint64) {
+	w.syncMu.Lock()
+	if w.syncedIndex >= index {
+		w.syncedIndex = index - 1
+	}
+	w.syncMu.Unlock()
+}
+
+func (w *WAL) syncedThrough() uint64 {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	return w.syncedIndex
+}
+
+// DurableIndex returns the highest index known to be synced to disk. Append
+// returns once an entry is written, and with a write buffer or a background
+// committer it may sit in memory for a while after that, so LastIndex can
+// run ahead of this. Callers that must only act on durable entries, such as
+// a Raft node advancing its commit index, gate on DurableIndex instead.
+// Everything found when the log was opened counts as durable, and a
+// truncation lowers it along with LastIndex.
+func (w *WAL) DurableIndex() uint64 {
+	return w.syncedThrough()
+}
+
+// WaitForSync blocks until the entry at index has been durably synced. With a
+// background committer it waits for the next sync that covers the entry;
+// without one it syncs immediately. It returns the sync error if the sync
+// covering the entry failed, and ErrWALClosed if the WAL closes first.
+func (w *WAL) WaitForSync(index uint64) error {
+	if last := w.LastIndex(); index > last {
+		return fmt.Errorf("index %d has not been appended (last index: %d)", index, last)
+	}
+
+	if w.config.SyncInterval <= 0 {
+		if w.syncedThrough() >= index {
+			return nil
+		}
+		if atomic.LoadInt32(&w.closed) == 1 {
+			return ErrWALClosed
+		}
+		return w.Sync()
+	}
+
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	for w.syncedIndex < index {
+		if w.syncErr != nil {
+			return w.syncErr
+		}
+		if atomic.LoadInt32(&w.closed) == 1 {
+			return ErrWALClosed
+		}
+		w.syncCond.Wait()
+	}
+	return nil
+}
+
+// admit enforces Config.MaxPendingEntries before n entries are written. If
+// they would take the unsynced count past the limit it syncs the log first,
+// or with block unset returns ErrBackpressure. Callers must hold writeMu.
+func (w *WAL) admit(n int, block bool) error {
+	limit := w.config.MaxPendingEntries
+	if limit <= 0 {
+		return nil
+	}
+	pending := w.nextIndex - 1 - w.syncedThrough()
+	if pending == 0 || pending+uint64(n) <= uint64(limit) {
+		return nil
+	}
+	if !block {
+		return ErrBackpressure
+	}
+	return w.syncLocked()
+}
+
+// Barrier returns once every append that returned before it was called is
+// durable, syncing the log if any of them isn't yet. Entries appended
+// concurrently with the call may or may not be covered. To make entry A in
+// one WAL durable before entry B is written to another, call Barrier on the
+// first between the two appends; with several logs at once, use FenceAll.
+// Unlike WaitForSync it never waits for the background committer.
+func (w *WAL) Barrier() error {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if w.syncedThrough() >= w.LastIndex() {
+		return nil
+	}
+	return w.Sync()
+}
+
+// FenceAll calls Barrier on every WAL in ws concurrently, so the fsyncs
+// overlap, and returns once all of them have finished. The error is the
+// first one in the order of ws, if any failed.
+func FenceAll(ws ...*WAL) error {
+	errs := make([]error, len(ws))
+	var wg sync.WaitGroup
+	for i, w := range ws {
+		wg.Add(1)
+		go func(i int, w *WAL) {
+			defer wg.Done()
+			errs[i] = w.Barrier()
+		}(i, w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
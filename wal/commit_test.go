@@ -0,0 +1,436 @@
+package wal
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGroupCommit(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := &Config{
+		MaxEntrySize:   DefaultMaxEntrySize,
+		MaxSegmentSize: DefaultMaxSegmentSize,
+		SyncInterval:   5 * time.Millisecond,
+	}
+
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		if err := w.Append([]byte("entry")); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+		wg.Add(1)
+		go func(index uint64) {
+			defer wg.Done()
+			if err := w.WaitForSync(index); err != nil {
+				t.Errorf("WaitForSync(%d) failed: %v", index, err)
+			}
+		}(w.LastIndex())
+	}
+	wg.Wait()
+
+	m := w.Metrics()
+	if m.SyncCount == 0 {
+		t.Error("Expected the background committer to sync")
+	}
+	if m.SyncCount >= 20 {
+		t.Errorf("Expected syncs to be shared between entries, got %d syncs for 20 entries", m.SyncCount)
+	}
+}
+
+func TestWaitForSyncWithoutInterval(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	w.Append([]byte("entry 1"))
+	if err := w.WaitForSync(1); err != nil {
+		t.Fatalf("WaitForSync failed: %v", err)
+	}
+	if w.metrics.SyncCount != 1 {
+		t.Errorf("Expected WaitForSync to sync once, got %d", w.metrics.SyncCount)
+	}
+
+	// Already durable: no further sync.
+	if err := w.WaitForSync(1); err != nil {
+		t.Fatalf("WaitForSync failed: %v", err)
+	}
+	if w.metrics.SyncCount != 1 {
+		t.Errorf("Expected no extra sync, got %d", w.metrics.SyncCount)
+	}
+
+	if err := w.WaitForSync(2); err == nil {
+		t.Error("Expected error waiting for an entry that was never appended")
+	}
+}
+
+func TestGroupCommitClose(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := &Config{
+		MaxEntrySize:   DefaultMaxEntrySize,
+		MaxSegmentSize: DefaultMaxSegmentSize,
+		SyncInterval:   time.Hour,
+	}
+
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.Append([]byte("entry 1"))
+
+	done := make(chan error, 1)
+	go func() { done <- w.WaitForSync(1) }()
+
+	// The interval never fires; Close must flush and release the waiter.
+	time.Sleep(10 * time.Millisecond)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected the final sync on Close to satisfy the waiter, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForSync did not return after Close")
+	}
+}
+
+func TestMaxPendingEntries(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, MaxPendingEntries: 3})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 7; i++ {
+		if err := w.Append([]byte("entry")); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	// Entries 4 and 7 each found 3 unsynced entries ahead of them.
+	if m := w.Metrics(); m.SyncCount != 2 {
+		t.Errorf("Expected 2 syncs, got %d", m.SyncCount)
+	}
+	if synced := w.syncedThrough(); synced != 6 {
+		t.Errorf("Expected entries through 6 synced, got %d", synced)
+	}
+
+	// A batch over the limit is written after a sync rather than refused.
+	if _, err := w.BatchAppend([][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}); err != nil {
+		t.Fatalf("Failed to append batch: %v", err)
+	}
+	if synced := w.syncedThrough(); synced != 7 {
+		t.Errorf("Expected entries through 7 synced, got %d", synced)
+	}
+}
+
+func TestAppendNonBlocking(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, MaxPendingEntries: 2})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := w.AppendNonBlocking([]byte("entry")); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	if _, err := w.AppendNonBlocking([]byte("entry")); err != ErrBackpressure {
+		t.Fatalf("Expected ErrBackpressure, got %v", err)
+	}
+	if w.LastIndex() != 2 {
+		t.Errorf("Expected the refused entry not to be written, got LastIndex %d", w.LastIndex())
+	}
+
+	if err := w.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	index, err := w.AppendNonBlocking([]byte("entry"))
+	if err != nil || index != 3 {
+		t.Errorf("Expected index 3 after sync, got %d, %v", index, err)
+	}
+}
+
+func TestAppendBlocking(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, MaxPendingEntries: 2})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	for i := 1; i <= 3; i++ {
+		index, err := w.AppendBlocking([]byte("entry"))
+		if err != nil || index != uint64(i) {
+			t.Fatalf("Expected index %d, got %d, %v", i, index, err)
+		}
+	}
+	// Entry 3 found the limit reached and waited for a sync instead.
+	if synced := w.syncedThrough(); synced != 2 {
+		t.Errorf("Expected entries through 2 synced, got %d", synced)
+	}
+}
+
+func TestBarrierAndFenceAll(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	data, err := New(filepath.Join(tmpDir, "data.wal"))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer data.Close()
+	meta, err := NewWithConfig(filepath.Join(tmpDir, "meta.wal"), &Config{MaxEntrySize: DefaultMaxEntrySize, SyncInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer meta.Close()
+
+	data.Append([]byte("entry A"))
+	if err := data.Barrier(); err != nil {
+		t.Fatalf("Barrier failed: %v", err)
+	}
+	if data.syncedThrough() != 1 || data.metrics.SyncCount != 1 {
+		t.Errorf("Expected entry A synced by one sync, got synced %d with %d syncs", data.syncedThrough(), data.metrics.SyncCount)
+	}
+	// Nothing new: no further sync.
+	data.Barrier()
+	if data.metrics.SyncCount != 1 {
+		t.Errorf("Expected no extra sync, got %d", data.metrics.SyncCount)
+	}
+
+	// The background committer would take an hour; FenceAll doesn't wait.
+	data.Append([]byte("entry B"))
+	meta.Append([]byte("entry B meta"))
+	if err := FenceAll(data, meta); err != nil {
+		t.Fatalf("FenceAll failed: %v", err)
+	}
+	if data.syncedThrough() != 2 || meta.syncedThrough() != 1 {
+		t.Errorf("Expected both logs synced, got %d and %d", data.syncedThrough(), meta.syncedThrough())
+	}
+
+	meta.Close()
+	if err := FenceAll(data, meta); err != ErrWALClosed {
+		t.Errorf("Expected ErrWALClosed from the closed log, got %v", err)
+	}
+}
+
+// flakySync is a memStorage whose next Sync fails once fail is set.
+type flakySync struct {
+	memStorage
+	fail bool
+}
+
+func (f *flakySync) Sync() error {
+	if f.fail {
+		f.fail = false
+		return errors.New("input/output error")
+	}
+	return nil
+}
+
+func TestSyncFailureStopsWAL(t *testing.T) {
+	s := &flakySync{}
+	w, err := NewWithStorage(s, &Config{MaxEntrySize: DefaultMaxEntrySize})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.Append([]byte("entry 1"))
+
+	s.fail = true
+	if err := w.Sync(); !errors.Is(err, ErrSyncFailed) {
+		t.Fatalf("Expected ErrSyncFailed, got %v", err)
+	}
+	// The disk would take a sync now, but the WAL no longer trusts it.
+	if err := w.Sync(); !errors.Is(err, ErrSyncFailed) {
+		t.Errorf("Expected Sync to keep failing, got %v", err)
+	}
+	if err := w.Append([]byte("entry 2")); !errors.Is(err, ErrSyncFailed) {
+		t.Errorf("Expected Append to fail, got %v", err)
+	}
+	if _, err := w.BatchAppend([][]byte{[]byte("entry 2")}); !errors.Is(err, ErrSyncFailed) {
+		t.Errorf("Expected BatchAppend to fail, got %v", err)
+	}
+	if err := w.WaitForSync(1); !errors.Is(err, ErrSyncFailed) {
+		t.Errorf("Expected WaitForSync to fail, got %v", err)
+	}
+	if w.LastIndex() != 1 {
+		t.Errorf("Expected LastIndex to stay 1, got %d", w.LastIndex())
+	}
+	if got, err := w.GetEntry(1); err != nil || string(got) != "entry 1" {
+		t.Errorf("Expected reads to keep working, got %q, %v", got, err)
+	}
+	if err := w.Close(); !errors.Is(err, ErrSyncFailed) {
+		t.Errorf("Expected Close to report the failed sync, got %v", err)
+	}
+}
+
+// brokenSync is a segment whose Sync always fails.
+type brokenSync struct {
+	Storage
+}
+
+func (b brokenSync) Sync() error { return errors.New("input/output error") }
+
+func TestSyncFailureStopsMaintenance(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		w.Append([]byte("entry"))
+	}
+	active := w.file
+	w.file = brokenSync{active}
+	if err := w.Sync(); !errors.Is(err, ErrSyncFailed) {
+		t.Fatalf("Expected ErrSyncFailed, got %v", err)
+	}
+	w.file = active
+
+	// None of these may rewrite or drop entries the disk may not hold.
+	keepAll := func(uint64, uint8, []byte) bool { return true }
+	errs := map[string]error{
+		"Compact":           w.Compact(keepAll),
+		"TruncateFromIndex": w.TruncateFromIndex(3),
+		"TruncateBefore":    w.TruncateBefore(2),
+		"Retain":            w.Retain(2, 2),
+		"Reset":             w.Reset(),
+		"InstallSnapshot":   w.InstallSnapshot(2, []byte("snap")),
+	}
+	_, errs["Reclaim"] = w.Reclaim()
+	for name, err := range errs {
+		if !errors.Is(err, ErrSyncFailed) {
+			t.Errorf("Expected %s to fail with ErrSyncFailed, got %v", name, err)
+		}
+	}
+	if w.FirstIndex() != 1 || w.LastIndex() != 3 {
+		t.Errorf("Expected entries 1-3 kept, got %d-%d", w.FirstIndex(), w.LastIndex())
+	}
+	w.Close()
+}
+
+func TestTruncateSyncFailure(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	for i := 1; i <= 3; i++ {
+		w.Append([]byte("entry"))
+	}
+
+	// A truncation whose sync fails stops the WAL like any other sync.
+	seg := w.segments[len(w.segments)-1]
+	active := seg.file
+	seg.file = brokenSync{active}
+	if err := w.TruncateFromIndex(3); !errors.Is(err, ErrSyncFailed) {
+		t.Fatalf("Expected ErrSyncFailed, got %v", err)
+	}
+	seg.file = active
+	if err := w.Append([]byte("entry")); !errors.Is(err, ErrSyncFailed) {
+		t.Errorf("Expected the next append to fail with ErrSyncFailed, got %v", err)
+	}
+}
+
+func TestDurableIndex(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		w.Append([]byte("entry"))
+	}
+	if w.DurableIndex() != 0 {
+		t.Errorf("Expected nothing durable before a sync, got %d", w.DurableIndex())
+	}
+	w.Sync()
+	w.Append([]byte("entry"))
+	if w.DurableIndex() != 3 || w.LastIndex() != 4 {
+		t.Errorf("Expected durable 3 of 4, got %d of %d", w.DurableIndex(), w.LastIndex())
+	}
+	if err := w.AppendAndSync([]byte("entry")); err != nil {
+		t.Fatalf("Failed to append and sync: %v", err)
+	}
+	if w.DurableIndex() != 5 {
+		t.Errorf("Expected DurableIndex 5 after AppendAndSync, got %d", w.DurableIndex())
+	}
+
+	// Truncated entries are no longer durable, and neither are ones that
+	// take their place.
+	w.TruncateFromIndex(3)
+	w.Append([]byte("entry"))
+	if w.DurableIndex() != 2 {
+		t.Errorf("Expected DurableIndex 2 after truncating, got %d", w.DurableIndex())
+	}
+	w.Close()
+
+	w2, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	if w2.DurableIndex() != 3 {
+		t.Errorf("Expected the recovered log to be durable through 3, got %d", w2.DurableIndex())
+	}
+}
+
+func TestDisableSync(t *testing.T) {
+	// Any fsync that got through would fail.
+	w, err := NewWithStorage(&failingSync{}, &Config{MaxEntrySize: DefaultMaxEntrySize, DisableSync: true, WriteBufferSize: 1024})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	if err := w.AppendAndSync([]byte("entry 1")); err != nil {
+		t.Fatalf("Failed to append and sync: %v", err)
+	}
+	w.Append([]byte("entry 2"))
+	if err := w.WaitForSync(2); err != nil {
+		t.Fatalf("Failed to wait for sync: %v", err)
+	}
+	if w.DurableIndex() != 2 || w.Metrics().SyncCount != 2 {
+		t.Errorf("Expected 2 syncs through index 2, got %d through %d", w.Metrics().SyncCount, w.DurableIndex())
+	}
+	// The write buffer is still flushed.
+	if n := len(w.file.(*writeBuffer).buf); n != 0 {
+		t.Errorf("Expected Sync to flush the write buffer, %d bytes left", n)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("Failed to close: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package wal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// Compact rewrites the log keeping only the entries for which keep returns
+// true, in their original order. keep is called for every entry with its
+// index, type and decompressed payload, which it must not retain. Kept
+// entries keep their type and timestamp but are renumbered from 1, so
+// indices shift: this breaks the monotonic-index invariant Raft relies on
+// and is meant for logs used as a plain record store. Any snapshot and
+// checkpoint are discarded, since the indices they name now refer to other
+// entries.
+//
+// The kept entries are written to a new segment under a temporary name and
+// synced, then the meta file is switched to it, and only then is it renamed
+// into place and the old segments deleted. A crash before the switch leaves
+// the old log untouched; after it, recovery finishes the job. Appends and
+// truncations wait until Compact returns.
+func (w *WAL) Compact(keep func(index uint64, entryType uint8, data []byte) bool) error {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if w.storageBacked {
+		return errNoSidecars("Compact")
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if w.syncFailure != nil {
+		return w.syncFailure
+	}
+
+	id := w.segments[len(w.segments)-1].id + 1
+	path := segmentPath(w.filePath, id)
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, w.config.fileMode())
+	if err != nil {
+		return err
+	}
+	seg := &segment{id: id, path: path, file: file}
+	w.setCurrentFormat(seg)
+	index, end, err := w.writeCompacted(file, seg, keep)
+	if err == nil {
+		err = w.preallocate(file)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// Everything that names an old index or offset goes before the switch.
+	if err := w.removeIndexFile(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to remove index file: %w", err)
+	}
+	if err := w.removeSnapshotFile(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to remove snapshot: %w", err)
+	}
+	if err := w.removeCheckpointFile(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to remove checkpoint: %w", err)
+	}
+	start := logStart{index: 1, segment: id, offset: seg.headerSize()}
+	if err := w.writeMetaFile(start); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write meta file: %w", err)
+	}
+
+	// The switch has happened; from here on a failure is finished by the
+	// next recovery instead of undone.
+	if err := os.Rename(tmpPath, path); err != nil {
+		file.Close()
+		return err
+	}
+	if err := w.syncDir(); err != nil {
+		file.Close()
+		return err
+	}
+
+	seg.file = w.segmentFile(path, file)
+	w.indexMu.Lock()
+	defer w.indexMu.Unlock()
+	w.segments = append(w.segments, seg)
+	w.index.reset(index)
+	w.digest = sumDigests(index)
+	w.start = start
+	w.cache.removeFrom(0)
+	w.nextIndex = uint64(len(index)) + 1
+	w.resetSynced(1)
+	w.markSynced(w.nextIndex-1, nil)
+	w.snapshotIndex = 0
+	w.uncheckpointed = 0
+	atomic.StoreUint64(&w.checkpointIndex, 0)
+	atomic.StoreInt64(&w.metrics.PendingBytes, 0)
+	w.file = seg.file
+	w.pinActive()
+	w.offset = end
+	w.segmentStart = 0
+
+	w.readMu.Lock()
+	defer w.readMu.Unlock()
+	if err := w.dropSegmentsBefore(len(w.segments) - 1); err != nil {
+		return fmt.Errorf("failed to remove segments: %w", err)
+	}
+	return w.copyToMirror(seg.file, end)
+}
+
+// writeCompacted writes seg's header and the entries keep accepts to file,
+// returning their index and the end of the last one. Every entry is read
+// back with its checksum verified. Callers must hold writeMu, which keeps
+// the old segments in place.
+func (w *WAL) writeCompacted(file *os.File, seg *segment, keep func(uint64, uint8, []byte) bool) ([]EntryIndex, int64, error) {
+	out := bufio.NewWriterSize(file, 64*1024)
+	if _, err := out.Write(w.fileHeader()); err != nil {
+		return nil, 0, err
+	}
+
+	var index []EntryIndex
+	offset := seg.headerSize()
+	var werr error
+	w.index.each(0, func(e EntryIndex) bool {
+		entry, _, err := w.readEntryAt(w.segmentByID(e.Segment), e.Offset)
+		if err != nil {
+			werr = fmt.Errorf("failed to read entry %d: %w", e.Index, err)
+			return false
+		}
+		if !keep(e.Index, entry.Type, entry.Data) {
+			return true
+		}
+		encoded := w.encodeEntry(w.copyEntry(entry))
+		if _, err := out.Write(encoded); err != nil {
+			werr = err
+			return false
+		}
+		next := uint64(len(index)) + 1
+		index = append(index, EntryIndex{Index: next, Segment: seg.id, Offset: offset, Size: int64(len(encoded)), Digest: entryDigest(next, entry.Type, entry.Data)})
+		offset += int64(len(encoded))
+		return true
+	})
+	if werr != nil {
+		return nil, 0, werr
+	}
+	if err := out.Flush(); err != nil {
+		return nil, 0, err
+	}
+	return index, offset, nil
+}
+
+// finishCompact completes a Compact that crashed after switching the log
+// start to its new segment but before renaming that segment into place. It
+// reports whether there was one to finish.
+func (w *WAL) finishCompact() (bool, error) {
+	if w.readOnly || w.storageBacked || w.start.segment <= w.segments[len(w.segments)-1].id {
+		return false, nil
+	}
+	path := segmentPath(w.filePath, w.start.segment)
+	if err := os.Rename(path+".tmp", path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := w.syncDir(); err != nil {
+		return false, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, w.config.fileMode())
+	if err != nil {
+		return false, err
+	}
+	seg := &segment{id: w.start.segment, path: path, file: w.segmentFile(path, file)}
+	if err := readFileHeader(seg); err != nil {
+		seg.file.Close()
+		return false, err
+	}
+	if err := w.copyToMirror(seg.file, w.wholeEntriesEnd(path, file)); err != nil {
+		seg.file.Close()
+		return false, err
+	}
+	w.segments = append(w.segments, seg)
+	return true, nil
+}
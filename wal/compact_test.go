@@ -0,0 +1,137 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, MaxSegmentSize: 256})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 1; i <= 20; i++ {
+		w.Append([]byte(fmt.Sprintf("entry-%02d", i)))
+	}
+	w.SetCheckpoint(10)
+	if len(w.segments) < 2 {
+		t.Fatalf("Expected several segments, got %d", len(w.segments))
+	}
+
+	// Keep the even entries.
+	err = w.Compact(func(index uint64, entryType uint8, data []byte) bool {
+		return index%2 == 0
+	})
+	if err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if len(w.segments) != 1 {
+		t.Errorf("Expected 1 segment after compaction, got %d", len(w.segments))
+	}
+	if w.FirstIndex() != 1 || w.LastIndex() != 10 {
+		t.Errorf("Expected indices [1, 10], got [%d, %d]", w.FirstIndex(), w.LastIndex())
+	}
+	if cp, _ := w.Checkpoint(); cp != 0 {
+		t.Errorf("Expected checkpoint cleared, got %d", cp)
+	}
+	if err := w.Append([]byte("entry-21")); err != nil {
+		t.Fatalf("Failed to append after compaction: %v", err)
+	}
+	w.Close()
+
+	w2, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	if w2.FirstIndex() != 1 || w2.LastIndex() != 11 {
+		t.Fatalf("Expected indices [1, 11] after restart, got [%d, %d]", w2.FirstIndex(), w2.LastIndex())
+	}
+	for i := uint64(1); i <= 10; i++ {
+		got, err := w2.GetEntry(i)
+		if err != nil {
+			t.Fatalf("Failed to get entry %d: %v", i, err)
+		}
+		if want := fmt.Sprintf("entry-%02d", 2*i); string(got) != want {
+			t.Errorf("Entry %d: expected %s, got %s", i, want, got)
+		}
+	}
+	if got, _ := w2.GetEntry(11); string(got) != "entry-21" {
+		t.Errorf("Expected entry-21 at index 11, got %s", got)
+	}
+}
+
+func TestCompactCrashBeforeRename(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 1; i <= 5; i++ {
+		w.Append([]byte(fmt.Sprintf("entry-%d", i)))
+	}
+	w.Sync()
+	old, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatalf("Failed to read segment: %v", err)
+	}
+	if err := w.Compact(func(index uint64, _ uint8, _ []byte) bool { return index > 3 }); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	path := w.segments[0].path
+	w.closeSegments()
+	w.lock.Close()
+
+	// Put the state back to just after the meta file switched over: the new
+	// segment still under its temporary name, the old one not yet deleted.
+	if err := os.Rename(path, path+".tmp"); err != nil {
+		t.Fatalf("Failed to rename segment: %v", err)
+	}
+	if err := os.WriteFile(walPath, old, 0644); err != nil {
+		t.Fatalf("Failed to write old segment: %v", err)
+	}
+
+	w2, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	if w2.LastIndex() != 2 {
+		t.Fatalf("Expected LastIndex to be 2, got %d", w2.LastIndex())
+	}
+	if got, _ := w2.GetEntry(1); string(got) != "entry-4" {
+		t.Errorf("Expected entry-4 at index 1, got %s", got)
+	}
+	if _, err := os.Stat(walPath); !os.IsNotExist(err) {
+		t.Errorf("Expected old segment removed, got %v", err)
+	}
+}
+
+func TestCompactEmpty(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	w.Append([]byte("a"))
+	w.Append([]byte("b"))
+	if err := w.Compact(func(uint64, uint8, []byte) bool { return false }); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if w.LastIndex() != 0 {
+		t.Errorf("Expected empty log, got LastIndex %d", w.LastIndex())
+	}
+	if index, err := w.AppendTyped(EntryTypeData, []byte("c")); err != nil || index != 1 {
+		t.Errorf("Expected next append at index 1, got %d, %v", index, err)
+	}
+}
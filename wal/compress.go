@@ -0,0 +1,81 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The zstd encoder and decoder are safe for concurrent EncodeAll/DecodeAll
+// calls and expensive to build, so one of each is shared by every WAL.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+// compress returns data encoded with c, and the codec actually used. Data
+// that doesn't shrink is returned as is with CompressionNone.
+func compress(c Compression, data []byte) ([]byte, Compression) {
+	var out []byte
+	switch c {
+	case CompressionSnappy:
+		out = snappy.Encode(nil, data)
+	case CompressionZstd:
+		out = zstdEncoder.EncodeAll(data, nil)
+	default:
+		return data, CompressionNone
+	}
+	if len(out) >= len(data) {
+		return data, CompressionNone
+	}
+	return out, c
+}
+
+// decompress reverses compress. The decoded size is checked against limit
+// before any allocation, like the entry length in readEntryAt. If dst is
+// non-nil the payload is decoded into it, or io.ErrShortBuffer returned if
+// it doesn't fit.
+func decompress(c Compression, dst, data []byte, limit uint32) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return data, nil
+	case CompressionSnappy:
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptedWAL, err)
+		}
+		if n > int(limit) {
+			return nil, ErrEntryTooLarge
+		}
+		if dst != nil && n > len(dst) {
+			return nil, io.ErrShortBuffer
+		}
+		out, err := snappy.Decode(dst, data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptedWAL, err)
+		}
+		return out, nil
+	case CompressionZstd:
+		var h zstd.Header
+		if err := h.Decode(data); err != nil || !h.HasFCS {
+			return nil, fmt.Errorf("%w: bad zstd frame header", ErrCorruptedWAL)
+		}
+		if h.FrameContentSize > uint64(limit) {
+			return nil, ErrEntryTooLarge
+		}
+		if dst == nil {
+			dst = make([]byte, 0, h.FrameContentSize)
+		} else if h.FrameContentSize > uint64(len(dst)) {
+			return nil, io.ErrShortBuffer
+		}
+		out, err := zstdDecoder.DecodeAll(data, dst[:0])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptedWAL, err)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown compression %d", ErrCorruptedWAL, c)
+	}
+}
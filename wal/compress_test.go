@@ -0,0 +1,171 @@
+package wal
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	for _, c := range []Compression{CompressionSnappy, CompressionZstd} {
+		tmpDir := t.TempDir()
+		walPath := filepath.Join(tmpDir, "test.wal")
+
+		config := &Config{MaxEntrySize: DefaultMaxEntrySize, Compression: c}
+		w, err := NewWithConfig(walPath, config)
+		if err != nil {
+			t.Fatalf("Failed to create WAL: %v", err)
+		}
+
+		entries := [][]byte{
+			bytes.Repeat([]byte(`{"op":"set","key":"a"}`), 100),
+			[]byte("x"),
+			bytes.Repeat([]byte{0}, 4096),
+		}
+		for _, data := range entries {
+			if err := w.AppendAndSync(data); err != nil {
+				t.Fatalf("Failed to append: %v", err)
+			}
+		}
+
+		stat, _ := os.Stat(walPath)
+		if raw := int64(WALFileHeaderSize + 3*EntryHeaderSize + 2200 + 1 + 4096); stat.Size() >= raw {
+			t.Errorf("Compression %d: expected file smaller than %d bytes, got %d", c, raw, stat.Size())
+		}
+		w.Close()
+
+		w2, err := NewWithConfig(walPath, config)
+		if err != nil {
+			t.Fatalf("Failed to recover WAL: %v", err)
+		}
+		all, err := w2.ReadAll()
+		if err != nil {
+			t.Fatalf("Failed to read all: %v", err)
+		}
+		if !reflect.DeepEqual(all, entries) {
+			t.Errorf("Compression %d: recovered entries don't match", c)
+		}
+		w2.Close()
+	}
+}
+
+func TestCompressionSkippedWhenLarger(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, Compression: CompressionZstd})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.Append([]byte("abc")); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+
+	buf := make([]byte, EntryHeaderSize+3)
+	if _, err := w.file.ReadAt(buf, WALFileHeaderSize); err != nil {
+		t.Fatalf("Failed to read entry: %v", err)
+	}
+	if Compression(buf[17]) != CompressionNone || string(buf[EntryHeaderSize:]) != "abc" {
+		t.Errorf("Expected abc stored uncompressed, got flag %d data %q", buf[17], buf[EntryHeaderSize:])
+	}
+}
+
+func TestCompressionMixedLog(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+	data := bytes.Repeat([]byte("compressible "), 50)
+
+	for _, c := range []Compression{CompressionNone, CompressionSnappy, CompressionZstd} {
+		w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, Compression: c})
+		if err != nil {
+			t.Fatalf("Failed to open WAL: %v", err)
+		}
+		w.Append(data)
+		w.Close()
+	}
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w.Close()
+
+	if w.LastIndex() != 3 {
+		t.Fatalf("Expected LastIndex to be 3, got %d", w.LastIndex())
+	}
+	for i := uint64(1); i <= 3; i++ {
+		got, err := w.GetEntry(i)
+		if err != nil {
+			t.Fatalf("Failed to get entry %d: %v", i, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Entry %d doesn't match", i)
+		}
+	}
+}
+
+func TestCompressionCorruption(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := &Config{MaxEntrySize: DefaultMaxEntrySize, Compression: CompressionSnappy}
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.AppendAndSync(bytes.Repeat([]byte("a"), 1000))
+	w.AppendAndSync(bytes.Repeat([]byte("b"), 1000))
+	second := w.index.at(1).Offset
+	w.Close()
+
+	// Clear the compression flag of entry 2; the checksum covers it.
+	buf, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	buf[second+17] = byte(CompressionNone)
+	if err := os.WriteFile(walPath, buf, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	if w2.LastIndex() != 1 {
+		t.Errorf("Expected LastIndex to be 1 after recovery, got %d", w2.LastIndex())
+	}
+}
+
+func TestCompressionGetEntryInto(t *testing.T) {
+	for _, c := range []Compression{CompressionSnappy, CompressionZstd} {
+		tmpDir := t.TempDir()
+		walPath := filepath.Join(tmpDir, "test.wal")
+
+		w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, Compression: c})
+		if err != nil {
+			t.Fatalf("Failed to create WAL: %v", err)
+		}
+		data := bytes.Repeat([]byte("compressible "), 50)
+		w.Append(data)
+
+		buf := make([]byte, len(data))
+		n, err := w.GetEntryInto(1, buf)
+		if err != nil {
+			t.Fatalf("Compression %d: failed to get entry: %v", c, err)
+		}
+		if !bytes.Equal(buf[:n], data) {
+			t.Errorf("Compression %d: entry doesn't match", c)
+		}
+		if _, err := w.GetEntryInto(1, buf[:len(data)-1]); err != io.ErrShortBuffer {
+			t.Errorf("Compression %d: expected io.ErrShortBuffer, got %v", c, err)
+		}
+		w.Close()
+	}
+}
@@ -0,0 +1,89 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogDigest(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	w1, err := New(filepath.Join(tmpDir, "a.wal"))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w1.Close()
+	config := &Config{MaxEntrySize: DefaultMaxEntrySize, Compression: CompressionSnappy, CompactHeader: true}
+	w2, err := NewWithConfig(filepath.Join(tmpDir, "b.wal"), config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w2.Close()
+
+	if w1.LogDigest() != 0 {
+		t.Errorf("Expected digest 0 for an empty log, got %x", w1.LogDigest())
+	}
+	entries := [][]byte{[]byte("one"), bytes.Repeat([]byte("two "), 100), []byte("three"), []byte("four")}
+	for _, data := range entries {
+		w1.Append(data)
+	}
+	// The same content through the other append paths and format settings.
+	w2.BatchAppend(entries[:2])
+	w2.AppendReader(bytes.NewReader(entries[2]), uint32(len(entries[2])))
+	w2.Append(entries[3])
+	if w1.LogDigest() != w2.LogDigest() {
+		t.Fatalf("Expected equal digests, got %x and %x", w1.LogDigest(), w2.LogDigest())
+	}
+
+	all := w1.LogDigest()
+	if _, err := w1.AppendTyped(EntryTypeNoOp, []byte("five")); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	w2.Append([]byte("five"))
+	if w1.LogDigest() == w2.LogDigest() {
+		t.Error("Expected entry types to change the digest")
+	}
+
+	if err := w1.TruncateFromIndex(5); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	if w1.LogDigest() != all {
+		t.Errorf("Expected digest %x after truncating the tail, got %x", all, w1.LogDigest())
+	}
+	if err := w1.TruncateBefore(3); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	if want := all - entryDigest(1, EntryTypeData, entries[0]) - entryDigest(2, EntryTypeData, entries[1]); w1.LogDigest() != want {
+		t.Errorf("Expected digest %x after truncating the head, got %x", want, w1.LogDigest())
+	}
+}
+
+func TestLogDigestRecovery(t *testing.T) {
+	for _, persist := range []bool{false, true} {
+		tmpDir := t.TempDir()
+		walPath := filepath.Join(tmpDir, "test.wal")
+		config := &Config{MaxEntrySize: DefaultMaxEntrySize, MaxSegmentSize: 256, PersistIndex: persist}
+
+		w, err := NewWithConfig(walPath, config)
+		if err != nil {
+			t.Fatalf("Failed to create WAL: %v", err)
+		}
+		for i := 0; i < 20; i++ {
+			w.Append([]byte(fmt.Sprintf("entry-%d", i)))
+		}
+		w.TruncateBefore(4)
+		want := w.LogDigest()
+		w.Close()
+
+		w2, err := NewWithConfig(walPath, config)
+		if err != nil {
+			t.Fatalf("Failed to recover WAL: %v", err)
+		}
+		if w2.LogDigest() != want {
+			t.Errorf("PersistIndex %v: expected digest %x after restart, got %x", persist, want, w2.LogDigest())
+		}
+		w2.Close()
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix && !windows
+
+package wal
+
+// isDiskFull reports false on platforms with no distinct out-of-space
+// error, such as plan9, so appends there fail with the plain write error.
+func isDiskFull(err error) bool {
+	return false
+}
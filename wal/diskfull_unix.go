@@ -0,0 +1,13 @@
+//go:build unix
+
+package wal
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isDiskFull reports whether err means the filesystem ran out of space.
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
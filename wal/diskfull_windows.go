@@ -0,0 +1,17 @@
+//go:build windows
+
+package wal
+
+import (
+	"errors"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// isDiskFull reports whether err means the volume ran out of space. Windows
+// reports it as ERROR_DISK_FULL or ERROR_HANDLE_DISK_FULL rather than ENOSPC.
+func isDiskFull(err error) bool {
+	return errors.Is(err, windows.ERROR_DISK_FULL) || errors.Is(err, windows.ERROR_HANDLE_DISK_FULL) ||
+		errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,53 @@
+package wal
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestDumpEntries(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+	config := segmentConfig(8, 2)
+	config.Compression = CompressionSnappy
+
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 4; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %02d", i+1)))
+	}
+	if _, err := w.AppendTyped(EntryTypeConfig, []byte("config")); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	// Damage entry 3 in place.
+	seg := w.segmentByID(w.index.at(2).Segment)
+	seg.file.WriteAt([]byte{'X'}, w.index.at(2).Offset+w.index.at(2).Size-1)
+
+	infos, err := w.DumpEntries()
+	if err != nil {
+		t.Fatalf("Failed to dump entries: %v", err)
+	}
+	if len(infos) != 5 {
+		t.Fatalf("Expected 5 entries, got %d", len(infos))
+	}
+	for i, info := range infos {
+		idx := w.index.at(i)
+		if info.Index != idx.Index || info.Segment != idx.Segment || info.Offset != idx.Offset || info.Size != idx.Size {
+			t.Errorf("Entry %d: expected position %+v, got %+v", i+1, idx, info)
+		}
+		if want := i != 2; info.ChecksumValid != want {
+			t.Errorf("Entry %d: expected ChecksumValid %v, got %+v", i+1, want, info)
+		}
+		if info.Checksum == 0 {
+			t.Errorf("Entry %d: expected the stored checksum, got 0", i+1)
+		}
+	}
+	if infos[0].Type != EntryTypeData || infos[4].Type != EntryTypeConfig {
+		t.Errorf("Expected types %d and %d, got %d and %d", EntryTypeData, EntryTypeConfig, infos[0].Type, infos[4].Type)
+	}
+}
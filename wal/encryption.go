@@ -0,0 +1,80 @@
+package wal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// An encrypted payload is stored as a random nonce followed by the AES-GCM
+// ciphertext and tag of the (possibly compressed) payload. The entry type
+// and timestamp are authenticated too, so a sealed payload can't be passed
+// off under another entry's header.
+const (
+	EncryptionKeySize  = 32 // AES-256
+	encryptionNonce    = 12
+	encryptionOverhead = encryptionNonce + 16
+)
+
+// newAEAD returns the cipher for Config.EncryptionKey, or nil if no key is
+// set.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	if len(key) != EncryptionKeySize {
+		return nil, fmt.Errorf("encryption key is %d bytes, want %d", len(key), EncryptionKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptionAAD returns the header fields a sealed payload is bound to.
+func encryptionAAD(t uint8, timestamp int64) []byte {
+	var aad [9]byte
+	aad[0] = t
+	byteOrder.PutUint64(aad[1:9], uint64(timestamp))
+	return aad[:]
+}
+
+// seal encrypts entry's stored payload in place and marks it encrypted.
+// Callers compute the checksum afterwards, so it covers the ciphertext.
+func (w *WAL) seal(entry *WALEntry) {
+	out := make([]byte, encryptionNonce, encryptionOverhead+len(entry.Data))
+	// crypto/rand only fails if the OS has no entropy source at all, and
+	// reusing a nonce would be worse than crashing.
+	if _, err := io.ReadFull(rand.Reader, out); err != nil {
+		panic(fmt.Sprintf("wal: failed to generate nonce: %v", err))
+	}
+	entry.Data = w.aead.Seal(out, out, entry.Data, encryptionAAD(entry.Type, entry.Timestamp))
+	entry.Encrypted = true
+}
+
+// open decrypts the sealed payload of entry, as read from disk. If dst is
+// non-nil the plaintext is written into it, or io.ErrShortBuffer returned if
+// it doesn't fit. A payload the configured key cannot open fails with
+// ErrDecryptionFailed, which unlike corruption is never repaired away.
+func (w *WAL) open(dst []byte, entry *WALEntry, sealed []byte) ([]byte, error) {
+	if w.aead == nil {
+		return nil, fmt.Errorf("%w: entry is encrypted but no EncryptionKey is configured", ErrDecryptionFailed)
+	}
+	if len(sealed) < encryptionOverhead {
+		return nil, fmt.Errorf("%w: encrypted payload of %d bytes", ErrCorruptedWAL, len(sealed))
+	}
+	if dst != nil {
+		if len(dst) < len(sealed)-encryptionOverhead {
+			return nil, io.ErrShortBuffer
+		}
+		dst = dst[:0]
+	}
+	plain, err := w.aead.Open(dst, sealed[:encryptionNonce], sealed[encryptionNonce:], encryptionAAD(entry.Type, entry.Timestamp))
+	if err != nil {
+		return nil, fmt.Errorf("%w: wrong EncryptionKey?", ErrDecryptionFailed)
+	}
+	return plain, nil
+}
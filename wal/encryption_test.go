@@ -0,0 +1,127 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, EncryptionKeySize)
+}
+
+func TestEncryption(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compact=%v", compact), func(t *testing.T) {
+			tmpDir := t.TempDir()
+			walPath := filepath.Join(tmpDir, "test.wal")
+			config := &Config{MaxEntrySize: DefaultMaxEntrySize, EncryptionKey: testKey(1), Compression: CompressionZstd, CompactHeader: compact}
+
+			w, err := NewWithConfig(walPath, config)
+			if err != nil {
+				t.Fatalf("Failed to create WAL: %v", err)
+			}
+			secret := strings.Repeat("top secret ", 100)
+			w.Append([]byte(secret))
+			w.Append([]byte("short"))
+			if _, err := w.AppendReader(strings.NewReader("streamed"), 8); err != nil {
+				t.Fatalf("Failed to append from reader: %v", err)
+			}
+			w.Close()
+
+			raw, err := os.ReadFile(walPath)
+			if err != nil {
+				t.Fatalf("Failed to read segment: %v", err)
+			}
+			for _, plain := range []string{"top secret", "short", "streamed"} {
+				if bytes.Contains(raw, []byte(plain)) {
+					t.Errorf("Segment contains plaintext %q", plain)
+				}
+			}
+
+			w2, err := NewWithConfig(walPath, config)
+			if err != nil {
+				t.Fatalf("Failed to recover WAL: %v", err)
+			}
+			defer w2.Close()
+			for i, want := range []string{secret, "short", "streamed"} {
+				got, err := w2.GetEntry(uint64(i + 1))
+				if err != nil {
+					t.Fatalf("Failed to get entry %d: %v", i+1, err)
+				}
+				if string(got) != want {
+					t.Errorf("Entry %d: expected %.20q, got %.20q", i+1, want, got)
+				}
+			}
+			buf := make([]byte, 16)
+			if n, err := w2.GetEntryInto(2, buf); err != nil || string(buf[:n]) != "short" {
+				t.Errorf("GetEntryInto: expected short, got %q, %v", buf[:n], err)
+			}
+			if raw, err := w2.GetRawEntry(1); err != nil || !raw.Encrypted {
+				t.Errorf("Expected entry 1 to be stored encrypted, got %+v, %v", raw, err)
+			}
+		})
+	}
+}
+
+func TestEncryptionMixedAndWrongKey(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	// Plaintext entries written before encryption was turned on.
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.Append([]byte("plain"))
+	w.Close()
+
+	config := &Config{MaxEntrySize: DefaultMaxEntrySize, EncryptionKey: testKey(1)}
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL with a key: %v", err)
+	}
+	w2.Append([]byte("sealed"))
+	w2.Close()
+
+	w3, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	for i, want := range []string{"plain", "sealed"} {
+		if got, err := w3.GetEntry(uint64(i + 1)); err != nil || string(got) != want {
+			t.Errorf("Entry %d: expected %s, got %q, %v", i+1, want, got, err)
+		}
+	}
+	w3.Close()
+
+	stat, err := os.Stat(walPath)
+	if err != nil {
+		t.Fatalf("Failed to stat segment: %v", err)
+	}
+	for name, c := range map[string]*Config{
+		"wrong key": {MaxEntrySize: DefaultMaxEntrySize, EncryptionKey: testKey(2)},
+		"no key":    {MaxEntrySize: DefaultMaxEntrySize},
+	} {
+		if _, err := NewWithConfig(walPath, c); !errors.Is(err, ErrDecryptionFailed) {
+			t.Errorf("%s: expected ErrDecryptionFailed, got %v", name, err)
+		}
+	}
+	// Recovery refused the log instead of truncating it.
+	if after, _ := os.Stat(walPath); after.Size() != stat.Size() {
+		t.Errorf("Expected segment size %d to be kept, got %d", stat.Size(), after.Size())
+	}
+}
+
+func TestEncryptionKeySize(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	if _, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, EncryptionKey: make([]byte, 16)}); err == nil {
+		t.Fatal("Expected error for a 16-byte key")
+	}
+}
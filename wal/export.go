@@ -0,0 +1,220 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// ExportTo copies entries fromIndex through toIndex, inclusive, into a new
+// WAL at destPath, which must not exist yet. Every entry is read back from
+// disk and its checksum verified, then re-encoded with this WAL's format
+// settings, keeping its type and timestamp, and its tag if this WAL has
+// Config.EntryTags. Indices are re-based: entry
+// fromIndex becomes index 1 of the copy. Dead space, truncated-away entries
+// and sidecar files are left behind.
+//
+// The source is only read, and appends may continue during the export; an
+// entry truncated away before it is reached fails the export. On error the
+// destination may hold a partial copy and should be discarded.
+func (w *WAL) ExportTo(destPath string, fromIndex, toIndex uint64) error {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if fromIndex < w.FirstIndex() || toIndex > w.LastIndex() || fromIndex > toIndex {
+		return fmt.Errorf("export range [%d, %d] out of range [%d, %d]", fromIndex, toIndex, w.FirstIndex(), w.LastIndex())
+	}
+	return w.exportRange(destPath, fromIndex, toIndex, 1)
+}
+
+// Fork copies the log up to and including upToIndex into a new, independent
+// WAL at destPath, which must not exist yet, and returns it open for
+// writing, e.g. to try out a divergent history. The copy is made as by
+// ExportTo, except that indices are kept: the fork starts at FirstIndex, as
+// the source does, and its next append gets upToIndex+1. It is opened with
+// this WAL's config, minus the callbacks and MirrorPath, which belong to
+// the source.
+//
+// The source is only read and is unaffected. On error nothing is returned
+// and destPath may hold a partial copy that should be discarded.
+func (w *WAL) Fork(destPath string, upToIndex uint64) (*WAL, error) {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return nil, ErrWALClosed
+	}
+	first := w.FirstIndex()
+	if upToIndex < first || upToIndex > w.LastIndex() {
+		return nil, fmt.Errorf("fork up to %d out of range [%d, %d]", upToIndex, first, w.LastIndex())
+	}
+	if err := w.exportRange(destPath, first, upToIndex, first); err != nil {
+		return nil, err
+	}
+
+	config := *w.config
+	config.OnAppend = nil
+	config.OnCorruption = nil
+	config.OnSegmentRotate = nil
+	config.OnLargeEntry = nil
+	// The source's mirror is its own, and locked.
+	config.MirrorPath = ""
+	return NewWithConfig(destPath, &config)
+}
+
+// exportRange copies entries fromIndex through toIndex into a new WAL at
+// destPath whose first index is first, and closes it.
+func (w *WAL) exportRange(destPath string, fromIndex, toIndex, first uint64) error {
+	if ids, err := discoverSegments(destPath); err != nil && !os.IsNotExist(err) {
+		return err
+	} else if len(ids) > 0 {
+		return fmt.Errorf("export destination %s already exists", destPath)
+	}
+
+	config := *w.config
+	config.OnAppend = nil
+	config.OnLargeEntry = nil
+	config.OnCorruption = nil
+	config.OnSegmentRotate = nil
+	config.MirrorPath = ""
+	config.SyncInterval = 0
+	// Copied entries keep their old timestamps, which would seal every
+	// segment after one entry.
+	config.RotationInterval = 0
+	dest, err := NewWithConfig(destPath, &config)
+	if err != nil {
+		return err
+	}
+	if err := dest.TruncateBefore(first); err != nil {
+		dest.Close()
+		return err
+	}
+
+	for i := fromIndex; i <= toIndex; i++ {
+		entry, err := w.exportEntry(i)
+		if err == nil {
+			err = dest.importEntry(entry)
+		}
+		if err != nil {
+			dest.Close()
+			return fmt.Errorf("export of entry %d: %w", i, err)
+		}
+	}
+	if err := dest.Sync(); err != nil {
+		dest.Close()
+		return err
+	}
+	return dest.Close()
+}
+
+// exportEntry reads the entry at index with its checksum verified, whatever
+// Config.SkipChecksumOnRead says.
+func (w *WAL) exportEntry(index uint64) (*WALEntry, error) {
+	w.indexMu.RLock()
+	info, ok := w.entryAt(index)
+	if !ok {
+		w.indexMu.RUnlock()
+		return nil, fmt.Errorf("index out of bounds")
+	}
+	seg := w.segmentByID(info.Segment)
+	w.readMu.RLock()
+	defer w.readMu.RUnlock()
+	w.indexMu.RUnlock()
+	entry, _, err := w.readEntryAt(seg, info.Offset)
+	if err != nil && isCorruption(err) {
+		w.reportCorruption(index, info.Offset, err)
+	}
+	return entry, err
+}
+
+// importEntry appends an entry read from another WAL as the next entry,
+// keeping its type, timestamp and, with Config.EntryTags and
+// Config.Namespaces, tag and namespace.
+func (w *WAL) importEntry(src *WALEntry) error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	_, err := w.writeEntryLocked(w.copyEntry(src), src.Data)
+	return err
+}
+
+// importBatchSize caps the bytes ImportFrom buffers before appending them.
+const importBatchSize = 1 << 20
+
+// ImportFrom bulk-loads a stream of payloads, such as a backup or a log in
+// another format, appending each as a data entry. decode is called
+// repeatedly to read the next payload from r; it returns io.EOF when r is
+// used up, and io.ErrUnexpectedEOF, as io.ReadFull does, when r ends part-way
+// through a payload. decode must return a new slice each time: payloads are
+// held until their batch is appended, as BatchAppend would, and the log is
+// synced once at the end, which is much faster than AppendAndSync per entry.
+//
+// ImportFrom returns the number of entries imported. On error the entries
+// before the failing one stay appended and are synced, and count says how
+// many there were; a source truncated mid-entry fails with an error wrapping
+// io.ErrUnexpectedEOF.
+func (w *WAL) ImportFrom(r io.Reader, decode func(io.Reader) ([]byte, error)) (count uint64, err error) {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return 0, ErrWALClosed
+	}
+	if w.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	limit := int64(importBatchSize)
+	if w.config.MaxSegmentSize > 0 {
+		limit = min(limit, w.config.MaxSegmentSize)
+	}
+	var batch [][]byte
+	var size int64
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, err := w.BatchAppend(batch); err != nil {
+			return fmt.Errorf("import of entries %d-%d: %w", count+1, count+uint64(len(batch)), err)
+		}
+		count += uint64(len(batch))
+		batch, size = batch[:0], 0
+		return nil
+	}
+
+	for {
+		data, derr := decode(r)
+		if derr == io.EOF {
+			break
+		}
+		if derr != nil {
+			if errors.Is(derr, io.ErrUnexpectedEOF) {
+				derr = fmt.Errorf("source truncated in entry %d: %w", count+uint64(len(batch))+1, derr)
+			} else {
+				derr = fmt.Errorf("decode of entry %d: %w", count+uint64(len(batch))+1, derr)
+			}
+			if err := flush(); err != nil {
+				return count, err
+			}
+			if err := w.Sync(); err != nil {
+				return count, err
+			}
+			return count, derr
+		}
+		if data == nil {
+			data = []byte{}
+		}
+		if size > 0 && size+EncodedSize(data) > limit {
+			if err := flush(); err != nil {
+				return count, err
+			}
+		}
+		batch = append(batch, data)
+		size += EncodedSize(data)
+	}
+	if err := flush(); err != nil {
+		return count, err
+	}
+	if err := w.Sync(); err != nil {
+		return count, err
+	}
+	return count, nil
+}
@@ -0,0 +1,295 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExportTo(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+	destPath := filepath.Join(tmpDir, "copy.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, MaxSegmentSize: 100})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 6; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %d", i+1)))
+	}
+	w.AppendTyped(EntryTypeConfig, []byte("config"))
+	if err := w.TruncateBefore(3); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+
+	if err := w.ExportTo(destPath, 4, 7); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	if w.FirstIndex() != 3 || w.LastIndex() != 7 {
+		t.Errorf("Expected source to keep [3, 7], got [%d, %d]", w.FirstIndex(), w.LastIndex())
+	}
+
+	dest, err := New(destPath)
+	if err != nil {
+		t.Fatalf("Failed to open export: %v", err)
+	}
+	defer dest.Close()
+
+	all, err := dest.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read export: %v", err)
+	}
+	expected := [][]byte{[]byte("entry 4"), []byte("entry 5"), []byte("entry 6"), []byte("config")}
+	if !reflect.DeepEqual(all, expected) {
+		t.Errorf("Expected %q, got %q", expected, all)
+	}
+	for i := uint64(1); i <= 4; i++ {
+		got, _ := dest.GetRawEntry(i)
+		want, _ := w.GetRawEntry(i + 3)
+		if got == nil || want == nil || got.Type != want.Type || got.Timestamp != want.Timestamp {
+			t.Errorf("Entry %d: expected type and timestamp of source entry %d, got %+v", i, i+3, got)
+		}
+	}
+}
+
+func TestExportToRejects(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+	destPath := filepath.Join(tmpDir, "copy.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	w.Append([]byte("entry 1"))
+	w.Append([]byte("entry 2"))
+
+	for _, r := range [][2]uint64{{0, 1}, {1, 3}, {2, 1}} {
+		if err := w.ExportTo(destPath, r[0], r[1]); err == nil {
+			t.Errorf("Expected error exporting [%d, %d]", r[0], r[1])
+		}
+	}
+
+	os.WriteFile(destPath, []byte("keep me"), 0644)
+	if err := w.ExportTo(destPath, 1, 2); err == nil {
+		t.Error("Expected error exporting over an existing file")
+	}
+	if data, _ := os.ReadFile(destPath); string(data) != "keep me" {
+		t.Errorf("Expected existing file untouched, got %q", data)
+	}
+}
+
+func TestExportToCorruption(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, SkipChecksumOnRead: true})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	w.AppendAndSync([]byte("entry 1"))
+	w.AppendAndSync([]byte("entry 2"))
+	w.file.WriteAt([]byte{'X'}, w.index.at(1).Offset+EntryHeaderSize)
+
+	err = w.ExportTo(filepath.Join(tmpDir, "copy.wal"), 1, 2)
+	if !errors.Is(err, ErrCorruptedWAL) {
+		t.Errorf("Expected ErrCorruptedWAL despite SkipChecksumOnRead, got %v", err)
+	}
+}
+
+// decodeLengthPrefixed reads a payload stored after its 4-byte length.
+func decodeLengthPrefixed(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(r, data); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func TestImportFrom(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	var src bytes.Buffer
+	var expected [][]byte
+	for i := 0; i < 500; i++ {
+		data := []byte(fmt.Sprintf("imported entry %d", i+1))
+		binary.Write(&src, binary.BigEndian, uint32(len(data)))
+		src.Write(data)
+		expected = append(expected, data)
+	}
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, MaxSegmentSize: 4096})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.Append([]byte("existing"))
+	count, err := w.ImportFrom(&src, decodeLengthPrefixed)
+	if err != nil || count != 500 {
+		t.Fatalf("Expected 500 entries imported, got %d, %v", count, err)
+	}
+	if w.LastIndex() != 501 || w.DurableIndex() != 501 {
+		t.Errorf("Expected entries through 501 synced, got last %d, durable %d", w.LastIndex(), w.DurableIndex())
+	}
+	if len(w.segments) < 2 {
+		t.Errorf("Expected the import to span segments, got %d", len(w.segments))
+	}
+	w.Close()
+
+	w, err = New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer w.Close()
+	all, err := w.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read WAL: %v", err)
+	}
+	if !reflect.DeepEqual(all, append([][]byte{[]byte("existing")}, expected...)) {
+		t.Errorf("Expected the existing entry then the imported ones, got %d entries", len(all))
+	}
+}
+
+func TestImportFromTruncated(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	var src bytes.Buffer
+	for i := 0; i < 3; i++ {
+		binary.Write(&src, binary.BigEndian, uint32(5))
+		src.WriteString(fmt.Sprintf("entr%d", i+1))
+	}
+	binary.Write(&src, binary.BigEndian, uint32(5))
+	src.WriteString("en")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	count, err := w.ImportFrom(&src, decodeLengthPrefixed)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Expected a truncation error, got %v", err)
+	}
+	if count != 3 || w.LastIndex() != 3 || w.DurableIndex() != 3 {
+		t.Errorf("Expected the 3 whole entries imported and synced, got %d, last %d, durable %d", count, w.LastIndex(), w.DurableIndex())
+	}
+	if got, err := w.GetEntry(3); err != nil || string(got) != "entr3" {
+		t.Errorf("Expected entry 3, got %q, %v", got, err)
+	}
+}
+
+func TestFork(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+	forkPath := filepath.Join(tmpDir, "fork.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, MaxSegmentSize: 100})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	for i := 0; i < 6; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %d", i+1)))
+	}
+	if err := w.TruncateBefore(2); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+
+	fork, err := w.Fork(forkPath, 4)
+	if err != nil {
+		t.Fatalf("Failed to fork: %v", err)
+	}
+	defer fork.Close()
+	if fork.FirstIndex() != 2 || fork.LastIndex() != 4 {
+		t.Errorf("Expected the fork to hold [2, 4], got [%d, %d]", fork.FirstIndex(), fork.LastIndex())
+	}
+	if index, err := fork.AppendTyped(EntryTypeData, []byte("forked 5")); err != nil || index != 5 {
+		t.Fatalf("Expected the fork to continue at 5, got %d, %v", index, err)
+	}
+	w.Append([]byte("entry 7"))
+
+	if got, _ := fork.GetEntry(5); string(got) != "forked 5" {
+		t.Errorf("Expected the fork's own entry 5, got %q", got)
+	}
+	if got, _ := w.GetEntry(5); string(got) != "entry 5" {
+		t.Errorf("Expected the source's entry 5 unaffected, got %q", got)
+	}
+	if w.FirstIndex() != 2 || w.LastIndex() != 7 {
+		t.Errorf("Expected the source to hold [2, 7], got [%d, %d]", w.FirstIndex(), w.LastIndex())
+	}
+
+	fork.Close()
+	fork, err = New(forkPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen fork: %v", err)
+	}
+	defer fork.Close()
+	all, err := fork.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read fork: %v", err)
+	}
+	expected := [][]byte{[]byte("entry 2"), []byte("entry 3"), []byte("entry 4"), []byte("forked 5")}
+	if !reflect.DeepEqual(all, expected) {
+		t.Errorf("Expected %q, got %q", expected, all)
+	}
+
+	if _, err := w.Fork(forkPath, 3); err == nil {
+		t.Error("Expected error forking onto an existing WAL")
+	}
+	if _, err := w.Fork(filepath.Join(tmpDir, "other.wal"), 8); err == nil {
+		t.Error("Expected error forking past the last index")
+	}
+}
+
+func TestExportMirrored(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+	mirrorPath := filepath.Join(tmpDir, "mirror", "test.wal")
+
+	w, err := NewWithConfig(walPath, mirrorConfig(mirrorPath))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	for i := 0; i < 5; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %02d", i+1)))
+	}
+
+	// The copies are unmirrored, and leave the source's mirror alone.
+	if err := w.ExportTo(filepath.Join(tmpDir, "export.wal"), 2, 4); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	fork, err := w.Fork(filepath.Join(tmpDir, "fork.wal"), 3)
+	if err != nil {
+		t.Fatalf("Failed to fork: %v", err)
+	}
+	defer fork.Close()
+	if err := fork.Append([]byte("forked 04")); err != nil {
+		t.Fatalf("Failed to append to fork: %v", err)
+	}
+	w.Append([]byte("entry 06"))
+	if err := w.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	assertMirrored(t, walPath, mirrorPath)
+}
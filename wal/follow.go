@@ -0,0 +1,76 @@
+package wal
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Follow streams entries like tail -f: it replays the log from fromIndex,
+// then delivers every entry appended after that as it is written, until ctx
+// is cancelled or the WAL closes. fromIndex may be LastIndex()+1 to receive
+// only new entries. Entries are delivered once written, not once synced.
+//
+// The channel is unbuffered and closed when following stops. If an entry
+// can't be read, for example because it was truncated away before the
+// follower reached it, a final event carries the error. Event data must not
+// be modified.
+func (w *WAL) Follow(ctx context.Context, fromIndex uint64) (<-chan FollowEvent, error) {
+	it, err := w.Iterator(fromIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan FollowEvent)
+	go func() {
+		defer close(events)
+		for {
+			// Take the wake-up channel before catching up, so an append
+			// landing in between is not missed.
+			appended := w.appendSignal()
+			for it.Next() {
+				select {
+				case events <- FollowEvent{Index: it.Index(), Data: it.Entry()}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if atomic.LoadInt32(&w.closed) == 1 {
+				return
+			}
+			if err := it.Err(); err != nil {
+				select {
+				case events <- FollowEvent{Index: it.next, Err: err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			select {
+			case <-appended:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// appendSignal returns a channel that is closed by the next append.
+func (w *WAL) appendSignal() <-chan struct{} {
+	w.followMu.Lock()
+	defer w.followMu.Unlock()
+	if w.appended == nil {
+		w.appended = make(chan struct{})
+	}
+	return w.appended
+}
+
+// wakeFollowers releases every Follow goroutine waiting for an append. It
+// costs one lock when nobody is following.
+func (w *WAL) wakeFollowers() {
+	w.followMu.Lock()
+	if w.appended != nil {
+		close(w.appended)
+		w.appended = nil
+	}
+	w.followMu.Unlock()
+}
@@ -0,0 +1,128 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, events <-chan FollowEvent) FollowEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatal("Follow channel closed early")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a Follow event")
+	}
+	return FollowEvent{}
+}
+
+func TestFollow(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	for i := 1; i <= 3; i++ {
+		w.Append([]byte(fmt.Sprintf("entry-%d", i)))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := w.Follow(ctx, 2)
+	if err != nil {
+		t.Fatalf("Failed to follow: %v", err)
+	}
+
+	// Replay, then live appends, including a batch.
+	go func() {
+		w.Append([]byte("entry-4"))
+		w.BatchAppend([][]byte{[]byte("entry-5"), []byte("entry-6")})
+	}()
+	for i := uint64(2); i <= 6; i++ {
+		ev := nextEvent(t, events)
+		if want := fmt.Sprintf("entry-%d", i); ev.Index != i || string(ev.Data) != want || ev.Err != nil {
+			t.Fatalf("Expected {%d %s}, got {%d %s %v}", i, want, ev.Index, ev.Data, ev.Err)
+		}
+	}
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("Expected no events after cancellation")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Follow channel not closed after cancellation")
+	}
+}
+
+func TestFollowClose(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	events, err := w.Follow(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("Failed to follow: %v", err)
+	}
+	w.Close()
+
+	select {
+	case ev, ok := <-events:
+		if ok {
+			t.Errorf("Expected channel closed, got event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Follow channel not closed after Close")
+	}
+	if _, err := w.Follow(context.Background(), 1); err != ErrWALClosed {
+		t.Errorf("Expected ErrWALClosed, got %v", err)
+	}
+}
+
+func TestFollowTruncated(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	for i := 0; i < 5; i++ {
+		w.Append([]byte("entry"))
+	}
+	events, err := w.Follow(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("Failed to follow: %v", err)
+	}
+	nextEvent(t, events)
+	if err := w.TruncateBefore(4); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+
+	for {
+		ev := nextEvent(t, events)
+		if ev.Err != nil {
+			break
+		}
+		if ev.Index >= 4 {
+			t.Fatalf("Expected an error before entry %d", ev.Index)
+		}
+	}
+	if _, ok := <-events; ok {
+		t.Error("Expected channel closed after the error event")
+	}
+}
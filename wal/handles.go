@@ -0,0 +1,220 @@
+package wal
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// segmentHandles bounds how many segment files are open at once, for
+// Config.MaxOpenSegments. Each segment's file is a lazyFile that opens
+// itself when used; once more than max are open, the least recently used
+// are closed again. The active segment is exempt, so appends never wait on
+// an open.
+type segmentHandles struct {
+	mu     sync.Mutex
+	max    int
+	ll     *list.List // open lazyFiles, most recently used first
+	active *lazyFile
+}
+
+func newSegmentHandles(max int) *segmentHandles {
+	if max <= 0 {
+		return nil
+	}
+	return &segmentHandles{max: max, ll: list.New()}
+}
+
+// lazyFile is a segment file opened on demand. Every Storage call opens it
+// if need be and keeps it from being closed until the call returns.
+type lazyFile struct {
+	h    *segmentHandles
+	open func() (Storage, error)
+
+	mu     sync.RWMutex // held for reading while file is in use
+	file   Storage      // nil while closed
+	closed bool         // Close was called; the segment is gone
+	el     *list.Element
+}
+
+// lazy returns a lazyFile for a segment that open opens, which is not open
+// yet if file is nil.
+func (h *segmentHandles) lazy(file Storage, open func() (Storage, error)) *lazyFile {
+	l := &lazyFile{h: h, open: open, file: file}
+	if file != nil {
+		h.add(l)
+	}
+	return l
+}
+
+// setActive exempts l from being closed, in place of the previous active
+// segment.
+func (h *segmentHandles) setActive(l *lazyFile) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.active = l
+}
+
+// touch marks l as just used. Callers hold l.mu for reading.
+func (h *segmentHandles) touch(l *lazyFile) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if l.el != nil {
+		h.ll.MoveToFront(l.el)
+	}
+}
+
+// add records that l was opened and closes least recently used files until
+// at most max are open.
+func (h *segmentHandles) add(l *lazyFile) {
+	var victims []*lazyFile
+	h.mu.Lock()
+	if l.el == nil {
+		l.el = h.ll.PushFront(l)
+	}
+	for el := h.ll.Back(); el != nil && h.ll.Len() > h.max; {
+		prev := el.Prev()
+		if v := el.Value.(*lazyFile); v != h.active && v != l {
+			h.ll.Remove(el)
+			v.el = nil
+			victims = append(victims, v)
+		}
+		el = prev
+	}
+	h.mu.Unlock()
+
+	// Closing waits for calls in progress, which may need h.mu to touch.
+	for _, v := range victims {
+		v.release()
+	}
+}
+
+// remove forgets l, which was closed for good.
+func (h *segmentHandles) remove(l *lazyFile) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if l.el != nil {
+		h.ll.Remove(l.el)
+		l.el = nil
+	}
+}
+
+// acquire returns the open file with l.mu held for reading, opening it
+// first if it is closed. Callers release it with l.mu.RUnlock.
+func (l *lazyFile) acquire() (Storage, error) {
+	for {
+		l.mu.RLock()
+		if l.file != nil {
+			l.h.touch(l)
+			return l.file, nil
+		}
+		l.mu.RUnlock()
+		if err := l.reopen(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (l *lazyFile) reopen() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return os.ErrClosed
+	}
+	if l.file != nil {
+		l.mu.Unlock()
+		return nil
+	}
+	file, err := l.open()
+	if err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	l.file = file
+	l.mu.Unlock()
+	l.h.add(l)
+	return nil
+}
+
+// release closes the file until it is next used.
+func (l *lazyFile) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+func (l *lazyFile) ReadAt(p []byte, off int64) (int, error) {
+	f, err := l.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer l.mu.RUnlock()
+	return f.ReadAt(p, off)
+}
+
+func (l *lazyFile) WriteAt(p []byte, off int64) (int, error) {
+	f, err := l.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer l.mu.RUnlock()
+	return f.WriteAt(p, off)
+}
+
+func (l *lazyFile) Truncate(size int64) error {
+	f, err := l.acquire()
+	if err != nil {
+		return err
+	}
+	defer l.mu.RUnlock()
+	return f.Truncate(size)
+}
+
+func (l *lazyFile) Sync() error {
+	f, err := l.acquire()
+	if err != nil {
+		return err
+	}
+	defer l.mu.RUnlock()
+	return f.Sync()
+}
+
+func (l *lazyFile) Stat() (os.FileInfo, error) {
+	f, err := l.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer l.mu.RUnlock()
+	return f.Stat()
+}
+
+func (l *lazyFile) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	f := l.file
+	l.file = nil
+	l.mu.Unlock()
+	l.h.remove(l)
+	if f == nil {
+		return nil
+	}
+	return f.Close()
+}
+
+// pinActive keeps the active segment's file open from now on. Callers must
+// hold writeMu, or be opening the WAL.
+func (w *WAL) pinActive() {
+	if w.handles == nil {
+		return
+	}
+	f := w.file
+	if b, ok := f.(*writeBuffer); ok {
+		f = b.Storage
+	}
+	if l, ok := f.(*lazyFile); ok {
+		w.handles.setActive(l)
+	}
+}
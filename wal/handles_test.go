@@ -0,0 +1,111 @@
+package wal
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// openHandles returns how many segment files w has open.
+func openHandles(w *WAL) int {
+	n := 0
+	for _, seg := range w.segments {
+		if l, ok := seg.file.(*lazyFile); ok {
+			l.mu.RLock()
+			if l.file != nil {
+				n++
+			}
+			l.mu.RUnlock()
+		}
+	}
+	return n
+}
+
+func TestMaxOpenSegments(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+	config := segmentConfig(8, 2)
+	config.MaxOpenSegments = 2
+
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := w.Append([]byte(fmt.Sprintf("entry-%02d", i))); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	if len(w.segments) != 5 {
+		t.Fatalf("Expected 5 segments, got %d", len(w.segments))
+	}
+	if n := openHandles(w); n > 2 {
+		t.Errorf("Expected at most 2 open segments after appending, got %d", n)
+	}
+
+	// Reading every segment opens each one in turn.
+	for i := uint64(1); i <= 10; i++ {
+		got, err := w.GetEntry(i)
+		if err != nil || string(got) != fmt.Sprintf("entry-%02d", i-1) {
+			t.Fatalf("Expected entry %d, got %q, %v", i, got, err)
+		}
+		if n := openHandles(w); n > 2 {
+			t.Fatalf("Expected at most 2 open segments after reading %d, got %d", i, n)
+		}
+	}
+	active := w.segments[len(w.segments)-1].file.(*lazyFile)
+	if active.file == nil {
+		t.Error("Expected the active segment to stay open")
+	}
+	w.Close()
+
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	if w2.LastIndex() != 10 {
+		t.Errorf("Expected LastIndex 10 after recovery, got %d", w2.LastIndex())
+	}
+	if n := openHandles(w2); n > 2 {
+		t.Errorf("Expected at most 2 open segments after recovery, got %d", n)
+	}
+	if err := w2.Append([]byte("entry-10")); err != nil {
+		t.Errorf("Failed to append after recovery: %v", err)
+	}
+	all, err := w2.ReadAll()
+	if err != nil || len(all) != 11 {
+		t.Errorf("Expected 11 entries, got %d, %v", len(all), err)
+	}
+}
+
+func TestMaxOpenSegmentsTruncate(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+	config := segmentConfig(8, 2)
+	config.MaxOpenSegments = 1
+
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	for i := 0; i < 8; i++ {
+		w.Append([]byte(fmt.Sprintf("entry-%02d", i)))
+	}
+
+	// Entry 2 is in the first, long closed segment, which becomes active.
+	if err := w.TruncateFromIndex(2); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	w.GetEntry(1)
+	if err := w.Append([]byte("entry-xx")); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if got, err := w.GetEntry(2); err != nil || string(got) != "entry-xx" {
+		t.Errorf("Expected the new entry 2, got %q, %v", got, err)
+	}
+	if n := openHandles(w); n != 1 {
+		t.Errorf("Expected 1 open segment, got %d", n)
+	}
+}
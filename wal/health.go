@@ -0,0 +1,69 @@
+package wal
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheck reports whether the WAL is usable, for liveness and readiness
+// probes, without writing anything. It fails with ErrWALClosed after Close,
+// with the error of the last sync if that failed, with a wrapped error if
+// the active segment can no longer be stat'ed, and with ErrSyncStale if
+// Config.MaxUnsyncedAge is set and the oldest unsynced entry was appended
+// longer ago than that. Read-only WALs never sync, so for them only the
+// first and the stat check apply.
+func (w *WAL) HealthCheck() error {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+
+	w.indexMu.RLock()
+	active := w.segments[len(w.segments)-1]
+	w.indexMu.RUnlock()
+	if _, err := active.file.Stat(); err != nil {
+		return fmt.Errorf("stat of active segment %s: %w", active.path, err)
+	}
+	if w.readOnly {
+		return nil
+	}
+
+	w.syncMu.Lock()
+	synced, syncErr := w.syncedIndex, w.syncErr
+	w.syncMu.Unlock()
+	if syncErr != nil {
+		return fmt.Errorf("last sync failed: %w", syncErr)
+	}
+	if w.config.MaxUnsyncedAge <= 0 {
+		return nil
+	}
+	ts, err := w.appendTime(synced + 1)
+	if err != nil || ts.IsZero() {
+		// Everything is synced, or the entry went in the meantime.
+		return nil
+	}
+	if age := w.config.now().Sub(ts); age > w.config.MaxUnsyncedAge {
+		return fmt.Errorf("%w: entry %d has waited %v for a sync, more than %v", ErrSyncStale, synced+1, age, w.config.MaxUnsyncedAge)
+	}
+	return nil
+}
+
+// appendTime returns when the entry at index was appended, reading only its
+// header, or the zero Time if it has no timestamp.
+func (w *WAL) appendTime(index uint64) (time.Time, error) {
+	w.indexMu.RLock()
+	info, ok := w.entryAt(index)
+	if !ok {
+		w.indexMu.RUnlock()
+		return time.Time{}, fmt.Errorf("index out of bounds")
+	}
+	seg := w.segmentByID(info.Segment)
+	w.readMu.RLock()
+	defer w.readMu.RUnlock()
+	w.indexMu.RUnlock()
+	h, err := readEntryHeader(seg, info.Offset)
+	if err != nil || h.timestamp == 0 {
+		return time.Time{}, err
+	}
+	return time.Unix(0, h.timestamp), nil
+}
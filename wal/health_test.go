@@ -0,0 +1,75 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	config := &Config{MaxEntrySize: DefaultMaxEntrySize, Clock: clock, MaxUnsyncedAge: time.Minute}
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	if err := w.HealthCheck(); err != nil {
+		t.Errorf("Expected a new WAL to be healthy, got %v", err)
+	}
+
+	w.Append([]byte("entry 1"))
+	clock.advance(30 * time.Second)
+	if err := w.HealthCheck(); err != nil {
+		t.Errorf("Expected an entry unsynced for 30s to be fine, got %v", err)
+	}
+	clock.advance(time.Minute)
+	if err := w.HealthCheck(); !errors.Is(err, ErrSyncStale) {
+		t.Errorf("Expected ErrSyncStale, got %v", err)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	if err := w.HealthCheck(); err != nil {
+		t.Errorf("Expected a synced WAL to be healthy, got %v", err)
+	}
+
+	// A file handle gone bad is reported.
+	w.file.(*os.File).Close()
+	if err := w.HealthCheck(); err == nil {
+		t.Error("Expected error with the active segment closed")
+	}
+	w.Close()
+	if err := w.HealthCheck(); !errors.Is(err, ErrWALClosed) {
+		t.Errorf("Expected ErrWALClosed, got %v", err)
+	}
+}
+
+// failingSync is a memStorage whose Sync fails.
+type failingSync struct {
+	memStorage
+}
+
+func (f *failingSync) Sync() error { return errors.New("sync failed") }
+
+func TestHealthCheckSyncFailure(t *testing.T) {
+	s := &flakySync{}
+	w, err := NewWithStorage(s, &Config{MaxEntrySize: DefaultMaxEntrySize})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	w.Append([]byte("entry 1"))
+	s.fail = true
+	if err := w.Sync(); err == nil {
+		t.Fatal("Expected the sync to fail")
+	}
+	if err := w.HealthCheck(); err == nil {
+		t.Error("Expected the failed sync to be reported")
+	}
+}
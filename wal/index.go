@@ -0,0 +1,294 @@
+package wal
+
+import (
+	"hash/crc32"
+	"os"
+)
+
+// Index file layout:
+//
+//	[0:4]   magic "WIDX"
+//	[4:8]   index format version
+//	[8:16]  id of the segment holding the end of the checkpoint
+//	[16:24] offset within that segment covered by the checkpoint
+//	[24:32] index of the first record
+//	[32:40] record count
+//	[40:..] records (segment, offset, size, digest), 32 bytes each
+//	[-4:]   CRC32 of everything above
+//
+// The file is written to a temporary path and renamed into place, so a
+// reader only ever sees a complete checkpoint or the previous one.
+
+// writeIndexFile checkpoints the in-memory index. Callers must hold writeMu
+// so that w.offset and w.index describe the same log state.
+func (w *WAL) writeIndexFile() error {
+	w.indexMu.RLock()
+	count := w.index.len()
+	buf := make([]byte, IndexFileHeaderSize+count*IndexRecordSize+IndexFileTrailerSize)
+	byteOrder.PutUint32(buf[0:4], IndexMagicNumber)
+	byteOrder.PutUint32(buf[4:8], IndexVersion)
+	byteOrder.PutUint64(buf[8:16], w.segments[len(w.segments)-1].id)
+	byteOrder.PutUint64(buf[16:24], uint64(w.offset))
+	byteOrder.PutUint64(buf[24:32], w.start.index)
+	byteOrder.PutUint64(buf[32:40], uint64(count))
+	pos := IndexFileHeaderSize
+	w.index.each(0, func(e EntryIndex) bool {
+		byteOrder.PutUint64(buf[pos:pos+8], e.Segment)
+		byteOrder.PutUint64(buf[pos+8:pos+16], uint64(e.Offset))
+		byteOrder.PutUint64(buf[pos+16:pos+24], uint64(e.Size))
+		byteOrder.PutUint64(buf[pos+24:pos+32], e.Digest)
+		pos += IndexRecordSize
+		return true
+	})
+	w.indexMu.RUnlock()
+	byteOrder.PutUint32(buf[pos:], crc32.ChecksumIEEE(buf[:pos]))
+
+	tmpPath := w.indexPath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, w.config.fileMode())
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, w.indexPath); err != nil {
+		return err
+	}
+	w.uncheckpointed = 0
+	return nil
+}
+
+// loadIndexFile reads the sidecar index. It returns ok=false if the file is
+// missing, damaged, or does not describe a prefix of the current segments,
+// in which case the caller must fall back to a full scan.
+func (w *WAL) loadIndexFile() (entries []EntryIndex, endSeg uint64, end int64, ok bool) {
+	buf, err := os.ReadFile(w.indexPath)
+	if err != nil || len(buf) < IndexFileHeaderSize+IndexFileTrailerSize {
+		return nil, 0, 0, false
+	}
+	body := buf[:len(buf)-IndexFileTrailerSize]
+	if crc32.ChecksumIEEE(body) != byteOrder.Uint32(buf[len(body):]) {
+		return nil, 0, 0, false
+	}
+	if byteOrder.Uint32(body[0:4]) != IndexMagicNumber || byteOrder.Uint32(body[4:8]) != IndexVersion {
+		return nil, 0, 0, false
+	}
+
+	endSeg = byteOrder.Uint64(body[8:16])
+	end = int64(byteOrder.Uint64(body[16:24]))
+	first := byteOrder.Uint64(body[24:32])
+	count := byteOrder.Uint64(body[32:40])
+	if first != w.start.index || uint64(len(body)-IndexFileHeaderSize) != count*IndexRecordSize {
+		return nil, 0, 0, false
+	}
+
+	// sizes of the segments the checkpoint spans, in order
+	sizes := make(map[uint64]int64)
+	pos := 0
+	for _, seg := range w.segments {
+		stat, err := seg.file.Stat()
+		if err != nil {
+			return nil, 0, 0, false
+		}
+		sizes[seg.id] = stat.Size()
+		if seg.id == endSeg {
+			break
+		}
+		pos++
+	}
+	if pos == len(w.segments) || end < WALFileHeaderSizeV1 || end > sizes[endSeg] {
+		return nil, 0, 0, false
+	}
+
+	entries = make([]EntryIndex, 0, count)
+	curSeg := w.start.segment
+	expected := w.start.offset
+	rec := IndexFileHeaderSize
+	for i := uint64(0); i < count; i++ {
+		e := EntryIndex{
+			Index:   first + i,
+			Segment: byteOrder.Uint64(body[rec : rec+8]),
+			Offset:  int64(byteOrder.Uint64(body[rec+8 : rec+16])),
+			Size:    int64(byteOrder.Uint64(body[rec+16 : rec+24])),
+			Digest:  byteOrder.Uint64(body[rec+24 : rec+32]),
+		}
+		rec += IndexRecordSize
+
+		// Moving to a later segment requires the previous one to end
+		// exactly where its last record did.
+		if e.Segment != curSeg {
+			if _, known := sizes[e.Segment]; !known || e.Segment < curSeg || sizes[curSeg] != expected {
+				return nil, 0, 0, false
+			}
+			curSeg = e.Segment
+			expected = w.segmentByID(e.Segment).headerSize()
+		}
+		// Entries are contiguous, so every record must start where the
+		// previous one ended.
+		if e.Offset != expected || e.Size < EntryHeaderSizeV1 {
+			return nil, 0, 0, false
+		}
+		expected += e.Size
+		entries = append(entries, e)
+	}
+	if curSeg != endSeg || expected != end {
+		return nil, 0, 0, false
+	}
+
+	// Spot-check the newest recorded entry; if the log was rewritten behind
+	// our back this is where it shows.
+	if count > 0 {
+		last := entries[count-1]
+		if _, size, err := w.readEntryAt(w.segmentByID(last.Segment), last.Offset); err != nil || size != last.Size {
+			return nil, 0, 0, false
+		}
+	}
+	return entries, endSeg, end, true
+}
+
+// Segment index file layout:
+//
+//	[0:4]   magic "WSIX"
+//	[4:8]   segment index format version
+//	[8:16]  size of the sealed segment
+//	[16:24] index of the first record
+//	[24:32] record count
+//	[32:..] records (offset, size, digest), 24 bytes each
+//	[-4:]   CRC32 of everything above
+//
+// A sealed segment never changes again unless TruncateFromIndex reopens
+// it, which deletes its segment index first, so the file is written once
+// and is valid for as long as the segment has the recorded size.
+
+func segmentIndexPath(seg *segment) string {
+	return seg.path + ".sidx"
+}
+
+// writeSegmentIndex records the entries of seg, just sealed at size bytes.
+// It is best effort: without the file, recovery scans the segment instead,
+// so the directory is not synced. Callers must hold writeMu.
+func (w *WAL) writeSegmentIndex(seg *segment, size int64) error {
+	w.indexMu.RLock()
+	first := w.index.search(func(e EntryIndex) bool { return e.Segment >= seg.id })
+	entries := w.index.slice(first, w.index.len())
+	buf := make([]byte, SegmentIndexHeaderSize+len(entries)*SegmentIndexRecordSize+IndexFileTrailerSize)
+	byteOrder.PutUint32(buf[0:4], SegmentIndexMagicNumber)
+	byteOrder.PutUint32(buf[4:8], SegmentIndexVersion)
+	byteOrder.PutUint64(buf[8:16], uint64(size))
+	if len(entries) > 0 {
+		byteOrder.PutUint64(buf[16:24], entries[0].Index)
+	}
+	byteOrder.PutUint64(buf[24:32], uint64(len(entries)))
+	pos := SegmentIndexHeaderSize
+	for _, e := range entries {
+		byteOrder.PutUint64(buf[pos:pos+8], uint64(e.Offset))
+		byteOrder.PutUint64(buf[pos+8:pos+16], uint64(e.Size))
+		byteOrder.PutUint64(buf[pos+16:pos+24], e.Digest)
+		pos += SegmentIndexRecordSize
+	}
+	w.indexMu.RUnlock()
+	byteOrder.PutUint32(buf[pos:], crc32.ChecksumIEEE(buf[:pos]))
+
+	path := segmentIndexPath(seg)
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, w.config.fileMode())
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// loadSegmentIndex returns the entries of the sealed segment seg, size bytes
+// long, from offset on, numbered from nextIndex. It returns ok=false if the
+// segment index is missing, damaged or does not match, in which case the
+// caller must scan the segment.
+func (w *WAL) loadSegmentIndex(seg *segment, offset int64, nextIndex uint64, size int64) (entries []EntryIndex, ok bool) {
+	buf, err := os.ReadFile(segmentIndexPath(seg))
+	if err != nil || len(buf) < SegmentIndexHeaderSize+IndexFileTrailerSize {
+		return nil, false
+	}
+	body := buf[:len(buf)-IndexFileTrailerSize]
+	if crc32.ChecksumIEEE(body) != byteOrder.Uint32(buf[len(body):]) {
+		return nil, false
+	}
+	if byteOrder.Uint32(body[0:4]) != SegmentIndexMagicNumber || byteOrder.Uint32(body[4:8]) != SegmentIndexVersion {
+		return nil, false
+	}
+	count := byteOrder.Uint64(body[24:32])
+	if int64(byteOrder.Uint64(body[8:16])) != size || uint64(len(body)-SegmentIndexHeaderSize) != count*SegmentIndexRecordSize {
+		return nil, false
+	}
+
+	// Records before offset were truncated away by TruncateBefore; the rest
+	// must start there and run contiguously to the end of the segment.
+	index := byteOrder.Uint64(body[16:24])
+	expected := offset
+	for rec := SegmentIndexHeaderSize; rec < len(body); rec += SegmentIndexRecordSize {
+		e := EntryIndex{
+			Index:   index,
+			Segment: seg.id,
+			Offset:  int64(byteOrder.Uint64(body[rec : rec+8])),
+			Size:    int64(byteOrder.Uint64(body[rec+8 : rec+16])),
+			Digest:  byteOrder.Uint64(body[rec+16 : rec+24]),
+		}
+		index++
+		if e.Offset < offset {
+			continue
+		}
+		if e.Offset != expected || e.Size < EntryHeaderSizeV1 || (len(entries) == 0 && e.Index != nextIndex) {
+			return nil, false
+		}
+		expected += e.Size
+		entries = append(entries, e)
+	}
+	if expected != size {
+		return nil, false
+	}
+
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		if _, n, err := w.readEntryAt(seg, last.Offset); err != nil || n != last.Size {
+			return nil, false
+		}
+	}
+	return entries, true
+}
+
+func removeSegmentIndex(seg *segment) error {
+	if err := os.Remove(segmentIndexPath(seg)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeIndexFile drops the sidecar index. It must be called before any
+// operation that rewrites existing offsets, otherwise a later checkpoint-less
+// crash could load offsets that no longer match the log.
+func (w *WAL) removeIndexFile() error {
+	if w.storageBacked {
+		return nil
+	}
+	if err := os.Remove(w.indexPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIndexFileWrittenOnClose(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := &Config{
+		MaxEntrySize:   DefaultMaxEntrySize,
+		MaxSegmentSize: DefaultMaxSegmentSize,
+		PersistIndex:   true,
+	}
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+
+	entries := [][]byte{
+		[]byte("entry 1"),
+		[]byte("entry 2"),
+		[]byte("entry 3"),
+	}
+	for _, entry := range entries {
+		if err := w.Append(entry); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+
+	if _, err := os.Stat(walPath + ".idx"); !os.IsNotExist(err) {
+		t.Fatalf("Expected no index file before Close, got %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if _, err := os.Stat(walPath + ".idx"); err != nil {
+		t.Fatalf("Expected index file after Close: %v", err)
+	}
+
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+
+	if w2.LastIndex() != 3 {
+		t.Errorf("Expected LastIndex to be 3 after recovery, got %d", w2.LastIndex())
+	}
+
+	recovered, err := w2.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read all: %v", err)
+	}
+	if !reflect.DeepEqual(recovered, entries) {
+		t.Errorf("Recovered entries don't match: %q", recovered)
+	}
+}
+
+func TestIndexFileTailScan(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := &Config{
+		MaxEntrySize:            DefaultMaxEntrySize,
+		MaxSegmentSize:          DefaultMaxSegmentSize,
+		PersistIndex:            true,
+		IndexCheckpointInterval: 2,
+	}
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := w.AppendAndSync([]byte{byte(i)}); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+
+	// Simulate a crash: the last checkpoint covers 4 entries, entry 5 is
+	// only in the log. The dying process releases its lock.
+	w.file.Close()
+	w.lock.Close()
+
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+
+	if w2.LastIndex() != 5 {
+		t.Fatalf("Expected LastIndex to be 5 after recovery, got %d", w2.LastIndex())
+	}
+	for i := 0; i < 5; i++ {
+		data, err := w2.GetEntry(uint64(i + 1))
+		if err != nil {
+			t.Fatalf("Failed to get entry %d: %v", i+1, err)
+		}
+		if !reflect.DeepEqual(data, []byte{byte(i)}) {
+			t.Errorf("Entry %d: expected %v, got %v", i+1, []byte{byte(i)}, data)
+		}
+	}
+}
+
+func TestIndexFileStaleFallsBackToScan(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := &Config{
+		MaxEntrySize:   DefaultMaxEntrySize,
+		MaxSegmentSize: DefaultMaxSegmentSize,
+		PersistIndex:   true,
+	}
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		w.Append([]byte("entry"))
+	}
+	w.Close()
+
+	// Shrink the log behind the index's back so the checkpoint claims more
+	// bytes than the file holds.
+	entrySize := int64(EntryHeaderSize + len("entry"))
+	if err := os.Truncate(walPath, WALFileHeaderSize+2*entrySize); err != nil {
+		t.Fatalf("Failed to truncate file: %v", err)
+	}
+
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+
+	if w2.LastIndex() != 2 {
+		t.Errorf("Expected LastIndex to be 2 after fallback scan, got %d", w2.LastIndex())
+	}
+}
+
+func TestIndexFileCorruptFallsBackToScan(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := &Config{
+		MaxEntrySize:   DefaultMaxEntrySize,
+		MaxSegmentSize: DefaultMaxSegmentSize,
+		PersistIndex:   true,
+	}
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		w.Append([]byte("entry"))
+	}
+	w.Close()
+
+	buf, err := os.ReadFile(walPath + ".idx")
+	if err != nil {
+		t.Fatalf("Failed to read index file: %v", err)
+	}
+	buf[IndexFileHeaderSize] ^= 0xFF
+	if err := os.WriteFile(walPath+".idx", buf, 0644); err != nil {
+		t.Fatalf("Failed to write index file: %v", err)
+	}
+
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+
+	if w2.LastIndex() != 3 {
+		t.Errorf("Expected LastIndex to be 3 after fallback scan, got %d", w2.LastIndex())
+	}
+}
+
+func TestIndexFileRemovedOnTruncate(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := &Config{
+		MaxEntrySize:            DefaultMaxEntrySize,
+		MaxSegmentSize:          DefaultMaxSegmentSize,
+		PersistIndex:            true,
+		IndexCheckpointInterval: 1,
+	}
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 3; i++ {
+		w.Append([]byte("entry"))
+	}
+	if err := w.TruncateFromIndex(2); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	if _, err := os.Stat(walPath + ".idx"); !os.IsNotExist(err) {
+		t.Errorf("Expected index file to be removed after truncation, got %v", err)
+	}
+}
+
+func TestIndexFileAfterTruncateBefore(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := &Config{
+		MaxEntrySize:   DefaultMaxEntrySize,
+		MaxSegmentSize: DefaultMaxSegmentSize,
+		PersistIndex:   true,
+	}
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		w.Append([]byte{byte(i + 1)})
+	}
+	if err := w.TruncateBefore(3); err != nil {
+		t.Fatalf("Failed to truncate before: %v", err)
+	}
+	w.Close()
+
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+
+	if w2.FirstIndex() != 3 || w2.LastIndex() != 5 {
+		t.Errorf("Expected range [3, 5], got [%d, %d]", w2.FirstIndex(), w2.LastIndex())
+	}
+	data, err := w2.GetEntry(3)
+	if err != nil {
+		t.Fatalf("Failed to get entry 3: %v", err)
+	}
+	if !reflect.DeepEqual(data, []byte{3}) {
+		t.Errorf("Expected [3], got %v", data)
+	}
+}
+
+func TestSegmentIndex(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := &Config{MaxEntrySize: DefaultMaxEntrySize, MaxSegmentSize: 256, PersistIndex: true}
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < 30; i++ {
+		w.Append([]byte(fmt.Sprintf("entry-%02d", i)))
+	}
+	w.Sync()
+	if len(w.segments) < 3 {
+		t.Fatalf("Expected several segments, got %d", len(w.segments))
+	}
+	sealed := w.segments[0]
+	target := w.index.at(0)
+	digest := w.LogDigest()
+	for _, seg := range w.segments[:len(w.segments)-1] {
+		if _, err := os.Stat(segmentIndexPath(seg)); err != nil {
+			t.Errorf("Expected a segment index for sealed segment %d: %v", seg.id, err)
+		}
+	}
+	if _, err := os.Stat(segmentIndexPath(w.segments[len(w.segments)-1])); !os.IsNotExist(err) {
+		t.Errorf("Expected no segment index for the active segment, got %v", err)
+	}
+	// Crash: no <path>.idx is written.
+	w.closeSegments()
+	w.lock.Close()
+
+	// Damage the first entry of a sealed segment. A scan would stop there;
+	// loading the segment index never reads it.
+	f, err := os.OpenFile(sealed.path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	f.WriteAt([]byte{0xFF}, target.Offset+target.Size-1)
+	f.Close()
+
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	if w2.LastIndex() != 30 {
+		t.Fatalf("Expected all 30 entries from the segment indexes, got %d", w2.LastIndex())
+	}
+	if w2.LogDigest() != digest {
+		t.Errorf("Expected digest %x, got %x", digest, w2.LogDigest())
+	}
+	if got, err := w2.GetEntry(29); err != nil || string(got) != "entry-28" {
+		t.Errorf("Expected entry-28, got %q, %v", got, err)
+	}
+}
+
+func TestSegmentIndexTruncate(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := &Config{MaxEntrySize: DefaultMaxEntrySize, MaxSegmentSize: 256, PersistIndex: true}
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < 30; i++ {
+		w.Append([]byte(fmt.Sprintf("entry-%02d", i)))
+	}
+	sealed := w.segments[1]
+	var cut uint64
+	for _, e := range w.index.slice(0, w.index.len()) {
+		if e.Segment == sealed.id {
+			cut = e.Index + 1
+			break
+		}
+	}
+	if err := w.TruncateFromIndex(cut); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	if _, err := os.Stat(segmentIndexPath(sealed)); !os.IsNotExist(err) {
+		t.Errorf("Expected the reopened segment's index removed, got %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		w.Append([]byte(fmt.Sprintf("new-%02d", i)))
+	}
+	w.Sync()
+	want := w.LastIndex()
+	w.closeSegments()
+	w.lock.Close()
+
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	if w2.LastIndex() != want {
+		t.Fatalf("Expected LastIndex %d, got %d", want, w2.LastIndex())
+	}
+	if got, err := w2.GetEntry(cut); err != nil || string(got) != "new-00" {
+		t.Errorf("Expected new-00 at %d, got %q, %v", cut, got, err)
+	}
+}
@@ -0,0 +1,230 @@
+package wal
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Iterator streams entries in index order without loading the whole log
+// into memory. It does not hold any lock between calls: each Next takes
+// indexMu and readMu just long enough to locate and read one entry, so an
+// open iterator never blocks writers or truncation. Entries appended after
+// the iterator was created are visible to it; if the entry it is about to
+// read is truncated away, Next returns false and Err reports why.
+//
+// An Iterator is not safe for concurrent use.
+type Iterator struct {
+	w       *WAL
+	next    uint64 // 0 once a reverse iterator has passed the first entry
+	seg     uint64
+	offset  int64 // 0 until positioned on a segment
+	reverse bool
+
+	filter bool // only yield entries tagged tag
+	tag    uint64
+
+	index uint64
+	data  []byte
+	err   error
+}
+
+// Iterator returns a cursor positioned before the entry at start. start may
+// be LastIndex()+1, in which case the iterator yields only entries appended
+// later.
+func (w *WAL) Iterator(start uint64) (*Iterator, error) {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return nil, ErrWALClosed
+	}
+
+	w.indexMu.RLock()
+	defer w.indexMu.RUnlock()
+
+	it := &Iterator{w: w, next: start}
+	if w.index.len() > 0 {
+		first := w.index.firstIndex()
+		last := w.index.lastIndex()
+		if start < first || start > last+1 {
+			return nil, fmt.Errorf("iterator start %d out of range [%d, %d]", start, first, last+1)
+		}
+	}
+	if rec, ok := w.entryAt(start); ok {
+		it.seg = rec.Segment
+		it.offset = rec.Offset
+	}
+	return it, nil
+}
+
+// ReverseIterator returns a cursor that walks from the entry at start down to
+// the first retained entry. Each step looks its entry up in the in-memory
+// index, so going backwards costs no more than going forwards. start must be
+// a retained index; on an empty log, 0 yields an iterator with no entries.
+// Entries appended after start are never visited, and truncating away the
+// entry it is about to read stops it with an error, as for Iterator.
+func (w *WAL) ReverseIterator(start uint64) (*Iterator, error) {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return nil, ErrWALClosed
+	}
+
+	w.indexMu.RLock()
+	defer w.indexMu.RUnlock()
+
+	if w.index.len() == 0 {
+		if start != 0 {
+			return nil, fmt.Errorf("reverse iterator start %d past LastIndex 0", start)
+		}
+		return &Iterator{w: w, reverse: true}, nil
+	}
+	first := w.index.firstIndex()
+	last := w.index.lastIndex()
+	if start > last {
+		return nil, fmt.Errorf("reverse iterator start %d past LastIndex %d", start, last)
+	}
+	if start < first {
+		return nil, fmt.Errorf("reverse iterator start %d before FirstIndex %d", start, first)
+	}
+	return &Iterator{w: w, next: start, reverse: true}, nil
+}
+
+// FilterTag makes the iterator skip every entry not tagged tag (see
+// AppendWithTag), deciding from the entry header alone, so skipped payloads
+// are never read. It returns the iterator, for chaining onto its creation.
+func (it *Iterator) FilterTag(tag uint64) *Iterator {
+	it.filter = true
+	it.tag = tag
+	return it
+}
+
+// skip reports whether the entry at offset in seg is filtered out. Callers
+// hold readMu for reading.
+func (it *Iterator) skip(seg *segment, offset int64) (bool, error) {
+	if !it.filter {
+		return false, nil
+	}
+	h, err := readEntryHeader(seg, offset)
+	if err != nil {
+		return false, err
+	}
+	return h.tag != it.tag, nil
+}
+
+// Next advances to the next entry, returning false at the end of the log or
+// on error. A reverse iterator advances to the previous entry instead.
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.reverse {
+		for {
+			if done, ok := it.prev(); done {
+				return ok
+			}
+		}
+	}
+	for {
+		if done, ok := it.forward(); done {
+			return ok
+		}
+	}
+}
+
+// forward reads the entry at it.next and steps past it. done is false if
+// the entry was filtered out, in which case the caller moves on.
+func (it *Iterator) forward() (done, ok bool) {
+	w := it.w
+
+	w.indexMu.RLock()
+	if w.index.len() > 0 && it.next < w.index.firstIndex() {
+		w.indexMu.RUnlock()
+		it.err = fmt.Errorf("entry %d was truncated during iteration", it.next)
+		return true, false
+	}
+	rec, found := w.entryAt(it.next)
+	if !found {
+		w.indexMu.RUnlock()
+		return true, false
+	}
+	// Within a segment entries are contiguous, so the offset simply
+	// advances; the index is only consulted to hop to the next segment.
+	if it.offset == 0 || rec.Segment != it.seg {
+		it.seg = rec.Segment
+		it.offset = rec.Offset
+	}
+	seg := w.segmentByID(it.seg)
+	w.readMu.RLock()
+	w.indexMu.RUnlock()
+	skip, err := it.skip(seg, it.offset)
+	if skip {
+		w.readMu.RUnlock()
+		it.offset += rec.Size
+		it.next++
+		return false, false
+	}
+	var entry *WALEntry
+	var size int64
+	if err == nil {
+		entry, size, err = w.readEntry(seg, it.next, it.offset)
+	}
+	w.readMu.RUnlock()
+	if err != nil {
+		it.err = fmt.Errorf("failed to read entry at index %d: %w", it.next, err)
+		return true, false
+	}
+
+	it.index = it.next
+	it.data = entry.Data
+	it.offset += size
+	it.next++
+	return true, true
+}
+
+// prev reads the entry at it.next and steps back one, like forward.
+// Segments are not scanned backwards, so every step takes its offset from
+// the index.
+func (it *Iterator) prev() (done, ok bool) {
+	if it.next == 0 {
+		return true, false
+	}
+	w := it.w
+
+	w.indexMu.RLock()
+	rec, found := w.entryAt(it.next)
+	if !found {
+		w.indexMu.RUnlock()
+		it.err = fmt.Errorf("entry %d was truncated during iteration", it.next)
+		return true, false
+	}
+	first := w.index.firstIndex()
+	seg := w.segmentByID(rec.Segment)
+	w.readMu.RLock()
+	w.indexMu.RUnlock()
+	skip, err := it.skip(seg, rec.Offset)
+	var entry *WALEntry
+	if err == nil && !skip {
+		entry, _, err = w.readEntry(seg, it.next, rec.Offset)
+	}
+	w.readMu.RUnlock()
+	if err != nil {
+		it.err = fmt.Errorf("failed to read entry at index %d: %w", it.next, err)
+		return true, false
+	}
+
+	if !skip {
+		it.index = it.next
+		it.data = entry.Data
+	}
+	if it.next == first {
+		it.next = 0
+	} else {
+		it.next--
+	}
+	return !skip, !skip
+}
+
+// Entry returns the payload of the current entry.
+func (it *Iterator) Entry() []byte { return it.data }
+
+// Index returns the index of the current entry.
+func (it *Iterator) Index() uint64 { return it.index }
+
+// Err returns the error that stopped iteration, if any.
+func (it *Iterator) Err() error { return it.err }
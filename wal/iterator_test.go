@@ -0,0 +1,214 @@
+package wal
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIterator(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, segmentConfig(8, 2))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 5; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %02d", i+1)))
+	}
+
+	it, err := w.Iterator(2)
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+
+	expected := uint64(2)
+	for it.Next() {
+		if it.Index() != expected {
+			t.Errorf("Expected index %d, got %d", expected, it.Index())
+		}
+		if want := fmt.Sprintf("entry %02d", expected); string(it.Entry()) != want {
+			t.Errorf("Entry %d: expected %s, got %s", expected, want, it.Entry())
+		}
+		expected++
+	}
+	if it.Err() != nil {
+		t.Fatalf("Iterator failed: %v", it.Err())
+	}
+	if expected != 6 {
+		t.Errorf("Expected iteration to stop after index 5, stopped after %d", expected-1)
+	}
+
+	// Entries appended later are picked up by the same iterator.
+	w.Append([]byte("entry 06"))
+	if !it.Next() || it.Index() != 6 {
+		t.Errorf("Expected iterator to see entry 6")
+	}
+}
+
+func TestIteratorOutOfRange(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	w.Append([]byte("entry 1"))
+	w.Append([]byte("entry 2"))
+
+	if _, err := w.Iterator(0); err == nil {
+		t.Error("Expected error for start 0")
+	}
+	if _, err := w.Iterator(4); err == nil {
+		t.Error("Expected error for start past LastIndex+1")
+	}
+
+	it, err := w.Iterator(3)
+	if err != nil {
+		t.Fatalf("Failed to create iterator at LastIndex+1: %v", err)
+	}
+	if it.Next() {
+		t.Error("Expected no entries at LastIndex+1")
+	}
+}
+
+func TestIteratorTruncated(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 4; i++ {
+		w.Append([]byte("entry"))
+	}
+
+	it, err := w.Iterator(1)
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	it.Next()
+	w.TruncateBefore(3)
+
+	if it.Next() {
+		t.Error("Expected iteration to stop at a truncated entry")
+	}
+	if it.Err() == nil {
+		t.Error("Expected an error after head truncation")
+	}
+}
+
+func TestReverseIterator(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, segmentConfig(8, 2))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	if it, err := w.ReverseIterator(0); err != nil || it.Next() {
+		t.Errorf("Expected an empty reverse iterator on an empty log, got %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %02d", i+1)))
+	}
+	w.TruncateBefore(2)
+
+	if _, err := w.ReverseIterator(7); err == nil {
+		t.Error("Expected error for start past LastIndex")
+	}
+	if _, err := w.ReverseIterator(1); err == nil {
+		t.Error("Expected error for start before FirstIndex")
+	}
+
+	it, err := w.ReverseIterator(5)
+	if err != nil {
+		t.Fatalf("Failed to create reverse iterator: %v", err)
+	}
+	expected := uint64(5)
+	for it.Next() {
+		if it.Index() != expected {
+			t.Errorf("Expected index %d, got %d", expected, it.Index())
+		}
+		if want := fmt.Sprintf("entry %02d", expected); string(it.Entry()) != want {
+			t.Errorf("Entry %d: expected %s, got %s", expected, want, it.Entry())
+		}
+		expected--
+	}
+	if it.Err() != nil {
+		t.Fatalf("Reverse iterator failed: %v", it.Err())
+	}
+	if expected != 1 {
+		t.Errorf("Expected iteration to stop after index 2, stopped after %d", expected+1)
+	}
+
+	it, err = w.ReverseIterator(w.LastIndex())
+	if err != nil {
+		t.Fatalf("Failed to create reverse iterator: %v", err)
+	}
+	it.Next()
+	w.TruncateFromIndex(4)
+	if it.Next() {
+		t.Error("Expected iteration to stop at a truncated entry")
+	}
+	if it.Err() == nil {
+		t.Error("Expected an error after tail truncation")
+	}
+}
+
+func TestIteratorFilterTag(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := segmentConfig(8, 3)
+	config.EntryTags = true
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	for i := 1; i <= 8; i++ {
+		if _, err := w.AppendWithTag(uint64(i%2), []byte(fmt.Sprintf("entry %02d", i))); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+
+	it, err := w.Iterator(1)
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	var got []uint64
+	for it.FilterTag(1); it.Next(); {
+		if want := fmt.Sprintf("entry %02d", it.Index()); string(it.Entry()) != want {
+			t.Errorf("Expected %q at %d, got %q", want, it.Index(), it.Entry())
+		}
+		got = append(got, it.Index())
+	}
+	if it.Err() != nil || !reflect.DeepEqual(got, []uint64{1, 3, 5, 7}) {
+		t.Errorf("Expected odd entries, got %v, %v", got, it.Err())
+	}
+
+	rev, err := w.ReverseIterator(8)
+	if err != nil {
+		t.Fatalf("Failed to create reverse iterator: %v", err)
+	}
+	got = nil
+	for rev.FilterTag(0); rev.Next(); {
+		got = append(got, rev.Index())
+	}
+	if rev.Err() != nil || !reflect.DeepEqual(got, []uint64{8, 6, 4, 2}) {
+		t.Errorf("Expected even entries backwards, got %v, %v", got, rev.Err())
+	}
+}
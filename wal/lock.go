@@ -0,0 +1,30 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+)
+
+// acquireLock opens (creating if needed) the lock file at path and takes an
+// advisory lock on it: exclusive for writers, shared for read-only opens.
+// The WAL locks a sidecar rather than a segment because segment 0 is
+// deleted once the head of the log is truncated. The lock is released when
+// the returned file is closed. A new lock file is created with mode.
+func acquireLock(path string, shared bool, mode os.FileMode) (*os.File, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if shared {
+		flag = os.O_RDONLY | os.O_CREATE
+	}
+	f, err := os.OpenFile(path, flag, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, shared); err != nil {
+		f.Close()
+		if err == ErrLocked {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, path)
+		}
+		return nil, err
+	}
+	return f, nil
+}
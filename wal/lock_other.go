@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package wal
+
+import "os"
+
+// lockFile is a no-op on platforms without advisory locking.
+func lockFile(f *os.File, shared bool) error {
+	return nil
+}
@@ -0,0 +1,126 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Manager owns a fixed set of independent WALs ("shards") in one directory,
+// so writes can be spread across them to parallelize fsyncs. Shard i lives
+// at <dir>/shard-<i>.wal with i zero-padded to three digits, plus that
+// WAL's own segments and sidecar files.
+type Manager struct {
+	dir    string
+	shards []*WAL
+}
+
+// shardPath returns the base path of shard id in dir.
+func shardPath(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("shard-%03d.wal", id))
+}
+
+// discoverShards returns the ids of the shard logs present in dir. Segment
+// and sidecar files of a shard are not counted separately.
+func discoverShards(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []int
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name, found := strings.CutPrefix(e.Name(), "shard-")
+		if !found {
+			continue
+		}
+		name, found = strings.CutSuffix(name, ".wal")
+		if !found || name == "" || strings.Trim(name, "0123456789") != "" {
+			continue
+		}
+		id, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// OpenManager opens or creates shards WALs in dir, each recovered on its
+// own with config. Opening fewer shards than dir already holds is an error,
+// since entries in the missing shards would silently go unread. A
+// Config.MirrorPath is taken as a directory, in which each shard keeps its
+// own mirror under its own file name.
+func OpenManager(dir string, shards int, config *Config) (*Manager, error) {
+	if shards <= 0 {
+		return nil, fmt.Errorf("invalid shard count %d", shards)
+	}
+	existing, err := discoverShards(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range existing {
+		if id >= shards {
+			return nil, fmt.Errorf("%s holds shard %d, more than the %d requested", dir, id, shards)
+		}
+	}
+
+	m := &Manager{dir: dir, shards: make([]*WAL, 0, shards)}
+	for i := 0; i < shards; i++ {
+		c := config
+		if config != nil && config.MirrorPath != "" {
+			shard := *config
+			shard.MirrorPath = shardPath(config.MirrorPath, i)
+			c = &shard
+		}
+		w, err := NewWithConfig(shardPath(dir, i), c)
+		if err != nil {
+			m.CloseAll()
+			return nil, fmt.Errorf("failed to open shard %d: %w", i, err)
+		}
+		m.shards = append(m.shards, w)
+	}
+	return m, nil
+}
+
+// Shards returns the number of shards.
+func (m *Manager) Shards() int {
+	return len(m.shards)
+}
+
+// Shard returns the WAL of shard i, for reads, truncation and everything
+// else Manager does not wrap.
+func (m *Manager) Shard(i int) (*WAL, error) {
+	if i < 0 || i >= len(m.shards) {
+		return nil, fmt.Errorf("shard %d out of range [0, %d)", i, len(m.shards))
+	}
+	return m.shards[i], nil
+}
+
+// Append appends data to shard and returns its index within that shard.
+func (m *Manager) Append(shard int, data []byte) (uint64, error) {
+	w, err := m.Shard(shard)
+	if err != nil {
+		return 0, err
+	}
+	return w.AppendTyped(EntryTypeData, data)
+}
+
+// CloseAll closes every shard, returning the first error encountered.
+func (m *Manager) CloseAll() error {
+	var firstErr error
+	for _, w := range m.shards {
+		if err := w.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
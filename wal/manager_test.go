@@ -0,0 +1,96 @@
+package wal
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestManagerAppendAndRecover(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	m, err := OpenManager(tmpDir, 3, &Config{MaxEntrySize: DefaultMaxEntrySize})
+	if err != nil {
+		t.Fatalf("Failed to open manager: %v", err)
+	}
+	for i := 0; i < 9; i++ {
+		index, err := m.Append(i%3, []byte(fmt.Sprintf("entry %d", i)))
+		if err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+		if want := uint64(i/3 + 1); index != want {
+			t.Errorf("Expected index %d in shard %d, got %d", want, i%3, index)
+		}
+	}
+	if _, err := m.Append(3, []byte("x")); err == nil {
+		t.Error("Expected error for out of range shard")
+	}
+	if err := m.CloseAll(); err != nil {
+		t.Fatalf("Failed to close manager: %v", err)
+	}
+
+	m2, err := OpenManager(tmpDir, 3, &Config{MaxEntrySize: DefaultMaxEntrySize})
+	if err != nil {
+		t.Fatalf("Failed to reopen manager: %v", err)
+	}
+	defer m2.CloseAll()
+	for shard := 0; shard < m2.Shards(); shard++ {
+		w, _ := m2.Shard(shard)
+		data, err := w.GetEntry(3)
+		if err != nil {
+			t.Fatalf("Failed to get entry from shard %d: %v", shard, err)
+		}
+		if want := fmt.Sprintf("entry %d", 6+shard); string(data) != want {
+			t.Errorf("Expected %s in shard %d, got %s", want, shard, data)
+		}
+	}
+}
+
+func TestManagerRejectsFewerShards(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	m, err := OpenManager(tmpDir, 4, &Config{MaxEntrySize: DefaultMaxEntrySize, MaxSegmentSize: 64})
+	if err != nil {
+		t.Fatalf("Failed to open manager: %v", err)
+	}
+	// Rotate shard 0 so its segments sit next to the shard files.
+	for i := 0; i < 4; i++ {
+		m.Append(0, []byte("some entry data"))
+	}
+	m.CloseAll()
+
+	if ids, _ := discoverShards(tmpDir); len(ids) != 4 {
+		t.Errorf("Expected 4 shards discovered, got %v", ids)
+	}
+	if _, err := OpenManager(tmpDir, 2, &Config{MaxEntrySize: DefaultMaxEntrySize}); err == nil {
+		t.Error("Expected error when opening fewer shards than exist")
+	}
+}
+
+func TestManagerMirrorsShards(t *testing.T) {
+	tmpDir := t.TempDir()
+	mirrorDir := filepath.Join(tmpDir, "mirror")
+
+	m, err := OpenManager(tmpDir, 2, &Config{MaxEntrySize: DefaultMaxEntrySize, MirrorPath: mirrorDir})
+	if err != nil {
+		t.Fatalf("Failed to open manager: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		m.Append(i%2, []byte(fmt.Sprintf("entry %d", i)))
+	}
+	m.CloseAll()
+
+	// Each shard has a mirror of its own, and comes back from it alone.
+	m, err = OpenManager(tmpDir, 2, &Config{MaxEntrySize: DefaultMaxEntrySize, MirrorPath: mirrorDir})
+	if err != nil {
+		t.Fatalf("Failed to reopen manager: %v", err)
+	}
+	defer m.CloseAll()
+	for shard := 0; shard < 2; shard++ {
+		assertMirrored(t, shardPath(tmpDir, shard), shardPath(mirrorDir, shard))
+		w, _ := m.Shard(shard)
+		if data, err := w.GetEntry(2); err != nil || string(data) != fmt.Sprintf("entry %d", 2+shard) {
+			t.Errorf("Shard %d: expected entry %d, got %q (%v)", shard, 2+shard, data, err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package wal
+
+import (
+	"hash/crc32"
+	"os"
+)
+
+// Meta file layout:
+//
+//	[0:4]   magic "WMET"
+//	[4:8]   meta format version
+//	[8:16]  index of the first retained entry
+//	[16:24] id of the segment holding it
+//	[24:32] offset of it within that segment
+//	[32:36] CRC32 of everything above
+//
+// The meta file only exists once the head of the log has been truncated.
+// Without it the log starts at index 1 in the first segment, right after
+// the file header.
+
+// logStart records where the retained log begins.
+type logStart struct {
+	index   uint64
+	segment uint64
+	offset  int64
+}
+
+func (w *WAL) writeMetaFile(start logStart) error {
+	buf := make([]byte, MetaFileSize)
+	byteOrder.PutUint32(buf[0:4], MetaMagicNumber)
+	byteOrder.PutUint32(buf[4:8], MetaVersion)
+	byteOrder.PutUint64(buf[8:16], start.index)
+	byteOrder.PutUint64(buf[16:24], start.segment)
+	byteOrder.PutUint64(buf[24:32], uint64(start.offset))
+	byteOrder.PutUint32(buf[32:36], crc32.ChecksumIEEE(buf[:32]))
+
+	tmpPath := w.metaPath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, w.config.fileMode())
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, w.metaPath); err != nil {
+		return err
+	}
+
+	// The rename must be durable before any segment it supersedes is
+	// deleted, or a crash could leave neither the old nor the new start.
+	return w.syncDir()
+}
+
+// loadMetaFile sets w.start from the meta file, defaulting to the beginning
+// of the first segment when there is none.
+func (w *WAL) loadMetaFile() error {
+	w.start = logStart{index: 1, segment: w.segments[0].id, offset: w.segments[0].headerSize()}
+	if w.storageBacked {
+		return nil
+	}
+
+	buf, err := os.ReadFile(w.metaPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(buf) != MetaFileSize ||
+		byteOrder.Uint32(buf[0:4]) != MetaMagicNumber ||
+		byteOrder.Uint32(buf[4:8]) != MetaVersion ||
+		crc32.ChecksumIEEE(buf[:32]) != byteOrder.Uint32(buf[32:36]) {
+		return ErrCorruptedWAL
+	}
+
+	w.start = logStart{
+		index:   byteOrder.Uint64(buf[8:16]),
+		segment: byteOrder.Uint64(buf[16:24]),
+		offset:  int64(byteOrder.Uint64(buf[24:32])),
+	}
+	if w.start.index == 0 || w.start.offset < WALFileHeaderSizeV1 {
+		return ErrCorruptedWAL
+	}
+	return nil
+}
+
+func (w *WAL) removeMetaFile() error {
+	if err := os.Remove(w.metaPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
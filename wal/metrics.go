@@ -0,0 +1,164 @@
+package wal
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics returns a snapshot of the WAL's counters. Each field is loaded
+// atomically, so the snapshot is safe to take while writers are active.
+func (w *WAL) Metrics() WALMetrics {
+	return WALMetrics{
+		WriteCount:   atomic.LoadInt64(&w.metrics.WriteCount),
+		SyncCount:    atomic.LoadInt64(&w.metrics.SyncCount),
+		BytesWritten: atomic.LoadInt64(&w.metrics.BytesWritten),
+		Corruptions:  atomic.LoadInt64(&w.metrics.Corruptions),
+		LastSyncTime: atomic.LoadInt64(&w.metrics.LastSyncTime),
+		CacheHits:    atomic.LoadInt64(&w.metrics.CacheHits),
+		CacheMisses:  atomic.LoadInt64(&w.metrics.CacheMisses),
+
+		BytesReclaimed:  atomic.LoadInt64(&w.metrics.BytesReclaimed),
+		PendingBytes:    atomic.LoadInt64(&w.metrics.PendingBytes),
+		TailCorruptions: atomic.LoadInt64(&w.metrics.TailCorruptions),
+		ReadCount:       atomic.LoadInt64(&w.metrics.ReadCount),
+		TruncateCount:   atomic.LoadInt64(&w.metrics.TruncateCount),
+		ClockSkewEvents: atomic.LoadInt64(&w.metrics.ClockSkewEvents),
+
+		AppendLatency: w.metrics.AppendLatency.load(),
+		SyncLatency:   w.metrics.SyncLatency.load(),
+	}
+}
+
+// Stats returns the first and last index, entry count and on-disk size of
+// the log, all taken under one acquisition of the index lock so they agree
+// with each other. Sizes come from the index rather than the files: a
+// segment ends where its last indexed entry does, so an append in progress
+// is never half counted.
+func (w *WAL) Stats() WALStats {
+	w.indexMu.RLock()
+	defer w.indexMu.RUnlock()
+
+	s := WALStats{EntryCount: w.index.len(), SegmentCount: len(w.segments)}
+	if w.index.len() > 0 {
+		s.FirstIndex = w.index.firstIndex()
+		s.LastIndex = w.index.lastIndex()
+	}
+	for _, seg := range w.segments {
+		s.FileSize += w.segmentEnd(seg)
+	}
+	return s
+}
+
+// segmentEnd returns the offset just past the last indexed entry of seg.
+// Callers must hold indexMu.
+func (w *WAL) segmentEnd(seg *segment) int64 {
+	end := seg.headerSize()
+	i := w.index.search(func(e EntryIndex) bool { return e.Segment > seg.id })
+	if i > 0 {
+		if e := w.index.at(i - 1); e.Segment == seg.id {
+			end = e.Offset + e.Size
+		}
+	}
+	if w.start.segment == seg.id && w.start.offset > end {
+		// Emptied by TruncateBefore; the dead prefix is still on disk.
+		end = w.start.offset
+	}
+	return end
+}
+
+// LastSync returns LastSyncTime as a time.Time, or the zero Time if the WAL
+// has never been synced.
+func (m WALMetrics) LastSync() time.Time {
+	if m.LastSyncTime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, m.LastSyncTime)
+}
+
+// LatencyBucketBound returns the upper bound of histogram bucket i: bucket 0
+// holds operations up to 1µs and each following bucket doubles the bound.
+// The last bucket is unbounded and reports the largest representable
+// duration.
+func LatencyBucketBound(i int) time.Duration {
+	if i >= LatencyBuckets-1 {
+		return time.Duration(1<<63 - 1)
+	}
+	return time.Microsecond << uint(i)
+}
+
+// observe records one operation that took d. Fields are updated atomically
+// and independently, so a concurrent snapshot may see a Count that is one
+// ahead of the Buckets or Sum.
+func (l *LatencyStats) observe(d time.Duration) {
+	ns := int64(d)
+	if ns < 1 {
+		// Zero marks an unset Min.
+		ns = 1
+	}
+	atomic.AddInt64(&l.Count, 1)
+	atomic.AddInt64(&l.Sum, ns)
+	for {
+		cur := atomic.LoadInt64(&l.Min)
+		if (cur != 0 && cur <= ns) || atomic.CompareAndSwapInt64(&l.Min, cur, ns) {
+			break
+		}
+	}
+	for {
+		cur := atomic.LoadInt64(&l.Max)
+		if cur >= ns || atomic.CompareAndSwapInt64(&l.Max, cur, ns) {
+			break
+		}
+	}
+	i := 0
+	for i < LatencyBuckets-1 && d > LatencyBucketBound(i) {
+		i++
+	}
+	atomic.AddInt64(&l.Buckets[i], 1)
+}
+
+func (l *LatencyStats) load() LatencyStats {
+	s := LatencyStats{
+		Count: atomic.LoadInt64(&l.Count),
+		Sum:   atomic.LoadInt64(&l.Sum),
+		Min:   atomic.LoadInt64(&l.Min),
+		Max:   atomic.LoadInt64(&l.Max),
+	}
+	for i := range l.Buckets {
+		s.Buckets[i] = atomic.LoadInt64(&l.Buckets[i])
+	}
+	return s
+}
+
+// Mean returns the average duration, or 0 if nothing was recorded.
+func (l LatencyStats) Mean() time.Duration {
+	if l.Count == 0 {
+		return 0
+	}
+	return time.Duration(l.Sum / l.Count)
+}
+
+// Percentile returns an upper bound on the p-th percentile (0 < p <= 100):
+// the bound of the first bucket at which the cumulative count reaches p
+// percent of all operations, capped at Max. It returns 0 if nothing was
+// recorded.
+func (l LatencyStats) Percentile(p float64) time.Duration {
+	var total int64
+	for _, n := range l.Buckets {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	want := int64(float64(total)*p/100 + 0.5)
+	if want < 1 {
+		want = 1
+	}
+	var seen int64
+	for i, n := range l.Buckets {
+		seen += n
+		if seen >= want {
+			return min(LatencyBucketBound(i), time.Duration(l.Max))
+		}
+	}
+	return time.Duration(l.Max)
+}
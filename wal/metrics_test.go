@@ -0,0 +1,210 @@
+package wal
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetricsSnapshot(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	m := w.Metrics()
+	if m.WriteCount != 0 || m.SyncCount != 0 || !m.LastSync().IsZero() {
+		t.Errorf("Expected empty metrics for new WAL, got %+v", m)
+	}
+
+	before := time.Now()
+	w.Append([]byte("entry 1"))
+	w.AppendAndSync([]byte("entry 2"))
+
+	m = w.Metrics()
+	if m.WriteCount != 2 {
+		t.Errorf("Expected WriteCount to be 2, got %d", m.WriteCount)
+	}
+	if m.SyncCount != 1 {
+		t.Errorf("Expected SyncCount to be 1, got %d", m.SyncCount)
+	}
+	if want := int64(2 * (EntryHeaderSize + len("entry 1"))); m.BytesWritten != want {
+		t.Errorf("Expected BytesWritten to be %d, got %d", want, m.BytesWritten)
+	}
+	if m.LastSync().Before(before) {
+		t.Errorf("Expected LastSync after %v, got %v", before, m.LastSync())
+	}
+
+	// The snapshot is a copy.
+	w.Append([]byte("entry 3"))
+	if m.WriteCount != 2 {
+		t.Errorf("Expected snapshot to stay at 2 writes, got %d", m.WriteCount)
+	}
+}
+
+func TestReadAndTruncateCounts(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	for i := 0; i < 5; i++ {
+		w.Append([]byte("entry"))
+	}
+
+	w.GetEntry(1)
+	w.GetEntry(2)
+	w.GetEntry(9) // out of bounds, not counted
+	w.ReadAll()
+	if m := w.Metrics(); m.ReadCount != 7 {
+		t.Errorf("Expected ReadCount to be 7, got %d", m.ReadCount)
+	}
+
+	w.TruncateFromIndex(5)
+	w.AppendAt(3, EntryTypeData, []byte("replacement"))
+	w.TruncateFromIndex(10) // past the end, not counted
+	if m := w.Metrics(); m.TruncateCount != 2 {
+		t.Errorf("Expected TruncateCount to be 2, got %d", m.TruncateCount)
+	}
+}
+
+func TestLatencyMetrics(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	w.Append([]byte("entry 1"))
+	w.BatchAppend([][]byte{[]byte("entry 2"), []byte("entry 3")})
+	w.Sync()
+
+	m := w.Metrics()
+	if m.AppendLatency.Count != 2 {
+		t.Errorf("Expected 2 append samples, got %d", m.AppendLatency.Count)
+	}
+	if m.SyncLatency.Count != 1 {
+		t.Errorf("Expected 1 sync sample, got %d", m.SyncLatency.Count)
+	}
+	a := m.AppendLatency
+	if a.Min <= 0 || a.Min > a.Max || a.Sum < a.Max {
+		t.Errorf("Inconsistent append latency: %+v", a)
+	}
+	if mean := a.Mean(); mean < time.Duration(a.Min) || mean > time.Duration(a.Max) {
+		t.Errorf("Expected mean between min and max, got %v", mean)
+	}
+}
+
+func TestLatencyStatsPercentile(t *testing.T) {
+	var l LatencyStats
+	if l.Percentile(99) != 0 || l.Mean() != 0 {
+		t.Errorf("Expected zero percentile and mean for empty stats")
+	}
+
+	for i := 0; i < 99; i++ {
+		l.observe(500 * time.Nanosecond)
+	}
+	l.observe(3 * time.Millisecond)
+
+	if l.Min != 500 || l.Max != int64(3*time.Millisecond) {
+		t.Errorf("Expected min 500ns and max 3ms, got %d and %d", l.Min, l.Max)
+	}
+	if l.Buckets[0] != 99 {
+		t.Errorf("Expected 99 samples in the first bucket, got %d", l.Buckets[0])
+	}
+	if got := l.Percentile(50); got != time.Microsecond {
+		t.Errorf("Expected p50 of 1µs, got %v", got)
+	}
+	if got := l.Percentile(100); got != 3*time.Millisecond {
+		t.Errorf("Expected p100 capped at max 3ms, got %v", got)
+	}
+
+	l.observe(time.Hour)
+	if l.Buckets[LatencyBuckets-1] != 1 {
+		t.Errorf("Expected an hour to land in the overflow bucket")
+	}
+}
+
+func TestStats(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, MaxSegmentSize: 64})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	if s := w.Stats(); s != (WALStats{FileSize: WALFileHeaderSize, SegmentCount: 1}) {
+		t.Errorf("Unexpected stats for new WAL: %+v", s)
+	}
+
+	for i := 0; i < 5; i++ {
+		w.Append([]byte("0123456789012345678901234"))
+	}
+	w.Sync()
+	if err := w.TruncateBefore(2); err != nil {
+		t.Fatalf("Failed to truncate before: %v", err)
+	}
+
+	s := w.Stats()
+	if s.FirstIndex != 2 || s.LastIndex != 5 || s.EntryCount != 4 {
+		t.Errorf("Expected entries 2-5, got %+v", s)
+	}
+	if s.SegmentCount != len(w.segments) || s.SegmentCount < 2 {
+		t.Errorf("Expected %d segments, got %d", len(w.segments), s.SegmentCount)
+	}
+	var onDisk int64
+	for _, seg := range w.segments {
+		stat, _ := seg.file.Stat()
+		onDisk += stat.Size()
+	}
+	if s.FileSize != onDisk {
+		t.Errorf("Expected FileSize %d, got %d", onDisk, s.FileSize)
+	}
+
+	if err := w.TruncateBefore(6); err != nil {
+		t.Fatalf("Failed to empty the log: %v", err)
+	}
+	if s := w.Stats(); s.EntryCount != 0 || s.FirstIndex != 0 || s.FileSize == 0 {
+		t.Errorf("Unexpected stats for emptied log: %+v", s)
+	}
+}
+
+func TestPendingBytes(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, MaxSegmentSize: 100})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	w.Append([]byte("entry 1"))
+	w.BatchAppend([][]byte{[]byte("entry 2")})
+	if want := int64(2 * (EntryHeaderSize + 7)); w.Metrics().PendingBytes != want {
+		t.Errorf("Expected %d pending bytes, got %d", want, w.Metrics().PendingBytes)
+	}
+	w.Sync()
+	if p := w.Metrics().PendingBytes; p != 0 {
+		t.Errorf("Expected no pending bytes after Sync, got %d", p)
+	}
+
+	// Rotation syncs the sealed segment, so only the new entry is at risk.
+	w.Append(make([]byte, 30))
+	w.Append(make([]byte, 30))
+	if want := int64(EntryHeaderSize + 30); w.Metrics().PendingBytes != want {
+		t.Errorf("Expected %d pending bytes after rotation, got %d", want, w.Metrics().PendingBytes)
+	}
+}
@@ -0,0 +1,611 @@
+package wal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// mirrorFile is the Storage of a segment with Config.MirrorPath set: every
+// write and truncation is applied to the primary and then to the segment's
+// copy under the mirror path, and Sync syncs both. Reads are served by the
+// primary alone. The mirror is opened on the first write, so sealed
+// segments, which are rarely written again, don't keep it open.
+//
+// Recovery takes whichever copy holds more whole entries, so a cut that
+// reached only one copy before a crash would come back from the other. A
+// cut is therefore recorded first, in <mirror segment>.cut, and the record
+// is only removed once both copies are cut; recovery finishes any cut it
+// finds recorded before comparing them. A TruncateFromIndex records its cut
+// before deleting the segments after the one it cuts, and recovery drops
+// those too.
+type mirrorFile struct {
+	Storage
+	path   string
+	mode   os.FileMode
+	noSync bool
+
+	mu   sync.Mutex
+	file *os.File
+	// A recorded cut to cutSize, dropping later segments if cutLast; once
+	// cutPrimary, the primary has been cut and only the mirror still needs
+	// to be.
+	cutSize    int64
+	cutLast    bool
+	cutPending bool
+	cutPrimary bool
+}
+
+// mirrorError wraps err from the mirror copy in ErrMirrorFailed.
+func mirrorError(err error) error {
+	return fmt.Errorf("%w: %w", ErrMirrorFailed, err)
+}
+
+// mirrorWrites puts s, a segment's Storage opened from path, behind a
+// mirrorFile if Config.MirrorPath is set and the WAL is writable.
+func (w *WAL) mirrorWrites(path string, s Storage) Storage {
+	if w.config.MirrorPath == "" || w.readOnly {
+		return s
+	}
+	return &mirrorFile{Storage: s, path: w.mirrorPathOf(path), mode: w.config.fileMode(), noSync: w.config.DisableSync}
+}
+
+// mirrorPathOf returns the mirror copy's path for the segment at path.
+func (w *WAL) mirrorPathOf(path string) string {
+	return w.config.MirrorPath + strings.TrimPrefix(path, w.filePath)
+}
+
+// mirrorOf returns the mirrorFile behind f, if f is mirrored.
+func mirrorOf(f Storage) (*mirrorFile, bool) {
+	if b, ok := f.(*writeBuffer); ok {
+		f = b.Storage
+	}
+	m, ok := f.(*mirrorFile)
+	return m, ok
+}
+
+// mirror returns the mirror copy, opening it if need be. Callers must hold
+// m.mu.
+func (m *mirrorFile) mirror() (*os.File, error) {
+	if m.file == nil {
+		file, err := os.OpenFile(m.path, os.O_RDWR|os.O_CREATE, m.mode)
+		if err != nil {
+			return nil, mirrorError(err)
+		}
+		m.file = file
+	}
+	return m.file, nil
+}
+
+func (m *mirrorFile) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Nothing goes to either copy until an unfinished cut is.
+	if err := m.finishCut(); err != nil {
+		return 0, err
+	}
+	n, err := m.Storage.WriteAt(p, off)
+	if err != nil {
+		return n, err
+	}
+	file, err := m.mirror()
+	if err != nil {
+		return n, err
+	}
+	if _, err := file.WriteAt(p, off); err != nil {
+		return n, mirrorError(err)
+	}
+	return n, nil
+}
+
+func (m *mirrorFile) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if stat, err := m.Storage.Stat(); err == nil && size < stat.Size() {
+		return m.cut(size)
+	}
+	// A cut prepared for a segment already no longer than it is void.
+	m.dropCut()
+	if err := m.finishCut(); err != nil {
+		return err
+	}
+	if err := m.Storage.Truncate(size); err != nil {
+		return err
+	}
+	file, err := m.mirror()
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(size); err != nil {
+		return mirrorError(err)
+	}
+	return nil
+}
+
+// recordCut durably records that the segment is about to be cut to size,
+// and if last, that the segments after it are about to be deleted. Callers
+// must hold m.mu.
+func (m *mirrorFile) recordCut(size int64, last bool) error {
+	if m.cutPending && !m.cutPrimary {
+		if m.cutSize == size && (m.cutLast || !last) {
+			return nil
+		}
+		last = last || m.cutLast
+	}
+	if err := m.finishCut(); err != nil {
+		return err
+	}
+	if err := writeCutRecord(m.path+".cut", size, last, m.mode, m.noSync); err != nil {
+		return mirrorError(err)
+	}
+	m.cutSize, m.cutLast, m.cutPending, m.cutPrimary = size, last, true, false
+	return nil
+}
+
+// cut shrinks both copies to size under a cut record. A failure on the
+// primary drops the record, since nothing was cut; one on the mirror
+// returns ErrMirrorFailed with the primary cut and the record kept, and the
+// mirror's cut is retried before anything else is written to it. Callers
+// must hold m.mu.
+func (m *mirrorFile) cut(size int64) error {
+	if err := m.recordCut(size, false); err != nil {
+		return err
+	}
+	if err := m.Storage.Truncate(size); err != nil {
+		m.dropCut()
+		return err
+	}
+	m.cutPrimary = true
+	return m.finishCut()
+}
+
+// finishCut cuts the mirror to a recorded cut the primary has already
+// taken, and removes the record. Callers must hold m.mu.
+func (m *mirrorFile) finishCut() error {
+	if !m.cutPending || !m.cutPrimary {
+		return nil
+	}
+	file, err := m.mirror()
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(m.cutSize); err != nil {
+		return mirrorError(err)
+	}
+	if !m.noSync {
+		if err := file.Sync(); err != nil {
+			return mirrorError(err)
+		}
+	}
+	if err := removeCutRecord(m.path+".cut", m.noSync); err != nil {
+		return mirrorError(err)
+	}
+	m.cutPending = false
+	return nil
+}
+
+// dropCut removes a cut record no copy was cut to. Callers must hold m.mu.
+func (m *mirrorFile) dropCut() {
+	if m.cutPending && !m.cutPrimary && removeCutRecord(m.path+".cut", m.noSync) == nil {
+		m.cutPending = false
+	}
+}
+
+func (m *mirrorFile) Sync() error {
+	if err := m.Storage.Sync(); err != nil {
+		return err
+	}
+	return m.syncMirror(false)
+}
+
+// syncMirror syncs the mirror copy, if anything has been written to it,
+// with fdatasync if dataOnly is set, finishing a cut first.
+func (m *mirrorFile) syncMirror(dataOnly bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.finishCut(); err != nil {
+		return err
+	}
+	if m.file == nil {
+		return nil
+	}
+	var err error
+	if dataOnly {
+		err = fdatasync(m.file)
+	} else {
+		err = m.file.Sync()
+	}
+	if err != nil {
+		return mirrorError(err)
+	}
+	return nil
+}
+
+// Close closes both copies. A cut still unfinished is left recorded for
+// recovery to finish.
+func (m *mirrorFile) Close() error {
+	err := m.Storage.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file != nil {
+		if merr := m.file.Close(); merr != nil && err == nil {
+			err = mirrorError(merr)
+		}
+		m.file = nil
+	}
+	return err
+}
+
+// prepareCut records that f, if it is mirrored, is about to be cut to size
+// and the segments after it deleted, before TruncateFromIndex deletes any.
+func prepareCut(f Storage, size int64) error {
+	m, ok := mirrorOf(f)
+	if !ok {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.recordCut(size, true)
+}
+
+// Cut record layout:
+//
+//	[0:8]   size the segment is being cut to
+//	[8]     1 if the segments after it are being deleted, else 0
+//	[9:13]  CRC32 of the above
+//
+// A record that doesn't check out was being written, so nothing was cut.
+const cutRecordSize = 13
+
+func writeCutRecord(path string, size int64, last bool, mode os.FileMode, noSync bool) error {
+	buf := make([]byte, cutRecordSize)
+	byteOrder.PutUint64(buf[0:8], uint64(size))
+	if last {
+		buf[8] = 1
+	}
+	byteOrder.PutUint32(buf[9:13], crc32.ChecksumIEEE(buf[:9]))
+	return writeSidecar(path, buf, mode, noSync)
+}
+
+// readCutRecord returns the size and flag recorded at path, and false if
+// there is no valid record.
+func readCutRecord(path string) (size int64, last, ok bool) {
+	buf, err := os.ReadFile(path)
+	if err != nil || len(buf) != cutRecordSize || crc32.ChecksumIEEE(buf[:9]) != byteOrder.Uint32(buf[9:13]) {
+		return 0, false, false
+	}
+	return int64(byteOrder.Uint64(buf[0:8])), buf[8] == 1, true
+}
+
+func removeCutRecord(path string, noSync bool) error {
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if noSync {
+		return nil
+	}
+	return syncDirOf(path)
+}
+
+// writeSidecar replaces the file at path with data through a synced
+// temporary file, unless noSync is set, so a crash leaves the old contents
+// or the new.
+func writeSidecar(path string, data []byte, mode os.FileMode, noSync bool) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if !noSync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	if noSync {
+		return nil
+	}
+	return syncDirOf(path)
+}
+
+// syncDirOf syncs the directory holding path.
+func syncDirOf(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// copyToMirror makes the mirror of f, if it has one, hold exactly the
+// primary's first size bytes, for a segment written before it was mirrored:
+// one just created by rotation or compaction.
+func (w *WAL) copyToMirror(f Storage, size int64) error {
+	m, ok := mirrorOf(f)
+	if !ok {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	file, err := m.mirror()
+	if err != nil {
+		return err
+	}
+	if err := copyRange(file, m.Storage, 0, size); err != nil {
+		return mirrorError(err)
+	}
+	if err := file.Truncate(size); err != nil {
+		return mirrorError(err)
+	}
+	if w.config.DisableSync {
+		return nil
+	}
+	if w.config.SyncMode == SyncModeData {
+		err = fdatasync(file)
+	} else {
+		err = file.Sync()
+	}
+	if err != nil {
+		return mirrorError(err)
+	}
+	return nil
+}
+
+// removeMirror deletes the mirror copy of a segment being deleted.
+func (w *WAL) removeMirror(seg *segment) error {
+	if w.config.MirrorPath == "" {
+		return nil
+	}
+	path := w.mirrorPathOf(seg.path)
+	for _, p := range []string{path + ".cut", path} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return mirrorError(err)
+		}
+	}
+	return nil
+}
+
+// reconcileMirror brings the segments and their mirror copies back in line
+// before recovery reads them, first locking the mirror and checking it is
+// this log's. Of the two copies of a segment, whichever holds more whole
+// entries from the start is copied into the other from where the other's
+// stop: a primary damaged past some point is completed from the mirror,
+// and a mirror that missed writes, or is new, catches up with the primary.
+// Mirror copies of segments older than the primary's first are stale and
+// deleted; segments only the mirror still has are restored.
+func (w *WAL) reconcileMirror() error {
+	if err := os.MkdirAll(filepath.Dir(w.config.MirrorPath), w.config.dirMode()); err != nil {
+		return mirrorError(err)
+	}
+	lock, err := acquireLock(w.config.MirrorPath+".lock", false, w.config.fileMode())
+	if err != nil {
+		if errors.Is(err, ErrLocked) {
+			return err
+		}
+		return mirrorError(err)
+	}
+	w.mirrorLock = lock
+	ids, err := discoverSegments(w.filePath)
+	if err != nil {
+		return err
+	}
+	mirrored, err := discoverSegments(w.config.MirrorPath)
+	if err != nil {
+		return mirrorError(err)
+	}
+	if err := w.claimMirror(len(ids) > 0, len(mirrored) > 0); err != nil {
+		return err
+	}
+	for _, id := range mirrored {
+		switch {
+		case len(ids) > 0 && id < ids[0]:
+			if err := os.Remove(segmentPath(w.config.MirrorPath, id)); err != nil && !os.IsNotExist(err) {
+				return mirrorError(err)
+			}
+		case len(ids) == 0 || id > ids[len(ids)-1]:
+			ids = append(ids, id)
+		}
+	}
+	// Finish deleting the segments after an unfinished TruncateFromIndex's.
+	for i, id := range ids {
+		if _, last, ok := readCutRecord(segmentPath(w.config.MirrorPath, id) + ".cut"); ok && last {
+			if err := w.dropSegmentFiles(ids[i+1:]); err != nil {
+				return err
+			}
+			ids = ids[:i+1]
+			break
+		}
+	}
+
+	for _, id := range ids {
+		if err := w.reconcileSegment(segmentPath(w.filePath, id), segmentPath(w.config.MirrorPath, id)); err != nil {
+			return fmt.Errorf("segment %d: %w", id, err)
+		}
+	}
+	if err := w.syncDir(); err != nil {
+		return err
+	}
+	if w.config.DisableSync {
+		return nil
+	}
+	if err := syncDirOf(w.config.MirrorPath); err != nil {
+		return mirrorError(err)
+	}
+	return nil
+}
+
+// dropSegmentFiles deletes both copies of the segments ids, newest first.
+func (w *WAL) dropSegmentFiles(ids []uint64) error {
+	for i := len(ids) - 1; i >= 0; i-- {
+		path := segmentPath(w.filePath, ids[i])
+		mirrorPath := segmentPath(w.config.MirrorPath, ids[i])
+		for _, p := range []string{segmentIndexPath(&segment{path: path}), mirrorPath + ".cut", mirrorPath, path} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// claimMirror checks that the mirror belongs to this log, going by the
+// random id both keep in a .logid file beside their segments, and gives
+// either the id it lacks. A mirror with an id of its own, or without one
+// but with segments, is another log's and refused, but for a primary with
+// no segments yet, which takes the mirror's id to be restored from it.
+func (w *WAL) claimMirror(hasSegments, mirrorHasSegments bool) error {
+	idPath, mirrorIDPath := w.filePath+".logid", w.config.MirrorPath+".logid"
+	id, err := readLogID(idPath)
+	if err != nil {
+		return err
+	}
+	mirrorID, err := readLogID(mirrorIDPath)
+	if err != nil {
+		return mirrorError(err)
+	}
+	foreign := fmt.Errorf("%w: %s mirrors another log", ErrMirrorFailed, w.config.MirrorPath)
+	switch {
+	case id != "" && mirrorID != "":
+		if id != mirrorID {
+			return foreign
+		}
+		return nil
+	case mirrorID != "":
+		if hasSegments {
+			return foreign
+		}
+		return writeSidecar(idPath, []byte(mirrorID), w.config.fileMode(), w.config.DisableSync)
+	case mirrorHasSegments:
+		return foreign
+	}
+	if id == "" {
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+		id = hex.EncodeToString(buf)
+		if err := writeSidecar(idPath, []byte(id), w.config.fileMode(), w.config.DisableSync); err != nil {
+			return err
+		}
+	}
+	if err := writeSidecar(mirrorIDPath, []byte(id), w.config.fileMode(), w.config.DisableSync); err != nil {
+		return mirrorError(err)
+	}
+	return nil
+}
+
+// readLogID returns the log id kept at path, or "" if there is none.
+func readLogID(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+// reconcileSegment is reconcileMirror for one segment, creating whichever
+// copy is missing.
+func (w *WAL) reconcileSegment(path, mirrorPath string) error {
+	primary, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, w.config.fileMode())
+	if err != nil {
+		return err
+	}
+	defer primary.Close()
+	mirror, err := os.OpenFile(mirrorPath, os.O_RDWR|os.O_CREATE, w.config.fileMode())
+	if err != nil {
+		return mirrorError(err)
+	}
+	defer mirror.Close()
+
+	// A cut recorded but not finished on both copies is finished first, so
+	// that the suffix it dropped isn't copied back.
+	if size, _, ok := readCutRecord(mirrorPath + ".cut"); ok {
+		for _, file := range []*os.File{primary, mirror} {
+			if stat, err := file.Stat(); err == nil && stat.Size() <= size {
+				continue
+			}
+			if err := file.Truncate(size); err != nil {
+				return err
+			}
+			if !w.config.DisableSync {
+				if err := file.Sync(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := removeCutRecord(mirrorPath+".cut", w.config.DisableSync); err != nil {
+		return mirrorError(err)
+	}
+
+	end := w.wholeEntriesEnd(path, primary)
+	mirrorEnd := w.wholeEntriesEnd(mirrorPath, mirror)
+	switch {
+	case mirrorEnd > end:
+		if err := copyRange(primary, mirror, end, mirrorEnd); err != nil {
+			return fmt.Errorf("restoring from mirror: %w", err)
+		}
+		if !w.config.DisableSync {
+			return primary.Sync()
+		}
+	case end > mirrorEnd:
+		if err := copyRange(mirror, primary, mirrorEnd, end); err != nil {
+			return mirrorError(err)
+		}
+		if err := mirror.Truncate(end); err != nil {
+			return mirrorError(err)
+		}
+		if !w.config.DisableSync {
+			if err := mirror.Sync(); err != nil {
+				return mirrorError(err)
+			}
+		}
+	}
+	return nil
+}
+
+// wholeEntriesEnd returns the offset just past the last of the unbroken run
+// of readable entries at the start of the segment file at path, or 0 if its
+// header can't be read.
+func (w *WAL) wholeEntriesEnd(path string, file *os.File) int64 {
+	seg := &segment{path: path, file: file}
+	if err := readFileHeader(seg); err != nil {
+		return 0
+	}
+	offset := seg.headerSize()
+	for {
+		_, size, err := w.readEntryAt(seg, offset)
+		if err != nil {
+			return offset
+		}
+		offset += size
+	}
+}
+
+// copyRange copies src's bytes from offset from up to offset to into dst at
+// the same offsets.
+func copyRange(dst io.WriterAt, src io.ReaderAt, from, to int64) error {
+	_, err := io.Copy(io.NewOffsetWriter(dst, from), io.NewSectionReader(src, from, to-from))
+	return err
+}
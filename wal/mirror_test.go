@@ -0,0 +1,331 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// mirrorConfig is segmentConfig(8, 2) mirroring to mirrorPath.
+func mirrorConfig(mirrorPath string) *Config {
+	config := segmentConfig(8, 2)
+	config.MirrorPath = mirrorPath
+	return config
+}
+
+// assertMirrored fails unless every segment of walPath has an identical copy
+// under mirrorPath, and the mirror holds nothing else.
+func assertMirrored(t *testing.T, walPath, mirrorPath string) {
+	t.Helper()
+	ids, err := discoverSegments(walPath)
+	if err != nil {
+		t.Fatalf("Failed to list segments: %v", err)
+	}
+	mirrored, err := discoverSegments(mirrorPath)
+	if err != nil {
+		t.Fatalf("Failed to list mirror segments: %v", err)
+	}
+	if !reflect.DeepEqual(ids, mirrored) {
+		t.Fatalf("Expected mirror segments %v, got %v", ids, mirrored)
+	}
+	for _, id := range ids {
+		primary, _ := os.ReadFile(segmentPath(walPath, id))
+		mirror, _ := os.ReadFile(segmentPath(mirrorPath, id))
+		if !bytes.Equal(primary, mirror) {
+			t.Errorf("Segment %d: mirror differs from primary (%d vs %d bytes)", id, len(mirror), len(primary))
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+	mirrorPath := filepath.Join(tmpDir, "mirror", "test.wal")
+
+	w, err := NewWithConfig(walPath, mirrorConfig(mirrorPath))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	for i := 0; i < 5; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %02d", i+1)))
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	assertMirrored(t, walPath, mirrorPath)
+
+	// Truncations and deleted segments reach the mirror too.
+	if err := w.TruncateFromIndex(5); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	if err := w.TruncateBefore(3); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	assertMirrored(t, walPath, mirrorPath)
+
+	if err := w.Compact(func(index uint64, entryType uint8, data []byte) bool { return index != 3 }); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	w.Append([]byte("entry 06"))
+	assertMirrored(t, walPath, mirrorPath)
+
+	if _, err := NewWithConfig(filepath.Join(tmpDir, "other.wal"), &Config{MaxEntrySize: DefaultMaxEntrySize, MirrorPath: filepath.Join(tmpDir, "other.wal")}); err == nil {
+		t.Error("Expected error mirroring a WAL onto itself")
+	}
+}
+
+func TestMirrorRestoresPrimary(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+	mirrorPath := filepath.Join(tmpDir, "mirror", "test.wal")
+
+	w, err := NewWithConfig(walPath, mirrorConfig(mirrorPath))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	var expected [][]byte
+	for i := 0; i < 6; i++ {
+		data := []byte(fmt.Sprintf("entry %02d", i+1))
+		w.Append(data)
+		expected = append(expected, data)
+	}
+	w.Close()
+
+	// Damage the first entry of the middle segment and lose the last one.
+	path := segmentPath(walPath, 1)
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	file.WriteAt([]byte("XX"), WALFileHeaderSize+EntryHeaderSize)
+	file.Close()
+	os.Remove(segmentPath(walPath, 2))
+
+	config := mirrorConfig(mirrorPath)
+	config.RecoveryMode = RecoveryStrict
+	w, err = NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer w.Close()
+	all, err := w.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read WAL: %v", err)
+	}
+	if !reflect.DeepEqual(all, expected) {
+		t.Errorf("Expected the log restored from the mirror, got %q", all)
+	}
+	assertMirrored(t, walPath, mirrorPath)
+}
+
+func TestMirrorCatchesUp(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+	mirrorPath := filepath.Join(tmpDir, "mirror", "test.wal")
+
+	w, err := NewWithConfig(walPath, segmentConfig(8, 2))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %02d", i+1)))
+	}
+	w.Close()
+
+	// A new mirror is filled in from the primary when the WAL is opened.
+	w, err = NewWithConfig(walPath, mirrorConfig(mirrorPath))
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer w.Close()
+	assertMirrored(t, walPath, mirrorPath)
+	w.Append([]byte("entry 06"))
+	assertMirrored(t, walPath, mirrorPath)
+}
+
+func TestMirrorWriteFailure(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+	mirrorPath := filepath.Join(tmpDir, "mirror", "test.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, MirrorPath: mirrorPath})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	w.Append([]byte("entry 1"))
+
+	// Break the mirror's file handle.
+	mirror := w.file.(*mirrorFile)
+	mirror.file.Close()
+	err = w.Append([]byte("entry 2"))
+	if !errors.Is(err, ErrMirrorFailed) {
+		t.Fatalf("Expected ErrMirrorFailed, got %v", err)
+	}
+	if w.LastIndex() != 1 {
+		t.Errorf("Expected the failed append dropped, got last index %d", w.LastIndex())
+	}
+	if err := w.Sync(); !errors.Is(err, ErrMirrorFailed) {
+		t.Errorf("Expected the mirror's sync to fail with ErrMirrorFailed, got %v", err)
+	}
+}
+
+func TestMirrorCrashDuringTruncate(t *testing.T) {
+	// How far TruncateFromIndex(2) got before the crash, on a log of entries
+	// 1-2, 3-4 and 5 in three segments.
+	crashes := map[string]func(walPath, mirrorPath string){
+		"dropping later segments": func(walPath, mirrorPath string) {
+			os.Remove(segmentPath(mirrorPath, 2))
+		},
+		"between the copies' cuts": func(walPath, mirrorPath string) {
+			for _, id := range []uint64{2, 1} {
+				os.Remove(segmentPath(mirrorPath, id))
+				os.Remove(segmentPath(walPath, id))
+			}
+			os.Truncate(walPath, WALFileHeaderSize+EntryHeaderSize+8)
+		},
+	}
+	for name, crash := range crashes {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			walPath := filepath.Join(tmpDir, "test.wal")
+			mirrorPath := filepath.Join(tmpDir, "mirror", "test.wal")
+
+			w, err := NewWithConfig(walPath, mirrorConfig(mirrorPath))
+			if err != nil {
+				t.Fatalf("Failed to create WAL: %v", err)
+			}
+			for i := 0; i < 5; i++ {
+				w.Append([]byte(fmt.Sprintf("entry %02d", i+1)))
+			}
+			w.Close()
+
+			// The cut is recorded before anything is deleted or cut.
+			if err := writeCutRecord(mirrorPath+".cut", WALFileHeaderSize+EntryHeaderSize+8, true, DefaultFileMode, false); err != nil {
+				t.Fatalf("Failed to write cut record: %v", err)
+			}
+			crash(walPath, mirrorPath)
+
+			w, err = NewWithConfig(walPath, mirrorConfig(mirrorPath))
+			if err != nil {
+				t.Fatalf("Failed to reopen WAL: %v", err)
+			}
+			defer w.Close()
+			if w.LastIndex() != 1 {
+				t.Errorf("Expected the truncation finished at last index 1, got %d", w.LastIndex())
+			}
+			if _, err := os.Stat(mirrorPath + ".cut"); !os.IsNotExist(err) {
+				t.Errorf("Expected the cut record removed, got %v", err)
+			}
+			assertMirrored(t, walPath, mirrorPath)
+		})
+	}
+}
+
+func TestMirrorTruncateFailure(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+	mirrorPath := filepath.Join(tmpDir, "mirror", "test.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, MirrorPath: mirrorPath})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %02d", i+1)))
+	}
+
+	// Break the mirror's file handle: the primary is still cut, and the
+	// WAL follows it.
+	mirror := w.file.(*mirrorFile)
+	mirror.file.Close()
+	if err := w.TruncateFromIndex(3); !errors.Is(err, ErrMirrorFailed) {
+		t.Fatalf("Expected ErrMirrorFailed, got %v", err)
+	}
+	if w.LastIndex() != 2 {
+		t.Errorf("Expected last index 2 after the truncation, got %d", w.LastIndex())
+	}
+	if _, err := w.GetEntry(3); err == nil {
+		t.Error("Expected entry 3 gone")
+	}
+	w.Close()
+
+	// Reopened, the mirror's cut is finished from the record.
+	w, err = NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, MirrorPath: mirrorPath})
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer w.Close()
+	if w.LastIndex() != 2 {
+		t.Errorf("Expected last index 2 after reopening, got %d", w.LastIndex())
+	}
+	assertMirrored(t, walPath, mirrorPath)
+}
+
+func TestMirrorBelongsToOneLog(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+	mirrorPath := filepath.Join(tmpDir, "mirror", "test.wal")
+
+	w, err := NewWithConfig(walPath, mirrorConfig(mirrorPath))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %02d", i+1)))
+	}
+	otherPath := filepath.Join(tmpDir, "other.wal")
+	if _, err := NewWithConfig(otherPath, mirrorConfig(mirrorPath)); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked sharing an open mirror, got %v", err)
+	}
+	w.Close()
+
+	// Another log, with entries of its own or none, can't take it over.
+	other, err := NewWithConfig(otherPath, segmentConfig(8, 2))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	other.Append([]byte("other 01"))
+	other.Close()
+	if _, err := NewWithConfig(otherPath, mirrorConfig(mirrorPath)); !errors.Is(err, ErrMirrorFailed) {
+		t.Errorf("Expected ErrMirrorFailed for another log's mirror, got %v", err)
+	}
+	w, err = NewWithConfig(walPath, mirrorConfig(mirrorPath))
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	w.Close()
+	os.Remove(walPath + ".logid")
+	if _, err := NewWithConfig(walPath, mirrorConfig(mirrorPath)); !errors.Is(err, ErrMirrorFailed) {
+		t.Errorf("Expected ErrMirrorFailed for a mirror claimed by no log, got %v", err)
+	}
+	os.Remove(mirrorPath + ".logid")
+	if _, err := NewWithConfig(walPath, mirrorConfig(mirrorPath)); !errors.Is(err, ErrMirrorFailed) {
+		t.Errorf("Expected ErrMirrorFailed for an unclaimed mirror with segments, got %v", err)
+	}
+
+	// A lost log is restored from its mirror.
+	restoredPath := filepath.Join(tmpDir, "restored", "test.wal")
+	if err := os.MkdirAll(filepath.Dir(restoredPath), 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := writeSidecar(mirrorPath+".logid", []byte("0123456789abcdef"), DefaultFileMode, false); err != nil {
+		t.Fatalf("Failed to write log id: %v", err)
+	}
+	w, err = NewWithConfig(restoredPath, mirrorConfig(mirrorPath))
+	if err != nil {
+		t.Fatalf("Failed to restore WAL: %v", err)
+	}
+	defer w.Close()
+	if w.LastIndex() != 3 {
+		t.Errorf("Expected entries 1-3 restored, got last index %d", w.LastIndex())
+	}
+	if id, _ := readLogID(restoredPath + ".logid"); id != "0123456789abcdef" {
+		t.Errorf("Expected the mirror's log id adopted, got %q", id)
+	}
+}
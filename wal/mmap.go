@@ -0,0 +1,97 @@
+package wal
+
+import (
+	"os"
+	"sync"
+)
+
+// mmapRemapStep is how far a file must have grown past its mapping before a
+// read remaps it. Reads of the unmapped tail until then use pread, so a log
+// being appended to and read at its end doesn't remap on every read.
+const mmapRemapStep = 1 << 20
+
+// mmapFile is a segment file whose reads are served from a read-only
+// mapping of it, which saves a system call per read. Writes go through the
+// file. Reads past the mapping fall back to ReadAt, and remap once the file
+// has grown by mmapRemapStep, or at once if nothing is mapped.
+//
+// Accessing a mapped page past the end of the file faults, so the mapping
+// is dropped before the file is truncated below it; Truncate waits for reads
+// in progress. A truncation by anything other than this WAL, such as another
+// process, is not covered and crashes readers with SIGBUS.
+type mmapFile struct {
+	*os.File
+	mu   sync.RWMutex
+	data []byte // the file's first len(data) bytes
+}
+
+// newMmapFile maps f as far as it currently extends. Where that fails, e.g.
+// on a platform without mmap, every read goes through the file.
+func newMmapFile(f *os.File) *mmapFile {
+	m := &mmapFile{File: f}
+	m.remap(0)
+	return m
+}
+
+func (m *mmapFile) ReadAt(p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	m.mu.RLock()
+	if off >= 0 && end <= int64(len(m.data)) {
+		n := copy(p, m.data[off:end])
+		m.mu.RUnlock()
+		return n, nil
+	}
+	mapped := int64(len(m.data))
+	m.mu.RUnlock()
+
+	atLeast := int64(1)
+	if mapped > 0 {
+		atLeast = mapped + mmapRemapStep
+	}
+	if end > mapped && m.remap(atLeast) {
+		return m.ReadAt(p, off)
+	}
+	return m.File.ReadAt(p, off)
+}
+
+// remap maps the whole file again if it now extends to at least atLeast
+// bytes, and reports whether it did.
+func (m *mmapFile) remap(atLeast int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stat, err := m.File.Stat()
+	if err != nil || stat.Size() == 0 || stat.Size() < atLeast || stat.Size() == int64(len(m.data)) || int64(int(stat.Size())) != stat.Size() {
+		return false
+	}
+	data, err := mmap(m.File, int(stat.Size()))
+	if err != nil {
+		return false
+	}
+	m.unmap()
+	m.data = data
+	return true
+}
+
+// unmap drops the mapping. Callers must hold mu for writing.
+func (m *mmapFile) unmap() {
+	if m.data != nil {
+		munmap(m.data)
+		m.data = nil
+	}
+}
+
+func (m *mmapFile) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if size < int64(len(m.data)) {
+		m.unmap()
+	}
+	return m.File.Truncate(size)
+}
+
+func (m *mmapFile) Close() error {
+	m.mu.Lock()
+	m.unmap()
+	m.mu.Unlock()
+	return m.File.Close()
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package wal
+
+import (
+	"errors"
+	"os"
+)
+
+// mmap is unavailable here; mmapFile then reads through the file.
+func mmap(f *os.File, size int) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func munmap(data []byte) error {
+	return nil
+}
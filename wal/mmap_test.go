@@ -0,0 +1,67 @@
+//go:build unix
+
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestMmap(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+	config := &Config{MaxEntrySize: DefaultMaxEntrySize, UseMmap: true}
+
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 1; i <= 10; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %02d", i)))
+	}
+	w.Close()
+
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	m, ok := w2.file.(*mmapFile)
+	if !ok {
+		t.Fatalf("Expected a mapped segment, got %T", w2.file)
+	}
+	if int64(len(m.data)) != w2.offset {
+		t.Errorf("Expected the whole segment of %d bytes mapped, got %d", w2.offset, len(m.data))
+	}
+	for i := uint64(1); i <= 10; i++ {
+		if got, err := w2.GetEntry(i); err != nil || string(got) != fmt.Sprintf("entry %02d", i) {
+			t.Errorf("Entry %d: got %q, %v", i, got, err)
+		}
+	}
+
+	// Truncation drops the mapping before cutting the file under it.
+	if err := w2.TruncateFromIndex(6); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	if m.data != nil {
+		t.Error("Expected the mapping dropped by the truncation")
+	}
+	w2.Append([]byte("entry 06'"))
+	if got, err := w2.GetEntry(6); err != nil || string(got) != "entry 06'" {
+		t.Errorf("Expected the re-appended entry, got %q, %v", got, err)
+	}
+
+	// Appends are read through the file until the segment has grown enough
+	// to remap.
+	mapped := len(m.data)
+	large := bytes.Repeat([]byte("x"), mmapRemapStep)
+	w2.Append(large)
+	if got, err := w2.GetEntry(7); err != nil || !bytes.Equal(got, large) {
+		t.Fatalf("Failed to read the large entry: %v", err)
+	}
+	if len(m.data) <= mapped || int64(len(m.data)) != w2.offset {
+		t.Errorf("Expected the mapping extended to %d bytes, got %d", w2.offset, len(m.data))
+	}
+}
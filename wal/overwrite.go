@@ -0,0 +1,92 @@
+package wal
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Overwrite replaces the payload of the entry at index with data, in place,
+// and syncs it, for a slot such as a heartbeat that is rewritten over and
+// over instead of appended to. The stored payload must come out exactly as
+// long as the one it replaces, so no offset in the log moves: data is stored
+// uncompressed and, with an EncryptionKey, sealed, and an entry stored any
+// other way can't be overwritten. The type, timestamp and tag are kept; the
+// checksum and the entry's share of LogDigest are updated.
+//
+// An overwrite is not atomic. A crash part-way leaves an entry that fails
+// its checksum, which recovery treats like any other damage: with the entry
+// in the middle of the log, that is the end of the log in RecoveryTruncate
+// and an error in RecoveryStrict. Only overwrite entries at the tail, or
+// ones you can afford to lose with everything after them.
+func (w *WAL) Overwrite(index uint64, data []byte) error {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if w.syncFailure != nil {
+		return w.syncFailure
+	}
+
+	w.indexMu.Lock()
+	defer w.indexMu.Unlock()
+	rec, ok := w.entryAt(index)
+	if !ok {
+		return fmt.Errorf("index %d out of range", index)
+	}
+	seg := w.segmentByID(rec.Segment)
+	if seg.version < 4 {
+		return fmt.Errorf("entry %d is in a version %d segment, which can't be overwritten", index, seg.version)
+	}
+	h, err := readEntryHeader(seg, rec.Offset)
+	if err != nil {
+		return err
+	}
+
+	entry := &WALEntry{Type: h.entryType, Data: data, Timestamp: h.timestamp, Tag: h.tag, Namespace: h.namespace}
+	if w.aead != nil {
+		w.seal(entry)
+	}
+	if uint32(len(entry.Data)) != h.length {
+		return fmt.Errorf("%w: entry %d stores %d bytes, overwriting it with %d bytes of data would store %d", ErrInvalidEntry, index, h.length, len(data), len(entry.Data))
+	}
+	entry.Checksum = sumEntry(seg.checksum, seg.tagged, seg.namespaced, entry)
+	buf := entry.encodeAs(seg.compact, seg.tagged, seg.namespaced)
+	if int64(len(buf)) != h.size+int64(h.length) {
+		return fmt.Errorf("%w: entry %d has a %d-byte header, expected %d", ErrInvalidEntry, index, h.size, int64(len(buf))-int64(h.length))
+	}
+
+	// Persisted digests of the entry are about to go stale.
+	if err := w.removeIndexFile(); err != nil {
+		return fmt.Errorf("failed to remove index file: %w", err)
+	}
+	if !w.storageBacked {
+		if err := removeSegmentIndex(seg); err != nil {
+			return fmt.Errorf("failed to remove segment index: %w", err)
+		}
+	}
+
+	// Readers past the index lookup must not see a half-written entry.
+	w.readMu.Lock()
+	defer w.readMu.Unlock()
+	if _, err := seg.file.WriteAt(buf, rec.Offset); err != nil {
+		return err
+	}
+	if err := w.syncFile(seg.file); err != nil {
+		return err
+	}
+
+	digest := entryDigest(index, entry.Type, data)
+	pos := int(index - w.index.firstIndex())
+	w.digest += digest - w.index.at(pos).Digest
+	w.index.setDigest(pos, digest)
+	w.cache.remove(func(i uint64) bool { return i == index })
+	return nil
+}
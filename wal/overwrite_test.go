@@ -0,0 +1,79 @@
+package wal
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestOverwrite(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		tmpDir := t.TempDir()
+		walPath := filepath.Join(tmpDir, "test.wal")
+		config := &Config{MaxEntrySize: DefaultMaxEntrySize, CompactHeader: compact, CacheSize: 4, EncryptionKey: testKey(1)}
+
+		w, err := NewWithConfig(walPath, config)
+		if err != nil {
+			t.Fatalf("Failed to create WAL: %v", err)
+		}
+		w.Append([]byte("first"))
+		w.Append([]byte("beat-0001"))
+		w.Append([]byte("last"))
+		before := w.index.at(1)
+
+		if err := w.Overwrite(2, []byte("beat-0002")); err != nil {
+			t.Fatalf("Failed to overwrite: %v", err)
+		}
+		if w.index.at(1).Offset != before.Offset || w.index.at(1).Size != before.Size {
+			t.Errorf("Expected the entry to stay at %d+%d, got %+v", before.Offset, before.Size, w.index.at(1))
+		}
+		if got, err := w.GetEntry(2); err != nil || string(got) != "beat-0002" {
+			t.Errorf("Expected the new payload, got %q, %v", got, err)
+		}
+		if err := w.Overwrite(2, []byte("beat-10000")); !errors.Is(err, ErrInvalidEntry) {
+			t.Errorf("Expected ErrInvalidEntry for a longer payload, got %v", err)
+		}
+		if err := w.Overwrite(4, []byte("last")); err == nil {
+			t.Error("Expected error for an index past LastIndex")
+		}
+		digest := w.LogDigest()
+		w.Close()
+
+		w2, err := NewWithConfig(walPath, config)
+		if err != nil {
+			t.Fatalf("Failed to recover WAL: %v", err)
+		}
+		all, err := w2.ReadAll()
+		if err != nil {
+			t.Fatalf("Failed to read all: %v", err)
+		}
+		if len(all) != 3 || string(all[1]) != "beat-0002" || string(all[2]) != "last" {
+			t.Errorf("compact=%v: expected the overwrite to survive recovery, got %q", compact, all)
+		}
+		if w2.LogDigest() != digest {
+			t.Errorf("compact=%v: expected digest %x after recovery, got %x", compact, digest, w2.LogDigest())
+		}
+		w2.Close()
+	}
+}
+
+func TestOverwriteReadOnly(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.Append([]byte("entry"))
+	w.Close()
+
+	ro, err := OpenReadOnly(walPath)
+	if err != nil {
+		t.Fatalf("Failed to open read-only: %v", err)
+	}
+	defer ro.Close()
+	if err := ro.Overwrite(1, []byte("other")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly, got %v", err)
+	}
+}
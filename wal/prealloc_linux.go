@@ -0,0 +1,19 @@
+//go:build linux
+
+package wal
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fallocate allocates disk blocks for f up to size and extends it to size,
+// falling back to ftruncate on filesystems that don't support it.
+func fallocate(f *os.File, size int64) error {
+	err := unix.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		return f.Truncate(size)
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package wal
+
+import "os"
+
+// fallocate extends f to size with ftruncate on platforms without
+// fallocate. The space is not reserved, but appends no longer grow the file.
+func fallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
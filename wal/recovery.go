@@ -1,118 +1,862 @@
 package wal
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func (w *WAL) initialize() error {
 	stat, _ := w.file.Stat()
-	if stat.Size() == 0 {
-		buf := make([]byte, WALFileHeaderSize)
-		binary.BigEndian.PutUint32(buf[0:4], WALMagicNumber)
-		binary.BigEndian.PutUint32(buf[4:8], WALVersion)
-		w.file.Write(buf)
-		w.file.Sync()
-		w.offset = int64(WALFileHeaderSize)
+	// A log whose header write never completed holds no entries and is
+	// started afresh, like an empty one.
+	if len(w.segments) == 1 && (stat.Size() == 0 || tornHeader(w.segments[0], stat.Size())) {
+		if w.readOnly { return fmt.Errorf("%w: %s has no header", ErrCorruptedWAL, w.filePath) }
+		buf := w.fileHeader()
+		if _, err := w.file.WriteAt(buf, 0); err != nil {
+			return fmt.Errorf("failed to write file header: %w", err)
+		}
+		if err := w.preallocate(w.file); err != nil {
+			return err
+		}
+		if err := w.syncFile(w.file); err != nil {
+			return fmt.Errorf("failed to sync file header: %w", err)
+		}
+		if err := w.syncDir(); err != nil {
+			return err
+		}
+		w.setCurrentFormat(w.segments[0])
+		w.offset = w.segments[0].headerSize()
+		w.start = logStart{index: 1, segment: w.segments[0].id, offset: w.offset}
+		if w.storageBacked {
+			return nil
+		}
+		// Leftover sidecars from a previous log at this path would
+		// describe offsets we are about to overwrite.
+		if err := w.removeMetaFile(); err != nil {
+			return err
+		}
+		if err := w.removeSnapshotFile(); err != nil {
+			return err
+		}
+		if err := w.removeCheckpointFile(); err != nil {
+			return err
+		}
+		if w.config.PersistIndex {
+			return w.removeIndexFile()
+		}
 		return nil
 	}
 	return w.recover()
 }
 
 func (w *WAL) recover() error {
-	header := make([]byte, WALFileHeaderSize)
-	if _, err := w.file.ReadAt(header, 0); err != nil { return err }
-	if binary.BigEndian.Uint32(header[0:4]) != WALMagicNumber { return ErrCorruptedWAL }
+	// Every segment is self-describing; entries are parsed with the
+	// version found in their own segment's header.
+	for _, seg := range w.segments {
+		if err := readFileHeader(seg); err != nil { return err }
+	}
 
-	offset := int64(WALFileHeaderSize)
-	nextIdx := uint64(1)
+	if err := w.loadMetaFile(); err != nil { return err }
+	if err := w.loadCheckpointFile(); err != nil { return err }
+	pos := -1
+	for i, seg := range w.segments {
+		if seg.id == w.start.segment { pos = i }
+	}
+	if pos < 0 {
+		finished, err := w.finishCompact()
+		if err != nil { return err }
+		if finished { pos = len(w.segments) - 1 }
+	}
+	if pos < 0 { return ErrCorruptedWAL }
+	if stat, err := w.segments[pos].file.Stat(); err != nil || stat.Size() < w.start.offset {
+		return ErrCorruptedWAL
+	}
+	// Finish a head truncation that crashed before deleting its segments.
+	if err := w.dropSegmentsBefore(pos); err != nil { return err }
 
-	for {
-		_, size, err := w.readEntryAt(offset)
-		if err != nil {
-			if err != io.EOF { w.truncate(offset) }
+	pos = 0
+	offset := w.start.offset
+	nextIdx := w.start.index
+
+	// A valid index checkpoint lets us skip straight to the unindexed tail.
+	if w.config.PersistIndex {
+		if entries, endSeg, end, ok := w.loadIndexFile(); ok {
+			w.index.reset(entries)
+			for i, seg := range w.segments {
+				if seg.id == endSeg { pos = i }
+			}
+			offset = end
+			nextIdx = w.start.index + uint64(len(entries))
+		}
+	}
+
+	for first := pos; pos < len(w.segments); pos++ {
+		seg := w.segments[pos]
+		if pos != first { offset = seg.headerSize() }
+
+		stat, serr := seg.file.Stat()
+		if serr != nil { return serr }
+
+		// A sealed segment's own index saves scanning it.
+		if w.config.PersistIndex && pos != len(w.segments)-1 {
+			if entries, ok := w.loadSegmentIndex(seg, offset, nextIdx, stat.Size()); ok {
+				w.index.append(entries...)
+				nextIdx += uint64(len(entries))
+				continue
+			}
+		}
+
+		var err error
+		for {
+			var entry *WALEntry
+			var size int64
+			entry, size, err = w.readEntryAt(seg, offset)
+			// A whole entry the key can't open is the caller's mistake, not
+			// damage to repair by truncating.
+			if errors.Is(err, ErrDecryptionFailed) { return fmt.Errorf("entry %d at offset %d of %s: %w", nextIdx, offset, seg.path, err) }
+			if err != nil { break }
+			// An aligned entry is only whole once its padding is written.
+			if offset+size > stat.Size() { err = io.ErrUnexpectedEOF; break }
+			w.index.append(EntryIndex{Index: nextIdx, Segment: seg.id, Offset: offset, Size: size, Digest: entryDigest(nextIdx, entry.Type, entry.Data)})
+			offset += size
+			nextIdx++
+		}
+
+		damaged := stat.Size() != offset
+		// A zero-filled tail is preallocated space, not damage. Sealed
+		// segments should have been trimmed; finish that.
+		if damaged && errors.Is(err, errUnwritten) && unwritten(seg, offset, stat.Size()) {
+			damaged = false
+			if pos != len(w.segments)-1 { w.truncate(seg.file, offset) }
+		}
+		if damaged {
+			if err == io.EOF || err == errPastEOF { err = io.ErrUnexpectedEOF }
+			last := pos == len(w.segments)-1
+			midLog := !last || w.hasDataAfter(seg, offset, stat.Size())
+			// A short read at the end of the active segment is a write cut
+			// off by a crash, the normal result of dying mid-append, and is
+			// dropped silently. A final entry that is all there but fails
+			// its checksum was damaged after being written.
+			if midLog || err != io.ErrUnexpectedEOF {
+				if !midLog { atomic.AddInt64(&w.metrics.TailCorruptions, 1) }
+				w.reportCorruption(nextIdx, offset, err)
+			}
+			if w.config.RecoveryMode == RecoveryStrict && midLog {
+				return fmt.Errorf("%w: unreadable entry %d at offset %d of %s: %v", ErrCorruptedWAL, nextIdx, offset, seg.path, err)
+			}
+		}
+
+		if pos == len(w.segments)-1 {
+			if damaged { w.truncate(seg.file, offset) }
+			break
+		}
+
+		// Sealed segments were synced before the next one was created, so
+		// anything short of a clean end is damage: keep the valid prefix
+		// and discard everything after it.
+		if damaged {
+			w.truncate(seg.file, offset)
+			if err := w.dropSegmentsAfter(pos); err != nil { return err }
 			break
 		}
-		w.index = append(w.index, EntryIndex{Index: nextIdx, Offset: offset})
-		offset += size
-		nextIdx++
 	}
+
+	w.file = w.segments[len(w.segments)-1].file
+	w.pinActive()
 	w.offset = offset
 	w.nextIndex = nextIdx
-	w.file.Seek(w.offset, 0)
+	w.digest = w.index.sumDigests(0, w.index.len())
+	w.checkRecoveredTail()
+	if err := w.preallocate(w.file); err != nil { return err }
+
+	// A crash between writing a snapshot and compacting behind it leaves
+	// entries the snapshot covers; finish the compaction. Under a retention
+	// policy they are kept on purpose, unless the snapshot is past the end.
+	if err := w.loadSnapshotIndex(); err != nil { return err }
+	if w.readOnly || w.snapshotIndex < w.start.index { return nil }
+	if w.snapshotIndex >= w.nextIndex || !w.retains() {
+		return w.truncateBefore(w.snapshotIndex + 1)
+	}
 	return nil
 }
 
-func (w *WAL) readEntryAt(offset int64) (*WALEntry, int64, error) {
-	headBuf := make([]byte, EntryHeaderSize)
-	if _, err := w.file.ReadAt(headBuf, offset); err != nil { return nil, 0, err }
+// checkRecoveredTail cross-checks the end of recovery against the active
+// segment: past w.offset there must be nothing, or only preallocated zeros,
+// since anything else was either truncated above or should have been. A
+// mismatch means the scan stopped early without noticing, or a truncation
+// failed, and is reported to Config.OnCorruption rather than failing the
+// open. Read-only WALs never truncate, so they are not checked.
+func (w *WAL) checkRecoveredTail() {
+	if w.readOnly {
+		return
+	}
+	stat, err := w.file.Stat()
+	if err != nil || stat.Size() == w.offset {
+		return
+	}
+	active := w.segments[len(w.segments)-1]
+	if stat.Size() > w.offset && unwritten(active, w.offset, stat.Size()) {
+		return
+	}
+	w.reportCorruption(w.nextIndex, w.offset, fmt.Errorf("%w: recovery ended at offset %d but %s is %d bytes", ErrCorruptedWAL, w.offset, active.path, stat.Size()))
+}
+
+// readFileHeader validates the header of seg and records its format version
+// and checksum type. Each older version is parsed by its own layout; a newer
+// one fails with ErrUnsupportedVersion rather than being misread.
+func readFileHeader(seg *segment) error {
+	header := make([]byte, WALFileHeaderSizeV1)
+	if _, err := seg.file.ReadAt(header, 0); err != nil { return err }
+	if byteOrder.Uint32(header[0:4]) != WALMagicNumber { return ErrCorruptedWAL }
+	seg.version = byteOrder.Uint32(header[4:8])
+	if seg.version > WALVersion {
+		return fmt.Errorf("%w: %s is version %d, supported up to %d", ErrUnsupportedVersion, seg.path, seg.version, WALVersion)
+	}
+	seg.checksum = ChecksumCRC32IEEE
+	if seg.version < 3 { return nil }
+
+	header = make([]byte, WALFileHeaderSize)
+	if _, err := seg.file.ReadAt(header, 0); err != nil { return err }
+	seg.checksum = ChecksumType(header[8])
+	if seg.checksum > checksumNone { return ErrCorruptedWAL }
+	if seg.version < 5 { return nil }
+
+	if header[9]&^(FileFlagCompactHeader|FileFlagAligned|FileFlagTagged|FileFlagNamespaced) != 0 { return ErrCorruptedWAL }
+	seg.compact = header[9]&FileFlagCompactHeader != 0
+	seg.tagged = header[9]&FileFlagTagged != 0
+	seg.namespaced = header[9]&FileFlagNamespaced != 0
+	if header[9]&FileFlagAligned != 0 {
+		seg.alignment = int64(byteOrder.Uint32(header[12:16]))
+		if !validAlignment(seg.alignment) { return ErrCorruptedWAL }
+	}
+	return nil
+}
+
+// tornHeader reports whether seg, size bytes long, is the base segment cut
+// short inside its file header, as a crash during initialize leaves it. Only
+// the base segment is written in place; later ones are renamed into place
+// with their header complete.
+func tornHeader(seg *segment, size int64) bool {
+	if seg.id != 0 {
+		return false
+	}
+	if size < WALFileHeaderSizeV1 {
+		return true
+	}
+	header := make([]byte, WALFileHeaderSizeV1)
+	if _, err := seg.file.ReadAt(header, 0); err != nil {
+		return false
+	}
+	if byteOrder.Uint32(header[0:4]) != WALMagicNumber {
+		return false
+	}
+	return size < fileHeaderSize(byteOrder.Uint32(header[4:8]))
+}
+
+func (w *WAL) readEntryAt(seg *segment, offset int64) (*WALEntry, int64, error) {
+	return w.readEntryInto(seg, offset, nil, true)
+}
+
+// entryHeader is an entry header decoded from any format version. Fields a
+// version lacks are zero.
+type entryHeader struct {
+	size        int64 // encoded header size; the payload follows
+	entryType   uint8
+	length      uint32
+	checksum    uint32
+	timestamp   int64
+	compression Compression
+	encrypted   bool
+	tag         uint64
+	namespace   uint8
+}
 
-	dLen := binary.BigEndian.Uint32(headBuf[1:5])
-	if dLen > w.config.MaxEntrySize { return nil, 0, ErrEntryTooLarge }
+// readEntryHeader decodes the header of the entry at offset in seg. A header
+// cut short by the end of the file fails with io.EOF, like a short ReadAt.
+func readEntryHeader(seg *segment, offset int64) (entryHeader, error) {
+	if seg.compact {
+		return readCompactEntryHeader(seg, offset)
+	}
+	buf := make([]byte, entryHeaderSize(seg.version)+seg.headerExtrasSize())
+	if _, err := seg.file.ReadAt(buf, offset); err != nil {
+		return entryHeader{}, err
+	}
+	// No format writes entry type 0, so a zero type byte is space nothing
+	// was written to.
+	if buf[0] == 0 {
+		return entryHeader{}, errUnwritten
+	}
+	h := entryHeader{
+		size:      int64(len(buf)),
+		entryType: buf[0],
+		length:    byteOrder.Uint32(buf[1:5]),
+		checksum:  byteOrder.Uint32(buf[5:9]),
+	}
+	if seg.version > 1 {
+		h.timestamp = int64(byteOrder.Uint64(buf[9:17]))
+	}
+	if seg.version >= 4 {
+		h.compression = Compression(buf[17] &^ EntryFlagEncrypted)
+		h.encrypted = buf[17]&EntryFlagEncrypted != 0
+	}
+	seg.parseExtras(&h, buf[entryHeaderSize(seg.version):])
+	return h, nil
+}
 
-	data := make([]byte, dLen)
-	if _, err := w.file.ReadAt(data, offset+EntryHeaderSize); err != nil { return nil, 0, err }
+// readCompactEntryHeader is readEntryHeader for FileFlagCompactHeader
+// segments; see putCompactHeader.
+func readCompactEntryHeader(seg *segment, offset int64) (entryHeader, error) {
+	buf := make([]byte, CompactEntryHeaderMaxSize+EntryTagSize+EntryNamespaceSize)
+	n, err := seg.file.ReadAt(buf, offset)
+	if n < CompactEntryHeaderMinSize {
+		if err == nil {
+			err = io.EOF
+		}
+		return entryHeader{}, err
+	}
+	buf = buf[:n]
+	if buf[0] == 0 {
+		return entryHeader{}, errUnwritten
+	}
+	length, vn := binary.Uvarint(buf[1:])
+	if vn <= 0 || vn > binary.MaxVarintLen32 || length > math.MaxUint32 {
+		return entryHeader{}, ErrCorruptedWAL
+	}
+	pos := 1 + vn
+	size := pos + 12 + int(seg.headerExtrasSize())
+	if n < size {
+		return entryHeader{}, io.EOF
+	}
+	h := entryHeader{
+		size:        int64(size),
+		entryType:   buf[0] & 0x0f,
+		length:      uint32(length),
+		checksum:    byteOrder.Uint32(buf[pos : pos+4]),
+		timestamp:   int64(byteOrder.Uint64(buf[pos+4 : pos+12])),
+		compression: Compression(buf[0]>>4) &^ Compression(EntryFlagEncrypted),
+		encrypted:   buf[0]>>4&EntryFlagEncrypted != 0,
+	}
+	seg.parseExtras(&h, buf[pos+12:size])
+	return h, nil
+}
+
+// readEntryInto is readEntryAt decoding the payload into dst instead of a
+// fresh allocation; the returned entry's Data aliases dst. It fails with
+// io.ErrShortBuffer if the payload doesn't fit. A nil dst allocates, as
+// readEntryAt does. Compressed or encrypted payloads still need a scratch
+// buffer for the stored bytes. With verify false, or in a segment written
+// without checksums, the checksum is not recomputed.
+func (w *WAL) readEntryInto(seg *segment, offset int64, dst []byte, verify bool) (*WALEntry, int64, error) {
+	h, err := readEntryHeader(seg, offset)
+	if err != nil { return nil, 0, err }
+	hs, dLen := h.size, h.length
+	limit := w.config.MaxEntrySize
+	if h.encrypted { limit += encryptionOverhead }
+	if dLen > limit { return nil, 0, ErrEntryTooLarge }
 
-	entry := &WALEntry{Type: headBuf[0], Data: data, Checksum: binary.BigEndian.Uint32(headBuf[5:9])}
-	if computeChecksum(entry.Type, data) != entry.Checksum {
+	var data []byte
+	stored := h.compression == CompressionNone && !h.encrypted
+	switch {
+	case dst == nil || !stored:
+		// A damaged length field can claim anything up to the limit; make
+		// sure the file holds that much before allocating for it. Small
+		// payloads aren't worth the stat.
+		if dLen > uncheckedEntrySize {
+			stat, err := seg.file.Stat()
+			if err != nil { return nil, 0, err }
+			if offset+hs+int64(dLen) > stat.Size() { return nil, 0, errPastEOF }
+		}
+		data = make([]byte, dLen)
+	case uint32(len(dst)) < dLen:
+		return nil, 0, io.ErrShortBuffer
+	default:
+		data = dst[:dLen]
+	}
+	if _, err := seg.file.ReadAt(data, offset+hs); err != nil { return nil, 0, err }
+
+	entry := &WALEntry{Type: h.entryType, Data: data, Checksum: h.checksum, Timestamp: h.timestamp, Compression: h.compression, Encrypted: h.encrypted, Tag: h.tag, Namespace: h.namespace}
+	if verify && seg.checksum != checksumNone && entryChecksum(seg, entry) != entry.Checksum {
 		atomic.AddInt64(&w.metrics.Corruptions, 1)
 		return nil, 0, ErrCorruptedWAL
 	}
-	return entry, int64(EntryHeaderSize + dLen), nil
+
+	// The checksum covers the stored bytes, so damage is caught before the
+	// decoder ever sees it.
+	if entry.Encrypted {
+		var out []byte
+		if entry.Compression == CompressionNone { out = dst }
+		data, err = w.open(out, entry, data)
+		if err != nil { return nil, 0, err }
+	}
+	plain, err := decompress(entry.Compression, dst, data, w.config.MaxEntrySize)
+	if err == io.ErrShortBuffer { return nil, 0, err }
+	if err != nil {
+		atomic.AddInt64(&w.metrics.Corruptions, 1)
+		return nil, 0, err
+	}
+	entry.Data = plain
+	return entry, padded(hs+int64(dLen), seg.alignment), nil
+}
+
+// entryChecksum recomputes the checksum of an entry as read from seg, using
+// the algorithm and header fields of the segment's format version.
+func entryChecksum(seg *segment, e *WALEntry) uint32 {
+	switch {
+	case seg.version == 1:
+		return computeChecksumV1(e.Type, e.Data)
+	case seg.version < 4:
+		return computeChecksumV2(seg.checksum, e.Type, e.Timestamp, e.Data)
+	default:
+		return sumEntry(seg.checksum, seg.tagged, seg.namespaced, e)
+	}
+}
+
+// hasDataAfter reports whether the entry at offset claims to end before
+// size, i.e. it is not the final entry of the file. A torn final write
+// reaches (or was meant to reach past) the end of the file, or of the written
+// part of a preallocated one.
+func (w *WAL) hasDataAfter(seg *segment, offset, size int64) bool {
+	h, err := readEntryHeader(seg, offset)
+	if err != nil {
+		return false
+	}
+	end := offset + h.size + int64(h.length)
+	return end < size && !unwritten(seg, end, size)
+}
+
+// readEntry is readEntryAt for an entry the index says exists; damage found
+// here is reported to Config.OnCorruption. The checksum is skipped if
+// Config.SkipChecksumOnRead is set.
+func (w *WAL) readEntry(seg *segment, index uint64, offset int64) (*WALEntry, int64, error) {
+	entry, size, err := w.readEntryInto(seg, offset, nil, !w.config.SkipChecksumOnRead)
+	if err != nil && isCorruption(err) {
+		w.reportCorruption(index, offset, err)
+	}
+	return entry, size, err
+}
+
+// errUnwritten is returned by readEntryAt for an offset holding zeros, as a
+// preallocated tail does. Where an entry is expected it is corruption.
+var errUnwritten = fmt.Errorf("%w: unwritten entry header", ErrCorruptedWAL)
+
+// errPastEOF is returned by readEntryAt for an entry whose length runs past
+// the end of the file: a torn final write, or a damaged length field.
+var errPastEOF = fmt.Errorf("%w: entry runs past the end of the file", ErrCorruptedWAL)
+
+// uncheckedEntrySize is the largest payload readEntryAt allocates for
+// without checking the file size first.
+const uncheckedEntrySize = 64 * 1024
+
+// isCorruption reports whether err from readEntryAt means the bytes on disk
+// are bad, as opposed to e.g. the file having been closed.
+func isCorruption(err error) bool {
+	return errors.Is(err, ErrCorruptedWAL) || errors.Is(err, ErrEntryTooLarge) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// reportCorruption passes a damaged entry to Config.OnCorruption. Readers
+// call it holding readMu, which is why the callback must not call back into
+// the WAL.
+func (w *WAL) reportCorruption(index uint64, offset int64, err error) {
+	if w.config.OnCorruption != nil {
+		w.config.OnCorruption(index, offset, err)
+	}
 }
 
-func (w *WAL) truncate(offset int64) error {
-	if err := w.file.Truncate(offset); err != nil { return err }
-	return w.file.Sync()
+// truncate cuts f at offset. In read-only mode the file is left as is; the
+// caller has already stopped indexing at offset.
+func (w *WAL) truncate(f Storage, offset int64) error {
+	if w.readOnly { return nil }
+	if err := f.Truncate(offset); err != nil { return err }
+	return f.Sync()
 }
 
 // TruncateFromIndex removes all entries from the given index onwards.
 // index is 1-based. If index is 5, entries 5, 6, 7... are deleted.
 // This is essential for Raft when a follower must resolve log conflicts.
 func (w *WAL) TruncateFromIndex(index uint64) error {
+	if w.config.Tracer == nil {
+		return w.truncateFromIndex(index)
+	}
+	span := w.startSpan(context.Background(), "wal.TruncateFromIndex", attribute.Int64("wal.index", int64(index)))
+	err := w.truncateFromIndex(index)
+	endSpan(span, err)
+	return err
+}
+
+func (w *WAL) truncateFromIndex(index uint64) error {
 	if atomic.LoadInt32(&w.closed) == 1 {
 		return ErrWALClosed
 	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
 
 	w.writeMu.Lock()
 	defer w.writeMu.Unlock()
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if w.syncFailure != nil {
+		return w.syncFailure
+	}
+	return w.truncateFromIndexLocked(index)
+}
 
+// truncateFromIndexLocked is TruncateFromIndex under writeMu.
+func (w *WAL) truncateFromIndexLocked(index uint64) error {
 	w.indexMu.Lock()
 	defer w.indexMu.Unlock()
+	return w.truncateSuffix(index)
+}
 
+// truncateSuffix removes the entries from index onwards. Callers must hold
+// writeMu and indexMu.
+func (w *WAL) truncateSuffix(index uint64) error {
 	// 1. Validation: Ensure index is within the current log range
-	if index == 0 || index > uint64(len(w.index)) {
-		return fmt.Errorf("invalid truncate index: %d (current log size: %d)", index, len(w.index))
+	target, ok := w.entryAt(index)
+	if !ok {
+		return fmt.Errorf("invalid truncate index: %d (current log size: %d)", index, w.index.len())
 	}
 
 	// 2. Find the file offset of the entry to be removed
-	// Since index is 1-based, index-1 is the slice position.
-	truncateOffset := w.index[index-1].Offset
+	truncateOffset := target.Offset
+	pos := 0
+	for i, seg := range w.segments {
+		if seg.id == target.Segment { pos = i }
+	}
+	file := w.segments[pos].file
 
-	// 3. Physical Truncation
-	// This removes the data from the underlying storage.
-	if err := w.file.Truncate(truncateOffset); err != nil {
-		return fmt.Errorf("failed to physically truncate file: %w", err)
+	// 3. Invalidate the index checkpoint
+	// Offsets past the truncation point are about to be reused.
+	if err := w.removeIndexFile(); err != nil {
+		return fmt.Errorf("failed to remove index file: %w", err)
+	}
+	// A sealed target segment is about to change size and become active.
+	if !w.storageBacked {
+		if err := removeSegmentIndex(w.segments[pos]); err != nil {
+			return fmt.Errorf("failed to remove segment index: %w", err)
+		}
 	}
 
-	// 4. Force Sync
+	// 4. Physical Truncation
+	// Later segments go entirely; the target segment is cut at the entry.
+	// readMu waits out reads already past the index lookup; new ones are
+	// held off by indexMu until the in-memory index matches the files.
+	// A mirror records the cut first, so a crash part-way through can't
+	// bring the cut entries back from either copy. Once anything is
+	// deleted, a failure stops the WAL as a failed sync does, since the
+	// in-memory index no longer matches the files; one on the mirror alone
+	// doesn't, and the in-memory state follows the primary before it is
+	// returned.
+	w.readMu.Lock()
+	defer w.readMu.Unlock()
+	if err := prepareCut(file, truncateOffset); err != nil {
+		return fmt.Errorf("failed to record truncation: %w", err)
+	}
+	if err := w.dropSegmentsAfter(pos); err != nil {
+		return w.failTruncation(fmt.Errorf("failed to remove segments: %w", err))
+	}
+	var mirrorErr error
+	if err := file.Truncate(truncateOffset); err != nil {
+		if !errors.Is(err, ErrMirrorFailed) {
+			return w.failTruncation(fmt.Errorf("failed to physically truncate file: %w", err))
+		}
+		mirrorErr = err
+	}
+	// Re-extend with fresh zeros, so the cut entries can't be mistaken
+	// for live ones.
+	if err := w.preallocate(file); err != nil {
+		if !errors.Is(err, ErrMirrorFailed) {
+			return w.failTruncation(fmt.Errorf("failed to preallocate file: %w", err))
+		}
+		if mirrorErr == nil {
+			mirrorErr = err
+		}
+	}
+
+	// 5. Force Sync
 	// Critical: Ensure the file system metadata (new size) is durable.
-	if err := w.file.Sync(); err != nil {
-		return fmt.Errorf("failed to sync after truncation: %w", err)
+	if err := w.syncFile(file); err != nil {
+		if !errors.Is(err, ErrMirrorFailed) {
+			return fmt.Errorf("failed to sync after truncation: %w", err)
+		}
+		if mirrorErr == nil {
+			mirrorErr = err
+		}
 	}
+	atomic.StoreInt64(&w.metrics.PendingBytes, 0)
 
-	// 5. Update In-Memory State
-	w.index = w.index[:index-1] // Remove indices from memory
+	// 6. Update In-Memory State
+	keep := int(index - w.index.firstIndex())
+	w.digest -= w.index.sumDigests(keep, w.index.len())
+	w.index.truncate(keep) // Remove indices from memory
+	w.cache.removeFrom(index)   // Cached payloads past the cut are stale
 	w.nextIndex = index         // Set next index to the one we just cleared
+	w.resetSynced(index)        // Re-appended entries start out unsynced
+	w.file = file               // The target segment is active again
+	w.pinActive()
 	w.offset = truncateOffset   // Move write pointer back
+	w.segmentStart = 0          // The active segment's oldest entry may have changed
+	atomic.AddInt64(&w.metrics.TruncateCount, 1)
+
+	if mirrorErr != nil {
+		return fmt.Errorf("failed to truncate mirror: %w", mirrorErr)
+	}
+	return nil
+}
+
+// failTruncation stops the WAL after a truncation failed with err once it
+// had begun deleting, like a failed sync: until it is reopened, nothing may
+// be written past an index that points into missing files. A cut recorded
+// by the mirror is left for recovery to finish.
+func (w *WAL) failTruncation(err error) error {
+	w.syncFailure = fmt.Errorf("%w: %w", ErrSyncFailed, err)
+	w.markSynced(0, w.syncFailure)
+	return w.syncFailure
+}
+
+// TruncateBefore removes all entries before the given index, making it the
+// new first entry. This is the log-compaction counterpart of
+// TruncateFromIndex: once entries are covered by a snapshot they can go.
+// Passing LastIndex()+1 discards every entry while keeping the index
+// sequence; indices at or below the current first entry are a no-op. An
+// empty log accepts any later index and continues from there, as a Raft
+// follower does after installing a snapshot past the end of its log.
+//
+// The new start is recorded in a sidecar meta file, so space is reclaimed a
+// segment at a time: segments entirely before index are deleted, while the
+// segment holding index keeps its dead prefix until it is itself dropped.
+func (w *WAL) TruncateBefore(index uint64) error {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if w.storageBacked {
+		return errNoSidecars("TruncateBefore")
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if w.syncFailure != nil {
+		return w.syncFailure
+	}
+
+	w.indexMu.Lock()
+	defer w.indexMu.Unlock()
+
+	if index > w.nextIndex && w.index.len() > 0 {
+		return fmt.Errorf("invalid truncate index: %d (next index: %d)", index, w.nextIndex)
+	}
+	return w.truncateBefore(index)
+}
 
-	// 6. Reset File Pointer
-	// Required because Append uses w.file.Write()
-	if _, err := w.file.Seek(w.offset, 0); err != nil {
-		return fmt.Errorf("failed to seek to new end: %w", err)
+// truncateBefore makes index the first index of the log. An index past the
+// end empties the log and moves the sequence forward: the next append gets
+// index. Callers must hold writeMu and indexMu, or be recovering.
+func (w *WAL) truncateBefore(index uint64) error {
+	first := w.nextIndex - uint64(w.index.len())
+	if index <= first {
+		return nil
+	}
+
+	start := logStart{index: index, segment: w.segments[len(w.segments)-1].id, offset: w.offset}
+	if index < w.nextIndex {
+		e := w.index.at(int(index - first))
+		start.segment = e.Segment
+		start.offset = e.Offset
+	}
+
+	// The checkpoint describes entries we are about to disown.
+	if err := w.removeIndexFile(); err != nil {
+		return fmt.Errorf("failed to remove index file: %w", err)
+	}
+	// Once the meta file is durable the truncation has happened; deleting
+	// old segments afterwards is just cleanup that recovery can redo.
+	if err := w.writeMetaFile(start); err != nil {
+		return fmt.Errorf("failed to write meta file: %w", err)
+	}
+	w.start = start
+	if index < w.nextIndex {
+		w.digest -= w.index.sumDigests(0, int(index-first))
+		w.index.dropFront(int(index - first))
+	} else {
+		w.index = newIndexTable(w.config.SparseIndexInterval)
+		w.digest = 0
+		w.nextIndex = index
 	}
+	w.cache.removeBefore(index)
 
+	pos := 0
+	for i, seg := range w.segments {
+		if seg.id == start.segment { pos = i }
+	}
+	w.readMu.Lock()
+	defer w.readMu.Unlock()
+	if err := w.dropSegmentsBefore(pos); err != nil {
+		return fmt.Errorf("failed to remove segments: %w", err)
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+// Retain keeps only the entries lo through hi, both inclusive, discarding
+// everything after hi as TruncateFromIndex does and everything before lo as
+// TruncateBefore does, for windowed retention. It requires
+// 1 <= lo <= hi <= LastIndex(), with hi at or past FirstIndex(); a lo at or
+// below the first entry keeps the head of the log as is. Readers see the log
+// either before or after both cuts, never in between.
+//
+// The tail is cut first. If cutting the head then fails, the tail stays cut
+// and the error says so. As with TruncateBefore, storage-backed WALs fail
+// with errors.ErrUnsupported.
+func (w *WAL) Retain(lo, hi uint64) error {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if w.storageBacked {
+		return errNoSidecars("Retain")
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if w.syncFailure != nil {
+		return w.syncFailure
+	}
+
+	w.indexMu.Lock()
+	defer w.indexMu.Unlock()
+
+	first, last := w.nextIndex-uint64(w.index.len()), w.nextIndex-1
+	if lo < 1 || lo > hi || hi < first || hi > last {
+		return fmt.Errorf("invalid retain range [%d, %d] (log holds [%d, %d])", lo, hi, first, last)
+	}
+	if hi < last {
+		if err := w.truncateSuffix(hi + 1); err != nil {
+			return err
+		}
+	}
+	if err := w.truncateBefore(lo); err != nil {
+		return fmt.Errorf("entries after %d were removed, but not those before %d: %w", hi, lo, err)
+	}
+	return nil
+}
+
+// Reset discards every entry, leaving an empty log whose next append gets
+// index 1, as if the WAL had just been created. Unlike closing and deleting
+// the files, the WAL stays open and keeps its lock. Any snapshot is removed
+// too.
+//
+// The log continues in a fresh segment, and the switch to it is recorded in
+// the meta file before older segments are deleted, so a crash part-way
+// leaves either the old entries or none. A storage-backed WAL is emptied in
+// place.
+func (w *WAL) Reset() error {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if w.syncFailure != nil {
+		return w.syncFailure
+	}
+
+	if !w.storageBacked {
+		if err := w.rotate(); err != nil {
+			return fmt.Errorf("failed to start a new segment: %w", err)
+		}
+	}
+
+	w.indexMu.Lock()
+	defer w.indexMu.Unlock()
+
+	if err := w.removeIndexFile(); err != nil {
+		return fmt.Errorf("failed to remove index file: %w", err)
+	}
+
+	active := w.segments[len(w.segments)-1]
+	if w.storageBacked {
+		w.readMu.Lock()
+		err := w.resetStorage(active)
+		w.readMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	// Either way the active segment is now empty and in the current format.
+	start := logStart{index: 1, segment: active.id, offset: active.headerSize()}
+	if !w.storageBacked {
+		// The snapshot would move the index sequence forward on recovery.
+		if err := w.removeSnapshotFile(); err != nil {
+			return fmt.Errorf("failed to remove snapshot: %w", err)
+		}
+		if err := w.removeCheckpointFile(); err != nil {
+			return fmt.Errorf("failed to remove checkpoint: %w", err)
+		}
+		if err := w.writeMetaFile(start); err != nil {
+			return fmt.Errorf("failed to write meta file: %w", err)
+		}
+	}
+
+	w.start = start
+	w.index = newIndexTable(w.config.SparseIndexInterval)
+	w.digest = 0
+	w.cache.removeFrom(0)
+	w.nextIndex = 1
+	w.resetSynced(1)
+	w.snapshotIndex = 0
+	w.uncheckpointed = 0
+	atomic.StoreUint64(&w.checkpointIndex, 0)
+
+	w.readMu.Lock()
+	defer w.readMu.Unlock()
+	if err := w.dropSegmentsBefore(len(w.segments) - 1); err != nil {
+		return fmt.Errorf("failed to remove segments: %w", err)
+	}
+	return nil
+}
+
+// resetStorage empties a storage-backed WAL's only segment down to a fresh
+// header. Callers must hold writeMu and readMu for writing.
+func (w *WAL) resetStorage(seg *segment) error {
+	if err := seg.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate storage: %w", err)
+	}
+	if _, err := seg.file.WriteAt(w.fileHeader(), 0); err != nil {
+		return fmt.Errorf("failed to write file header: %w", err)
+	}
+	if err := w.preallocate(seg.file); err != nil {
+		return fmt.Errorf("failed to preallocate storage: %w", err)
+	}
+	if err := w.syncFile(seg.file); err != nil {
+		return fmt.Errorf("failed to sync after reset: %w", err)
+	}
+	atomic.StoreInt64(&w.metrics.PendingBytes, 0)
+	w.setCurrentFormat(seg)
+	w.offset = seg.headerSize()
+	return nil
+}
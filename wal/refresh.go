@@ -0,0 +1,136 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// Refresh picks up entries a writer in another process has appended since
+// the log was opened, or since the last Refresh; see OpenFollower. It scans
+// on from the end of the index and then through any segments the writer has
+// started since. An entry that is not all there yet, such as one the writer
+// is in the middle of appending, ends the scan without error and is picked
+// up by a later Refresh. Follow and iterators see the new entries as usual.
+//
+// Refresh only follows appends. If the active segment has shrunk below what
+// is already indexed, the writer has truncated or rewritten the log and
+// Refresh fails; the log must be reopened. A WAL open for writing is always
+// current, and Refresh returns nil.
+func (w *WAL) Refresh() error {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if !w.readOnly {
+		return nil
+	}
+
+	// writeMu keeps concurrent Refreshes from indexing the same entries.
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+
+	// Listed before scanning: a later segment only exists once the writer
+	// has sealed the one before it, so the scan then reaches its end.
+	ids, err := discoverSegments(w.filePath)
+	if err != nil {
+		return err
+	}
+	seg := w.segments[len(w.segments)-1]
+	start := w.nextIndex
+	for {
+		entries, end, err := w.scanFrom(seg, w.offset, w.nextIndex)
+		if err != nil {
+			return err
+		}
+		w.indexMu.Lock()
+		w.index.append(entries...)
+		w.digest += sumDigests(entries)
+		w.indexMu.Unlock()
+		w.offset = end
+		w.nextIndex += uint64(len(entries))
+
+		next, ok := nextSegmentID(ids, seg.id)
+		if !ok {
+			break
+		}
+		if stat, err := seg.file.Stat(); err != nil {
+			return err
+		} else if stat.Size() != end {
+			return fmt.Errorf("%w: unreadable entry %d at offset %d of sealed segment %s", ErrCorruptedWAL, w.nextIndex, end, seg.path)
+		}
+		if seg, err = w.openFollowedSegment(next); err != nil {
+			return err
+		}
+		w.offset = seg.headerSize()
+	}
+
+	if w.nextIndex > start {
+		w.markSynced(w.nextIndex-1, nil)
+		w.wakeFollowers()
+	}
+	return nil
+}
+
+// scanFrom indexes the whole entries of seg from offset on, numbering them
+// from next, and returns them with the offset just past the last one. It
+// stops without error at the first entry it can't read.
+func (w *WAL) scanFrom(seg *segment, offset int64, next uint64) ([]EntryIndex, int64, error) {
+	stat, err := seg.file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if stat.Size() < offset {
+		return nil, 0, fmt.Errorf("%s is %d bytes but was indexed up to %d: the log was rewritten; reopen it", seg.path, stat.Size(), offset)
+	}
+
+	var entries []EntryIndex
+	for {
+		entry, size, err := w.readEntryAt(seg, offset)
+		if errors.Is(err, ErrDecryptionFailed) {
+			return nil, 0, fmt.Errorf("entry %d at offset %d of %s: %w", next, offset, seg.path, err)
+		}
+		// Anything past the size taken above is left for the next scan.
+		if err != nil || offset+size > stat.Size() {
+			return entries, offset, nil
+		}
+		entries = append(entries, EntryIndex{Index: next, Segment: seg.id, Offset: offset, Size: size, Digest: entryDigest(next, entry.Type, entry.Data)})
+		offset += size
+		next++
+	}
+}
+
+// nextSegmentID returns the lowest id in ids, which are sorted, above id.
+func nextSegmentID(ids []uint64, id uint64) (uint64, bool) {
+	for _, next := range ids {
+		if next > id {
+			return next, true
+		}
+	}
+	return 0, false
+}
+
+// openFollowedSegment opens segment id, which the writer has started since
+// it was last looked for, and makes it the active one. Callers must hold
+// writeMu.
+func (w *WAL) openFollowedSegment(id uint64) (*segment, error) {
+	path := segmentPath(w.filePath, id)
+	file, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{id: id, path: path, file: w.segmentFile(path, file)}
+	if err := readFileHeader(seg); err != nil {
+		seg.file.Close()
+		return nil, err
+	}
+	w.indexMu.Lock()
+	w.segments = append(w.segments, seg)
+	w.indexMu.Unlock()
+	w.file = seg.file
+	w.pinActive()
+	return seg, nil
+}
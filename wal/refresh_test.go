@@ -0,0 +1,86 @@
+package wal
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestRefresh(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, segmentConfig(8, 2))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	w.Append([]byte("entry 01"))
+
+	r, err := OpenFollower(walPath)
+	if err != nil {
+		t.Fatalf("Failed to open follower: %v", err)
+	}
+	defer r.Close()
+	if r.LastIndex() != 1 {
+		t.Fatalf("Expected LastIndex 1, got %d", r.LastIndex())
+	}
+
+	// Entries 2 to 5 span two new segments.
+	for i := 2; i <= 5; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %02d", i)))
+	}
+	if err := r.Refresh(); err != nil {
+		t.Fatalf("Failed to refresh: %v", err)
+	}
+	if r.LastIndex() != 5 || len(r.segments) != 3 {
+		t.Fatalf("Expected LastIndex 5 in 3 segments, got %d in %d", r.LastIndex(), len(r.segments))
+	}
+	for i := uint64(1); i <= 5; i++ {
+		got, err := r.GetEntry(i)
+		if err != nil || string(got) != fmt.Sprintf("entry %02d", i) {
+			t.Errorf("Expected entry %d, got %q, %v", i, got, err)
+		}
+	}
+
+	// Half an entry is a write in progress: it is left for later.
+	encoded := w.encodeEntry(w.newEntry(EntryTypeData, []byte("entry 06"), 0))
+	w.file.WriteAt(encoded[:10], w.offset)
+	if err := r.Refresh(); err != nil || r.LastIndex() != 5 {
+		t.Fatalf("Expected a torn tail to be skipped, got LastIndex %d, %v", r.LastIndex(), err)
+	}
+	w.file.WriteAt(encoded[10:], w.offset+10)
+	if err := r.Refresh(); err != nil || r.LastIndex() != 6 {
+		t.Fatalf("Expected the completed entry 6, got LastIndex %d, %v", r.LastIndex(), err)
+	}
+	if got, err := r.GetEntry(6); err != nil || string(got) != "entry 06" {
+		t.Errorf("Expected entry 6, got %q, %v", got, err)
+	}
+}
+
+func TestRefreshAfterTruncation(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	for i := 0; i < 3; i++ {
+		w.Append([]byte("entry"))
+	}
+	r, err := OpenFollower(walPath)
+	if err != nil {
+		t.Fatalf("Failed to open follower: %v", err)
+	}
+	defer r.Close()
+
+	w.TruncateFromIndex(2)
+	if err := r.Refresh(); err == nil {
+		t.Error("Expected an error once the log shrank under the follower")
+	}
+	if err := w.Refresh(); err != nil {
+		t.Errorf("Expected Refresh on a writer to do nothing, got %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package wal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// RepairReport is the result of Repair.
+type RepairReport struct {
+	OutputPath string        // the salvaged log, a new WAL
+	Entries    int           // entries written to it
+	Recovered  []RepairRange // byte ranges whose entries were salvaged
+	Dropped    []RepairRange // byte ranges skipped as unreadable
+}
+
+// RepairRange is the byte range [Start, End) of one segment file.
+type RepairRange struct {
+	Segment uint64 // id of the segment file
+	Start   int64
+	End     int64
+}
+
+// Repair salvages what it can from a damaged log at filePath, which must not
+// be open. Where recovery stops at the first unreadable entry and discards
+// everything after it, Repair skips the damage: from each bad entry it
+// searches forward, one byte (or alignment unit) at a time, for the next
+// offset holding a plausible header whose entry passes its checksum, and
+// carries on from there. A segment with an unreadable file header is dropped
+// whole. Entries TruncateBefore already discarded are not salvaged.
+//
+// The salvaged entries are written, with their types, timestamps and stored
+// payloads unchanged, to a new single-segment WAL at <filePath>.repaired,
+// which must not exist yet. Entries are renumbered from 1, since what was
+// lost in a skipped range can't be known. The original files are only read.
+// Encrypted entries are copied as they are, so the copy needs the same
+// EncryptionKey.
+func Repair(filePath string) (*RepairReport, error) {
+	lock, err := acquireLock(filePath+".lock", true, DefaultFileMode)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	w := &WAL{
+		filePath: filePath,
+		dirPath:  filepath.Dir(filePath),
+		metaPath: filePath + ".meta",
+		config:   &Config{},
+		readOnly: true,
+	}
+	if err := w.openSegments(); err != nil {
+		return nil, err
+	}
+	defer w.closeSegments()
+
+	outPath := filePath + ".repaired"
+	out, err := os.OpenFile(outPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, DefaultFileMode)
+	if err != nil {
+		return nil, err
+	}
+	report := &RepairReport{OutputPath: outPath}
+	if err := w.salvage(out, report); err != nil {
+		out.Close()
+		os.Remove(outPath)
+		return nil, err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return nil, err
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+	return report, w.syncDir()
+}
+
+// salvage writes every readable entry of w's segments to out, filling in
+// report.
+func (w *WAL) salvage(out *os.File, report *RepairReport) error {
+	headerErrs := make([]error, len(w.segments))
+	tagged, namespaced := false, false
+	for i, seg := range w.segments {
+		headerErrs[i] = readFileHeader(seg)
+		tagged = tagged || (headerErrs[i] == nil && seg.tagged)
+		namespaced = namespaced || (headerErrs[i] == nil && seg.namespaced)
+	}
+	// Tags and namespaces survive if any segment has them; other entries
+	// get tag and namespace 0.
+	buf := bufio.NewWriterSize(out, 64*1024)
+	if _, err := buf.Write(encodeFileHeader(ChecksumCRC32IEEE, false, tagged, namespaced, 0)); err != nil {
+		return err
+	}
+	// A damaged meta file only costs the dead prefix, which is then
+	// salvaged too.
+	if w.loadMetaFile() != nil {
+		w.start = logStart{}
+	}
+
+	readahead := make([]byte, readaheadSize)
+	for i, seg := range w.segments {
+		if seg.id < w.start.segment {
+			continue
+		}
+		stat, err := seg.file.Stat()
+		if err != nil {
+			return err
+		}
+		size := stat.Size()
+		if headerErrs[i] != nil {
+			if size > 0 {
+				report.addDropped(seg.id, 0, size)
+			}
+			continue
+		}
+		offset := seg.headerSize()
+		if seg.id == w.start.segment && w.start.offset > offset {
+			offset = w.start.offset
+		}
+
+		scan := seg.buffered(readahead)
+		for offset < size {
+			entry, n, err := readStoredEntry(scan, offset, size)
+			if err == nil {
+				entry.Checksum = sumEntry(ChecksumCRC32IEEE, tagged, namespaced, entry)
+				if _, err := buf.Write(entry.encodeAs(false, tagged, namespaced)); err != nil {
+					return err
+				}
+				report.Entries++
+				report.addRecovered(seg.id, offset, offset+n)
+				offset += n
+				continue
+			}
+			if errors.Is(err, errUnwritten) && unwritten(scan, offset, size) {
+				// Preallocated space, the clean end of the segment.
+				break
+			}
+			next := resync(scan, offset, size)
+			report.addDropped(seg.id, offset, next)
+			offset = next
+		}
+	}
+	return buf.Flush()
+}
+
+// resync returns the first offset after offset at which seg holds an entry
+// that reads back whole and passes its checksum, or size if there is none.
+func resync(seg *segment, offset, size int64) int64 {
+	step := max(seg.alignment, 1)
+	for pos := padded(offset+1, step); pos < size; pos += step {
+		if _, _, err := readStoredEntry(seg, pos, size); err == nil {
+			return pos
+		}
+	}
+	return size
+}
+
+// readStoredEntry reads the entry at offset in seg as stored, without
+// decompressing or decrypting it, and verifies its checksum. Anything
+// implausible for a real header, such as an unknown type or codec or a
+// payload running past size, fails without reading the payload.
+func readStoredEntry(seg *segment, offset, size int64) (*WALEntry, int64, error) {
+	h, err := readEntryHeader(seg, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !knownEntryType(h.entryType) || h.compression > CompressionZstd {
+		return nil, 0, ErrInvalidEntry
+	}
+	end := offset + h.size + int64(h.length)
+	if end > size {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, h.length)
+	if _, err := seg.file.ReadAt(data, offset+h.size); err != nil {
+		return nil, 0, err
+	}
+	entry := &WALEntry{Type: h.entryType, Data: data, Checksum: h.checksum, Timestamp: h.timestamp, Compression: h.compression, Encrypted: h.encrypted, Tag: h.tag, Namespace: h.namespace}
+	if entryChecksum(seg, entry) != entry.Checksum {
+		return nil, 0, ErrCorruptedWAL
+	}
+	n := padded(end-offset, seg.alignment)
+	if offset+n > size {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	return entry, n, nil
+}
+
+// addRecovered records that [start, end) of segment was salvaged.
+func (r *RepairReport) addRecovered(segment uint64, start, end int64) {
+	if n := len(r.Recovered); n > 0 && r.Recovered[n-1].Segment == segment && r.Recovered[n-1].End == start {
+		r.Recovered[n-1].End = end
+		return
+	}
+	r.Recovered = append(r.Recovered, RepairRange{Segment: segment, Start: start, End: end})
+}
+
+// addDropped records that [start, end) of segment was skipped.
+func (r *RepairReport) addDropped(segment uint64, start, end int64) {
+	r.Dropped = append(r.Dropped, RepairRange{Segment: segment, Start: start, End: end})
+}
+
+// String summarizes the report, e.g. for a repair tool's output.
+func (r *RepairReport) String() string {
+	var dropped int64
+	for _, d := range r.Dropped {
+		dropped += d.End - d.Start
+	}
+	return fmt.Sprintf("salvaged %d entries to %s; dropped %d bytes in %d ranges", r.Entries, r.OutputPath, dropped, len(r.Dropped))
+}
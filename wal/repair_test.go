@@ -0,0 +1,136 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 1; i <= 10; i++ {
+		w.Append([]byte(fmt.Sprintf("entry-%02d", i)))
+	}
+	bad := w.index.at(3)   // entry 4: damaged payload
+	worse := w.index.at(6) // entry 7: absurd length
+	w.Close()
+
+	f, err := os.OpenFile(walPath, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	f.WriteAt([]byte("X"), bad.Offset+EntryHeaderSize)
+	var length [4]byte
+	byteOrder.PutUint32(length[:], 1<<30)
+	f.WriteAt(length[:], worse.Offset+1)
+	f.Close()
+	before, _ := os.ReadFile(walPath)
+
+	report, err := Repair(walPath)
+	if err != nil {
+		t.Fatalf("Failed to repair: %v", err)
+	}
+	if report.Entries != 8 {
+		t.Errorf("Expected 8 entries salvaged, got %d", report.Entries)
+	}
+	want := []RepairRange{
+		{Segment: 0, Start: bad.Offset, End: bad.Offset + bad.Size},
+		{Segment: 0, Start: worse.Offset, End: worse.Offset + worse.Size},
+	}
+	if fmt.Sprint(report.Dropped) != fmt.Sprint(want) {
+		t.Errorf("Expected dropped ranges %v, got %v", want, report.Dropped)
+	}
+	if len(report.Recovered) != 3 {
+		t.Errorf("Expected 3 recovered ranges, got %v", report.Recovered)
+	}
+	if after, _ := os.ReadFile(walPath); !bytes.Equal(before, after) {
+		t.Error("Repair modified the original log")
+	}
+
+	w2, err := New(report.OutputPath)
+	if err != nil {
+		t.Fatalf("Failed to open repaired WAL: %v", err)
+	}
+	defer w2.Close()
+	all, err := w2.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read repaired WAL: %v", err)
+	}
+	var got []string
+	for _, data := range all {
+		got = append(got, string(data))
+	}
+	expected := "[entry-01 entry-02 entry-03 entry-05 entry-06 entry-08 entry-09 entry-10]"
+	if fmt.Sprint(got) != expected {
+		t.Errorf("Expected %s, got %v", expected, got)
+	}
+
+	if _, err := Repair(walPath); err == nil {
+		t.Error("Expected Repair to refuse an existing output file")
+	}
+}
+
+func TestRepairAcrossSegments(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, MaxSegmentSize: 128, Compression: CompressionSnappy})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	var entries [][]byte
+	for i := 1; i <= 12; i++ {
+		data := bytes.Repeat([]byte{byte('a' + i)}, 40)
+		entries = append(entries, data)
+		w.Append(data)
+	}
+	if len(w.segments) < 3 {
+		t.Fatalf("Expected several segments, got %d", len(w.segments))
+	}
+	second := w.segments[1].path
+	w.Close()
+
+	// Recovery would drop every segment after a damaged sealed one; Repair
+	// keeps them.
+	f, err := os.OpenFile(walPath, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	f.WriteAt([]byte("garbage!"), WALFileHeaderSize+2)
+	f.Close()
+	if err := os.WriteFile(second, []byte("not a segment"), 0644); err != nil {
+		t.Fatalf("Failed to overwrite segment: %v", err)
+	}
+
+	report, err := Repair(walPath)
+	if err != nil {
+		t.Fatalf("Failed to repair: %v", err)
+	}
+	if len(report.Dropped) != 2 || report.Dropped[1] != (RepairRange{Segment: 1, Start: 0, End: 13}) {
+		t.Errorf("Expected the damaged entry and the second segment dropped, got %v", report.Dropped)
+	}
+
+	w2, err := New(report.OutputPath)
+	if err != nil {
+		t.Fatalf("Failed to open repaired WAL: %v", err)
+	}
+	defer w2.Close()
+	all, err := w2.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read repaired WAL: %v", err)
+	}
+	if len(all) != report.Entries || len(all) == 0 {
+		t.Fatalf("Expected %d entries, got %d", report.Entries, len(all))
+	}
+	if last := all[len(all)-1]; !bytes.Equal(last, entries[len(entries)-1]) {
+		t.Errorf("Expected the last entry salvaged, got %q", last)
+	}
+}
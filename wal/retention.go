@@ -0,0 +1,180 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// retains reports whether a retention policy is configured. With one, entries
+// covered by a snapshot are kept until Reclaim finds their segment over a
+// limit, so lagging readers can still catch up from the log.
+func (w *WAL) retains() bool {
+	return w.config.MaxTotalSize > 0 || w.config.MaxSegmentAge > 0
+}
+
+// Reclaim deletes the oldest sealed segments whose entries are all covered
+// by the installed snapshot, for as long as the log exceeds MaxTotalSize or
+// the segment is older than MaxSegmentAge (by its modification time, i.e.
+// when it was sealed). Segments holding any entry past the snapshot, and the
+// active segment, are never deleted. It returns the number of segments
+// deleted.
+//
+// Reclaim also runs after every InstallSnapshot and segment rotation, so
+// calling it directly is only needed to enforce MaxSegmentAge on a log that
+// isn't growing.
+func (w *WAL) Reclaim() (deleted int, err error) {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return 0, ErrWALClosed
+	}
+	if w.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return 0, ErrWALClosed
+	}
+	if w.syncFailure != nil {
+		return 0, w.syncFailure
+	}
+	return w.reclaim()
+}
+
+// Expire drops the expired head of the log: every leading entry appended
+// more than Config.EntryTTL ago, by Config.Clock, as TruncateBefore would.
+// Only a prefix can go, so it stops at the first live entry even if later
+// ones have expired, as when the clock was set back. Entries without a
+// timestamp, from v1 segments, never expire.
+// It returns the number of entries dropped. Expire doesn't run by itself:
+// call it periodically, or before reading the window.
+func (w *WAL) Expire() (removed int, err error) {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return 0, ErrWALClosed
+	}
+	if w.readOnly {
+		return 0, ErrReadOnly
+	}
+	if w.config.EntryTTL <= 0 {
+		return 0, fmt.Errorf("expiry needs Config.EntryTTL")
+	}
+	if w.storageBacked {
+		return 0, errNoSidecars("Expire")
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return 0, ErrWALClosed
+	}
+	if w.syncFailure != nil {
+		return 0, w.syncFailure
+	}
+
+	w.indexMu.Lock()
+	defer w.indexMu.Unlock()
+	cutoff := w.config.now().Add(-w.config.EntryTTL).UnixNano()
+	var rerr error
+	w.index.each(0, func(e EntryIndex) bool {
+		h, err := readEntryHeader(w.segmentByID(e.Segment), e.Offset)
+		if err != nil {
+			rerr = fmt.Errorf("failed to read entry %d: %w", e.Index, err)
+			return false
+		}
+		if h.timestamp == 0 || h.timestamp >= cutoff {
+			return false
+		}
+		removed++
+		return true
+	})
+	if rerr != nil {
+		return 0, rerr
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	if err := w.truncateBefore(w.index.firstIndex() + uint64(removed)); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// reclaim is Reclaim for callers holding writeMu.
+func (w *WAL) reclaim() (int, error) {
+	if !w.retains() || w.snapshotIndex == 0 {
+		return 0, nil
+	}
+
+	w.indexMu.Lock()
+	defer w.indexMu.Unlock()
+
+	// last index held by each segment; segments without entries are absent
+	last := make(map[uint64]uint64)
+	w.index.each(0, func(e EntryIndex) bool {
+		last[e.Segment] = e.Index
+		return true
+	})
+
+	stats := make([]os.FileInfo, len(w.segments))
+	var total int64
+	for i, seg := range w.segments {
+		stat, err := seg.file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		stats[i] = stat
+		total += stat.Size()
+	}
+
+	// Entries before the first one still indexed are already gone.
+	covered := w.start.index - 1
+	cut := 0
+	for pos := 0; pos < len(w.segments)-1; pos++ {
+		seg := w.segments[pos]
+		l, ok := last[seg.id]
+		if ok && l > w.snapshotIndex {
+			break
+		}
+		overSize := w.config.MaxTotalSize > 0 && total > w.config.MaxTotalSize
+		tooOld := w.config.MaxSegmentAge > 0 && w.config.now().Sub(stats[pos].ModTime()) > w.config.MaxSegmentAge
+		if !overSize && !tooOld {
+			break
+		}
+		total -= stats[pos].Size()
+		cut = pos + 1
+		if ok {
+			covered = l
+		}
+	}
+	if cut == 0 {
+		return 0, nil
+	}
+
+	before := len(w.segments)
+	if err := w.truncateBefore(covered + 1); err != nil {
+		return 0, err
+	}
+	return before - len(w.segments), nil
+}
+
+// removeSegmentFile deletes a segment that has been dropped from the log,
+// counting the space it frees.
+func (w *WAL) removeSegmentFile(seg *segment) error {
+	var size int64
+	if stat, err := seg.file.Stat(); err == nil {
+		size = stat.Size()
+	}
+	seg.file.Close()
+	if err := w.removeMirror(seg); err != nil {
+		return err
+	}
+	if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := removeSegmentIndex(seg); err != nil {
+		return err
+	}
+	atomic.AddInt64(&w.metrics.BytesReclaimed, size)
+	return nil
+}
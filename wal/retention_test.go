@@ -0,0 +1,215 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// retentionWAL returns a WAL with two 8-byte entries per segment holding
+// entries 1..count.
+func retentionWAL(t *testing.T, walPath string, config *Config, count int) *WAL {
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < count; i++ {
+		if err := w.Append([]byte(fmt.Sprintf("entry %02d", i+1))); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	return w
+}
+
+func TestReclaimBySize(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := segmentConfig(8, 2)
+	config.MaxTotalSize = 1 << 30
+	w := retentionWAL(t, walPath, config, 10)
+	defer w.Close()
+
+	// Under the limit the snapshot leaves the covered entries in place.
+	if err := w.InstallSnapshot(5, []byte("state")); err != nil {
+		t.Fatalf("Failed to install snapshot: %v", err)
+	}
+	if w.FirstIndex() != 1 {
+		t.Errorf("Expected FirstIndex to stay 1, got %d", w.FirstIndex())
+	}
+
+	// Five full segments, capped at three: segments 0 and 1 (entries 1-4)
+	// go, segment 2 holds entry 6 and stays.
+	config.MaxTotalSize = 3 * config.MaxSegmentSize
+	deleted, err := w.Reclaim()
+	if err != nil {
+		t.Fatalf("Failed to reclaim: %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("Expected 2 segments deleted, got %d", deleted)
+	}
+	if w.FirstIndex() != 5 {
+		t.Errorf("Expected FirstIndex to be 5, got %d", w.FirstIndex())
+	}
+	if m := w.Metrics(); m.BytesReclaimed != 2*config.MaxSegmentSize {
+		t.Errorf("Expected %d bytes reclaimed, got %d", 2*config.MaxSegmentSize, m.BytesReclaimed)
+	}
+}
+
+func TestReclaimKeepsLiveEntries(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := segmentConfig(8, 2)
+	config.MaxTotalSize = 1
+	w := retentionWAL(t, walPath, config, 10)
+	defer w.Close()
+
+	// Entry 4 shares segment 1 with entry 3, so only segment 0 may go.
+	if err := w.InstallSnapshot(3, []byte("state")); err != nil {
+		t.Fatalf("Failed to install snapshot: %v", err)
+	}
+	if w.FirstIndex() != 3 {
+		t.Errorf("Expected FirstIndex to be 3, got %d", w.FirstIndex())
+	}
+	if _, err := os.Stat(walPath + ".000001"); err != nil {
+		t.Errorf("Expected segment 1 to be kept: %v", err)
+	}
+	if deleted, _ := w.Reclaim(); deleted != 0 {
+		t.Errorf("Expected nothing more to reclaim, got %d", deleted)
+	}
+}
+
+func TestReclaimByAge(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := segmentConfig(8, 2)
+	config.MaxSegmentAge = time.Hour
+	w := retentionWAL(t, walPath, config, 6)
+	defer w.Close()
+
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(walPath, old, old)
+
+	if err := w.InstallSnapshot(6, []byte("state")); err != nil {
+		t.Fatalf("Failed to install snapshot: %v", err)
+	}
+	if w.FirstIndex() != 3 {
+		t.Errorf("Expected only the old segment reclaimed (FirstIndex 3), got %d", w.FirstIndex())
+	}
+}
+
+func TestRetentionSurvivesRestart(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := segmentConfig(8, 2)
+	config.MaxTotalSize = 1 << 30
+	w := retentionWAL(t, walPath, config, 4)
+	w.InstallSnapshot(3, []byte("state"))
+	w.Close()
+
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+
+	if w2.FirstIndex() != 1 || w2.LastIndex() != 4 {
+		t.Errorf("Expected covered entries to be retained, got [%d, %d]", w2.FirstIndex(), w2.LastIndex())
+	}
+}
+
+func TestExpire(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	config := segmentConfig(8, 2)
+	config.Clock = clock
+	config.EntryTTL = time.Hour
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	// Entries 1-3 at 0:00, 4-5 at 0:30, 6 at 1:00.
+	for i := 1; i <= 6; i++ {
+		switch i {
+		case 4, 6:
+			clock.advance(30 * time.Minute)
+		}
+		w.Append([]byte(fmt.Sprintf("entry %02d", i)))
+	}
+
+	if removed, err := w.Expire(); err != nil || removed != 0 {
+		t.Errorf("Expected nothing expired yet, got %d, %v", removed, err)
+	}
+	clock.advance(31 * time.Minute)
+	removed, err := w.Expire()
+	if err != nil || removed != 5 {
+		t.Fatalf("Expected 5 expired entries, got %d, %v", removed, err)
+	}
+	if w.FirstIndex() != 6 || w.LastIndex() != 6 {
+		t.Errorf("Expected only entry 6 left, got %d-%d", w.FirstIndex(), w.LastIndex())
+	}
+	if _, err := os.Stat(walPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the expired first segment deleted, got %v", err)
+	}
+	if got, err := w.GetEntry(6); err != nil || string(got) != "entry 06" {
+		t.Errorf("Expected entry 6, got %q, %v", got, err)
+	}
+
+	// Once everything has expired the log is empty but keeps counting.
+	clock.advance(time.Hour)
+	if removed, err := w.Expire(); err != nil || removed != 1 {
+		t.Errorf("Expected the last entry expired, got %d, %v", removed, err)
+	}
+	if index, err := w.AppendTyped(EntryTypeData, []byte("entry 07")); err != nil || index != 7 {
+		t.Errorf("Expected the next append at 7, got %d, %v", index, err)
+	}
+}
+
+func TestExpireStopsAtLiveEntry(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)}
+	config := &Config{MaxEntrySize: DefaultMaxEntrySize, Clock: clock, EntryTTL: time.Hour}
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	w.Append([]byte("old"))
+	clock.advance(time.Hour)
+	w.Append([]byte("new"))
+	// The clock is set back: entry 3 looks older than entry 2.
+	clock.now = clock.now.Add(-2 * time.Hour)
+	w.Append([]byte("older"))
+	clock.advance(2 * time.Hour)
+	w.Append([]byte("newest"))
+
+	clock.advance(30 * time.Minute)
+	if removed, err := w.Expire(); err != nil || removed != 1 {
+		t.Fatalf("Expected 1 expired entry, got %d, %v", removed, err)
+	}
+	if w.FirstIndex() != 2 {
+		t.Errorf("Expected the log to start at 2, got %d", w.FirstIndex())
+	}
+	if got, err := w.GetEntry(3); err != nil || string(got) != "older" {
+		t.Errorf("Expected entry 3 kept behind a live entry, got %q, %v", got, err)
+	}
+
+	w2, err := New(filepath.Join(tmpDir, "other.wal"))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w2.Close()
+	if _, err := w2.Expire(); err == nil {
+		t.Error("Expected error without EntryTTL")
+	}
+}
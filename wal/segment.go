@@ -0,0 +1,465 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// segmentPath returns the file name of segment id. Segment 0 is the base path
+// itself, so logs written before rotation existed open unchanged.
+func segmentPath(filePath string, id uint64) string {
+	if id == 0 {
+		return filePath
+	}
+	return fmt.Sprintf("%s.%06d", filePath, id)
+}
+
+// discoverSegments returns the ids of all segment files for filePath, sorted
+// ascending. Sidecar files (.idx, .tmp, ...) are ignored.
+func discoverSegments(filePath string) ([]uint64, error) {
+	entries, err := os.ReadDir(filepath.Dir(filePath))
+	if err != nil {
+		return nil, err
+	}
+
+	base := filepath.Base(filePath)
+	var ids []uint64
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		if name == base {
+			ids = append(ids, 0)
+			continue
+		}
+		suffix, found := strings.CutPrefix(name, base+".")
+		if !found || suffix == "" || strings.Trim(suffix, "0123456789") != "" {
+			continue
+		}
+		id, err := strconv.ParseUint(suffix, 10, 64)
+		if err != nil || id == 0 {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// openSegments opens every existing segment, creating the base file if the
+// log does not exist yet (or failing, in read-only mode). The last segment
+// becomes the active one.
+func (w *WAL) openSegments() error {
+	ids, err := discoverSegments(w.filePath)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		ids = []uint64{0}
+	}
+
+	flag := os.O_RDWR | os.O_CREATE
+	if w.readOnly {
+		flag = os.O_RDONLY
+	}
+	for i, id := range ids {
+		path := segmentPath(w.filePath, id)
+		if w.handles != nil && i < len(ids)-1 {
+			// Opened on first use; only the active segment stays open.
+			w.segments = append(w.segments, &segment{id: id, path: path, file: w.segmentFile(path, nil)})
+			continue
+		}
+		file, err := os.OpenFile(path, flag, w.config.fileMode())
+		if err != nil {
+			w.closeSegments()
+			return err
+		}
+		w.segments = append(w.segments, &segment{id: id, path: path, file: w.segmentFile(path, file)})
+	}
+	w.file = w.segments[len(w.segments)-1].file
+	w.pinActive()
+	return nil
+}
+
+// segmentFile returns the Storage a segment reads and writes file, opened
+// from path, through: mapped if Config.UseMmap is set, closed and reopened
+// as needed under Config.MaxOpenSegments, copied to the mirror if
+// Config.MirrorPath is set, and behind a write buffer if
+// Config.WriteBufferSize is. With MaxOpenSegments, file may be nil to leave
+// the segment closed until it is first used.
+func (w *WAL) segmentFile(path string, file *os.File) Storage {
+	if w.handles == nil {
+		return w.bufferWrites(w.mirrorWrites(path, w.mapFile(file)))
+	}
+	flag := os.O_RDWR
+	if w.readOnly {
+		flag = os.O_RDONLY
+	}
+	open := func() (Storage, error) {
+		file, err := os.OpenFile(path, flag, 0)
+		if err != nil {
+			return nil, err
+		}
+		return w.mapFile(file), nil
+	}
+	var s Storage
+	if file != nil {
+		s = w.mapFile(file)
+	}
+	return w.bufferWrites(w.mirrorWrites(path, w.handles.lazy(s, open)))
+}
+
+// mapFile maps file if Config.UseMmap is set.
+func (w *WAL) mapFile(file *os.File) Storage {
+	if w.config.UseMmap {
+		return newMmapFile(file)
+	}
+	return file
+}
+
+// rotate seals the active segment and starts a new one. Callers must hold
+// writeMu.
+func (w *WAL) rotate() error {
+	if w.storageBacked {
+		return errNoSidecars("segment rotation")
+	}
+
+	// A sealed segment ends at its last entry; only the active one carries
+	// preallocated space.
+	if w.config.PreallocateSize > 0 {
+		if err := w.file.Truncate(w.offset); err != nil {
+			return err
+		}
+	}
+	// The sealed segment must be durable before the next one exists, so a
+	// torn write can only ever be found in the last segment.
+	if err := w.syncFile(w.file); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&w.metrics.PendingBytes, 0)
+	if w.config.Clock != nil {
+		// MaxSegmentAge goes by the time a segment was sealed.
+		now := w.config.Clock.Now()
+		os.Chtimes(w.segments[len(w.segments)-1].path, now, now)
+	}
+	if w.config.PersistIndex {
+		// Best effort, like retention below.
+		w.writeSegmentIndex(w.segments[len(w.segments)-1], w.offset)
+	}
+
+	id := w.segments[len(w.segments)-1].id + 1
+	path := segmentPath(w.filePath, id)
+
+	// Build the header under a temporary name so a crash never leaves a
+	// headerless segment behind.
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, w.config.fileMode())
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(w.fileHeader(), 0); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := w.preallocate(file); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if !w.config.DisableSync {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	// Entries written to the new segment are only as durable as its
+	// directory entry.
+	if err := w.syncDir(); err != nil {
+		file.Close()
+		return err
+	}
+
+	sealed := w.segments[len(w.segments)-1]
+	seg := &segment{id: id, path: path, file: w.segmentFile(path, file)}
+	if err := w.copyToMirror(seg.file, seg.headerSize()); err != nil {
+		seg.file.Close()
+		return err
+	}
+	w.setCurrentFormat(seg)
+	w.indexMu.Lock()
+	w.segments = append(w.segments, seg)
+	first, last := w.segmentRange(sealed.id)
+	w.indexMu.Unlock()
+
+	w.file = seg.file
+	w.pinActive()
+	w.offset = seg.headerSize()
+	w.segmentStart = 0
+
+	// Before retention gets a chance to delete the sealed segment.
+	if w.config.OnSegmentRotate != nil {
+		w.config.OnSegmentRotate(sealed.path, first, last)
+	}
+	// Retention is best effort here; a failure is retried on the next
+	// rotation or explicit Reclaim.
+	w.reclaim()
+	return nil
+}
+
+// segmentRange returns the indices of the first and last entries in segment
+// id, or 0, 0 if it holds none. Callers must hold indexMu.
+func (w *WAL) segmentRange(id uint64) (first, last uint64) {
+	i := w.index.search(func(e EntryIndex) bool { return e.Segment >= id })
+	j := w.index.search(func(e EntryIndex) bool { return e.Segment > id })
+	if i == j {
+		return 0, 0
+	}
+	return w.index.firstIndex() + uint64(i), w.index.firstIndex() + uint64(j-1)
+}
+
+// headerExtrasSize returns how many bytes the tag and namespace add to each
+// entry header in s.
+func (s *segment) headerExtrasSize() int64 {
+	var n int64
+	if s.tagged {
+		n += EntryTagSize
+	}
+	if s.namespaced {
+		n += EntryNamespaceSize
+	}
+	return n
+}
+
+// parseExtras decodes into h the tag and namespace that end an entry header
+// in s, where buf holds what follows the fixed fields.
+func (s *segment) parseExtras(h *entryHeader, buf []byte) {
+	if s.tagged {
+		h.tag = byteOrder.Uint64(buf)
+		buf = buf[EntryTagSize:]
+	}
+	if s.namespaced {
+		h.namespace = buf[0]
+	}
+}
+
+// needsRotation reports whether an encoded write of size bytes must go to a
+// new segment. Entries are never split: if the write doesn't fit, it starts
+// a new segment, though an empty segment takes it however large it is. A
+// segment in an older format version, protected by a different checksum,
+// using the other header kind, tags or not, or another alignment than
+// configured, is also sealed, so the active segment only ever holds entries
+// encoded the way Append encodes them, as is one that has outlived
+// Config.RotationInterval. Callers must hold writeMu.
+func (w *WAL) needsRotation(size int64) bool {
+	active := w.segments[len(w.segments)-1]
+	if active.version != WALVersion || active.checksum != w.config.checksumType() || active.compact != w.config.CompactHeader ||
+		active.tagged != w.config.EntryTags || active.namespaced != w.config.Namespaces || active.alignment != int64(w.config.Alignment) {
+		return true
+	}
+	if w.config.RotationInterval > 0 && w.activeSegmentAge() >= w.config.RotationInterval {
+		return true
+	}
+	return w.config.MaxSegmentSize > 0 && w.offset > active.headerSize() && w.offset+size > w.config.MaxSegmentSize
+}
+
+// activeSegmentAge returns how long ago the oldest entry in the active
+// segment was appended, or 0 if it holds none. The timestamp is read from
+// disk once per segment and cached in segmentStart. Callers must hold
+// writeMu.
+func (w *WAL) activeSegmentAge() time.Duration {
+	if w.segmentStart == 0 {
+		active := w.segments[len(w.segments)-1]
+		w.indexMu.RLock()
+		i := w.index.search(func(e EntryIndex) bool { return e.Segment >= active.id })
+		var offset int64 = -1
+		if i < w.index.len() {
+			offset = w.index.at(i).Offset
+		}
+		w.indexMu.RUnlock()
+		if offset < 0 {
+			return 0
+		}
+		h, err := readEntryHeader(active, offset)
+		if err != nil {
+			return 0
+		}
+		w.segmentStart = h.timestamp
+	}
+	return w.config.now().Sub(time.Unix(0, w.segmentStart))
+}
+
+// preallocate extends f to Config.PreallocateSize if it is shorter. Files
+// get real blocks via fallocate; other storage is simply truncated upwards.
+// Either way the new space reads as zeros, which recovery recognizes as
+// unwritten.
+func (w *WAL) preallocate(f Storage) error {
+	if w.config.PreallocateSize <= 0 || w.readOnly {
+		return nil
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() >= w.config.PreallocateSize {
+		return nil
+	}
+	if file, ok := osFile(f); ok {
+		return fallocate(file, w.config.PreallocateSize)
+	}
+	return f.Truncate(w.config.PreallocateSize)
+}
+
+// unwritten reports whether every byte of seg from offset to size is zero,
+// i.e. the space past offset was preallocated and never written.
+func unwritten(seg *segment, offset, size int64) bool {
+	buf := make([]byte, 64*1024)
+	for offset < size {
+		chunk := buf[:min(int64(len(buf)), size-offset)]
+		if _, err := seg.file.ReadAt(chunk, offset); err != nil {
+			return false
+		}
+		for _, b := range chunk {
+			if b != 0 {
+				return false
+			}
+		}
+		offset += int64(len(chunk))
+	}
+	return true
+}
+
+// headerSize returns the offset of the segment's first entry.
+func (s *segment) headerSize() int64 {
+	return padded(fileHeaderSize(s.version), s.alignment)
+}
+
+// readaheadSize is the buffer a sequential scan reads segments through.
+const readaheadSize = 64 * 1024
+
+// readahead is a Storage whose ReadAt serves a forward scan from one large
+// buffered read at a time, like a bufio.Reader that still answers ReadAt,
+// so the entry decoding used for random access works unchanged. Reads at
+// least as large as the buffer go straight to the underlying storage.
+type readahead struct {
+	Storage
+	buf []byte
+	off int64 // storage offset of buf[0]
+	n   int   // valid bytes in buf
+}
+
+func (r *readahead) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.off && off+int64(len(p)) <= r.off+int64(r.n) {
+		return copy(p, r.buf[off-r.off:]), nil
+	}
+	if len(p) >= len(r.buf) {
+		return r.Storage.ReadAt(p, off)
+	}
+	n, err := r.Storage.ReadAt(r.buf, off)
+	r.off, r.n = off, n
+	if n >= len(p) {
+		return copy(p, r.buf), nil
+	}
+	return copy(p, r.buf[:n]), err
+}
+
+// buffered returns a copy of s read through buf, for a sequential scan.
+// Nothing may write to s while the copy is in use.
+func (s *segment) buffered(buf []byte) *segment {
+	c := *s
+	c.file = &readahead{Storage: s.file, buf: buf}
+	return &c
+}
+
+// segmentByID returns the segment with the given id. Callers must hold
+// indexMu.
+func (w *WAL) segmentByID(id uint64) *segment {
+	i := sort.Search(len(w.segments), func(i int) bool { return w.segments[i].id >= id })
+	if i < len(w.segments) && w.segments[i].id == id {
+		return w.segments[i]
+	}
+	return nil
+}
+
+// dropSegmentsAfter closes and deletes every segment after position pos,
+// then syncs the directory so the deletions are durable. Read-only WALs only
+// close them. Callers must hold indexMu for writing.
+func (w *WAL) dropSegmentsAfter(pos int) error {
+	removed := false
+	// Delete newest first so a crash part-way never leaves a gap.
+	for i := len(w.segments) - 1; i > pos; i-- {
+		seg := w.segments[i]
+		seg.file.Close()
+		if w.readOnly {
+			w.segments = w.segments[:i]
+			continue
+		}
+		if err := removeSegmentIndex(seg); err != nil {
+			w.segments = w.segments[:i+1]
+			return err
+		}
+		if err := w.removeMirror(seg); err != nil {
+			w.segments = w.segments[:i+1]
+			return err
+		}
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			w.segments = w.segments[:i+1]
+			return err
+		}
+		w.segments = w.segments[:i]
+		removed = true
+	}
+	if removed {
+		return w.syncDir()
+	}
+	return nil
+}
+
+// dropSegmentsBefore closes and deletes every segment before position pos,
+// then syncs the directory so the deletions are durable. Read-only WALs only
+// close them. Callers must hold indexMu for writing.
+func (w *WAL) dropSegmentsBefore(pos int) error {
+	removed := false
+	for pos > 0 {
+		seg := w.segments[0]
+		if w.readOnly {
+			seg.file.Close()
+			w.segments = w.segments[1:]
+			pos--
+			continue
+		}
+		if err := w.removeSegmentFile(seg); err != nil {
+			return err
+		}
+		w.segments = w.segments[1:]
+		pos--
+		removed = true
+	}
+	if removed {
+		return w.syncDir()
+	}
+	return nil
+}
+
+func (w *WAL) closeSegments() error {
+	var firstErr error
+	for _, seg := range w.segments {
+		if err := seg.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,902 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// segmentConfig returns a config whose segments hold exactly perSegment
+// entries of entrySize payload bytes.
+func segmentConfig(entrySize, perSegment int) *Config {
+	return &Config{
+		MaxEntrySize:   DefaultMaxEntrySize,
+		MaxSegmentSize: int64(WALFileHeaderSize + perSegment*(EntryHeaderSize+entrySize)),
+	}
+}
+
+func TestSegmentRotation(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, segmentConfig(8, 2))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	var entries [][]byte
+	for i := 0; i < 5; i++ {
+		data := []byte(fmt.Sprintf("entry %02d", i+1))
+		entries = append(entries, data)
+		if err := w.Append(data); err != nil {
+			t.Fatalf("Failed to append entry %d: %v", i+1, err)
+		}
+	}
+
+	for _, path := range []string{walPath, walPath + ".000001", walPath + ".000002"} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected segment %s to exist: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(walPath + ".000003"); !os.IsNotExist(err) {
+		t.Errorf("Expected no fourth segment, got %v", err)
+	}
+
+	if w.LastIndex() != 5 {
+		t.Errorf("Expected LastIndex to be 5, got %d", w.LastIndex())
+	}
+	for i, expected := range entries {
+		actual, err := w.GetEntry(uint64(i + 1))
+		if err != nil {
+			t.Fatalf("Failed to get entry %d: %v", i+1, err)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Entry %d: expected %s, got %s", i+1, expected, actual)
+		}
+	}
+	all, err := w.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read all: %v", err)
+	}
+	if !reflect.DeepEqual(all, entries) {
+		t.Errorf("ReadAll across segments returned %q", all)
+	}
+}
+
+func TestSegmentRotationInterval(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+	config := &Config{MaxEntrySize: DefaultMaxEntrySize, RotationInterval: 50 * time.Millisecond}
+
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.Append([]byte("entry 1"))
+	w.Append([]byte("entry 2"))
+	if len(w.segments) != 1 {
+		t.Fatalf("Expected 1 segment, got %d", len(w.segments))
+	}
+
+	// Idling past the interval starts nothing; the next append does.
+	time.Sleep(100 * time.Millisecond)
+	if len(w.segments) != 1 {
+		t.Fatalf("Expected no rotation without appends, got %d segments", len(w.segments))
+	}
+	w.Append([]byte("entry 3"))
+	w.Append([]byte("entry 4"))
+	if len(w.segments) != 2 {
+		t.Fatalf("Expected 2 segments, got %d", len(w.segments))
+	}
+	w.Close()
+
+	// After a restart the age comes from the segment's oldest entry.
+	time.Sleep(100 * time.Millisecond)
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	w2.Append([]byte("entry 5"))
+	if len(w2.segments) != 3 {
+		t.Fatalf("Expected 3 segments after restart, got %d", len(w2.segments))
+	}
+	for i := uint64(1); i <= 5; i++ {
+		if got, err := w2.GetEntry(i); err != nil || string(got) != fmt.Sprintf("entry %d", i) {
+			t.Errorf("Entry %d: got %q, %v", i, got, err)
+		}
+	}
+}
+
+func TestSegmentEntryNotSplit(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := &Config{MaxEntrySize: 1024, MaxSegmentSize: 64}
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	small := make([]byte, 20)
+	large := make([]byte, 100)
+	for _, data := range [][]byte{small, large, small} {
+		if err := w.Append(data); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+
+	// The large entry doesn't fit behind the first one, and is too big for
+	// any segment, so it gets one of its own.
+	for i, want := range []int64{
+		WALFileHeaderSize + EntryHeaderSize + 20,
+		WALFileHeaderSize + EntryHeaderSize + 100,
+		WALFileHeaderSize + EntryHeaderSize + 20,
+	} {
+		stat, err := os.Stat(segmentPath(walPath, uint64(i)))
+		if err != nil {
+			t.Fatalf("Failed to stat segment %d: %v", i, err)
+		}
+		if stat.Size() != want {
+			t.Errorf("Segment %d: expected size %d, got %d", i, want, stat.Size())
+		}
+	}
+}
+
+func TestSegmentRecovery(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w1, err := NewWithConfig(walPath, segmentConfig(8, 3))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	var entries [][]byte
+	for i := 0; i < 10; i++ {
+		data := []byte(fmt.Sprintf("entry %02d", i+1))
+		entries = append(entries, data)
+		if err := w1.AppendAndSync(data); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	w1.Close()
+
+	w2, err := NewWithConfig(walPath, segmentConfig(8, 3))
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+
+	if w2.LastIndex() != 10 {
+		t.Errorf("Expected LastIndex to be 10 after recovery, got %d", w2.LastIndex())
+	}
+	recovered, err := w2.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read all: %v", err)
+	}
+	if !reflect.DeepEqual(recovered, entries) {
+		t.Errorf("Recovered entries don't match: %q", recovered)
+	}
+
+	// Appends continue in the last recovered segment.
+	if err := w2.Append([]byte("entry 11")); err != nil {
+		t.Fatalf("Failed to append after recovery: %v", err)
+	}
+	if _, err := os.Stat(walPath + ".000003"); err != nil {
+		t.Errorf("Expected entry 11 in segment 3: %v", err)
+	}
+	if _, err := os.Stat(walPath + ".000004"); !os.IsNotExist(err) {
+		t.Errorf("Expected no fifth segment, got %v", err)
+	}
+}
+
+func TestSegmentRecoveryDamagedSealedSegment(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w1, err := NewWithConfig(walPath, segmentConfig(8, 2))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		w1.AppendAndSync([]byte(fmt.Sprintf("entry %02d", i+1)))
+	}
+	w1.Close()
+
+	// Corrupt the second entry of segment 1 (index 4).
+	f, err := os.OpenFile(walPath+".000001", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	f.WriteAt([]byte{0xFF}, int64(WALFileHeaderSize+2*EntryHeaderSize+8))
+	f.Close()
+
+	w2, err := NewWithConfig(walPath, segmentConfig(8, 2))
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+
+	if w2.LastIndex() != 3 {
+		t.Errorf("Expected LastIndex to be 3 after recovery, got %d", w2.LastIndex())
+	}
+	if _, err := os.Stat(walPath + ".000002"); !os.IsNotExist(err) {
+		t.Errorf("Expected segment after the damage to be removed, got %v", err)
+	}
+}
+
+func TestSegmentTruncateFromIndex(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, segmentConfig(8, 2))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 6; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %02d", i+1)))
+	}
+
+	if err := w.TruncateFromIndex(2); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	for _, path := range []string{walPath + ".000001", walPath + ".000002"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected segment %s to be removed, got %v", path, err)
+		}
+	}
+
+	if err := w.Append([]byte("entry 2b")); err != nil {
+		t.Fatalf("Failed to append after truncation: %v", err)
+	}
+	data, err := w.GetEntry(2)
+	if err != nil {
+		t.Fatalf("Failed to get entry: %v", err)
+	}
+	if string(data) != "entry 2b" {
+		t.Errorf("Expected entry 2b, got %s", data)
+	}
+}
+
+func TestSegmentIndexFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := segmentConfig(8, 2)
+	config.PersistIndex = true
+	config.IndexCheckpointInterval = 3
+
+	w1, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	var entries [][]byte
+	for i := 0; i < 7; i++ {
+		data := []byte(fmt.Sprintf("entry %02d", i+1))
+		entries = append(entries, data)
+		w1.AppendAndSync(data)
+	}
+	// Crash: the checkpoint stops at entry 6, entry 7 is in a newer segment.
+	w1.closeSegments()
+	w1.lock.Close()
+
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+
+	recovered, err := w2.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read all: %v", err)
+	}
+	if !reflect.DeepEqual(recovered, entries) {
+		t.Errorf("Recovered entries don't match: %q", recovered)
+	}
+}
+
+// brokenTruncate is a segment whose Truncate always fails.
+type brokenTruncate struct {
+	Storage
+}
+
+func (b brokenTruncate) Truncate(int64) error { return errors.New("input/output error") }
+
+func TestSegmentTruncateFromIndexFailure(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := NewWithConfig(walPath, segmentConfig(8, 2))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %02d", i+1)))
+	}
+
+	// The later segments are gone by the time the cut fails, so the WAL
+	// stops rather than keep an index into them.
+	seg := w.segments[0]
+	first := seg.file
+	seg.file = brokenTruncate{first}
+	if err := w.TruncateFromIndex(2); !errors.Is(err, ErrSyncFailed) {
+		t.Fatalf("Expected ErrSyncFailed, got %v", err)
+	}
+	seg.file = first
+	if err := w.Append([]byte("entry 06")); !errors.Is(err, ErrSyncFailed) {
+		t.Errorf("Expected the next append to fail with ErrSyncFailed, got %v", err)
+	}
+	w.Close()
+
+	w, err = NewWithConfig(walPath, segmentConfig(8, 2))
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer w.Close()
+	if w.LastIndex() != 2 {
+		t.Errorf("Expected the first segment's entries 1-2 recovered, got last index %d", w.LastIndex())
+	}
+}
+
+func TestSegmentTruncateBefore(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w1, err := NewWithConfig(walPath, segmentConfig(8, 2))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		w1.AppendAndSync([]byte(fmt.Sprintf("entry %02d", i+1)))
+	}
+
+	// Index 4 is the second entry of segment 1, so only segment 0 goes.
+	if err := w1.TruncateBefore(4); err != nil {
+		t.Fatalf("Failed to truncate before: %v", err)
+	}
+	if _, err := os.Stat(walPath); !os.IsNotExist(err) {
+		t.Errorf("Expected segment 0 to be removed, got %v", err)
+	}
+	if _, err := os.Stat(walPath + ".000001"); err != nil {
+		t.Errorf("Expected segment 1 to be kept: %v", err)
+	}
+	w1.Close()
+
+	w2, err := NewWithConfig(walPath, segmentConfig(8, 2))
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+
+	if w2.FirstIndex() != 4 || w2.LastIndex() != 6 {
+		t.Errorf("Expected range [4, 6] after recovery, got [%d, %d]", w2.FirstIndex(), w2.LastIndex())
+	}
+	data, err := w2.GetEntry(4)
+	if err != nil {
+		t.Fatalf("Failed to get entry 4: %v", err)
+	}
+	if string(data) != "entry 04" {
+		t.Errorf("Expected entry 04, got %s", data)
+	}
+}
+
+func TestSegmentPreallocate(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := segmentConfig(8, 2)
+	config.PreallocateSize = 4096
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	if stat, _ := os.Stat(walPath); stat.Size() != 4096 {
+		t.Errorf("Expected new segment preallocated to 4096 bytes, got %d", stat.Size())
+	}
+
+	var entries [][]byte
+	for i := 0; i < 3; i++ {
+		data := []byte(fmt.Sprintf("entry %02d", i+1))
+		entries = append(entries, data)
+		w.AppendAndSync(data)
+	}
+
+	// The sealed segment is trimmed to its entries; the active one keeps
+	// its preallocation.
+	want := int64(WALFileHeaderSize + 2*(EntryHeaderSize+8))
+	if stat, _ := os.Stat(walPath); stat.Size() != want {
+		t.Errorf("Expected sealed segment of %d bytes, got %d", want, stat.Size())
+	}
+	if stat, _ := os.Stat(walPath + ".000001"); stat.Size() != 4096 {
+		t.Errorf("Expected active segment of 4096 bytes, got %d", stat.Size())
+	}
+	w.Close()
+
+	var reported int
+	config.OnCorruption = func(uint64, int64, error) { reported++ }
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+
+	if reported != 0 || w2.Metrics().Corruptions != 0 {
+		t.Errorf("Expected the zero tail to be recovered silently, got %d reports", reported)
+	}
+	if w2.offset != int64(WALFileHeaderSize+EntryHeaderSize+8) {
+		t.Errorf("Expected offset at the end of entry 3, got %d", w2.offset)
+	}
+	w2.Append([]byte("entry 04"))
+	entries = append(entries, []byte("entry 04"))
+	all, err := w2.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read all: %v", err)
+	}
+	if !reflect.DeepEqual(all, entries) {
+		t.Errorf("Expected %q, got %q", entries, all)
+	}
+}
+
+func TestSegmentPreallocateTruncateFromIndex(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := segmentConfig(8, 2)
+	config.PreallocateSize = 4096
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.Append([]byte("entry 01"))
+	w.Append([]byte("entry 02"))
+	if err := w.TruncateFromIndex(2); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	if stat, _ := os.Stat(walPath); stat.Size() != 4096 {
+		t.Errorf("Expected truncated segment re-preallocated, got %d bytes", stat.Size())
+	}
+	w.Close()
+
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	if w2.LastIndex() != 1 {
+		t.Errorf("Expected truncated entry to stay gone, got LastIndex %d", w2.LastIndex())
+	}
+}
+
+func TestSegmentPreallocateTornWrite(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := segmentConfig(8, 2)
+	config.PreallocateSize = 4096
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.AppendAndSync([]byte("entry 01"))
+	end := w.offset
+	// Simulate a crash part-way through the next write.
+	w.file.WriteAt(w.newEntry(EntryTypeData, []byte("entry 02"), 0).encode()[:10], end)
+	w.closeSegments()
+	w.lock.Close()
+
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	if w2.LastIndex() != 1 || w2.offset != end {
+		t.Errorf("Expected recovery to stop after entry 1, got LastIndex %d offset %d", w2.LastIndex(), w2.offset)
+	}
+	if stat, _ := os.Stat(walPath); stat.Size() != 4096 {
+		t.Errorf("Expected the damaged tail replaced by fresh preallocation, got %d bytes", stat.Size())
+	}
+
+	w2.Append([]byte("entry 02"))
+	if data, _ := w2.GetEntry(2); string(data) != "entry 02" {
+		t.Errorf("Expected entry 02, got %q", data)
+	}
+}
+
+func TestSegmentCompactHeader(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := &Config{MaxEntrySize: DefaultMaxEntrySize, CompactHeader: true, PersistIndex: true}
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	entries := [][]byte{[]byte("a"), make([]byte, 300), []byte("entry 3")}
+	for _, data := range entries {
+		if err := w.AppendAndSync(data); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	// One-byte lengths for the small entries, two for the 300-byte one.
+	want := int64(WALFileHeaderSize + 3*CompactEntryHeaderMinSize + 1 + 1 + 300 + 7)
+	if stat, _ := os.Stat(walPath); stat.Size() != want {
+		t.Errorf("Expected %d bytes with compact headers, got %d", want, stat.Size())
+	}
+	w.Close()
+
+	// Recover both with and without the index checkpoint.
+	for _, persist := range []bool{true, false} {
+		config.PersistIndex = persist
+		w2, err := NewWithConfig(walPath, config)
+		if err != nil {
+			t.Fatalf("Failed to recover WAL: %v", err)
+		}
+		all, err := w2.ReadAll()
+		if err != nil {
+			t.Fatalf("Failed to read all: %v", err)
+		}
+		if !reflect.DeepEqual(all, entries) {
+			t.Errorf("Recovered entries don't match (PersistIndex %v)", persist)
+		}
+		if _, ts, _ := w2.GetEntryWithMeta(1); ts.IsZero() {
+			t.Error("Expected compact entries to keep their timestamp")
+		}
+		w2.Close()
+	}
+}
+
+func TestSegmentCompactHeaderMixed(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	for i, compact := range []bool{false, true, false} {
+		config := &Config{MaxEntrySize: DefaultMaxEntrySize, CompactHeader: compact}
+		w, err := NewWithConfig(walPath, config)
+		if err != nil {
+			t.Fatalf("Failed to open WAL: %v", err)
+		}
+		w.Append([]byte(fmt.Sprintf("entry %d", i+1)))
+		if active := w.segments[len(w.segments)-1]; active.compact != compact {
+			t.Errorf("Expected active segment compact=%v, got %v", compact, active.compact)
+		}
+		w.Close()
+	}
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w.Close()
+	if len(w.segments) != 3 {
+		t.Errorf("Expected each header change to seal a segment, got %d segments", len(w.segments))
+	}
+	all, _ := w.ReadAll()
+	want := [][]byte{[]byte("entry 1"), []byte("entry 2"), []byte("entry 3")}
+	if !reflect.DeepEqual(all, want) {
+		t.Errorf("Expected %q, got %q", want, all)
+	}
+}
+
+func TestSegmentCompactHeaderTornTail(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := &Config{MaxEntrySize: DefaultMaxEntrySize, CompactHeader: true}
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.AppendAndSync([]byte("entry 1"))
+	w.AppendAndSync([]byte("entry 2"))
+	size := w.offset
+	w.Close()
+
+	// Cut into the second entry's header.
+	if err := os.Truncate(walPath, size-int64(len("entry 2"))-5); err != nil {
+		t.Fatalf("Failed to truncate file: %v", err)
+	}
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	if w2.LastIndex() != 1 {
+		t.Errorf("Expected LastIndex to be 1, got %d", w2.LastIndex())
+	}
+}
+
+func TestSegmentAlignment(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := &Config{MaxEntrySize: DefaultMaxEntrySize, Alignment: 512, PersistIndex: true}
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	entries := [][]byte{[]byte("a"), make([]byte, 600), []byte("entry 3")}
+	w.Append(entries[0])
+	w.Append(entries[1])
+	if _, err := w.AppendReader(bytes.NewReader(entries[2]), uint32(len(entries[2]))); err != nil {
+		t.Fatalf("Failed to stream entry: %v", err)
+	}
+	w.Close()
+
+	if stat, _ := os.Stat(walPath); stat.Size() != 512*5 {
+		t.Errorf("Expected header 512 + entries 512, 1024, 512 bytes, got %d", stat.Size())
+	}
+
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	for _, e := range w2.index.slice(0, w2.index.len()) {
+		if e.Offset%512 != 0 || e.Size%512 != 0 {
+			t.Errorf("Entry %d: expected aligned offset and size, got %d and %d", e.Index, e.Offset, e.Size)
+		}
+	}
+	all, _ := w2.ReadAll()
+	if !reflect.DeepEqual(all, entries) {
+		t.Error("Recovered entries don't match")
+	}
+	if report, err := w2.Verify(); err != nil || len(report.Failures) != 0 {
+		t.Errorf("Expected a clean verify, got %+v, %v", report, err)
+	}
+}
+
+func TestSegmentAlignmentMixed(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	for i, alignment := range []int{0, 256, 0} {
+		w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, Alignment: alignment, PersistIndex: true})
+		if err != nil {
+			t.Fatalf("Failed to open WAL: %v", err)
+		}
+		w.Append([]byte(fmt.Sprintf("entry %d", i+1)))
+		w.Close()
+	}
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w.Close()
+	if len(w.segments) != 3 || w.segments[1].alignment != 256 {
+		t.Errorf("Expected each alignment change to seal a segment, got %d segments", len(w.segments))
+	}
+	all, _ := w.ReadAll()
+	want := [][]byte{[]byte("entry 1"), []byte("entry 2"), []byte("entry 3")}
+	if !reflect.DeepEqual(all, want) {
+		t.Errorf("Expected %q, got %q", want, all)
+	}
+
+	if _, err := NewWithConfig(filepath.Join(tmpDir, "other.wal"), &Config{MaxEntrySize: DefaultMaxEntrySize, Alignment: 1000, PersistIndex: true}); err == nil {
+		t.Error("Expected error for an alignment that is not a power of two")
+	}
+}
+
+func TestSegmentAlignmentTornPadding(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := &Config{MaxEntrySize: DefaultMaxEntrySize, Alignment: 512, PersistIndex: true}
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.AppendAndSync([]byte("entry 1"))
+	w.AppendAndSync([]byte("entry 2"))
+	second := w.index.at(1).Offset
+	w.Close()
+
+	// The crash cut entry 2 off after its payload but before its padding.
+	os.Truncate(walPath, second+EntryHeaderSize+int64(len("entry 2")))
+
+	w2, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	if w2.LastIndex() != 1 || w2.offset != second {
+		t.Errorf("Expected recovery to stop after entry 1, got LastIndex %d offset %d", w2.LastIndex(), w2.offset)
+	}
+	w2.Append([]byte("entry 2"))
+	if data, _ := w2.GetEntry(2); string(data) != "entry 2" {
+		t.Errorf("Expected entry 2, got %q", data)
+	}
+}
+
+func TestSegmentEntryTags(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		tmpDir := t.TempDir()
+		walPath := filepath.Join(tmpDir, "test.wal")
+
+		w, err := New(walPath)
+		if err != nil {
+			t.Fatalf("Failed to create WAL: %v", err)
+		}
+		if _, err := w.AppendWithTag(7, []byte("entry 1")); err == nil {
+			t.Error("Expected error appending a tag without EntryTags")
+		}
+		w.Append([]byte("entry 1"))
+		w.Close()
+
+		config := &Config{MaxEntrySize: DefaultMaxEntrySize, CompactHeader: compact, EntryTags: true}
+		w, err = NewWithConfig(walPath, config)
+		if err != nil {
+			t.Fatalf("Failed to open WAL: %v", err)
+		}
+		w.AppendWithTag(7, []byte("entry 2"))
+		w.Append([]byte("entry 3"))
+		if _, err := w.AppendWithTag(1<<63, []byte("entry 4")); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+		if len(w.segments) != 2 || !w.segments[1].tagged {
+			t.Fatalf("Expected tags to start a tagged segment, got %d segments", len(w.segments))
+		}
+		headerSize := int64(EntryHeaderSize)
+		if compact {
+			headerSize = CompactEntryHeaderMinSize
+		}
+		if want := headerSize + EntryTagSize + 7; w.index.at(1).Size != want {
+			t.Errorf("compact=%v: expected a %d-byte tagged entry, got %d", compact, want, w.index.at(1).Size)
+		}
+		w.Close()
+
+		for _, persist := range []bool{false, true} {
+			config.PersistIndex = persist
+			w2, err := NewWithConfig(walPath, config)
+			if err != nil {
+				t.Fatalf("Failed to recover WAL: %v", err)
+			}
+			for i, want := range []uint64{0, 7, 0, 1 << 63} {
+				if tag, err := w2.GetEntryTag(uint64(i + 1)); err != nil || tag != want {
+					t.Errorf("compact=%v: expected entry %d tagged %d, got %d, %v", compact, i+1, want, tag, err)
+				}
+			}
+			if entry, err := w2.GetRawEntry(2); err != nil || entry.Tag != 7 || string(entry.Data) != "entry 2" {
+				t.Errorf("compact=%v: expected entry 2 tagged 7, got %+v, %v", compact, entry, err)
+			}
+			w2.Close()
+		}
+
+		// The checksum covers the tag.
+		w3, err := NewWithConfig(walPath, config)
+		if err != nil {
+			t.Fatalf("Failed to recover WAL: %v", err)
+		}
+		rec := w3.index.at(1)
+		w3.segmentByID(rec.Segment).file.WriteAt([]byte{8}, rec.Offset+headerSize+EntryTagSize-1)
+		if _, err := w3.GetEntry(2); !errors.Is(err, ErrCorruptedWAL) {
+			t.Errorf("compact=%v: expected a changed tag to fail the checksum, got %v", compact, err)
+		}
+		w3.Close()
+	}
+}
+
+func TestOnSegmentRotate(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+	type rotation struct {
+		path        string
+		first, last uint64
+	}
+	var got []rotation
+	config := segmentConfig(8, 2)
+	config.OnSegmentRotate = func(path string, first, last uint64) {
+		// The sealed segment is still in place when the hook runs.
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected sealed segment %s to exist: %v", path, err)
+		}
+		got = append(got, rotation{path, first, last})
+	}
+
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	for i := 0; i < 5; i++ {
+		if err := w.Append([]byte(fmt.Sprintf("entry %02d", i+1))); err != nil {
+			t.Fatalf("Failed to append entry %d: %v", i+1, err)
+		}
+	}
+
+	want := []rotation{{walPath, 1, 2}, {walPath + ".000001", 3, 4}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected rotations %v, got %v", want, got)
+	}
+}
+
+func TestSegmentNamespaces(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		for _, tagged := range []bool{false, true} {
+			tmpDir := t.TempDir()
+			walPath := filepath.Join(tmpDir, "test.wal")
+
+			w, err := New(walPath)
+			if err != nil {
+				t.Fatalf("Failed to create WAL: %v", err)
+			}
+			if _, err := w.AppendNS(1, []byte("cmd 0")); err == nil {
+				t.Error("Expected error appending to a namespace without Namespaces")
+			}
+			w.Append([]byte("old"))
+			w.Close()
+
+			config := &Config{MaxEntrySize: DefaultMaxEntrySize, CompactHeader: compact, EntryTags: tagged, Namespaces: true}
+			w, err = NewWithConfig(walPath, config)
+			if err != nil {
+				t.Fatalf("Failed to open WAL: %v", err)
+			}
+			w.AppendNS(1, []byte("cmd 1"))
+			w.AppendNS(2, []byte("evt 1"))
+			w.Append([]byte("plain"))
+			if _, err := w.AppendNS(1, []byte("cmd 2")); err != nil {
+				t.Fatalf("Failed to append: %v", err)
+			}
+			if len(w.segments) != 2 || !w.segments[1].namespaced {
+				t.Fatalf("Expected namespaces to start a namespaced segment, got %d segments", len(w.segments))
+			}
+			headerSize := int64(EntryHeaderSize)
+			if compact {
+				headerSize = CompactEntryHeaderMinSize
+			}
+			if tagged {
+				headerSize += EntryTagSize
+			}
+			if want := headerSize + EntryNamespaceSize + 5; w.index.at(1).Size != want {
+				t.Errorf("compact=%v tagged=%v: expected a %d-byte entry, got %d", compact, tagged, want, w.index.at(1).Size)
+			}
+			w.Close()
+
+			w2, err := NewWithConfig(walPath, config)
+			if err != nil {
+				t.Fatalf("Failed to recover WAL: %v", err)
+			}
+			want := map[uint8][]string{0: {"old", "plain"}, 1: {"cmd 1", "cmd 2"}, 2: {"evt 1"}, 3: nil}
+			check := func(when string) {
+				for ns, entries := range want {
+					all, err := w2.ReadAllNS(ns)
+					if err != nil {
+						t.Fatalf("%s: failed to read namespace %d: %v", when, ns, err)
+					}
+					var got []string
+					for _, e := range all {
+						got = append(got, string(e))
+					}
+					if !reflect.DeepEqual(got, entries) {
+						t.Errorf("compact=%v tagged=%v %s: expected namespace %d to hold %v, got %v", compact, tagged, when, ns, entries, got)
+					}
+				}
+			}
+			check("after recovery")
+			if entry, err := w2.GetRawEntry(3); err != nil || entry.Namespace != 2 {
+				t.Errorf("Expected entry 3 in namespace 2, got %+v, %v", entry, err)
+			}
+			if err := w2.Compact(func(uint64, uint8, []byte) bool { return true }); err != nil {
+				t.Fatalf("Failed to compact: %v", err)
+			}
+			check("after compaction")
+
+			// The checksum covers the namespace.
+			rec := w2.index.at(1)
+			w2.segmentByID(rec.Segment).file.WriteAt([]byte{3}, rec.Offset+rec.Size-5-1)
+			if _, err := w2.GetEntry(2); !errors.Is(err, ErrCorruptedWAL) {
+				t.Errorf("compact=%v tagged=%v: expected a changed namespace to fail the checksum, got %v", compact, tagged, err)
+			}
+			w2.Close()
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package wal
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sync/atomic"
+)
+
+// Snapshot file layout:
+//
+//	[0:4]   magic "WSNP"
+//	[4:8]   snapshot format version
+//	[8:16]  last index covered by the snapshot
+//	[16:24] length of the snapshot data
+//	[24:28] CRC32 of the header above and the data
+//	[28:..] snapshot data
+//
+// Like the meta file it is written to a temporary path and renamed into
+// place, so there is always at most one complete snapshot.
+
+// InstallSnapshot stores snapshot as covering every entry up to and
+// including index, then discards those entries from the head of the log.
+// The snapshot is durable before anything is discarded. An index at or past
+// the end of the log empties it, and the next append gets index+1; this is
+// how a lagging Raft follower adopts its leader's snapshot. With a retention
+// policy (MaxTotalSize or MaxSegmentAge) covered entries are instead left
+// for Reclaim.
+func (w *WAL) InstallSnapshot(index uint64, snapshot []byte) error {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if w.storageBacked {
+		return errNoSidecars("InstallSnapshot")
+	}
+	if index == 0 {
+		return fmt.Errorf("invalid snapshot index: 0")
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if w.syncFailure != nil {
+		return w.syncFailure
+	}
+
+	if index < w.snapshotIndex {
+		return fmt.Errorf("snapshot at %d is older than the installed one at %d", index, w.snapshotIndex)
+	}
+	if err := w.writeSnapshotFile(index, snapshot); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	w.snapshotIndex = index
+
+	// With a retention policy the covered entries stay until Reclaim drops
+	// their segments, unless the snapshot is past the end of the log and the
+	// index sequence has to move.
+	if w.retains() && index < w.nextIndex {
+		_, err := w.reclaim()
+		return err
+	}
+	w.indexMu.Lock()
+	defer w.indexMu.Unlock()
+	return w.truncateBefore(index + 1)
+}
+
+// Snapshot returns the most recently installed snapshot and the last index
+// it covers, or ErrNoSnapshot if none was ever installed.
+func (w *WAL) Snapshot() (index uint64, data []byte, err error) {
+	if w.storageBacked {
+		return 0, nil, ErrNoSnapshot
+	}
+	buf, err := os.ReadFile(w.snapshotPath)
+	if os.IsNotExist(err) {
+		return 0, nil, ErrNoSnapshot
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	index, data, err = decodeSnapshot(buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	return index, data, nil
+}
+
+func (w *WAL) writeSnapshotFile(index uint64, snapshot []byte) error {
+	buf := make([]byte, SnapshotHeaderSize+len(snapshot))
+	byteOrder.PutUint32(buf[0:4], SnapshotMagicNumber)
+	byteOrder.PutUint32(buf[4:8], SnapshotVersion)
+	byteOrder.PutUint64(buf[8:16], index)
+	byteOrder.PutUint64(buf[16:24], uint64(len(snapshot)))
+	copy(buf[SnapshotHeaderSize:], snapshot)
+	crc := crc32.Update(crc32.ChecksumIEEE(buf[:24]), crc32.IEEETable, snapshot)
+	byteOrder.PutUint32(buf[24:28], crc)
+
+	tmpPath := w.snapshotPath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, w.config.fileMode())
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, w.snapshotPath); err != nil {
+		return err
+	}
+
+	// The snapshot must survive a crash before the entries it replaces are
+	// dropped.
+	return w.syncDir()
+}
+
+// loadSnapshotIndex sets w.snapshotIndex from the snapshot file, if any.
+func (w *WAL) loadSnapshotIndex() error {
+	w.snapshotIndex = 0
+	if w.storageBacked {
+		return nil
+	}
+	buf, err := os.ReadFile(w.snapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	index, _, err := decodeSnapshot(buf)
+	if err != nil {
+		return err
+	}
+	w.snapshotIndex = index
+	return nil
+}
+
+func decodeSnapshot(buf []byte) (uint64, []byte, error) {
+	if len(buf) < SnapshotHeaderSize ||
+		byteOrder.Uint32(buf[0:4]) != SnapshotMagicNumber ||
+		byteOrder.Uint32(buf[4:8]) != SnapshotVersion ||
+		byteOrder.Uint64(buf[16:24]) != uint64(len(buf)-SnapshotHeaderSize) {
+		return 0, nil, ErrCorruptedWAL
+	}
+	data := buf[SnapshotHeaderSize:]
+	if crc32.Update(crc32.ChecksumIEEE(buf[:24]), crc32.IEEETable, data) != byteOrder.Uint32(buf[24:28]) {
+		return 0, nil, ErrCorruptedWAL
+	}
+	return byteOrder.Uint64(buf[8:16]), data, nil
+}
+
+func (w *WAL) removeSnapshotFile() error {
+	if err := os.Remove(w.snapshotPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInstallSnapshot(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	if _, _, err := w.Snapshot(); err != ErrNoSnapshot {
+		t.Errorf("Expected ErrNoSnapshot, got %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %d", i+1)))
+	}
+
+	if err := w.InstallSnapshot(3, []byte("state at 3")); err != nil {
+		t.Fatalf("Failed to install snapshot: %v", err)
+	}
+	if w.FirstIndex() != 4 || w.LastIndex() != 5 {
+		t.Errorf("Expected range [4, 5], got [%d, %d]", w.FirstIndex(), w.LastIndex())
+	}
+	if err := w.InstallSnapshot(2, []byte("stale")); err == nil {
+		t.Error("Expected error installing an older snapshot")
+	}
+	w.Close()
+
+	w2, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+
+	index, data, err := w2.Snapshot()
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+	if index != 3 || string(data) != "state at 3" {
+		t.Errorf("Expected snapshot at 3, got %q at %d", data, index)
+	}
+	if w2.FirstIndex() != 4 {
+		t.Errorf("Expected FirstIndex to be 4 after recovery, got %d", w2.FirstIndex())
+	}
+	all, err := w2.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read all: %v", err)
+	}
+	if !reflect.DeepEqual(all, [][]byte{[]byte("entry 4"), []byte("entry 5")}) {
+		t.Errorf("Recovered entries don't match: %q", all)
+	}
+}
+
+func TestInstallSnapshotPastEnd(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.Append([]byte("entry 1"))
+
+	// A follower adopting its leader's snapshot discards its whole log.
+	if err := w.InstallSnapshot(10, []byte("state at 10")); err != nil {
+		t.Fatalf("Failed to install snapshot: %v", err)
+	}
+	if err := w.Append([]byte("entry 11")); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if w.FirstIndex() != 11 || w.LastIndex() != 11 {
+		t.Errorf("Expected range [11, 11], got [%d, %d]", w.FirstIndex(), w.LastIndex())
+	}
+	w.Close()
+
+	w2, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+
+	data, err := w2.GetEntry(11)
+	if err != nil {
+		t.Fatalf("Failed to get entry 11: %v", err)
+	}
+	if string(data) != "entry 11" {
+		t.Errorf("Expected entry 11, got %s", data)
+	}
+}
+
+func TestInstallSnapshotCrashBeforeCompaction(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %d", i+1)))
+	}
+	// Simulate a crash right after the snapshot became durable.
+	if err := w.writeSnapshotFile(2, []byte("state at 2")); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	w.Close()
+
+	w2, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+
+	if w2.FirstIndex() != 3 {
+		t.Errorf("Expected recovery to finish the compaction at 3, got FirstIndex %d", w2.FirstIndex())
+	}
+	if _, err := os.Stat(walPath + ".meta"); err != nil {
+		t.Errorf("Expected meta file recording the new start: %v", err)
+	}
+}
+
+func TestSnapshotCorrupted(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.Append([]byte("entry 1"))
+	w.InstallSnapshot(1, []byte("state at 1"))
+	w.Close()
+
+	buf, _ := os.ReadFile(walPath + ".snap")
+	buf[len(buf)-1] ^= 0xFF
+	os.WriteFile(walPath+".snap", buf, 0644)
+
+	if _, err := New(walPath); err != ErrCorruptedWAL {
+		t.Errorf("Expected ErrCorruptedWAL for a damaged snapshot, got %v", err)
+	}
+}
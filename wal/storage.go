@@ -0,0 +1,106 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Storage is the byte store a WAL writes its entries to. *os.File
+// implements it, and is what the path-based constructors use.
+//
+// Writes are positional: the WAL tracks the end of the log itself and never
+// relies on a file offset, so an implementation need not support Seek.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+	Stat() (os.FileInfo, error)
+}
+
+// NewWithStorage opens or creates a WAL on s, recovering whatever it holds
+// exactly as NewWithConfig recovers a file. The WAL owns s from then on and
+// closes it in Close.
+//
+// A storage-backed WAL is a single segment with no sidecar files: it never
+// rotates, MaxSegmentSize, RotationInterval, PersistIndex, UseMmap,
+// MaxOpenSegments, MirrorPath and the retention settings are ignored, and
+// TruncateBefore and InstallSnapshot, which rely on a durable meta file,
+// fail with errors.ErrUnsupported. No advisory lock is taken; keeping s to a
+// single writer is up to the caller. A log in an older format version, or
+// protected by a different ChecksumType than configured, can be read but not
+// appended to, since that would need a new segment.
+func NewWithStorage(s Storage, config *Config) (*WAL, error) {
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(config.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := *config
+	cfg.MaxSegmentSize = 0
+	cfg.RotationInterval = 0
+	cfg.PersistIndex = false
+	cfg.MaxTotalSize = 0
+	cfg.MaxSegmentAge = 0
+	cfg.UseMmap = false
+	cfg.MirrorPath = ""
+
+	w := &WAL{
+		config:        &cfg,
+		storageBacked: true,
+		cache:         newEntryCache(cfg.CacheSize),
+		aead:          aead,
+		index:         newIndexTable(cfg.SparseIndexInterval),
+		nextIndex:     1,
+	}
+	w.file = w.bufferWrites(s)
+	w.segments = []*segment{{id: 0, file: w.file}}
+	w.syncCond = sync.NewCond(&w.syncMu)
+
+	if err := w.initialize(); err != nil {
+		return nil, err
+	}
+
+	w.syncedIndex = w.nextIndex - 1
+	if cfg.SyncInterval > 0 {
+		w.startSyncLoop()
+	}
+	return w, nil
+}
+
+// osFile returns the file under the wrappers a segment's Storage may have,
+// for calls only a file supports. Nothing written to it directly may
+// overlap bytes still in a write buffer.
+func osFile(f Storage) (*os.File, bool) {
+	for {
+		switch s := f.(type) {
+		case *os.File:
+			return s, true
+		case *writeBuffer:
+			f = s.Storage
+		case *mmapFile:
+			f = s.File
+		case *mirrorFile:
+			f = s.Storage
+		case *lazyFile:
+			s.mu.RLock()
+			f = s.file
+			s.mu.RUnlock()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// errNoSidecars reports an operation that needs files next to the log,
+// which a storage-backed WAL doesn't have.
+func errNoSidecars(op string) error {
+	return fmt.Errorf("%s on a storage-backed WAL: %w", op, errors.ErrUnsupported)
+}
@@ -0,0 +1,340 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// memStorage is an in-memory Storage. Close only marks it closed, so a test
+// can reopen the same bytes.
+type memStorage struct {
+	mu     sync.Mutex
+	buf    []byte
+	syncs  int
+	reads  int
+	closed bool
+}
+
+func (m *memStorage) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reads++
+	if off >= int64(len(m.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memStorage) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(m.buf)) {
+		m.buf = append(m.buf, make([]byte, end-int64(len(m.buf)))...)
+	}
+	return copy(m.buf[off:], p), nil
+}
+
+func (m *memStorage) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if size > int64(len(m.buf)) {
+		// Like a file, extend with zeros.
+		m.buf = append(m.buf, make([]byte, size-int64(len(m.buf)))...)
+	}
+	m.buf = m.buf[:size]
+	return nil
+}
+
+func (m *memStorage) Sync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.syncs++
+	return nil
+}
+
+func (m *memStorage) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	return nil
+}
+
+func (m *memStorage) Stat() (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return memFileInfo{size: int64(len(m.buf))}, nil
+}
+
+type memFileInfo struct{ size int64 }
+
+func (fi memFileInfo) Name() string       { return "mem" }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+func TestStorageRoundTrip(t *testing.T) {
+	s := &memStorage{}
+	w, err := NewWithStorage(s, &Config{MaxEntrySize: DefaultMaxEntrySize, MaxSegmentSize: 64})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+
+	entries := [][]byte{[]byte("entry 1"), []byte("entry 2"), []byte("entry 3")}
+	for _, data := range entries {
+		if err := w.AppendAndSync(data); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	if len(w.segments) != 1 {
+		t.Errorf("Expected a storage-backed WAL to never rotate, got %d segments", len(w.segments))
+	}
+	if s.syncs < len(entries) {
+		t.Errorf("Expected at least %d syncs, got %d", len(entries), s.syncs)
+	}
+	w.Close()
+	if !s.closed {
+		t.Error("Expected Close to close the storage")
+	}
+
+	w2, err := NewWithStorage(s, &Config{MaxEntrySize: DefaultMaxEntrySize})
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	all, err := w2.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read all: %v", err)
+	}
+	if !reflect.DeepEqual(all, entries) {
+		t.Errorf("Expected %q, got %q", entries, all)
+	}
+}
+
+func TestStorageReadAllBuffered(t *testing.T) {
+	s := &memStorage{}
+	w, err := NewWithStorage(s, &Config{MaxEntrySize: DefaultMaxEntrySize})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	var entries [][]byte
+	for i := 0; i < 1000; i++ {
+		data := []byte(fmt.Sprintf("entry %04d", i+1))
+		entries = append(entries, data)
+		w.Append(data)
+	}
+	// A large entry bypasses the buffer.
+	big := make([]byte, 2*readaheadSize)
+	big[0] = 1
+	entries = append(entries, big)
+	w.Append(big)
+
+	s.reads = 0
+	all, err := w.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read all: %v", err)
+	}
+	if !reflect.DeepEqual(all, entries) {
+		t.Error("ReadAll returned different entries")
+	}
+	if s.reads > 10 {
+		t.Errorf("Expected a handful of reads for %d entries, got %d", len(entries), s.reads)
+	}
+}
+
+func TestStorageRecoversTornTail(t *testing.T) {
+	s := &memStorage{}
+	w, err := NewWithStorage(s, &Config{MaxEntrySize: DefaultMaxEntrySize})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.Append([]byte("entry 1"))
+	w.Append([]byte("entry 2"))
+	w.Close()
+
+	s.buf = s.buf[:len(s.buf)-3]
+
+	w2, err := NewWithStorage(s, &Config{MaxEntrySize: DefaultMaxEntrySize})
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	if w2.LastIndex() != 1 {
+		t.Errorf("Expected LastIndex to be 1, got %d", w2.LastIndex())
+	}
+
+	// The torn entry is overwritten in place.
+	w2.Append([]byte("entry 2b"))
+	if data, _ := w2.GetEntry(2); string(data) != "entry 2b" {
+		t.Errorf("Expected entry 2b, got %s", data)
+	}
+}
+
+func TestStorageTruncateFromIndex(t *testing.T) {
+	s := &memStorage{}
+	w, err := NewWithStorage(s, &Config{MaxEntrySize: DefaultMaxEntrySize, PersistIndex: true})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	for _, data := range []string{"entry 1", "entry 2", "entry 3"} {
+		w.Append([]byte(data))
+	}
+	if err := w.TruncateFromIndex(2); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	w.Append([]byte("entry 2b"))
+
+	all, _ := w.ReadAll()
+	if want := [][]byte{[]byte("entry 1"), []byte("entry 2b")}; !reflect.DeepEqual(all, want) {
+		t.Errorf("Expected %q, got %q", want, all)
+	}
+	if int64(len(s.buf)) != w.offset {
+		t.Errorf("Expected storage size %d, got %d", w.offset, len(s.buf))
+	}
+}
+
+func TestStorageUnsupported(t *testing.T) {
+	w, err := NewWithStorage(&memStorage{}, &Config{MaxEntrySize: DefaultMaxEntrySize})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	w.Append([]byte("entry 1"))
+	if err := w.TruncateBefore(2); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Expected errors.ErrUnsupported from TruncateBefore, got %v", err)
+	}
+	if err := w.InstallSnapshot(1, []byte("state")); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Expected errors.ErrUnsupported from InstallSnapshot, got %v", err)
+	}
+	if _, _, err := w.Snapshot(); err != ErrNoSnapshot {
+		t.Errorf("Expected ErrNoSnapshot, got %v", err)
+	}
+	if err := w.SetCheckpoint(1); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Expected errors.ErrUnsupported from SetCheckpoint, got %v", err)
+	}
+}
+
+func TestStorageReset(t *testing.T) {
+	s := &memStorage{}
+	w, err := NewWithStorage(s, &Config{MaxEntrySize: DefaultMaxEntrySize})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	w.Append([]byte("entry 1"))
+	w.Append([]byte("entry 2"))
+	if err := w.Reset(); err != nil {
+		t.Fatalf("Failed to reset: %v", err)
+	}
+	if len(s.buf) != WALFileHeaderSize {
+		t.Errorf("Expected storage cut to the header, got %d bytes", len(s.buf))
+	}
+	w.Append([]byte("fresh"))
+	if data, err := w.GetEntry(1); err != nil || string(data) != "fresh" {
+		t.Errorf("Expected fresh entry at index 1, got %q, %v", data, err)
+	}
+}
+
+// fullStorage is a memStorage that holds at most limit bytes; a write past
+// that stores what fits and fails with ENOSPC, as a full disk does.
+type fullStorage struct {
+	memStorage
+	limit int64
+}
+
+func (f *fullStorage) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) <= f.limit {
+		return f.memStorage.WriteAt(p, off)
+	}
+	n := 0
+	if off < f.limit {
+		n, _ = f.memStorage.WriteAt(p[:f.limit-off], off)
+	}
+	return n, &os.PathError{Op: "write", Path: "mem", Err: syscall.ENOSPC}
+}
+
+func TestStorageDiskFull(t *testing.T) {
+	s := &fullStorage{limit: 1 << 20}
+	config := &Config{MaxEntrySize: DefaultMaxEntrySize}
+	w, err := NewWithStorage(s, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.Append([]byte("entry 1"))
+	s.limit = w.offset + 10
+
+	for name, appendFn := range map[string]func() error{
+		"Append": func() error { return w.Append([]byte("a long entry that won't fit")) },
+		"BatchAppend": func() error {
+			_, err := w.BatchAppend([][]byte{[]byte("entry 2"), []byte("entry 3")})
+			return err
+		},
+		"AppendReader": func() error {
+			_, err := w.AppendReader(strings.NewReader("streamed entry"), 14)
+			return err
+		},
+	} {
+		err := appendFn()
+		if !errors.Is(err, ErrDiskFull) || !errors.Is(err, syscall.ENOSPC) {
+			t.Errorf("%s: expected ErrDiskFull wrapping ENOSPC, got %v", name, err)
+		}
+		if size := int64(len(s.buf)); size != w.offset {
+			t.Errorf("%s: expected the partial write rolled back to %d, got %d bytes", name, w.offset, size)
+		}
+	}
+	if w.LastIndex() != 1 {
+		t.Errorf("Expected LastIndex 1 after failed appends, got %d", w.LastIndex())
+	}
+
+	// Once space is freed appending carries on where it left off.
+	s.limit = 1 << 20
+	if err := w.Append([]byte("entry 2")); err != nil {
+		t.Fatalf("Failed to append after freeing space: %v", err)
+	}
+	w.Close()
+
+	var reports int
+	config.OnCorruption = func(uint64, int64, error) { reports++ }
+	w2, err := NewWithStorage(s, config)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w2.Close()
+	all, err := w2.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read all: %v", err)
+	}
+	if !reflect.DeepEqual(all, [][]byte{[]byte("entry 1"), []byte("entry 2")}) || reports != 0 {
+		t.Errorf("Expected a clean log of two entries, got %q with %d corruption reports", all, reports)
+	}
+}
+
+func TestStorageHeaderWriteFailure(t *testing.T) {
+	// A header that can't be written, or synced, fails the open rather
+	// than leave a log without one.
+	if _, err := NewWithStorage(&fullStorage{limit: 4}, &Config{MaxEntrySize: DefaultMaxEntrySize}); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Expected the header write to fail with ENOSPC, got %v", err)
+	}
+	if _, err := NewWithStorage(brokenSync{&memStorage{}}, &Config{MaxEntrySize: DefaultMaxEntrySize}); !errors.Is(err, ErrSyncFailed) {
+		t.Errorf("Expected the header sync to fail with ErrSyncFailed, got %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build linux
+
+package wal
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fdatasync flushes file data and only the metadata needed to read it back
+// (such as the size), skipping timestamps and other inode updates.
+func fdatasync(f *os.File) error {
+	return unix.Fdatasync(int(f.Fd()))
+}
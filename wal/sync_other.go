@@ -0,0 +1,10 @@
+//go:build !linux
+
+package wal
+
+import "os"
+
+// fdatasync falls back to a full fsync on platforms without fdatasync.
+func fdatasync(f *os.File) error {
+	return f.Sync()
+}
@@ -0,0 +1,318 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// indexTable holds the in-memory index: one EntryIndex per entry, for
+// consecutive indices. By default it is a plain slice. With
+// Config.SparseIndexInterval set it is packed instead: each entry takes
+// a varint with its size and its 8-byte digest, plus its segment and offset
+// only where it doesn't directly follow the one before (the first entry of a
+// segment, or after dead space). Every interval-th entry is marked with
+// where it starts and where it is on disk, so looking an entry up decodes at
+// most interval of them. An entry costs about 10 bytes instead of 40, for
+// lookups that scan forward from the nearest mark. Dropping entries from the
+// front only moves the first mark up to the new first entry, so the first
+// block may be short.
+//
+// The table is guarded by indexMu like the slice it replaces.
+type indexTable struct {
+	interval int // 0 for a plain slice
+
+	entries []EntryIndex // plain
+
+	base    uint64      // Index of the first entry (packed)
+	count   int         // entries held (packed)
+	skip    int         // entries dropped from the first mark's block (packed)
+	data    []byte      // the encoded entries (packed)
+	dropped int         // bytes dropped from the front of data (packed)
+	marks   []tableMark // one per interval entries (packed)
+	last    EntryIndex  // the last entry, which the next append follows (packed)
+}
+
+// tableMark records where a marked entry starts in indexTable.data, counting
+// the bytes dropped from its front, and where it lives on disk, so decoding
+// can start there.
+type tableMark struct {
+	pos     int
+	segment uint64
+	offset  int64
+}
+
+// newIndexTable returns an empty table, packed with a mark every interval
+// entries if interval is positive.
+func newIndexTable(interval int) indexTable {
+	if interval <= 0 {
+		return indexTable{entries: make([]EntryIndex, 0)}
+	}
+	return indexTable{interval: interval}
+}
+
+func (t *indexTable) len() int {
+	if t.interval == 0 {
+		return len(t.entries)
+	}
+	return t.count
+}
+
+// firstIndex and lastIndex return the first and last entry's Index; the
+// table must not be empty.
+func (t *indexTable) firstIndex() uint64 {
+	if t.interval == 0 {
+		return t.entries[0].Index
+	}
+	return t.base
+}
+
+func (t *indexTable) lastIndex() uint64 {
+	if t.interval == 0 {
+		return t.entries[len(t.entries)-1].Index
+	}
+	return t.base + uint64(t.count) - 1
+}
+
+// at returns the entry at position i.
+func (t *indexTable) at(i int) EntryIndex {
+	if t.interval == 0 {
+		return t.entries[i]
+	}
+	if i == t.count-1 {
+		return t.last
+	}
+	e, _ := t.decodeAt(i)
+	return e
+}
+
+// lastEntry returns the last entry; the table must not be empty.
+func (t *indexTable) lastEntry() EntryIndex {
+	return t.at(t.len() - 1)
+}
+
+// append adds entries, whose indices must follow on from the last one.
+func (t *indexTable) append(entries ...EntryIndex) {
+	if t.interval == 0 {
+		t.entries = append(t.entries, entries...)
+		return
+	}
+	for _, e := range entries {
+		t.appendPacked(e)
+	}
+}
+
+func (t *indexTable) appendPacked(e EntryIndex) {
+	if t.count == 0 {
+		t.base = e.Index
+	} else if e.Index != t.base+uint64(t.count) {
+		panic(fmt.Sprintf("wal: index %d appended after %d", e.Index, t.base+uint64(t.count)-1))
+	}
+	if (t.skip+t.count)%t.interval == 0 {
+		t.marks = append(t.marks, tableMark{pos: t.dropped + len(t.data), segment: e.Segment, offset: e.Offset})
+	}
+	moved := t.count == 0 || e.Segment != t.last.Segment || e.Offset != t.last.Offset+t.last.Size
+	head := uint64(e.Size) << 1
+	if moved {
+		head |= 1
+	}
+	t.data = binary.AppendUvarint(t.data, head)
+	if moved {
+		t.data = binary.AppendUvarint(t.data, e.Segment)
+		t.data = binary.AppendUvarint(t.data, uint64(e.Offset))
+	}
+	t.data = byteOrder.AppendUint64(t.data, e.Digest)
+	t.last = e
+	t.count++
+}
+
+// decodeAt returns the entry at position i and where its digest is stored
+// in data.
+func (t *indexTable) decodeAt(i int) (EntryIndex, int) {
+	var found EntryIndex
+	var digestPos int
+	t.scan(i, func(e EntryIndex, pos int) bool {
+		found, digestPos = e, pos
+		return false
+	})
+	return found, digestPos
+}
+
+// scan decodes the entries from position i on, from the mark before it,
+// calling fn with each and the position of its digest until fn returns
+// false.
+func (t *indexTable) scan(i int, fn func(e EntryIndex, digestPos int) bool) {
+	k, pos := t.blockStart(i)
+	m := t.marks[(i+t.skip)/t.interval]
+	cur := EntryIndex{Segment: m.segment, Offset: m.offset}
+	for ; k < t.count; k++ {
+		var e EntryIndex
+		var digestPos int
+		e, pos, digestPos = t.decode(cur, pos, k)
+		if k >= i && !fn(e, digestPos) {
+			return
+		}
+		cur = e
+		cur.Offset += e.Size
+	}
+}
+
+// blockStart returns the position of the marked entry that decoding the
+// entry at position i starts from, and where it is encoded in data.
+func (t *indexTable) blockStart(i int) (int, int) {
+	k := i - (i+t.skip)%t.interval
+	if k < 0 {
+		k = 0
+	}
+	return k, t.marks[(i+t.skip)/t.interval].pos - t.dropped
+}
+
+// decode reads the entry at position k, encoded at pos, whose segment and
+// offset are those of prev unless stored. It returns the entry, the position
+// after it and the position of its digest.
+func (t *indexTable) decode(prev EntryIndex, pos, k int) (EntryIndex, int, int) {
+	head, n := binary.Uvarint(t.data[pos:])
+	pos += n
+	e := EntryIndex{Index: t.base + uint64(k), Segment: prev.Segment, Offset: prev.Offset, Size: int64(head >> 1)}
+	if head&1 != 0 {
+		seg, n := binary.Uvarint(t.data[pos:])
+		pos += n
+		off, n := binary.Uvarint(t.data[pos:])
+		pos += n
+		e.Segment, e.Offset = seg, int64(off)
+	}
+	e.Digest = byteOrder.Uint64(t.data[pos:])
+	return e, pos + 8, pos
+}
+
+// each calls fn with the entries from position i on, in order, until fn
+// returns false.
+func (t *indexTable) each(i int, fn func(e EntryIndex) bool) {
+	if t.interval == 0 {
+		for _, e := range t.entries[i:] {
+			if !fn(e) {
+				return
+			}
+		}
+		return
+	}
+	if i >= t.count {
+		return
+	}
+	t.scan(i, func(e EntryIndex, _ int) bool { return fn(e) })
+}
+
+// slice returns a copy of the entries at positions i through j-1.
+func (t *indexTable) slice(i, j int) []EntryIndex {
+	if t.interval == 0 {
+		return append([]EntryIndex(nil), t.entries[i:j]...)
+	}
+	out := make([]EntryIndex, 0, j-i)
+	t.each(i, func(e EntryIndex) bool {
+		if len(out) == j-i {
+			return false
+		}
+		out = append(out, e)
+		return true
+	})
+	return out
+}
+
+// sumDigests returns the sum of the digests of the entries at positions i
+// through j-1.
+func (t *indexTable) sumDigests(i, j int) uint64 {
+	if t.interval == 0 {
+		return sumDigests(t.entries[i:j])
+	}
+	var sum uint64
+	left := j - i
+	t.each(i, func(e EntryIndex) bool {
+		if left == 0 {
+			return false
+		}
+		sum += e.Digest
+		left--
+		return true
+	})
+	return sum
+}
+
+// setDigest replaces the digest of the entry at position i.
+func (t *indexTable) setDigest(i int, digest uint64) {
+	if t.interval == 0 {
+		t.entries[i].Digest = digest
+		return
+	}
+	_, pos := t.decodeAt(i)
+	byteOrder.PutUint64(t.data[pos:], digest)
+	if i == t.count-1 {
+		t.last.Digest = digest
+	}
+}
+
+// truncate keeps the first n entries.
+func (t *indexTable) truncate(n int) {
+	if t.interval == 0 {
+		t.entries = t.entries[:n]
+		return
+	}
+	if n >= t.count {
+		return
+	}
+	if n == 0 {
+		*t = newIndexTable(t.interval)
+		return
+	}
+	last, digestPos := t.decodeAt(n - 1)
+	t.data = t.data[:digestPos+8]
+	t.marks = t.marks[:(t.skip+n-1)/t.interval+1]
+	t.last = last
+	t.count = n
+}
+
+// dropFront removes the first n entries. A packed table drops the blocks
+// before the new first entry whole and moves that block's mark up to it, so
+// it decodes at most one block; the space is given back when data next
+// grows.
+func (t *indexTable) dropFront(n int) {
+	if t.interval == 0 {
+		t.entries = append([]EntryIndex(nil), t.entries[n:]...)
+		return
+	}
+	if n == 0 {
+		return
+	}
+	if n >= t.count {
+		*t = newIndexTable(t.interval)
+		return
+	}
+	k, pos := t.blockStart(n)
+	block := (n + t.skip) / t.interval
+	m := t.marks[block]
+	cur := EntryIndex{Segment: m.segment, Offset: m.offset}
+	for ; k < n; k++ {
+		cur, pos, _ = t.decode(cur, pos, k)
+		cur.Offset += cur.Size
+	}
+	first, _, _ := t.decode(cur, pos, n)
+
+	t.marks = t.marks[block:]
+	t.marks[0] = tableMark{pos: t.dropped + pos, segment: first.Segment, offset: first.Offset}
+	t.data = t.data[pos:]
+	t.dropped += pos
+	t.skip = (n + t.skip) % t.interval
+	t.base += uint64(n)
+	t.count -= n
+}
+
+// search returns the first position whose entry satisfies f, as sort.Search
+// does, for f false up to some position and true from there on.
+func (t *indexTable) search(f func(e EntryIndex) bool) int {
+	return sort.Search(t.len(), func(i int) bool { return f(t.at(i)) })
+}
+
+// reset replaces the table's contents with entries.
+func (t *indexTable) reset(entries []EntryIndex) {
+	*t = newIndexTable(t.interval)
+	t.append(entries...)
+}
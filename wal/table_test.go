@@ -0,0 +1,169 @@
+package wal
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// tableEntries returns n entries from index 5 on, spread over segments with
+// a gap of dead space every so often, as a log's index would be.
+func tableEntries(n int) []EntryIndex {
+	entries := make([]EntryIndex, 0, n)
+	seg, offset := uint64(1), int64(WALFileHeaderSize)
+	for i := 0; i < n; i++ {
+		switch {
+		case i > 0 && i%7 == 0:
+			seg, offset = seg+1, WALFileHeaderSize
+		case i%5 == 3:
+			offset += 512
+		}
+		size := int64(EntryHeaderSize + i%40)
+		entries = append(entries, EntryIndex{Index: uint64(5 + i), Segment: seg, Offset: offset, Size: size, Digest: uint64(i) * 0x9e3779b97f4a7c15})
+		offset += size
+	}
+	return entries
+}
+
+func TestIndexTable(t *testing.T) {
+	entries := tableEntries(50)
+	for _, interval := range []int{0, 1, 4, 16} {
+		table := newIndexTable(interval)
+		table.append(entries...)
+		if table.len() != len(entries) || table.firstIndex() != 5 || table.lastIndex() != 54 {
+			t.Fatalf("interval %d: expected entries 5-54, got %d from %d to %d", interval, table.len(), table.firstIndex(), table.lastIndex())
+		}
+		for i, e := range entries {
+			if got := table.at(i); got != e {
+				t.Fatalf("interval %d: entry %d: expected %+v, got %+v", interval, i, e, got)
+			}
+		}
+		if got := table.slice(10, 30); !reflect.DeepEqual(got, entries[10:30]) {
+			t.Errorf("interval %d: slice mismatch", interval)
+		}
+		if got, want := table.sumDigests(3, 41), sumDigests(entries[3:41]); got != want {
+			t.Errorf("interval %d: expected digest sum %d, got %d", interval, want, got)
+		}
+		if got := table.search(func(e EntryIndex) bool { return e.Segment >= 3 }); got != 14 {
+			t.Errorf("interval %d: expected segment 3 to start at 14, got %d", interval, got)
+		}
+
+		table.setDigest(20, 42)
+		table.setDigest(49, 43)
+		if table.at(20).Digest != 42 || table.at(49).Digest != 43 || table.at(21) != entries[21] {
+			t.Errorf("interval %d: setDigest changed the wrong entries", interval)
+		}
+		table.setDigest(20, entries[20].Digest)
+		table.setDigest(49, entries[49].Digest)
+
+		table.truncate(33)
+		table.append(entries[33:40]...)
+		table.dropFront(9)
+		if got := table.slice(0, table.len()); !reflect.DeepEqual(got, entries[9:40]) {
+			t.Errorf("interval %d: expected entries 14-44 after truncate and dropFront, got %v", interval, got)
+		}
+		var seen []EntryIndex
+		table.each(25, func(e EntryIndex) bool {
+			seen = append(seen, e)
+			return true
+		})
+		if !reflect.DeepEqual(seen, entries[34:40]) {
+			t.Errorf("interval %d: each from 25 returned %v", interval, seen)
+		}
+		table.truncate(0)
+		if table.len() != 0 {
+			t.Errorf("interval %d: expected an empty table, got %d entries", interval, table.len())
+		}
+	}
+}
+
+func TestSparseIndex(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	config := segmentConfig(8, 3)
+	config.SparseIndexInterval = 4
+	w, err := NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		w.Append([]byte(fmt.Sprintf("entry %02d", i+1)))
+	}
+	if err := w.TruncateFromIndex(18); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	if err := w.TruncateBefore(6); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	w.Append([]byte("entry 18"))
+	w.Close()
+
+	// Reopened packed, the index describes the log exactly as a plain one.
+	plain, err := NewWithConfig(walPath, segmentConfig(8, 3))
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	want, wantDigest := plain.IndexSnapshot(), plain.LogDigest()
+	plain.Close()
+
+	w, err = NewWithConfig(walPath, config)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer w.Close()
+	if got := w.IndexSnapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected index %v, got %v", want, got)
+	}
+	if w.LogDigest() != wantDigest {
+		t.Errorf("Expected digest %d, got %d", wantDigest, w.LogDigest())
+	}
+	if w.FirstIndex() != 6 || w.LastIndex() != 18 {
+		t.Fatalf("Expected entries 6-18, got %d-%d", w.FirstIndex(), w.LastIndex())
+	}
+	for i := uint64(6); i <= 18; i++ {
+		data, err := w.GetEntry(i)
+		if want := fmt.Sprintf("entry %02d", i); err != nil || string(data) != want {
+			t.Errorf("Entry %d: expected %q, got %q (%v)", i, want, data, err)
+		}
+	}
+}
+
+func TestIndexTableDropFront(t *testing.T) {
+	entries := tableEntries(200)
+	for _, interval := range []int{1, 4, 16} {
+		// Drop, append and truncate in steps that leave the first block of
+		// every length, checking the packed table against a plain one.
+		table, plain := newIndexTable(interval), newIndexTable(0)
+		table.append(entries[:60]...)
+		plain.append(entries[:60]...)
+		next := 60
+		for step := 0; plain.len() > 0; step++ {
+			drop := min(step%7, plain.len())
+			table.dropFront(drop)
+			plain.dropFront(drop)
+			if step%3 == 0 && next < len(entries) {
+				table.append(entries[next:next+5]...)
+				plain.append(entries[next:next+5]...)
+				next += 5
+			}
+			if step%11 == 10 {
+				table.truncate(plain.len() - 1)
+				plain.truncate(plain.len() - 1)
+				next--
+			}
+			if table.len() != plain.len() {
+				t.Fatalf("interval %d, step %d: expected %d entries, got %d", interval, step, plain.len(), table.len())
+			}
+			if got, want := table.slice(0, table.len()), plain.slice(0, plain.len()); len(want) > 0 && !reflect.DeepEqual(got, want) {
+				t.Fatalf("interval %d, step %d: expected %v, got %v", interval, step, want, got)
+			}
+			for i := 0; i < plain.len(); i++ {
+				if got := table.at(i); got != plain.at(i) {
+					t.Fatalf("interval %d, step %d: entry %d: expected %+v, got %+v", interval, step, i, plain.at(i), got)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package wal
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing: with Config.Tracer set, every single-entry append, Sync and
+// TruncateFromIndex runs in a span. Callers test Config.Tracer before
+// building attributes, so without a tracer no span is started and nothing is
+// allocated.
+
+// startSpan starts the span for one operation as a child of ctx. Callers
+// must have checked that Config.Tracer is set.
+func (w *WAL) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) trace.Span {
+	_, span := w.config.Tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	return span
+}
+
+// endSpan marks span failed if err is set, then ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,93 @@
+package wal
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/embedded"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// recordingTracer keeps every span it starts.
+type recordingTracer struct {
+	embedded.Tracer
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	noop.Span
+	name   string
+	parent trace.Span
+	attrs  map[attribute.Key]attribute.Value
+	status codes.Code
+	ended  bool
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	span := &recordedSpan{name: name, parent: trace.SpanFromContext(ctx), attrs: make(map[attribute.Key]attribute.Value)}
+	config := trace.NewSpanStartConfig(opts...)
+	span.SetAttributes(config.Attributes()...)
+	t.spans = append(t.spans, span)
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+func (s *recordedSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, a := range kv {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *recordedSpan) SetStatus(code codes.Code, _ string) { s.status = code }
+func (s *recordedSpan) End(...trace.SpanEndOption)          { s.ended = true }
+
+func TestTracing(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	tracer := &recordingTracer{}
+	w, err := NewWithConfig(walPath, &Config{MaxEntrySize: DefaultMaxEntrySize, Tracer: tracer})
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	parent := &recordedSpan{}
+	ctx := trace.ContextWithSpan(context.Background(), parent)
+	if _, err := w.AppendAndSyncContext(ctx, []byte("entry 1")); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	w.Append([]byte("entry 2"))
+	w.TruncateFromIndex(2)
+	w.TruncateFromIndex(5)
+
+	want := []struct {
+		name   string
+		attr   attribute.Key
+		value  int64
+		parent bool
+	}{
+		{"wal.Append", "wal.index", 1, true},
+		{"wal.Sync", "wal.sync.bytes", int64(EntryHeaderSize + len("entry 1")), true},
+		{"wal.Append", "wal.entry.size", int64(len("entry 2")), false},
+		{"wal.TruncateFromIndex", "wal.index", 2, false},
+		{"wal.TruncateFromIndex", "wal.index", 5, false},
+	}
+	if len(tracer.spans) != len(want) {
+		t.Fatalf("Expected %d spans, got %d", len(want), len(tracer.spans))
+	}
+	for i, s := range tracer.spans {
+		if s.name != want[i].name || s.attrs[want[i].attr].AsInt64() != want[i].value || !s.ended {
+			t.Errorf("Span %d: expected ended %s with %s=%d, got %s %v", i, want[i].name, want[i].attr, want[i].value, s.name, s.attrs)
+		}
+		if (s.parent == parent) != want[i].parent {
+			t.Errorf("Span %d: expected parented on ctx %v", i, want[i].parent)
+		}
+	}
+	if tracer.spans[3].status != codes.Unset || tracer.spans[4].status != codes.Error {
+		t.Errorf("Expected only the failed truncation marked as an error")
+	}
+}
@@ -1,22 +1,87 @@
 package wal
 
 import (
+	"crypto/cipher"
 	"errors"
 	"os"
 	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	WALMagicNumber = uint32(0x57414C21) // "WAL!"
-	WALVersion     = uint32(1)
+	WALVersion     = uint32(5)
+
+	EntryTypeData     = uint8(1)
+	EntryTypeConfig   = uint8(2) // cluster configuration change
+	EntryTypeNoOp     = uint8(3) // e.g. a new Raft leader's first entry
+	EntryTypeSnapshot = uint8(4) // marks the point a snapshot was taken
+
+	WALFileHeaderSize   = 16 // v3: magic, version, checksum type, flags (v5), reserved
+	WALFileHeaderSizeV1 = 8  // v1 and v2: magic, version
+	EntryHeaderSize     = 18 // v4: type, length, checksum, timestamp, compression
+	EntryHeaderSizeV2   = 17 // v2 and v3: type, length, checksum, timestamp
+	EntryHeaderSizeV1   = 9  // v1: type, length, checksum
+
+	// FileFlagCompactHeader marks a v5 segment whose entries use the
+	// compact header: type and compression share a byte and the length is
+	// a uvarint, so the header is 14 to 18 bytes.
+	FileFlagCompactHeader     = uint8(0x01)
+	CompactEntryHeaderMinSize = 14
+	CompactEntryHeaderMaxSize = 18
+
+	// FileFlagAligned marks a v5 segment whose entries are zero-padded to
+	// start on multiples of the alignment in header bytes [12:16]. The
+	// segment header is padded the same way.
+	FileFlagAligned = uint8(0x02)
+	MaxAlignment    = 1 << 20 // largest Config.Alignment
+
+	// FileFlagTagged marks a v5 segment whose entry headers, of either
+	// kind, end in an 8-byte user tag (Config.EntryTags).
+	FileFlagTagged = uint8(0x04)
+	EntryTagSize   = 8
+
+	// FileFlagNamespaced marks a v5 segment whose entry headers, of either
+	// kind, end in a 1-byte namespace (Config.Namespaces), after the tag if
+	// the segment is also tagged.
+	FileFlagNamespaced = uint8(0x08)
+	EntryNamespaceSize = 1
+
+	// EntryFlagEncrypted is set in a v4+ entry's compression field (the
+	// high bit of its 4 bits in the compact header) when the payload is
+	// sealed with Config.EncryptionKey.
+	EntryFlagEncrypted = uint8(0x08)
+
+	IndexMagicNumber     = uint32(0x57494458) // "WIDX"
+	IndexVersion         = uint32(3)
+	IndexFileHeaderSize  = 40
+	IndexRecordSize      = 32
+	IndexFileTrailerSize = 4
+
+	SegmentIndexMagicNumber = uint32(0x57534958) // "WSIX"
+	SegmentIndexVersion     = uint32(1)
+	SegmentIndexHeaderSize  = 32
+	SegmentIndexRecordSize  = 24
+
+	MetaMagicNumber = uint32(0x574D4554) // "WMET"
+	MetaVersion     = uint32(1)
+	MetaFileSize    = 36
 
-	EntryTypeData = uint8(1)
+	SnapshotMagicNumber = uint32(0x57534E50) // "WSNP"
+	SnapshotVersion     = uint32(1)
+	SnapshotHeaderSize  = 28
 
-	WALFileHeaderSize = 8
-	EntryHeaderSize   = 9
+	CheckpointMagicNumber = uint32(0x57434B50) // "WCKP"
+	CheckpointVersion     = uint32(1)
+	CheckpointFileSize    = 20
 
 	DefaultMaxEntrySize   = 10 * 1024 * 1024  // 10MB
 	DefaultMaxSegmentSize = 100 * 1024 * 1024 // 100MB
+
+	DefaultFileMode = os.FileMode(0644)
+	DefaultDirMode  = os.FileMode(0755)
 )
 
 var (
@@ -24,17 +89,82 @@ var (
 	ErrInvalidEntry  = errors.New("invalid entry format")
 	ErrEntryTooLarge = errors.New("entry exceeds maximum size")
 	ErrWALClosed     = errors.New("WAL is closed")
+	ErrReadOnly      = errors.New("WAL is opened read-only")
+	ErrLocked        = errors.New("WAL is locked by another process")
+	ErrNoSnapshot    = errors.New("no snapshot installed")
+	ErrBackpressure  = errors.New("too many unsynced entries")
+
+	// ErrUnsupportedVersion is returned for a segment written in a newer
+	// format version than this package reads.
+	ErrUnsupportedVersion = errors.New("unsupported WAL format version")
+
+	// ErrDecryptionFailed is returned for an encrypted entry that the
+	// configured EncryptionKey cannot open, or when no key is configured.
+	ErrDecryptionFailed = errors.New("entry cannot be decrypted")
+
+	// ErrDiskFull wraps the error of an append that ran out of space. The
+	// partial write is rolled back, so the log is unchanged and the append
+	// can be retried once space is freed.
+	ErrDiskFull = errors.New("no space left for the WAL")
+
+	// ErrSyncStale is returned by HealthCheck for an entry that has gone
+	// unsynced for longer than Config.MaxUnsyncedAge.
+	ErrSyncStale = errors.New("WAL sync is stale")
+
+	// ErrIndexMismatch is returned by AppendIfLastIndex when the log has
+	// moved on from the last index the caller expected.
+	ErrIndexMismatch = errors.New("last index does not match")
+
+	// ErrSyncFailed wraps the error of a failed fsync. After one, the OS may
+	// have dropped the dirty pages it could not write while reporting later
+	// syncs as successful, so nothing written since the last good sync can be
+	// trusted to be on disk. The WAL stops: every later append, sync,
+	// truncation, compaction, reclaim and snapshot install fails with the same
+	// error until it is closed and reopened, when recovery reads back what the
+	// disk really holds. A truncation that fails after deleting part of the
+	// log stops the WAL in the same way.
+	ErrSyncFailed = errors.New("WAL sync failed")
+
+	// ErrMirrorFailed wraps an error writing, syncing or deleting the
+	// mirror copy of the log kept under Config.MirrorPath, as opposed to the
+	// primary. The primary has been written when an append fails with it,
+	// but the entry is dropped as after any failed write; a truncation that
+	// fails with it has still cut the primary. Opening a WAL also fails
+	// with it if the mirror holds another log's segments.
+	ErrMirrorFailed = errors.New("WAL mirror write failed")
+
+	// ErrExternalModification is returned, with Config.DetectExternalTruncation
+	// set, by an append that finds the active segment shorter than the end
+	// of the log: something outside the WAL truncated it while it was open.
+	// Entries the index still lists are gone, so nothing is written; the WAL
+	// must be closed and reopened, when recovery keeps what is left.
+	ErrExternalModification = errors.New("WAL file was modified externally")
 )
 
 type WALEntry struct {
-	Type     uint8
-	Data     []byte
-	Checksum uint32
+	Type      uint8
+	Data      []byte
+	Checksum  uint32
+	Timestamp int64 // Unix nanoseconds at append time; 0 for v1 entries
+
+	// Compression is the codec Data is stored with on disk. Entries
+	// returned by reads always carry decompressed Data.
+	Compression Compression
+	// Encrypted reports whether Data is sealed with Config.EncryptionKey on
+	// disk; reads return it decrypted.
+	Encrypted bool
+	// Tag is the user tag given to AppendWithTag; 0 for untagged entries.
+	Tag uint64
+	// Namespace is the namespace given to AppendNS; 0 for other entries.
+	Namespace uint8
 }
 
 type EntryIndex struct {
-	Index  uint64
-	Offset int64
+	Index   uint64
+	Segment uint64 // id of the segment file holding the entry
+	Offset  int64  // offset within that segment
+	Size    int64  // encoded size, header included
+	Digest  uint64 // the entry's share of LogDigest
 }
 
 type WALMetrics struct {
@@ -42,28 +172,476 @@ type WALMetrics struct {
 	SyncCount    int64
 	BytesWritten int64
 	Corruptions  int64
-	LastSyncTime int64
+	LastSyncTime int64 // Unix nanoseconds; see LastSync
+	CacheHits    int64 // GetEntry calls served from the read cache
+	CacheMisses  int64 // GetEntry calls that went to disk with the cache on
+
+	BytesReclaimed  int64 // size of segments deleted by compaction or Reclaim
+	PendingBytes    int64 // bytes written since the last successful sync
+	TailCorruptions int64 // complete final entries that failed their checksum on recovery
+	ReadCount       int64 // entries returned by GetEntry, ReadAll and ReadPage
+	TruncateCount   int64 // TruncateFromIndex calls, including AppendAt overwriting a suffix
+	ClockSkewEvents int64 // appends stamped past a clock that had not moved beyond the last entry
+
+	AppendLatency LatencyStats // Append, AppendTyped and BatchAppend calls
+	SyncLatency   LatencyStats // Sync calls, including those made by group commit
+}
+
+// WALStats describes the shape of the log at one instant; see Stats.
+type WALStats struct {
+	FirstIndex   uint64 // 0 if the log is empty
+	LastIndex    uint64 // 0 if the log is empty
+	EntryCount   int
+	FileSize     int64 // log bytes across all segments; preallocated space excluded
+	SegmentCount int
 }
 
+// LatencyBuckets is the number of histogram buckets in LatencyStats.
+const LatencyBuckets = 20
+
+// LatencyStats summarizes the durations of one kind of operation, in
+// nanoseconds. Buckets[i] counts operations that took at most
+// LatencyBucketBound(i); the last bucket counts everything slower. Min is
+// only meaningful when Count is non-zero.
+type LatencyStats struct {
+	Count   int64
+	Sum     int64
+	Min     int64
+	Max     int64
+	Buckets [LatencyBuckets]int64
+}
+
+// SyncMode selects the system call used by Sync.
+type SyncMode int
+
+const (
+	// SyncModeFull uses fsync, flushing data and all file metadata.
+	SyncModeFull SyncMode = iota
+	// SyncModeData uses fdatasync where available, flushing data and only
+	// the metadata required to read it back. Elsewhere it behaves like
+	// SyncModeFull.
+	SyncModeData
+)
+
+// ChecksumType identifies the algorithm protecting entries. It is recorded
+// in each segment header, so a log stays readable whatever the current
+// configuration asks for.
+type ChecksumType uint8
+
+const (
+	// ChecksumCRC32IEEE is CRC-32 with the IEEE polynomial, the only
+	// algorithm before format version 3.
+	ChecksumCRC32IEEE ChecksumType = iota
+	// ChecksumCRC32Castagnoli is CRC-32C, hardware accelerated on most
+	// modern CPUs.
+	ChecksumCRC32Castagnoli
+	// ChecksumXXHash64 is xxHash64 truncated to the 32-bit checksum field.
+	ChecksumXXHash64
+	// checksumNone marks a segment written under Config.DisableChecksum:
+	// entries carry a zero checksum and are never verified.
+	checksumNone
+)
+
+// Compression selects the codec applied to entry payloads. It is recorded
+// per entry, so a log may mix codecs freely.
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+	CompressionZstd
+)
+
+// RecoveryMode decides what recovery does with an unreadable entry.
+type RecoveryMode int
+
+const (
+	// RecoveryTruncate treats any unreadable entry as a torn write and
+	// truncates the log there, discarding everything after it.
+	RecoveryTruncate RecoveryMode = iota
+	// RecoveryStrict only truncates a damaged final entry. Damage with valid
+	// data after it makes New fail with ErrCorruptedWAL instead, so the log
+	// can be restored from backup rather than silently shortened.
+	RecoveryStrict
+)
+
 type Config struct {
 	MaxEntrySize   uint32
 	MaxSegmentSize int64
+
+	// PersistIndex keeps a sidecar index file (<path>.idx) so that a clean
+	// restart can load offsets directly instead of rescanning the log. Each
+	// sealed segment also gets its own index (<segment>.sidx), written once
+	// at rotation, so even without a usable <path>.idx only the active
+	// segment is scanned.
+	PersistIndex bool
+	// IndexCheckpointInterval is the number of appends between index
+	// checkpoints. Zero means the index is only written on Close.
+	IndexCheckpointInterval int
+	// SparseIndexInterval, when positive, packs the in-memory index for logs
+	// too large to index at 40 bytes an entry: entries take about 10 bytes,
+	// and only every SparseIndexInterval-th keeps its position in full, so
+	// finding an entry decodes up to that many from the one before it. A
+	// larger interval saves a little more memory for slower lookups; 64 is a
+	// reasonable start. Zero keeps the plain index.
+	SparseIndexInterval int
+
+	// SyncMode selects fsync (the default) or fdatasync for Sync.
+	SyncMode SyncMode
+	// DisableSync skips the fsyncs of appends, segment rotation and the
+	// WAL's directory, for tests, benchmarks and caches that can be rebuilt.
+	// Sync, AppendAndSync and WaitForSync still flush the write buffer and
+	// count as syncs, in Metrics and DurableIndex alike, but nothing forces
+	// the data to the disk: a crash or power loss can lose any of it, or
+	// leave the segments in any state the OS happened to write back. Never
+	// set it for data that must survive.
+	DisableSync bool
+	// MirrorPath, if set, is where a second copy of the log is kept, e.g.
+	// on another device: every segment write, truncation and sync is
+	// applied to the segment at the same offset in a file named as it is,
+	// but under MirrorPath instead of the WAL's path. The mirror is locked
+	// like the log, in <MirrorPath>.lock, and tied to it by an id kept in
+	// <MirrorPath>.logid and beside the log, so one mirror can't take in a
+	// second log's segments. An operation that fails on the mirror only
+	// fails with ErrMirrorFailed. When the WAL is opened, each segment is
+	// compared with its copy and whichever holds more whole entries
+	// completes the other, so a primary damaged past some point is restored
+	// from the mirror before recovery runs, and a mirror that is new or
+	// missed writes catches up. Other sidecar files are not mirrored.
+	// Read-only and storage-backed WALs ignore it.
+	MirrorPath string
+	// DetectExternalTruncation makes every append stat the active segment
+	// first and fail with ErrExternalModification if it is shorter than the
+	// log the WAL has written to it, as after an operator's mistake or a
+	// misbehaving filesystem, instead of writing past a hole. It costs a
+	// stat per append, or per batch.
+	DetectExternalTruncation bool
+	// SyncInterval, when non-zero, starts a background goroutine that syncs
+	// at this cadence (group commit). Use WaitForSync to wait for an entry
+	// to become durable.
+	SyncInterval time.Duration
+	// MaxPendingEntries, when non-zero, bounds how many entries may be written
+	// but not yet synced. An append that would pass the limit first syncs the
+	// log itself, as AppendBlocking does, so producers slow to the rate fsync
+	// allows; AppendNonBlocking returns ErrBackpressure instead. A batch larger
+	// than the limit is still written, right after a sync.
+	MaxPendingEntries int
+	// MaxUnsyncedAge, if set, makes HealthCheck fail with ErrSyncStale
+	// once an entry has waited longer than this to be synced, a sign that
+	// nothing is syncing the log or that syncs hang.
+	MaxUnsyncedAge time.Duration
+	// WriteBufferSize, if set, collects appends in a buffer of that many
+	// bytes and hands them to the OS in one write once it fills, instead of
+	// one write per append. Sync, Close, rotation and SyncInterval flush it;
+	// an entry larger than the buffer is written directly. Reads are served
+	// from the buffer, so this process still reads its own writes the
+	// moment Append returns, but other processes (OpenReadOnly included)
+	// don't see buffered entries, and a crash of the process, not just of
+	// the machine, loses them. Entries are only durable after a Sync, as
+	// without the buffer.
+	WriteBufferSize int
+	// UseMmap serves reads from a read-only memory mapping of each segment
+	// instead of a pread per entry, for read-heavy logs that fit in memory.
+	// Writes still go through the file, and the mapping is extended as the
+	// file grows; entries in the last MiB appended since it was last
+	// extended are read as usual. Truncation by the WAL itself is safe, but
+	// a segment truncated behind the WAL's back, e.g. by another process,
+	// crashes readers with SIGBUS. It is ignored where mmap isn't available
+	// and by NewWithStorage.
+	UseMmap bool
+	// MaxOpenSegments, if set, bounds how many segment files are open at
+	// once, for logs with more segments than the process may hold file
+	// descriptors. Sealed segments are opened when an entry in them is read
+	// and closed again, least recently used first, once more than this many
+	// are open; the active segment is always open and doesn't count
+	// against another segment being opened. Reads of a closed segment pay
+	// for an open, and with UseMmap for a new mapping. It is ignored by
+	// NewWithStorage.
+	MaxOpenSegments int
+
+	// OnCorruption, if set, is called whenever an unreadable entry is found:
+	// during recovery before the log is truncated at offset, and when a read
+	// of an indexed entry fails its checksum or comes up short. index is the
+	// index the entry has or would have had; offset is within its segment.
+	// A torn final write, cut short by a crash, is not corruption and is
+	// truncated without a call. Unlike OnAppend, it runs with the WAL's
+	// locks held, so it must not call back into the WAL: a
+	// TruncateFromIndex from inside it deadlocks. Hand any repair off to
+	// another goroutine.
+	OnCorruption func(index uint64, offset int64, err error)
+	// OnAppend, if set, is called for every entry once it is written and
+	// indexed, so GetEntry already sees it; batches call it once per entry.
+	// It runs after the WAL's locks are released, so it may read from the
+	// WAL but calls from concurrent appends can overlap or arrive out of
+	// index order. The entry is not necessarily synced yet; use WaitForSync
+	// for durability. data is the caller's slice and must not be modified;
+	// it is nil for AppendReader, which never holds the payload.
+	OnAppend func(index uint64, entryType uint8, data []byte)
+	// OnSegmentRotate, if set, is called each time the active segment is
+	// sealed and the next one has been opened, with the sealed segment's
+	// path and the indices of the first and last entries it holds (both 0
+	// if it holds none), e.g. to ship it to an archive. The sealed file is
+	// synced and never written again, but the WAL still reads from it:
+	// copy it, don't move, modify or delete it; retention does the
+	// deleting. The call is made with the write lock held, so every append
+	// waits for it to return; hand slow work to another goroutine.
+	OnSegmentRotate func(sealedPath string, firstIndex, lastIndex uint64)
+	// EntrySizeWarnThreshold is the payload size above which appends are
+	// reported to OnLargeEntry, for visibility into entries creeping toward
+	// MaxEntrySize before they fail with ErrEntryTooLarge. Zero disables it.
+	EntrySizeWarnThreshold uint32
+	// OnLargeEntry, if set, is called with the index and payload size of
+	// every entry appended over EntrySizeWarnThreshold. Like OnAppend it runs
+	// after the WAL's locks are released, once the entry is indexed.
+	OnLargeEntry func(index uint64, size uint32)
+	// Tracer, if set, traces every single-entry append (Append, AppendTyped,
+	// AppendContext, AppendBlocking, AppendNonBlocking), Sync and
+	// TruncateFromIndex. Spans carry the entry type, size and index, or the
+	// bytes a sync flushed; AppendContext and AppendAndSyncContext parent
+	// theirs on ctx. With no tracer nothing is traced and nothing allocated.
+	Tracer trace.Tracer
+	// RecoveryMode selects how recovery handles damage mid-log.
+	RecoveryMode RecoveryMode
+
+	// ChecksumType selects the checksum for new segments. Existing segments
+	// are always verified with the algorithm they were written with.
+	ChecksumType ChecksumType
+	// DisableChecksum writes new segments without entry checksums, for
+	// callers whose entries already carry their own integrity check. The
+	// choice is recorded in the segment header, and entries in such a
+	// segment are never verified. This gives up the WAL's own damage
+	// detection: a flipped bit is returned as data, and recovery can only
+	// tell a torn write by the file ending early, so a torn entry inside
+	// preallocated space reads back with zeros in place of the missing
+	// bytes. Verify and Repair can't tell good entries from bad there
+	// either. Segments written with a checksum stay verified.
+	DisableChecksum bool
+
+	// Compression, if set, compresses each payload before it is written.
+	// Payloads that don't get smaller are stored uncompressed.
+	Compression Compression
+
+	// EncryptionKey, if set, is an AES-256 key (EncryptionKeySize bytes)
+	// every new payload is encrypted with, using AES-GCM and a random nonce
+	// per entry, after compression. Checksums cover the ciphertext. Entries
+	// written without a key stay readable, but an encrypted one read with a
+	// missing or wrong key fails with ErrDecryptionFailed, and so does
+	// opening a log that holds one. Snapshot data is stored as given.
+	EncryptionKey []byte
+
+	// CacheSize is the number of recent entries GetEntry keeps in memory.
+	// The cache is filled by appends and reads. Zero disables it.
+	CacheSize int
+
+	// MaxTotalSize and MaxSegmentAge form a retention policy: entries covered
+	// by the snapshot are kept, and Reclaim deletes their segments oldest
+	// first only while the log is larger than MaxTotalSize or the segment is
+	// older than MaxSegmentAge. Zero disables either limit; with both zero,
+	// InstallSnapshot compacts immediately.
+	MaxTotalSize  int64
+	MaxSegmentAge time.Duration
+	// EntryTTL is how long an entry lives, by its timestamp: Expire drops
+	// the leading entries older than this, snapshot or not, for a log used
+	// as a time-windowed buffer. Zero means entries never expire.
+	EntryTTL time.Duration
+
+	// RotationInterval, if set, seals the active segment once its oldest
+	// entry is that old, so each segment spans a bounded stretch of time
+	// even while under MaxSegmentSize, e.g. hourly segments for archival.
+	// The check is made on the next write, so an idle log gains no empty
+	// segments. It only starts new segments; deleting old ones is up to
+	// MaxSegmentAge.
+	RotationInterval time.Duration
+
+	// CompactHeader writes new segments with compact entry headers, which
+	// save up to four bytes per entry against the 18-byte default. Either
+	// kind of segment is always readable; changing the setting seals the
+	// active segment at the next append.
+	CompactHeader bool
+	// Alignment, when non-zero, pads every entry in new segments with zeros
+	// up to the next multiple of this many bytes, so writes start and end on
+	// device block boundaries (4096 is typical). It must be a power of two.
+	// The padding is not checksummed. Changing the setting seals the active
+	// segment at the next append, as with CompactHeader.
+	Alignment int
+	// EntryTags writes new segments with an 8-byte tag in every entry
+	// header, set with AppendWithTag and read back with GetEntryTag or an
+	// iterator's FilterTag without touching the payload, e.g. a partition
+	// id or a Raft term. Other appends store tag 0. The tag is covered by
+	// the checksum. Changing the setting seals the active segment at the
+	// next append, as with CompactHeader; Compact and ExportTo only keep
+	// tags while it is set.
+	EntryTags bool
+	// Namespaces writes new segments with a 1-byte namespace in every
+	// entry header, so several logical streams, e.g. commands and events,
+	// share one file and one fsync. AppendNS sets it and ReadAllNS reads
+	// one stream back; other appends go to namespace 0. Entries of all
+	// namespaces share one index sequence. The namespace is covered by the
+	// checksum, and changing the setting seals the active segment at the
+	// next append, as with EntryTags.
+	Namespaces bool
+
+	// SkipChecksumOnRead makes GetEntry, GetRange, ReadAll and iterators
+	// return payloads without recomputing their checksums. That saves CPU
+	// on large reads, but a bit flip on disk after recovery then goes
+	// unnoticed and is returned as data, so enable it only when the storage
+	// is trusted or Verify has been run. Recovery and Verify always check.
+	SkipChecksumOnRead bool
+
+	// PreallocateSize extends each new active segment to this many bytes up
+	// front, so appends overwrite allocated space instead of growing the
+	// file. The unwritten tail reads as zeros and is trimmed when the
+	// segment is sealed. Zero disables preallocation.
+	PreallocateSize int64
+
+	// FileMode and DirMode are the permissions for files the WAL creates
+	// and for directories NewWithConfig creates, defaulting to
+	// DefaultFileMode and DefaultDirMode. As with os.OpenFile, the process
+	// umask is applied on top, so it can only remove bits: a WAL holding
+	// sensitive data should set FileMode to 0600 rather than rely on the
+	// umask. Existing files and directories keep their permissions.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// Clock supplies the current time for entry timestamps, LastSyncTime,
+	// RotationInterval and MaxSegmentAge; nil means the system clock. Tests
+	// can inject a fake one to make those deterministic: segments are then
+	// also stamped with its time when sealed. Latencies are always measured
+	// on the system's monotonic clock.
+	Clock Clock
+}
+
+func (c *Config) fileMode() os.FileMode {
+	if c.FileMode == 0 {
+		return DefaultFileMode
+	}
+	return c.FileMode
+}
+
+func (c *Config) dirMode() os.FileMode {
+	if c.DirMode == 0 {
+		return DefaultDirMode
+	}
+	return c.DirMode
+}
+
+// checksumType returns the checksum new segments are written with.
+func (c *Config) checksumType() ChecksumType {
+	if c.DisableChecksum {
+		return checksumNone
+	}
+	return c.ChecksumType
+}
+
+func (c *Config) now() time.Time {
+	if c.Clock == nil {
+		return time.Now()
+	}
+	return c.Clock.Now()
+}
+
+// Clock is a source of the current time; see Config.Clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock a nil Config.Clock stands for.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time { return time.Now() }
+
+// segment is one physical file of the log. Segment 0 lives at the WAL's base
+// path; later segments append a zero-padded id (e.g. demo.wal.000001).
+type segment struct {
+	id       uint64
+	path     string
+	file     Storage
+	version  uint32       // format version from the segment header
+	checksum ChecksumType // from the header; always IEEE before v3
+	compact  bool         // entries use the compact header; v5 only
+	tagged   bool         // entry headers end in a tag; v5 only
+
+	namespaced bool  // entry headers end in a namespace; v5 only
+	alignment  int64 // entries are padded to multiples of this; 0 if not, v5 only
 }
 
 type WAL struct {
-	file     *os.File
-	filePath string
-	dirPath  string
+	// file is the active (last) segment; offset is its write position.
+	file           Storage
+	filePath       string
+	dirPath        string
+	indexPath      string
+	metaPath       string
+	snapshotPath   string
+	checkpointPath string
 
+	// Lock order is writeMu, then indexMu, then readMu; no path takes them
+	// the other way round. writeMu serializes appends, truncation and
+	// sidecar writes. indexMu guards the index and segment list. readMu is
+	// held for reading during file reads and for writing while files are
+	// cut or deleted. Readers take readMu before releasing indexMu, so an
+	// entry found in the index is still on disk when it is read.
 	writeMu sync.Mutex
 	readMu  sync.RWMutex
 	indexMu sync.RWMutex
 
-	index     []EntryIndex
+	segments  []*segment // ordered by id, guarded by indexMu
+	index     indexTable
+	digest    uint64 // LogDigest of the entries in index, guarded by indexMu
 	nextIndex uint64
+	start     logStart // where the retained log begins, guarded by writeMu
+
+	// timestamp of the active segment's oldest entry, or 0 until looked up;
+	// guarded by writeMu
+	segmentStart int64
+
+	// timestamp of the newest entry, or 0 until looked up, which appends
+	// stamp theirs past; guarded by writeMu
+	lastTimestamp int64
+
+	// last index covered by the installed snapshot, guarded by writeMu
+	snapshotIndex uint64
+
+	// appends since the last index checkpoint, guarded by writeMu
+	uncheckpointed int
+
+	// index passed to SetCheckpoint; written under writeMu, read atomically
+	checkpointIndex uint64
+
+	// the first sync failure, wrapped in ErrSyncFailed, after which appends
+	// and syncs fail; guarded by writeMu
+	syncFailure error
+
+	config   *Config
+	offset   int64
+	closed   int32
+	readOnly bool     // opened with OpenReadOnly
+	lock     *os.File // holds the advisory lock on <path>.lock
+	metrics  WALMetrics
+	cache    *entryCache     // nil unless Config.CacheSize > 0
+	aead     cipher.AEAD     // nil unless Config.EncryptionKey is set
+	handles  *segmentHandles // nil unless Config.MaxOpenSegments > 0
+
+	storageBacked bool     // opened with NewWithStorage; no lock or sidecar files
+	mirrorLock    *os.File // holds the lock on <MirrorPath>.lock, with MirrorPath set
+
+	// group commit state; syncedIndex is the highest index known durable
+	syncMu      sync.Mutex
+	syncCond    *sync.Cond
+	syncedIndex uint64
+	syncErr     error
+	stopSync    chan struct{}
+	syncDone    chan struct{}
+
+	// Follow wake-ups: appended is closed by the next append or Close
+	followMu sync.Mutex
+	appended chan struct{}
+}
 
-	config  *Config
-	offset  int64
-	closed  int32
-	metrics WALMetrics
+// FollowEvent is an entry delivered by Follow. Err is only set on the last
+// event, when following stopped for a reason other than the context.
+type FollowEvent struct {
+	Index uint64
+	Data  []byte
+	Err   error
 }
\ No newline at end of file
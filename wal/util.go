@@ -2,25 +2,336 @@ package wal
 
 import (
 	"encoding/binary"
+	"hash"
 	"hash/crc32"
+
+	"github.com/cespare/xxhash/v2"
 )
 
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// byteOrder is the byte order of every multi-byte integer the WAL stores, in
+// segments and sidecar files alike, and of those it hashes. It is big-endian
+// whatever the host, so files move between machines unchanged; this is the
+// one place to change it.
+var byteOrder = binary.BigEndian
+
+// newEntry builds a checksummed entry for data, compressed and encrypted as
+// configured.
+func (w *WAL) newEntry(t uint8, data []byte, timestamp int64) *WALEntry {
+	return w.newTaggedEntry(t, 0, 0, data, timestamp)
+}
+
+// newTaggedEntry is newEntry for an entry tagged tag in namespace ns.
+func (w *WAL) newTaggedEntry(t uint8, tag uint64, ns uint8, data []byte, timestamp int64) *WALEntry {
+	return w.copyEntry(&WALEntry{Type: t, Data: data, Timestamp: timestamp, Tag: tag, Namespace: ns})
+}
+
+// copyEntry builds a checksummed entry with the type, payload, timestamp,
+// tag and namespace of src, whose Data is plain, compressed and encrypted as
+// configured. Without Config.EntryTags or Config.Namespaces the tag or the
+// namespace is dropped, since there is nowhere to store it.
+func (w *WAL) copyEntry(src *WALEntry) *WALEntry {
+	entry := &WALEntry{Type: src.Type, Timestamp: src.Timestamp}
+	if w.config.EntryTags {
+		entry.Tag = src.Tag
+	}
+	if w.config.Namespaces {
+		entry.Namespace = src.Namespace
+	}
+	entry.Data, entry.Compression = compress(w.config.Compression, src.Data)
+	if w.aead != nil {
+		w.seal(entry)
+	}
+	entry.Checksum = sumEntry(w.config.checksumType(), w.config.EntryTags, w.config.Namespaces, entry)
+	return entry
+}
+
+// storedCompression returns the compression field as written to disk: the
+// codec, plus EntryFlagEncrypted for a sealed payload.
+func (e *WALEntry) storedCompression() Compression {
+	if e.Encrypted {
+		return e.Compression | Compression(EntryFlagEncrypted)
+	}
+	return e.Compression
+}
+
+// encode serializes the entry with the plain header of the current (v5)
+// format, unchanged since v4. Older fields keep their positions; each
+// version up to v4 appended to the header.
 func (e *WALEntry) encode() []byte {
-	dLen := uint32(len(e.Data))
-	buf := make([]byte, EntryHeaderSize+dLen)
+	return e.encodeAs(false, false, false)
+}
+
+// encodeAs serializes the entry with the header kind of a segment with the
+// given FileFlagCompactHeader, FileFlagTagged and FileFlagNamespaced flags.
+func (e *WALEntry) encodeAs(compact, tagged, namespaced bool) []byte {
+	buf := make([]byte, maxHeaderSize+len(e.Data))
+	n := e.putHeaderAs(buf, uint32(len(e.Data)), compact, tagged, namespaced)
+	n += copy(buf[n:], e.Data)
+	return buf[:n]
+}
+
+// maxHeaderSize is the largest entry header any v5 segment can have.
+const maxHeaderSize = max(EntryHeaderSize, CompactEntryHeaderMaxSize) + EntryTagSize + EntryNamespaceSize
+
+// putHeaderAs writes the header encodeAs puts in front of a payload of dLen
+// bytes into buf and returns its length. A tagged header is the untagged one
+// followed by the tag, and a namespaced one ends in the namespace.
+func (e *WALEntry) putHeaderAs(buf []byte, dLen uint32, compact, tagged, namespaced bool) int {
+	n := EntryHeaderSize
+	if compact {
+		n = e.putCompactHeader(buf, dLen)
+	} else {
+		e.putHeader(buf, dLen)
+	}
+	if tagged {
+		byteOrder.PutUint64(buf[n:n+EntryTagSize], e.Tag)
+		n += EntryTagSize
+	}
+	if namespaced {
+		buf[n] = e.Namespace
+		n += EntryNamespaceSize
+	}
+	return n
+}
+
+// putHeader writes the v4 header of the entry, with a payload of dLen bytes,
+// into buf.
+func (e *WALEntry) putHeader(buf []byte, dLen uint32) {
 	buf[0] = e.Type
-	binary.BigEndian.PutUint32(buf[1:5], dLen)
-	binary.BigEndian.PutUint32(buf[5:9], e.Checksum)
-	copy(buf[9:], e.Data)
+	byteOrder.PutUint32(buf[1:5], dLen)
+	byteOrder.PutUint32(buf[5:9], e.Checksum)
+	byteOrder.PutUint64(buf[9:17], uint64(e.Timestamp))
+	buf[17] = byte(e.storedCompression())
+}
+
+// putCompactHeader writes the compact header of FileFlagCompactHeader
+// segments for the entry, with a payload of dLen bytes, into buf and
+// returns its length:
+//
+//	[0]     type (low 4 bits) and compression (high 4 bits)
+//	[1:n]   uvarint payload length, 1 to 5 bytes
+//	[n:+4]  checksum
+//	[+4:+8] timestamp
+//
+// The checksum is computed over the same fields as in encode.
+func (e *WALEntry) putCompactHeader(buf []byte, dLen uint32) int {
+	buf[0] = e.Type | byte(e.storedCompression())<<4
+	n := 1 + binary.PutUvarint(buf[1:], uint64(dLen))
+	byteOrder.PutUint32(buf[n:n+4], e.Checksum)
+	byteOrder.PutUint64(buf[n+4:n+12], uint64(e.Timestamp))
+	return n + 12
+}
+
+// encodeEntry serializes entry for the active segment, which always uses the
+// configured header kind and alignment.
+func (w *WAL) encodeEntry(entry *WALEntry) []byte {
+	buf := entry.encodeAs(w.config.CompactHeader, w.config.EntryTags, w.config.Namespaces)
+	if pad := padded(int64(len(buf)), int64(w.config.Alignment)) - int64(len(buf)); pad > 0 {
+		buf = append(buf, make([]byte, pad)...)
+	}
+	return buf
+}
+
+// EncodedSize returns how many bytes data takes up in the log as an entry in
+// the current format with the default header and no compression, i.e.
+// EntryHeaderSize plus its length. Compression and CompactHeader can only
+// make an entry smaller; EncryptionKey adds 28 bytes, EntryTags 8,
+// Namespaces 1, and Alignment rounds the size up to a multiple of itself.
+func EncodedSize(data []byte) int64 {
+	return EntryHeaderSize + int64(len(data))
+}
+
+// validAlignment reports whether a is usable as Config.Alignment.
+func validAlignment(a int64) bool {
+	return a > 0 && a <= MaxAlignment && a&(a-1) == 0
+}
+
+// padded rounds n up to a multiple of alignment, a power of two. An
+// alignment of 0 leaves n as is.
+func padded(n, alignment int64) int64 {
+	if alignment <= 1 {
+		return n
+	}
+	return (n + alignment - 1) &^ (alignment - 1)
+}
+
+// encodeHeader is encodeEntry without the payload, for an entry whose dLen
+// payload bytes are written separately.
+func (w *WAL) encodeHeader(entry *WALEntry, dLen uint32) []byte {
+	buf := make([]byte, maxHeaderSize)
+	return buf[:entry.putHeaderAs(buf, dLen, w.config.CompactHeader, w.config.EntryTags, w.config.Namespaces)]
+}
+
+// knownEntryType reports whether t is one of the EntryType constants.
+func knownEntryType(t uint8) bool {
+	return t >= EntryTypeData && t <= EntryTypeSnapshot
+}
+
+// encodeFileHeader returns the header every new segment starts with,
+// zero-padded to alignment if that is set.
+func encodeFileHeader(checksum ChecksumType, compact, tagged, namespaced bool, alignment int) []byte {
+	buf := make([]byte, padded(WALFileHeaderSize, int64(alignment)))
+	byteOrder.PutUint32(buf[0:4], WALMagicNumber)
+	byteOrder.PutUint32(buf[4:8], WALVersion)
+	buf[8] = byte(checksum)
+	if compact {
+		buf[9] |= FileFlagCompactHeader
+	}
+	if tagged {
+		buf[9] |= FileFlagTagged
+	}
+	if namespaced {
+		buf[9] |= FileFlagNamespaced
+	}
+	if alignment > 0 {
+		buf[9] |= FileFlagAligned
+		byteOrder.PutUint32(buf[12:16], uint32(alignment))
+	}
 	return buf
 }
 
-func computeChecksum(t uint8, data []byte) uint32 {
-	crc := crc32.NewIEEE()
+// fileHeader returns the header for a new segment under the current config.
+func (w *WAL) fileHeader() []byte {
+	return encodeFileHeader(w.config.checksumType(), w.config.CompactHeader, w.config.EntryTags, w.config.Namespaces, w.config.Alignment)
+}
+
+// setCurrentFormat records that seg was just given fileHeader.
+func (w *WAL) setCurrentFormat(seg *segment) {
+	seg.version = WALVersion
+	seg.checksum = w.config.checksumType()
+	seg.compact = w.config.CompactHeader
+	seg.tagged = w.config.EntryTags
+	seg.namespaced = w.config.Namespaces
+	seg.alignment = int64(w.config.Alignment)
+}
+
+// fileHeaderSize returns the size of the segment header in the given format
+// version, i.e. the offset of the segment's first entry.
+func fileHeaderSize(version uint32) int64 {
+	if version < 3 {
+		return WALFileHeaderSizeV1
+	}
+	return WALFileHeaderSize
+}
+
+// entryHeaderSize returns the size of an entry header in a segment of the
+// given format version.
+func entryHeaderSize(version uint32) int64 {
+	switch {
+	case version == 1:
+		return EntryHeaderSizeV1
+	case version < 4:
+		return EntryHeaderSizeV2
+	}
+	return EntryHeaderSize
+}
+
+// computeChecksum covers every header field except the checksum itself, plus
+// the stored (possibly compressed) payload, using the given algorithm.
+func computeChecksum(kind ChecksumType, t uint8, timestamp int64, c Compression, data []byte) uint32 {
+	header := checksumHeader(t, uint32(len(data)), timestamp, c)
+	return checksum(kind, header[:], data)
+}
+
+// sumEntry returns the checksum of e, as stored, in a v4+ segment protected
+// by kind, tagged and namespaced or not. The tag and then the namespace are
+// hashed after the header fields computeChecksum covers.
+func sumEntry(kind ChecksumType, tagged, namespaced bool, e *WALEntry) uint32 {
+	if !tagged && !namespaced {
+		return computeChecksum(kind, e.Type, e.Timestamp, e.storedCompression(), e.Data)
+	}
+	header := checksumHeader(e.Type, uint32(len(e.Data)), e.Timestamp, e.storedCompression())
+	return checksum(kind, headerExtras(header[:], tagged, namespaced, e), e.Data)
+}
+
+// headerExtras appends the tag and namespace of e to fields, as far as a
+// segment with the given flags stores them.
+func headerExtras(fields []byte, tagged, namespaced bool, e *WALEntry) []byte {
+	if tagged {
+		fields = byteOrder.AppendUint64(fields, e.Tag)
+	}
+	if namespaced {
+		fields = append(fields, e.Namespace)
+	}
+	return fields
+}
+
+// checksumHeader returns the header fields computeChecksum hashes ahead of a
+// payload of dLen bytes.
+func checksumHeader(t uint8, dLen uint32, timestamp int64, c Compression) [14]byte {
+	var header [14]byte
+	header[0] = t
+	byteOrder.PutUint32(header[1:5], dLen)
+	byteOrder.PutUint64(header[5:13], uint64(timestamp))
+	header[13] = byte(c)
+	return header
+}
+
+// computeChecksumV2 is the checksum of v2 and v3 entries, which have no
+// compression byte.
+func computeChecksumV2(kind ChecksumType, t uint8, timestamp int64, data []byte) uint32 {
+	var header [13]byte
+	header[0] = t
+	byteOrder.PutUint32(header[1:5], uint32(len(data)))
+	byteOrder.PutUint64(header[5:13], uint64(timestamp))
+	return checksum(kind, header[:], data)
+}
+
+// computeChecksumV1 is the checksum of v1 entries, which have no timestamp.
+func computeChecksumV1(t uint8, data []byte) uint32 {
 	var header [5]byte
 	header[0] = t
-	binary.BigEndian.PutUint32(header[1:5], uint32(len(data)))
-	crc.Write(header[:])
-	crc.Write(data)
-	return crc.Sum32()
-}
\ No newline at end of file
+	byteOrder.PutUint32(header[1:5], uint32(len(data)))
+	return checksum(ChecksumCRC32IEEE, header[:], data)
+}
+
+// newChecksumHash returns the algorithm of checksum as a streaming hash, for
+// payloads that are never in memory at once. sumChecksum reads the result.
+func newChecksumHash(kind ChecksumType) hash.Hash {
+	switch kind {
+	case ChecksumCRC32Castagnoli:
+		return crc32.New(castagnoliTable)
+	case ChecksumXXHash64:
+		return xxhash.New()
+	case checksumNone:
+		return noChecksum{}
+	default:
+		return crc32.NewIEEE()
+	}
+}
+
+// noChecksum is the streaming hash of checksumNone, which sums to zero.
+type noChecksum struct{}
+
+func (noChecksum) Write(p []byte) (int, error) { return len(p), nil }
+func (noChecksum) Sum(b []byte) []byte         { return append(b, 0, 0, 0, 0) }
+func (noChecksum) Reset()                      {}
+func (noChecksum) Size() int                   { return 4 }
+func (noChecksum) BlockSize() int              { return 1 }
+func (noChecksum) Sum32() uint32               { return 0 }
+
+func sumChecksum(h hash.Hash) uint32 {
+	if h64, ok := h.(hash.Hash64); ok {
+		return uint32(h64.Sum64())
+	}
+	return h.(hash.Hash32).Sum32()
+}
+
+// checksum hashes header followed by data with the given algorithm.
+func checksum(kind ChecksumType, header, data []byte) uint32 {
+	switch kind {
+	case ChecksumCRC32Castagnoli:
+		return crc32.Update(crc32.Checksum(header, castagnoliTable), castagnoliTable, data)
+	case ChecksumXXHash64:
+		d := xxhash.New()
+		d.Write(header)
+		d.Write(data)
+		return uint32(d.Sum64())
+	case checksumNone:
+		return 0
+	default:
+		return crc32.Update(crc32.ChecksumIEEE(header), crc32.IEEETable, data)
+	}
+}
@@ -1,11 +1,17 @@
 package wal
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func New(filePath string) (*WAL, error) {
@@ -15,88 +21,1071 @@ func New(filePath string) (*WAL, error) {
 	})
 }
 
+// NewWithConfig opens or creates the WAL at filePath. It takes an exclusive
+// advisory lock on <filePath>.lock and fails with ErrLocked while another
+// WAL, in this process or any other, has the log open.
 func NewWithConfig(filePath string, config *Config) (*WAL, error) {
-	dirPath := filepath.Dir(filePath)
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		return nil, err
-	}
+	return open(filePath, config, false, true)
+}
+
+// OpenReadOnly opens an existing WAL for inspection. The files are opened
+// O_RDONLY and never modified: a damaged tail is left on disk and simply not
+// indexed, and an unfinished head truncation is not completed. GetEntry,
+// GetRange, ReadAll, LastIndex and iterators work as usual; every method that
+// would write returns ErrReadOnly. Any number of read-only opens may share a
+// log, but not with a writer; see ErrLocked.
+func OpenReadOnly(filePath string) (*WAL, error) {
+	return open(filePath, &Config{MaxEntrySize: DefaultMaxEntrySize}, true, true)
+}
 
-	// Sync directory for durability
-	dir, _ := os.Open(dirPath)
-	dir.Sync()
-	dir.Close()
+// OpenFollower is OpenReadOnly without the lock, for a process that follows
+// a log another process is writing, such as a monitoring sidecar. It sees
+// the log as it was when opened; Refresh picks up what the writer has
+// appended since. Nothing stops the writer from truncating or compacting
+// underneath it, so a follower is only reliable for logs that are appended
+// to and trimmed from the head.
+func OpenFollower(filePath string) (*WAL, error) {
+	return open(filePath, &Config{MaxEntrySize: DefaultMaxEntrySize}, true, false)
+}
 
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+// open opens the WAL at filePath, taking the advisory lock unless lock is
+// false.
+func open(filePath string, config *Config, readOnly, lock bool) (*WAL, error) {
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(config.EncryptionKey)
 	if err != nil {
 		return nil, err
 	}
 
+	dirPath := filepath.Dir(filePath)
+	if !readOnly {
+		if err := os.MkdirAll(dirPath, config.dirMode()); err != nil {
+			return nil, err
+		}
+	}
+
+	var lockHandle *os.File
+	if lock {
+		lockHandle, err = acquireLock(filePath+".lock", readOnly, config.fileMode())
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	w := &WAL{
-		file:      file,
-		filePath:  filePath,
-		dirPath:   dirPath,
-		config:    config,
-		index:     make([]EntryIndex, 0),
-		nextIndex: 1,
+		filePath:       filePath,
+		dirPath:        dirPath,
+		indexPath:      filePath + ".idx",
+		metaPath:       filePath + ".meta",
+		snapshotPath:   filePath + ".snap",
+		checkpointPath: filePath + ".ckpt",
+		config:         config,
+		readOnly:       readOnly,
+		lock:           lockHandle,
+		cache:          newEntryCache(config.CacheSize),
+		aead:           aead,
+		handles:        newSegmentHandles(config.MaxOpenSegments),
+		index:          newIndexTable(config.SparseIndexInterval),
+		nextIndex:      1,
 	}
 
+	w.syncCond = sync.NewCond(&w.syncMu)
+
+	if config.MirrorPath != "" && !readOnly {
+		if filepath.Clean(config.MirrorPath) == filepath.Clean(filePath) {
+			w.closeLock()
+			return nil, fmt.Errorf("mirror path %s is the WAL's own path", config.MirrorPath)
+		}
+		if err := w.reconcileMirror(); err != nil {
+			w.closeLock()
+			return nil, err
+		}
+	}
+	if err := w.openSegments(); err != nil {
+		w.closeLock()
+		return nil, err
+	}
 	if err := w.initialize(); err != nil {
-		file.Close()
+		w.closeSegments()
+		w.closeLock()
 		return nil, err
 	}
+
+	// Whatever recovery found is already on disk.
+	w.syncedIndex = w.nextIndex - 1
+	if config.SyncInterval > 0 {
+		w.startSyncLoop()
+	}
 	return w, nil
 }
 
+func validateConfig(config *Config) error {
+	if config.ChecksumType > ChecksumXXHash64 {
+		return fmt.Errorf("unknown checksum type %d", config.ChecksumType)
+	}
+	if config.Compression > CompressionZstd {
+		return fmt.Errorf("unknown compression %d", config.Compression)
+	}
+	if config.Alignment != 0 && !validAlignment(int64(config.Alignment)) {
+		return fmt.Errorf("alignment %d is not a power of two up to %d", config.Alignment, MaxAlignment)
+	}
+	return nil
+}
+
 func (w *WAL) Append(data []byte) error {
-	if atomic.LoadInt32(&w.closed) == 1 { return ErrWALClosed }
-	if data == nil { return fmt.Errorf("data is nil") }
-	if uint32(len(data)) > w.config.MaxEntrySize { return ErrEntryTooLarge }
+	_, err := w.appendEntry(context.Background(), EntryTypeData, 0, 0, data, true)
+	return err
+}
+
+// AppendTyped appends an entry of the given type, one of the EntryType
+// constants, and returns its index. Append is AppendTyped with
+// EntryTypeData.
+func (w *WAL) AppendTyped(entryType uint8, data []byte) (uint64, error) {
+	if !knownEntryType(entryType) {
+		return 0, fmt.Errorf("unknown entry type %d", entryType)
+	}
+	return w.appendEntry(context.Background(), entryType, 0, 0, data, true)
+}
+
+// AppendWithTag appends data with a user tag, such as a partition id or a
+// Raft term, stored in the entry header so it can be read back with
+// GetEntryTag or filtered on by an iterator without reading the payload.
+// It returns the assigned index. The WAL must have Config.EntryTags set.
+func (w *WAL) AppendWithTag(tag uint64, data []byte) (uint64, error) {
+	if !w.config.EntryTags {
+		return 0, fmt.Errorf("entry tags need Config.EntryTags")
+	}
+	return w.appendEntry(context.Background(), EntryTypeData, tag, 0, data, true)
+}
+
+// AppendNS appends data to namespace ns, one of up to 256 logical streams
+// sharing the log, and returns its index. Indices are assigned across all
+// namespaces, so a stream's entries are numbered with gaps; ReadAllNS reads
+// one stream back. Every other append writes to namespace 0. The WAL must
+// have Config.Namespaces set.
+func (w *WAL) AppendNS(ns uint8, data []byte) (uint64, error) {
+	if !w.config.Namespaces {
+		return 0, fmt.Errorf("namespaces need Config.Namespaces")
+	}
+	return w.appendEntry(context.Background(), EntryTypeData, 0, ns, data, true)
+}
+
+// AppendAt appends an entry at a caller-assigned index, as a Raft follower
+// does with entries from its leader. index must be LastIndex()+1, or the
+// index of an entry already in the log, in which case that entry and all
+// after it are truncated first, the way AppendEntries overwrites a
+// conflicting suffix. The truncation and the append happen under one lock,
+// so no other append can land in between. A gap past LastIndex()+1 or an
+// index before FirstIndex is an error and changes nothing.
+func (w *WAL) AppendAt(index uint64, entryType uint8, data []byte) error {
+	if !knownEntryType(entryType) {
+		return fmt.Errorf("unknown entry type %d", entryType)
+	}
+	if err := w.writeEntryAt(index, entryType, data); err != nil {
+		return err
+	}
+	w.reportLargeEntry(index, uint32(len(data)))
+	if w.config.OnAppend != nil {
+		w.config.OnAppend(index, entryType, data)
+	}
+	return nil
+}
+
+// writeEntryAt is AppendAt under writeMu.
+func (w *WAL) writeEntryAt(index uint64, entryType uint8, data []byte) error {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if data == nil {
+		return fmt.Errorf("data is nil")
+	}
+	if uint32(len(data)) > w.config.MaxEntrySize {
+		return ErrEntryTooLarge
+	}
+
+	start := time.Now()
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if w.syncFailure != nil {
+		return w.syncFailure
+	}
+
+	if index > w.nextIndex {
+		return fmt.Errorf("append at %d would leave a gap after the last index %d", index, w.nextIndex-1)
+	}
+	if index < w.start.index {
+		return fmt.Errorf("append at %d is before the first index %d", index, w.start.index)
+	}
+	if err := w.admit(1, true); err != nil {
+		return err
+	}
+	if index < w.nextIndex {
+		if err := w.truncateFromIndexLocked(index); err != nil {
+			return err
+		}
+	}
+	if _, err := w.writeEntryLocked(w.newEntry(entryType, data, w.nextTimestamp(w.config.now().UnixNano())), data); err != nil {
+		return err
+	}
+	w.metrics.AppendLatency.observe(time.Since(start))
+	return nil
+}
+
+// AppendIfLastIndex appends data only if LastIndex is expected, checking and
+// appending under one lock, and returns the new entry's index. Otherwise it
+// appends nothing and returns the actual last index with an error wrapping
+// ErrIndexMismatch, so a writer coordinating with others through the log
+// learns that it lost the race, and to what. Passing 0 appends only to an
+// empty log.
+func (w *WAL) AppendIfLastIndex(expected uint64, data []byte) (uint64, error) {
+	index, err := w.writeEntryIf(expected, data)
+	if err == nil {
+		w.reportLargeEntry(index, uint32(len(data)))
+	}
+	if err == nil && w.config.OnAppend != nil {
+		w.config.OnAppend(index, EntryTypeData, data)
+	}
+	return index, err
+}
+
+// writeEntryIf is AppendIfLastIndex under writeMu.
+func (w *WAL) writeEntryIf(expected uint64, data []byte) (uint64, error) {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return 0, ErrWALClosed
+	}
+	if w.readOnly {
+		return 0, ErrReadOnly
+	}
+	if data == nil {
+		return 0, fmt.Errorf("data is nil")
+	}
+	if uint32(len(data)) > w.config.MaxEntrySize {
+		return 0, ErrEntryTooLarge
+	}
 
+	start := time.Now()
 	w.writeMu.Lock()
 	defer w.writeMu.Unlock()
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return 0, ErrWALClosed
+	}
+	if w.syncFailure != nil {
+		return 0, w.syncFailure
+	}
+
+	if last := w.LastIndex(); last != expected {
+		return last, fmt.Errorf("%w: expected %d, log is at %d", ErrIndexMismatch, expected, last)
+	}
+	if err := w.admit(1, true); err != nil {
+		return 0, err
+	}
+	index, err := w.writeEntryLocked(w.newEntry(EntryTypeData, data, w.nextTimestamp(w.config.now().UnixNano())), data)
+	if err != nil {
+		return 0, err
+	}
+	w.metrics.AppendLatency.observe(time.Since(start))
+	return index, nil
+}
+
+// AppendBlocking is Append returning the assigned index: if
+// Config.MaxPendingEntries entries are already unsynced it syncs the log
+// first and then writes, so the caller waits for the disk rather than
+// being refused.
+func (w *WAL) AppendBlocking(data []byte) (uint64, error) {
+	return w.appendEntry(context.Background(), EntryTypeData, 0, 0, data, true)
+}
 
-	entry := &WALEntry{Type: EntryTypeData, Data: data}
-	entry.Checksum = computeChecksum(entry.Type, data)
-	encoded := entry.encode()
+// AppendNonBlocking is AppendBlocking for producers that would rather shed
+// load than wait: if Config.MaxPendingEntries entries are already unsynced
+// it writes nothing and returns ErrBackpressure. It returns the assigned
+// index.
+func (w *WAL) AppendNonBlocking(data []byte) (uint64, error) {
+	return w.appendEntry(context.Background(), EntryTypeData, 0, 0, data, false)
+}
 
-	n, err := w.file.Write(encoded)
-	if err != nil { return err }
+// appendEntry writes one entry, tagged tag in namespace ns, and returns its
+// index, in a span under ctx if tracing is on, then reports it to
+// Config.OnAppend. block selects how Config.MaxPendingEntries is enforced;
+// see admit.
+func (w *WAL) appendEntry(ctx context.Context, entryType uint8, tag uint64, ns uint8, data []byte, block bool) (uint64, error) {
+	var span trace.Span
+	if w.config.Tracer != nil {
+		span = w.startSpan(ctx, "wal.Append",
+			attribute.Int("wal.entry.type", int(entryType)), attribute.Int("wal.entry.size", len(data)))
+	}
+	index, err := w.writeEntry(entryType, tag, ns, data, block)
+	if span != nil {
+		span.SetAttributes(attribute.Int64("wal.index", int64(index)))
+		endSpan(span, err)
+	}
+	if err == nil {
+		w.reportLargeEntry(index, uint32(len(data)))
+	}
+	if err == nil && w.config.OnAppend != nil {
+		w.config.OnAppend(index, entryType, data)
+	}
+	return index, err
+}
+
+// reportLargeEntry tells Config.OnLargeEntry about the entry just appended at
+// index if its size is over Config.EntrySizeWarnThreshold. Callers must not
+// hold the WAL's locks.
+func (w *WAL) reportLargeEntry(index uint64, size uint32) {
+	if w.config.OnLargeEntry != nil && w.config.EntrySizeWarnThreshold > 0 && size > w.config.EntrySizeWarnThreshold {
+		w.config.OnLargeEntry(index, size)
+	}
+}
+
+// writeEntry is appendEntry under writeMu.
+func (w *WAL) writeEntry(entryType uint8, tag uint64, ns uint8, data []byte, block bool) (uint64, error) {
+	if atomic.LoadInt32(&w.closed) == 1 { return 0, ErrWALClosed }
+	if w.readOnly { return 0, ErrReadOnly }
+	if data == nil { return 0, fmt.Errorf("data is nil") }
+	if uint32(len(data)) > w.config.MaxEntrySize { return 0, ErrEntryTooLarge }
+
+	start := time.Now()
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	// Close may have taken writeMu first.
+	if atomic.LoadInt32(&w.closed) == 1 { return 0, ErrWALClosed }
+	if w.syncFailure != nil { return 0, w.syncFailure }
+
+	if err := w.admit(1, block); err != nil { return 0, err }
+	index, err := w.writeEntryLocked(w.newTaggedEntry(entryType, tag, ns, data, w.nextTimestamp(w.config.now().UnixNano())), data)
+	if err != nil { return 0, err }
+	w.metrics.AppendLatency.observe(time.Since(start))
+	return index, nil
+}
+
+// writeEntryLocked writes entry at the end of the log and indexes it; data is
+// its uncompressed payload, for the read cache. Callers must hold writeMu.
+func (w *WAL) writeEntryLocked(entry *WALEntry, data []byte) (uint64, error) {
+	encoded := w.encodeEntry(entry)
+
+	if err := w.checkActiveSize(); err != nil { return 0, err }
+	if w.needsRotation(int64(len(encoded))) {
+		if err := w.rotate(); err != nil { return 0, err }
+	}
+
+	n, err := w.file.WriteAt(encoded, w.offset)
+	if err != nil { return 0, w.abortWrite(err) }
+
+	index := w.commitEntry(int64(n), entryDigest(w.nextIndex, entry.Type, data))
+	w.cache.add(index, data)
+	return index, nil
+}
+
+// checkActiveSize implements Config.DetectExternalTruncation: it fails with
+// ErrExternalModification if the active segment no longer reaches w.offset.
+// A longer file is fine; preallocation leaves one. Callers must hold
+// writeMu.
+func (w *WAL) checkActiveSize() error {
+	if !w.config.DetectExternalTruncation {
+		return nil
+	}
+	stat, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() < w.offset {
+		return fmt.Errorf("%w: active segment is %d bytes, log ends at %d", ErrExternalModification, stat.Size(), w.offset)
+	}
+	return nil
+}
+
+// nextTimestamp returns the timestamp to stamp an entry appended at clock
+// reading now with: now itself, or just past the newest entry's timestamp if
+// the clock has not moved beyond it, so stored timestamps only ever increase
+// and time-ordered reads stay correct across a clock stepped back by NTP or
+// a VM migration. Each such correction counts in ClockSkewEvents. Callers
+// must hold writeMu.
+func (w *WAL) nextTimestamp(now int64) int64 {
+	if w.lastTimestamp == 0 {
+		w.lastTimestamp = w.newestTimestamp()
+	}
+	if now <= w.lastTimestamp {
+		now = w.lastTimestamp + 1
+		atomic.AddInt64(&w.metrics.ClockSkewEvents, 1)
+	}
+	w.lastTimestamp = now
+	return now
+}
+
+// newestTimestamp reads the timestamp of the last entry in the log, or
+// returns 0 if there is none or it has none. Callers must hold writeMu.
+func (w *WAL) newestTimestamp() int64 {
+	w.indexMu.RLock()
+	if w.index.len() == 0 {
+		w.indexMu.RUnlock()
+		return 0
+	}
+	last := w.index.lastEntry()
+	seg := w.segmentByID(last.Segment)
+	w.indexMu.RUnlock()
+	h, err := readEntryHeader(seg, last.Offset)
+	if err != nil {
+		return 0
+	}
+	return h.timestamp
+}
 
-	entryOffset := w.offset
-	w.offset += int64(n)
+// abortWrite cleans up after a write at the end of the log failed with err:
+// whatever part of it reached the file is dropped, so a later, shorter
+// append can't leave it behind as a damaged tail, and w.offset still marks
+// the end of the log. Running out of space is reported as ErrDiskFull.
+// Callers must hold writeMu.
+func (w *WAL) abortWrite(err error) error {
+	if terr := w.file.Truncate(w.offset); terr == nil {
+		w.preallocate(w.file)
+	}
+	if isDiskFull(err) {
+		return fmt.Errorf("%w: %w", ErrDiskFull, err)
+	}
+	return err
+}
 
+// commitEntry indexes the size-byte entry just written at the end of the log
+// and moves the end past it; digest is its entryDigest. Callers must hold
+// writeMu.
+func (w *WAL) commitEntry(size int64, digest uint64) uint64 {
+	index := w.nextIndex
 	w.indexMu.Lock()
-	w.index = append(w.index, EntryIndex{Index: w.nextIndex, Offset: entryOffset})
+	segID := w.segments[len(w.segments)-1].id
+	w.index.append(EntryIndex{Index: index, Segment: segID, Offset: w.offset, Size: size, Digest: digest})
+	w.digest += digest
 	w.indexMu.Unlock()
 
+	w.offset += size
 	w.nextIndex++
 	atomic.AddInt64(&w.metrics.WriteCount, 1)
+	atomic.AddInt64(&w.metrics.BytesWritten, size)
+	atomic.AddInt64(&w.metrics.PendingBytes, size)
+	w.maybeCheckpoint(1)
+	w.wakeFollowers()
+	return index
+}
+
+// AppendReader appends an entry of exactly size bytes read from r without
+// holding the payload in memory: the header is written first, the payload is
+// copied through to the file in chunks while its checksum is computed, and
+// the header is then completed. The payload is stored uncompressed whatever
+// Config.Compression says, and is not added to the read cache. With
+// Config.EncryptionKey set the payload is read into memory first, since it is
+// sealed as a whole, and appended as Append would.
+//
+// If r yields fewer or more than size bytes, or fails, nothing is appended.
+// Other appends wait while r is drained, so r must not depend on them.
+func (w *WAL) AppendReader(r io.Reader, size uint32) (uint64, error) {
+	index, err := w.writeReader(r, size)
+	if err == nil {
+		w.reportLargeEntry(index, size)
+	}
+	if err == nil && w.config.OnAppend != nil {
+		w.config.OnAppend(index, EntryTypeData, nil)
+	}
+	return index, err
+}
+
+// writeReader is AppendReader under writeMu.
+func (w *WAL) writeReader(r io.Reader, size uint32) (uint64, error) {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return 0, ErrWALClosed
+	}
+	if w.readOnly {
+		return 0, ErrReadOnly
+	}
+	if size > w.config.MaxEntrySize {
+		return 0, ErrEntryTooLarge
+	}
+	if w.aead != nil {
+		data, err := readPayload(r, size)
+		if err != nil {
+			return 0, err
+		}
+		return w.writeEntry(EntryTypeData, 0, 0, data, true)
+	}
+
+	start := time.Now()
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return 0, ErrWALClosed
+	}
+	if w.syncFailure != nil {
+		return 0, w.syncFailure
+	}
+
+	if err := w.admit(1, true); err != nil {
+		return 0, err
+	}
+	entry := &WALEntry{Type: EntryTypeData, Timestamp: w.nextTimestamp(w.config.now().UnixNano()), Compression: CompressionNone}
+	encoded := padded(int64(len(w.encodeHeader(entry, size)))+int64(size), int64(w.config.Alignment))
+	if err := w.checkActiveSize(); err != nil {
+		return 0, err
+	}
+	if w.needsRotation(encoded) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	digest := newEntryDigest(w.nextIndex, entry.Type)
+	if err := w.streamEntry(entry, r, size, digest); err != nil {
+		return 0, w.abortWrite(err)
+	}
+
+	index := w.commitEntry(encoded, digest.Sum64())
+	w.metrics.AppendLatency.observe(time.Since(start))
+	return index, nil
+}
+
+// streamEntry writes entry at the end of the log with its payload taken from
+// r, which is also fed to digest. Until the final header write the stored
+// checksum is zero, so a crash part-way leaves an entry recovery rejects.
+// Callers must hold writeMu.
+func (w *WAL) streamEntry(entry *WALEntry, r io.Reader, size uint32, digest io.Writer) error {
+	header := w.encodeHeader(entry, size)
+	if _, err := w.file.WriteAt(header, w.offset); err != nil {
+		return err
+	}
+
+	sum := newChecksumHash(w.config.checksumType())
+	fields := checksumHeader(entry.Type, size, entry.Timestamp, entry.Compression)
+	sum.Write(headerExtras(fields[:], w.config.EntryTags, w.config.Namespaces, entry))
+	body := io.NewOffsetWriter(w.file, w.offset+int64(len(header)))
+	n, err := io.CopyN(io.MultiWriter(body, sum, digest), r, int64(size))
+	if err == io.EOF {
+		return fmt.Errorf("reader ended after %d of %d bytes", n, size)
+	}
+	if err != nil {
+		return err
+	}
+	var extra [1]byte
+	if _, err := io.ReadFull(r, extra[:]); err == nil {
+		return fmt.Errorf("reader has more than %d bytes", size)
+	} else if err != io.EOF {
+		return err
+	}
+	end := w.offset + int64(len(header)) + int64(size)
+	if pad := padded(end, int64(w.config.Alignment)) - end; pad > 0 {
+		if _, err := w.file.WriteAt(make([]byte, pad), end); err != nil {
+			return err
+		}
+	}
+
+	entry.Checksum = sumChecksum(sum)
+	_, err = w.file.WriteAt(w.encodeHeader(entry, size), w.offset)
+	return err
+}
+
+// readPayload reads exactly size bytes from r, failing if r yields fewer or
+// more.
+func readPayload(r io.Reader, size uint32) ([]byte, error) {
+	data := make([]byte, size)
+	if n, err := io.ReadFull(r, data); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("reader ended after %d of %d bytes", n, size)
+	} else if err != nil {
+		return nil, err
+	}
+	var extra [1]byte
+	if _, err := io.ReadFull(r, extra[:]); err == nil {
+		return nil, fmt.Errorf("reader has more than %d bytes", size)
+	} else if err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// BatchAppend writes all entries with a single write call and returns their
+// assigned indices. Either every entry is added to the index or, on error,
+// none is; every entry is checked against MaxEntrySize before anything is
+// written, and the error names the batch position of the first too large.
+// Entries in a batch always land in the same segment. A crash during the
+// write can still leave a prefix of the batch on disk; recovery keeps
+// whichever entries are complete.
+func (w *WAL) BatchAppend(entries [][]byte) ([]uint64, error) {
+	indices, err := w.writeBatch(entries, true)
+	if err == nil {
+		for i, data := range entries {
+			w.reportLargeEntry(indices[i], uint32(len(data)))
+		}
+	}
+	if err == nil && w.config.OnAppend != nil {
+		for i, data := range entries {
+			w.config.OnAppend(indices[i], EntryTypeData, data)
+		}
+	}
+	return indices, err
+}
+
+// writeBatch is BatchAppend under writeMu.
+func (w *WAL) writeBatch(entries [][]byte, block bool) ([]uint64, error) {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return nil, ErrWALClosed
+	}
+	if w.readOnly {
+		return nil, ErrReadOnly
+	}
+	total := 0
+	for i, data := range entries {
+		if data == nil {
+			return nil, fmt.Errorf("data at batch position %d is nil", i)
+		}
+		if uint32(len(data)) > w.config.MaxEntrySize {
+			return nil, fmt.Errorf("data at batch position %d: %w", i, ErrEntryTooLarge)
+		}
+		total += int(EncodedSize(data))
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	start := time.Now()
+	buf := make([]byte, 0, total)
+	sizes := make([]int64, len(entries))
+	encode := func(ts int64) {
+		buf = buf[:0]
+		for i, data := range entries {
+			encoded := w.encodeEntry(w.newEntry(EntryTypeData, data, ts))
+			sizes[i] = int64(len(encoded))
+			buf = append(buf, encoded...)
+		}
+	}
+	// Encoded outside the lock, and again under it in the rare case the
+	// clock has not moved past the last append's timestamp.
+	now := w.config.now().UnixNano()
+	encode(now)
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return nil, ErrWALClosed
+	}
+	if w.syncFailure != nil {
+		return nil, w.syncFailure
+	}
+
+	if err := w.admit(len(entries), block); err != nil {
+		return nil, err
+	}
+	if ts := w.nextTimestamp(now); ts != now {
+		encode(ts)
+	}
+	if err := w.checkActiveSize(); err != nil {
+		return nil, err
+	}
+	if w.needsRotation(int64(len(buf))) {
+		if err := w.rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	n, err := w.file.WriteAt(buf, w.offset)
+	if err != nil {
+		return nil, w.abortWrite(err)
+	}
+
+	indices := make([]uint64, len(entries))
+	digests := make([]uint64, len(entries))
+	for i, data := range entries {
+		digests[i] = entryDigest(w.nextIndex+uint64(i), EntryTypeData, data)
+	}
+	w.indexMu.Lock()
+	segID := w.segments[len(w.segments)-1].id
+	for i, size := range sizes {
+		indices[i] = w.nextIndex
+		w.index.append(EntryIndex{Index: w.nextIndex, Segment: segID, Offset: w.offset, Size: size, Digest: digests[i]})
+		w.digest += digests[i]
+		w.offset += size
+		w.nextIndex++
+	}
+	w.indexMu.Unlock()
+	for i, data := range entries {
+		w.cache.add(indices[i], data)
+	}
+
+	atomic.AddInt64(&w.metrics.WriteCount, int64(len(entries)))
 	atomic.AddInt64(&w.metrics.BytesWritten, int64(n))
-	return nil
+	atomic.AddInt64(&w.metrics.PendingBytes, int64(n))
+	w.maybeCheckpoint(len(entries))
+	w.wakeFollowers()
+	w.metrics.AppendLatency.observe(time.Since(start))
+	return indices, nil
+}
+
+// BatchAppendAndSync is BatchAppend followed by a single Sync.
+func (w *WAL) BatchAppendAndSync(entries [][]byte) ([]uint64, error) {
+	indices, err := w.BatchAppend(entries)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Sync(); err != nil {
+		return nil, err
+	}
+	return indices, nil
+}
+
+// maybeCheckpoint records count new appends and writes the index file once
+// IndexCheckpointInterval is reached. Callers must hold writeMu.
+func (w *WAL) maybeCheckpoint(count int) {
+	if !w.config.PersistIndex {
+		return
+	}
+	w.uncheckpointed += count
+	if w.config.IndexCheckpointInterval > 0 && w.uncheckpointed >= w.config.IndexCheckpointInterval {
+		// A failed checkpoint only costs recovery time; the entries
+		// themselves are already written.
+		w.writeIndexFile()
+	}
 }
 
 func (w *WAL) Sync() error {
+	return w.syncContext(context.Background())
+}
+
+// syncContext is Sync under ctx, which parents its span if tracing is on.
+func (w *WAL) syncContext(ctx context.Context) error {
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	var span trace.Span
+	if w.config.Tracer != nil {
+		span = w.startSpan(ctx, "wal.Sync")
+	}
 	w.writeMu.Lock()
 	defer w.writeMu.Unlock()
-	err := w.file.Sync()
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return ErrWALClosed
+	}
+	if span == nil {
+		return w.syncLocked()
+	}
+	span.SetAttributes(attribute.Int64("wal.sync.bytes", atomic.LoadInt64(&w.metrics.PendingBytes)))
+	err := w.syncLocked()
+	endSpan(span, err)
+	return err
+}
+
+// syncLocked is Sync for callers that hold writeMu.
+func (w *WAL) syncLocked() error {
+	if w.syncFailure != nil {
+		return w.syncFailure
+	}
+	start := time.Now()
+	err := w.syncFile(w.file)
+	if err == nil {
+		atomic.StoreInt64(&w.metrics.PendingBytes, 0)
+	}
+	w.metrics.SyncLatency.observe(time.Since(start))
 	atomic.AddInt64(&w.metrics.SyncCount, 1)
-	atomic.StoreInt64(&w.metrics.LastSyncTime, time.Now().UnixNano())
+	atomic.StoreInt64(&w.metrics.LastSyncTime, w.config.now().UnixNano())
+	w.markSynced(w.nextIndex-1, err)
 	return err
 }
 
+// syncFile flushes f according to the configured SyncMode. SyncModeData only
+// applies to files; other storage is always flushed with Sync. A failed
+// fsync stops the WAL; see ErrSyncFailed. A mirror copy is synced after the
+// primary, and a failure there only returns ErrMirrorFailed. A write buffer
+// that can't be flushed still holds its entries, so that failure can be
+// retried. Callers must hold writeMu.
+func (w *WAL) syncFile(f Storage) error {
+	if b, ok := f.(*writeBuffer); ok {
+		if err := b.Flush(); err != nil {
+			return err
+		}
+		f = b.Storage
+	}
+	if w.config.DisableSync {
+		return nil
+	}
+	mirror, _ := f.(*mirrorFile)
+	if mirror != nil {
+		f = mirror.Storage
+	}
+	var err error
+	if file, ok := osFile(f); ok && w.config.SyncMode == SyncModeData {
+		err = fdatasync(file)
+	} else {
+		err = f.Sync()
+	}
+	if err != nil {
+		w.syncFailure = fmt.Errorf("%w: %w", ErrSyncFailed, err)
+		w.markSynced(0, w.syncFailure)
+		return w.syncFailure
+	}
+	if mirror != nil {
+		return mirror.syncMirror(w.config.SyncMode == SyncModeData)
+	}
+	return nil
+}
+
+// syncDir makes changes to the set of files in the WAL's directory durable:
+// a file's contents can survive a crash while its directory entry, or the
+// removal of one, does not. Storage-backed WALs have no directory, and
+// Config.DisableSync skips it.
+func (w *WAL) syncDir() error {
+	if w.storageBacked || w.config.DisableSync {
+		return nil
+	}
+	dir, err := os.Open(w.dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
 func (w *WAL) GetEntry(index uint64) ([]byte, error) {
 	w.indexMu.RLock()
-	if index == 0 || index > uint64(len(w.index)) {
+	info, ok := w.entryAt(index)
+	if !ok {
 		w.indexMu.RUnlock()
 		return nil, fmt.Errorf("index out of bounds")
 	}
-	info := w.index[index-1]
+	seg := w.segmentByID(info.Segment)
+	gen := w.cache.generation()
+	// Take readMu before letting go of indexMu, so a truncation can't cut
+	// the entry between finding it and reading it.
+	w.readMu.RLock()
+	defer w.readMu.RUnlock()
+	w.indexMu.RUnlock()
+
+	if w.cache != nil {
+		if data, ok := w.cache.get(index); ok {
+			atomic.AddInt64(&w.metrics.CacheHits, 1)
+			atomic.AddInt64(&w.metrics.ReadCount, 1)
+			return data, nil
+		}
+		atomic.AddInt64(&w.metrics.CacheMisses, 1)
+	}
+
+	entry, _, err := w.readEntry(seg, index, info.Offset)
+	if err != nil {
+		return nil, err
+	}
+	w.cache.addIfCurrent(index, entry.Data, gen)
+	atomic.AddInt64(&w.metrics.ReadCount, 1)
+	return entry.Data, nil
+}
+
+// GetEntryInto reads the payload of the entry at index into buf and returns
+// its length, so callers can reuse buffers across reads. It returns
+// io.ErrShortBuffer if buf is too small. Uncompressed payloads are read
+// straight into buf without any allocation for the payload. The read cache
+// is not consulted.
+func (w *WAL) GetEntryInto(index uint64, buf []byte) (int, error) {
+	w.indexMu.RLock()
+	info, ok := w.entryAt(index)
+	if !ok {
+		w.indexMu.RUnlock()
+		return 0, fmt.Errorf("index out of bounds")
+	}
+	seg := w.segmentByID(info.Segment)
+	w.readMu.RLock()
+	defer w.readMu.RUnlock()
+	w.indexMu.RUnlock()
+
+	if buf == nil {
+		buf = []byte{}
+	}
+	entry, _, err := w.readEntryInto(seg, info.Offset, buf, !w.config.SkipChecksumOnRead)
+	if err != nil {
+		if isCorruption(err) {
+			w.reportCorruption(index, info.Offset, err)
+		}
+		return 0, err
+	}
+	return len(entry.Data), nil
+}
+
+// GetEntryType returns the type of the entry at index, so readers can
+// dispatch on it before interpreting the payload.
+func (w *WAL) GetEntryType(index uint64) (uint8, error) {
+	w.indexMu.RLock()
+	info, ok := w.entryAt(index)
+	if !ok {
+		w.indexMu.RUnlock()
+		return 0, fmt.Errorf("index out of bounds")
+	}
+	seg := w.segmentByID(info.Segment)
+	w.readMu.RLock()
+	defer w.readMu.RUnlock()
+	w.indexMu.RUnlock()
+	entry, _, err := w.readEntry(seg, index, info.Offset)
+	if err != nil {
+		return 0, err
+	}
+	return entry.Type, nil
+}
+
+// GetEntryWithMeta returns the entry's payload together with the time it was
+// appended, as stamped: if the clock had not moved past the previous entry,
+// this is just after that entry's time instead, so timestamps increase with
+// the index. Entries written in the v1 format carry no timestamp and report
+// the zero Time.
+func (w *WAL) GetEntryWithMeta(index uint64) (data []byte, ts time.Time, err error) {
+	w.indexMu.RLock()
+	info, ok := w.entryAt(index)
+	if !ok {
+		w.indexMu.RUnlock()
+		return nil, time.Time{}, fmt.Errorf("index out of bounds")
+	}
+	seg := w.segmentByID(info.Segment)
+	w.readMu.RLock()
+	defer w.readMu.RUnlock()
+	w.indexMu.RUnlock()
+	entry, _, err := w.readEntry(seg, index, info.Offset)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if entry.Timestamp != 0 {
+		ts = time.Unix(0, entry.Timestamp)
+	}
+	return entry.Data, ts, nil
+}
+
+// GetRawEntry returns the decoded entry at index with every header field:
+// type, stored checksum, timestamp, the codec the payload was stored with,
+// whether it was encrypted and its tag. Data is the decompressed payload,
+// read from disk into a fresh buffer; the read cache is not consulted, so
+// the result is always the caller's to keep or modify.
+func (w *WAL) GetRawEntry(index uint64) (*WALEntry, error) {
+	w.indexMu.RLock()
+	info, ok := w.entryAt(index)
+	if !ok {
+		w.indexMu.RUnlock()
+		return nil, fmt.Errorf("index out of bounds")
+	}
+	seg := w.segmentByID(info.Segment)
+	w.readMu.RLock()
+	defer w.readMu.RUnlock()
 	w.indexMu.RUnlock()
+	entry, _, err := w.readEntry(seg, index, info.Offset)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
 
+// GetEntryTag returns the tag the entry at index was appended with, see
+// AppendWithTag, reading only its header: the payload is neither read nor
+// verified. Entries appended without a tag, or before Config.EntryTags was
+// set, have tag 0.
+func (w *WAL) GetEntryTag(index uint64) (uint64, error) {
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return 0, ErrWALClosed
+	}
+	w.indexMu.RLock()
+	info, ok := w.entryAt(index)
+	if !ok {
+		w.indexMu.RUnlock()
+		return 0, fmt.Errorf("index out of bounds")
+	}
+	seg := w.segmentByID(info.Segment)
 	w.readMu.RLock()
 	defer w.readMu.RUnlock()
-	entry, _, err := w.readEntryAt(info.Offset)
-	return entry.Data, err
+	w.indexMu.RUnlock()
+	h, err := readEntryHeader(seg, info.Offset)
+	if err != nil {
+		return 0, err
+	}
+	return h.tag, nil
+}
+
+// EntryOffset returns where the entry at index is stored: its byte offset
+// within the segment file holding it, which EntryPath names, and its
+// encoded size, header and any alignment padding included. The values stay
+// valid until the entry is truncated away or the log is compacted.
+func (w *WAL) EntryOffset(index uint64) (offset int64, size int64, err error) {
+	w.indexMu.RLock()
+	defer w.indexMu.RUnlock()
+	info, ok := w.entryAt(index)
+	if !ok {
+		return 0, 0, fmt.Errorf("index out of bounds")
+	}
+	return info.Offset, info.Size, nil
+}
+
+// EntryPath returns the path of the segment file holding the entry at
+// index. Storage-backed WALs, which have no files, return "".
+func (w *WAL) EntryPath(index uint64) (string, error) {
+	w.indexMu.RLock()
+	defer w.indexMu.RUnlock()
+	info, ok := w.entryAt(index)
+	if !ok {
+		return "", fmt.Errorf("index out of bounds")
+	}
+	if w.storageBacked {
+		return "", nil
+	}
+	return w.segmentByID(info.Segment).path, nil
+}
+
+// IndexSnapshot returns a copy of the in-memory index, one record per
+// retained entry in index order, for debugging and for building external
+// indexes. Changes to the copy don't affect the WAL, and later appends or
+// truncations don't affect the copy. Offsets are valid as EntryOffset's are.
+func (w *WAL) IndexSnapshot() []EntryIndex {
+	w.indexMu.RLock()
+	defer w.indexMu.RUnlock()
+	return w.index.slice(0, w.index.len())
+}
+
+// BytesAfterIndex returns how many bytes TruncateFromIndex(index) would
+// free: the entries from index on in its segment plus every later segment
+// in full. index must be in [FirstIndex, LastIndex]. Preallocated space is
+// not counted, since the active segment keeps it.
+func (w *WAL) BytesAfterIndex(index uint64) (int64, error) {
+	w.indexMu.RLock()
+	defer w.indexMu.RUnlock()
+	info, ok := w.entryAt(index)
+	if !ok {
+		return 0, fmt.Errorf("index %d out of range [%d, %d]", index, w.nextIndex-uint64(w.index.len()), w.nextIndex-1)
+	}
+	var total int64
+	for _, seg := range w.segments {
+		switch {
+		case seg.id == info.Segment:
+			total += w.segmentEnd(seg) - info.Offset
+		case seg.id > info.Segment:
+			total += w.segmentEnd(seg)
+		}
+	}
+	return total, nil
+}
+
+// BytesBeforeIndex returns how many bytes TruncateBefore(index) would free.
+// Space is reclaimed a segment at a time, so this is the size of the
+// segments entirely before the one holding index; entries before index in
+// that segment stay on disk as dead space and are not counted. index must be
+// in [FirstIndex, LastIndex+1], the latter discarding every entry.
+func (w *WAL) BytesBeforeIndex(index uint64) (int64, error) {
+	w.indexMu.RLock()
+	defer w.indexMu.RUnlock()
+	first := w.nextIndex - uint64(w.index.len())
+	if index < first || index > w.nextIndex {
+		return 0, fmt.Errorf("index %d out of range [%d, %d]", index, first, w.nextIndex)
+	}
+	target := w.segments[len(w.segments)-1].id
+	if info, ok := w.entryAt(index); ok {
+		target = info.Segment
+	}
+	var total int64
+	for _, seg := range w.segments {
+		if seg.id < target {
+			total += w.segmentEnd(seg)
+		}
+	}
+	return total, nil
 }
 
 func (w *WAL) AppendAndSync(data []byte) error {
@@ -106,38 +1095,443 @@ func (w *WAL) AppendAndSync(data []byte) error {
 	return w.Sync()
 }
 
+// AppendContext is Append for callers with a deadline. It returns ctx.Err()
+// without writing if ctx is already done, and the assigned index otherwise.
+// The write itself is not interruptible.
+func (w *WAL) AppendContext(ctx context.Context, data []byte) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.appendEntry(ctx, EntryTypeData, 0, 0, data, true)
+}
+
+// AppendAndSyncContext is AppendAndSync for callers with a deadline. If ctx
+// is done before the sync finishes it returns the entry's index together
+// with ctx.Err(): the entry is in the log, but its durability is unknown.
+// The sync keeps running in the background; use WaitForSync to wait for it.
+func (w *WAL) AppendAndSyncContext(ctx context.Context, data []byte) (uint64, error) {
+	index, err := w.AppendContext(ctx, data)
+	if err != nil {
+		return 0, err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- w.syncContext(ctx) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return 0, err
+		}
+		return index, nil
+	case <-ctx.Done():
+		return index, ctx.Err()
+	}
+}
+
+// entryAt returns the index record for index. Callers must hold indexMu.
+func (w *WAL) entryAt(index uint64) (EntryIndex, bool) {
+	if w.index.len() == 0 || index < w.index.firstIndex() {
+		return EntryIndex{}, false
+	}
+	pos := index - w.index.firstIndex()
+	if pos >= uint64(w.index.len()) {
+		return EntryIndex{}, false
+	}
+	return w.index.at(int(pos)), true
+}
+
+// FirstIndex returns the index of the oldest retained entry, or 0 if the log
+// is empty.
+func (w *WAL) FirstIndex() uint64 {
+	w.indexMu.RLock()
+	defer w.indexMu.RUnlock()
+	if w.index.len() == 0 {
+		return 0
+	}
+	return w.index.firstIndex()
+}
+
 func (w *WAL) LastIndex() uint64 {
 	w.indexMu.RLock()
 	defer w.indexMu.RUnlock()
-	if len(w.index) == 0 {
+	if w.index.len() == 0 {
 		return 0
 	}
-	return w.index[len(w.index)-1].Index
+	return w.index.lastIndex()
 }
 
+// NextIndex returns the index the next append gets: LastIndex()+1, or for
+// an empty log the index it continues from, which TruncateBefore and
+// InstallSnapshot can have moved past 1.
+func (w *WAL) NextIndex() uint64 {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	return w.nextIndex
+}
+
+// ReadAll returns every entry in the log. Entries are contiguous, so each
+// segment is decoded front to back through a readahead buffer, turning a
+// read per entry into a few large ones; checksums are verified as usual.
 func (w *WAL) ReadAll() ([][]byte, error) {
 	w.indexMu.RLock()
-	indices := make([]EntryIndex, len(w.index))
-	copy(indices, w.index)
+	indices := w.index.slice(0, w.index.len())
+	segs := make(map[uint64]*segment, len(w.segments))
+	for _, seg := range w.segments {
+		segs[seg.id] = seg
+	}
+	w.readMu.RLock()
+	defer w.readMu.RUnlock()
 	w.indexMu.RUnlock()
 
 	results := make([][]byte, 0, len(indices))
+
+	// Appends may still land in the active segment, but only past the
+	// entries indexed above, so the buffered bytes stay valid.
+	buf := make([]byte, readaheadSize)
+	var seg *segment
+	for _, idx := range indices {
+		if seg == nil || seg.id != idx.Segment {
+			seg = segs[idx.Segment].buffered(buf)
+		}
+		entry, _, err := w.readEntry(seg, idx.Index, idx.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read entry at index %d: %w", idx.Index, err)
+		}
+		results = append(results, entry.Data)
+	}
+
+	atomic.AddInt64(&w.metrics.ReadCount, int64(len(results)))
+	return results, nil
+}
+
+// ReadAllNS is ReadAll for the entries of namespace ns, see AppendNS, in
+// index order. It reads every entry's header to find its namespace, but only
+// the payloads it returns. Entries in segments written without
+// Config.Namespaces are in namespace 0.
+func (w *WAL) ReadAllNS(ns uint8) ([][]byte, error) {
+	w.indexMu.RLock()
+	indices := w.index.slice(0, w.index.len())
+	segs := make(map[uint64]*segment, len(w.segments))
+	for _, seg := range w.segments {
+		segs[seg.id] = seg
+	}
 	w.readMu.RLock()
 	defer w.readMu.RUnlock()
+	w.indexMu.RUnlock()
 
+	var results [][]byte
+	buf := make([]byte, readaheadSize)
+	var seg *segment
 	for _, idx := range indices {
-		entry, _, err := w.readEntryAt(idx.Offset)
+		if seg == nil || seg.id != idx.Segment {
+			seg = segs[idx.Segment].buffered(buf)
+		}
+		h, err := readEntryHeader(seg, idx.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read entry at index %d: %w", idx.Index, err)
+		}
+		if h.namespace != ns {
+			continue
+		}
+		entry, _, err := w.readEntry(seg, idx.Index, idx.Offset)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read entry at index %d: %w", idx.Index, err)
 		}
 		results = append(results, entry.Data)
 	}
 
+	atomic.AddInt64(&w.metrics.ReadCount, int64(len(results)))
 	return results, nil
 }
 
+// GetRange returns the entries lo through hi, inclusive. The range is read
+// under a single acquisition of readMu, walking each segment sequentially
+// from the first entry's offset rather than looking every entry up.
+func (w *WAL) GetRange(lo, hi uint64) ([][]byte, error) {
+	if lo > hi {
+		return nil, fmt.Errorf("invalid range [%d, %d]", lo, hi)
+	}
+
+	// A contiguous run of entries within one segment.
+	type run struct {
+		seg    *segment
+		offset int64
+		count  int
+	}
+
+	w.indexMu.RLock()
+	if _, ok := w.entryAt(lo); !ok {
+		w.indexMu.RUnlock()
+		return nil, fmt.Errorf("index %d out of bounds", lo)
+	}
+	if _, ok := w.entryAt(hi); !ok {
+		w.indexMu.RUnlock()
+		return nil, fmt.Errorf("index %d out of bounds", hi)
+	}
+	var runs []run
+	w.index.each(int(lo-w.index.firstIndex()), func(e EntryIndex) bool {
+		if len(runs) == 0 || runs[len(runs)-1].seg.id != e.Segment {
+			runs = append(runs, run{seg: w.segmentByID(e.Segment), offset: e.Offset})
+		}
+		runs[len(runs)-1].count++
+		return e.Index < hi
+	})
+	w.readMu.RLock()
+	defer w.readMu.RUnlock()
+	w.indexMu.RUnlock()
+
+	results := make([][]byte, 0, hi-lo+1)
+
+	index := lo
+	for _, r := range runs {
+		offset := r.offset
+		for i := 0; i < r.count; i++ {
+			entry, size, err := w.readEntry(r.seg, index, offset)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read entry at index %d: %w", index, err)
+			}
+			results = append(results, entry.Data)
+			offset += size
+			index++
+		}
+	}
+	return results, nil
+}
+
+// ForEach calls fn with each entry from lo through hi, both inclusive, in
+// order, reading them one at a time instead of collecting them as GetRange
+// does. It stops at the first error fn returns and returns it as is. The
+// data slice is only valid until fn returns: its buffer is reused for the
+// next entry, so fn must copy whatever it keeps.
+//
+// No lock is held while fn runs, so fn may call into the WAL. The range is
+// checked up front, but an entry truncated away before it is reached fails
+// ForEach with an error.
+func (w *WAL) ForEach(lo, hi uint64, fn func(index uint64, data []byte) error) error {
+	if lo > hi {
+		return fmt.Errorf("invalid range [%d, %d]", lo, hi)
+	}
+	w.indexMu.RLock()
+	_, loOK := w.entryAt(lo)
+	_, hiOK := w.entryAt(hi)
+	w.indexMu.RUnlock()
+	if !loOK {
+		return fmt.Errorf("index %d out of bounds", lo)
+	}
+	if !hiOK {
+		return fmt.Errorf("index %d out of bounds", hi)
+	}
+
+	var buf []byte
+	for index := lo; index <= hi; index++ {
+		data, err := w.readInto(index, buf)
+		if err != nil {
+			return fmt.Errorf("failed to read entry at index %d: %w", index, err)
+		}
+		if cap(data) > cap(buf) {
+			buf = data[:cap(data)]
+		}
+		if err := fn(index, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readInto returns the payload of the entry at index, decoded into buf if
+// it fits and into a fresh slice otherwise.
+func (w *WAL) readInto(index uint64, buf []byte) ([]byte, error) {
+	w.indexMu.RLock()
+	info, ok := w.entryAt(index)
+	if !ok {
+		w.indexMu.RUnlock()
+		return nil, fmt.Errorf("index out of bounds")
+	}
+	seg := w.segmentByID(info.Segment)
+	w.readMu.RLock()
+	defer w.readMu.RUnlock()
+	w.indexMu.RUnlock()
+
+	verify := !w.config.SkipChecksumOnRead
+	entry, _, err := w.readEntryInto(seg, info.Offset, buf, verify)
+	if err == io.ErrShortBuffer {
+		entry, _, err = w.readEntryInto(seg, info.Offset, nil, verify)
+	}
+	if err != nil {
+		if isCorruption(err) {
+			w.reportCorruption(index, info.Offset, err)
+		}
+		return nil, err
+	}
+	return entry.Data, nil
+}
+
+// GetEntriesLimited returns consecutive entries starting at lo whose
+// payloads add up to at most maxBytes, and the index to ask for next. The
+// first entry is returned even if it alone is larger, so a caller sending
+// the entries on, such as a Raft leader filling AppendEntries, always makes
+// progress. Fewer entries come back at the end of the log, and none when lo
+// is LastIndex()+1.
+//
+// Entries are picked from their stored sizes before any is read, and at
+// most one is read and not returned. Compressed entries can take more room
+// once decompressed than stored, so a log using compression may get fewer
+// entries than would have fit.
+func (w *WAL) GetEntriesLimited(lo uint64, maxBytes int) ([][]byte, uint64, error) {
+	type run struct {
+		seg    *segment
+		offset int64
+		count  int
+	}
+
+	w.indexMu.RLock()
+	if lo == w.nextIndex {
+		w.indexMu.RUnlock()
+		return nil, lo, nil
+	}
+	if _, ok := w.entryAt(lo); !ok {
+		w.indexMu.RUnlock()
+		return nil, lo, fmt.Errorf("index %d out of bounds", lo)
+	}
+	// An entry header takes at most EntryHeaderSize bytes, plus the tag and
+	// namespace where the segment has them, so this picks every entry whose
+	// payload could still fit.
+	var runs []run
+	budget := int64(maxBytes)
+	w.index.each(int(lo-w.index.firstIndex()), func(e EntryIndex) bool {
+		var seg *segment
+		if len(runs) > 0 && runs[len(runs)-1].seg.id == e.Segment {
+			seg = runs[len(runs)-1].seg
+		} else {
+			seg = w.segmentByID(e.Segment)
+		}
+		stored := e.Size - EntryHeaderSize - seg.headerExtrasSize()
+		if len(runs) > 0 && stored > budget {
+			return false
+		}
+		budget -= stored
+		if len(runs) == 0 || runs[len(runs)-1].seg.id != e.Segment {
+			runs = append(runs, run{seg: seg, offset: e.Offset})
+		}
+		runs[len(runs)-1].count++
+		return true
+	})
+	w.readMu.RLock()
+	defer w.readMu.RUnlock()
+	w.indexMu.RUnlock()
+
+	var results [][]byte
+	total := 0
+	index := lo
+	for _, r := range runs {
+		offset := r.offset
+		for i := 0; i < r.count; i++ {
+			entry, size, err := w.readEntry(r.seg, index, offset)
+			if err != nil {
+				return nil, lo, fmt.Errorf("failed to read entry at index %d: %w", index, err)
+			}
+			if len(results) > 0 && total+len(entry.Data) > maxBytes {
+				return results, index, nil
+			}
+			results = append(results, entry.Data)
+			total += len(entry.Data)
+			offset += size
+			index++
+		}
+	}
+	return results, index, nil
+}
+
+// ReadPage returns up to maxEntries entries starting at startIndex, and the
+// index the next page starts at, or 0 once this page reaches the end of the
+// log, so a tool can page through a log too large for ReadAll. A startIndex
+// past LastIndex returns no entries and 0; one before FirstIndex is an
+// error. Entries appended after a page that returned 0 can be read by
+// asking for LastIndex()+1 as before.
+func (w *WAL) ReadPage(startIndex uint64, maxEntries int) ([][]byte, uint64, error) {
+	if maxEntries <= 0 {
+		return nil, 0, fmt.Errorf("invalid page size %d", maxEntries)
+	}
+
+	var first, last uint64
+	w.indexMu.RLock()
+	if w.index.len() > 0 {
+		first, last = w.index.firstIndex(), w.index.lastIndex()
+	}
+	w.indexMu.RUnlock()
+	if startIndex > last {
+		return nil, 0, nil
+	}
+	if startIndex < first {
+		return nil, 0, fmt.Errorf("index %d out of bounds", startIndex)
+	}
+
+	hi := last
+	if uint64(maxEntries) <= last-startIndex {
+		hi = startIndex + uint64(maxEntries) - 1
+	}
+	page, err := w.GetRange(startIndex, hi)
+	if err != nil {
+		return nil, 0, err
+	}
+	atomic.AddInt64(&w.metrics.ReadCount, int64(len(page)))
+	if hi == last {
+		return page, 0, nil
+	}
+	return page, hi + 1, nil
+}
+
 func (w *WAL) Close() error {
 	if !atomic.CompareAndSwapInt32(&w.closed, 0, 1) { return nil }
-	w.Sync()
-	return w.file.Close()
-}
\ No newline at end of file
+	// The committer syncs under writeMu, so it must be gone first.
+	w.stopSyncLoop()
+
+	// Holding writeMu, Close waits for any write already in progress and
+	// every later one sees closed and fails, so the final sync covers each
+	// write that succeeded.
+	w.writeMu.Lock()
+	err := w.closeLocked()
+	w.writeMu.Unlock()
+
+	// Wake any WaitForSync callers the final sync didn't satisfy.
+	w.syncMu.Lock()
+	w.syncCond.Broadcast()
+	w.syncMu.Unlock()
+	w.wakeFollowers()
+	return err
+}
+
+// closeLocked flushes and closes the files. Callers must hold writeMu.
+func (w *WAL) closeLocked() error {
+	var err error
+	if !w.readOnly {
+		err = w.syncLocked()
+	}
+	if err == nil && w.config.PersistIndex {
+		err = w.writeIndexFile()
+	}
+	// Every file change is synced where it happens; this is a last barrier
+	// for the sidecars, whose renames are not.
+	if err == nil && !w.readOnly {
+		err = w.syncDir()
+	}
+	// Let reads in progress finish before their files go.
+	w.readMu.Lock()
+	if cerr := w.closeSegments(); err == nil {
+		err = cerr
+	}
+	w.readMu.Unlock()
+	w.closeLock()
+	return err
+}
+
+// closeLock releases the advisory lock, and the mirror's if it holds one.
+// Storage-backed WALs hold none.
+func (w *WAL) closeLock() {
+	if w.lock != nil {
+		w.lock.Close()
+	}
+	if w.mirrorLock != nil {
+		w.mirrorLock.Close()
+	}
+}
@@ -0,0 +1,54 @@
+// Package walprom exports a WAL's metrics to Prometheus. It lives outside
+// package wal so that only programs which import it depend on the
+// Prometheus client.
+package walprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"wal_project/wal"
+)
+
+type collector struct {
+	w *wal.WAL
+
+	writes      *prometheus.Desc
+	syncs       *prometheus.Desc
+	bytes       *prometheus.Desc
+	corruptions *prometheus.Desc
+	lastSync    *prometheus.Desc
+}
+
+// NewCollector returns a collector that reads w.Metrics() on every scrape.
+// labels are attached to every metric, so several WALs can be registered
+// side by side, e.g. with a "shard" label each.
+func NewCollector(w *wal.WAL, labels prometheus.Labels) prometheus.Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName("wal", "", name), help, nil, labels)
+	}
+	return &collector{
+		w:           w,
+		writes:      desc("writes_total", "Entries appended."),
+		syncs:       desc("syncs_total", "Sync calls, including failed ones."),
+		bytes:       desc("written_bytes_total", "Encoded bytes appended, headers included."),
+		corruptions: desc("corruptions_total", "Entries that failed their checksum or could not be decoded."),
+		lastSync:    desc("last_sync_timestamp_seconds", "Unix time of the last sync, or 0 if there was none."),
+	}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.writes
+	ch <- c.syncs
+	ch <- c.bytes
+	ch <- c.corruptions
+	ch <- c.lastSync
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	m := c.w.Metrics()
+	ch <- prometheus.MustNewConstMetric(c.writes, prometheus.CounterValue, float64(m.WriteCount))
+	ch <- prometheus.MustNewConstMetric(c.syncs, prometheus.CounterValue, float64(m.SyncCount))
+	ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.CounterValue, float64(m.BytesWritten))
+	ch <- prometheus.MustNewConstMetric(c.corruptions, prometheus.CounterValue, float64(m.Corruptions))
+	ch <- prometheus.MustNewConstMetric(c.lastSync, prometheus.GaugeValue, float64(m.LastSyncTime)/1e9)
+}
@@ -0,0 +1,67 @@
+package walprom
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"wal_project/wal"
+)
+
+func TestCollector(t *testing.T) {
+	tmpDir := t.TempDir()
+	walPath := filepath.Join(tmpDir, "test.wal")
+
+	w, err := wal.New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	w.Append([]byte("entry 1"))
+	w.Append([]byte("entry 2"))
+
+	c := NewCollector(w, prometheus.Labels{"shard": "0"})
+	expected := `
+# HELP wal_corruptions_total Entries that failed their checksum or could not be decoded.
+# TYPE wal_corruptions_total counter
+wal_corruptions_total{shard="0"} 0
+# HELP wal_syncs_total Sync calls, including failed ones.
+# TYPE wal_syncs_total counter
+wal_syncs_total{shard="0"} 0
+# HELP wal_writes_total Entries appended.
+# TYPE wal_writes_total counter
+wal_writes_total{shard="0"} 2
+# HELP wal_written_bytes_total Encoded bytes appended, headers included.
+# TYPE wal_written_bytes_total counter
+wal_written_bytes_total{shard="0"} 50
+`
+	err = testutil.CollectAndCompare(c, strings.NewReader(expected),
+		"wal_corruptions_total", "wal_syncs_total", "wal_writes_total", "wal_written_bytes_total")
+	if err != nil {
+		t.Errorf("Unexpected metrics: %v", err)
+	}
+
+	if err := w.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatalf("Failed to register collector: %v", err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather: %v", err)
+	}
+	if len(families) != 5 {
+		t.Errorf("Expected 5 metrics, got %d", len(families))
+	}
+	for _, f := range families {
+		if f.GetName() == "wal_last_sync_timestamp_seconds" && f.GetMetric()[0].GetGauge().GetValue() == 0 {
+			t.Error("Expected the last sync time to be set after Sync")
+		}
+	}
+}
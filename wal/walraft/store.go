@@ -0,0 +1,198 @@
+// Package walraft adapts a WAL to the raft.LogStore interface of
+// github.com/hashicorp/raft. It lives outside package wal so that only
+// programs which import it depend on the Raft library.
+package walraft
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"wal_project/wal"
+)
+
+// Each Raft log is stored as one EntryTypeData entry at the log's own index,
+// with the fields the WAL has no place for in front of the payload:
+//
+//	[0]     encoding version
+//	[1:9]   term
+//	[9]     raft.LogType
+//	[10:18] AppendedAt in Unix nanoseconds, 0 if unset
+//	[18:..] uvarint length of Extensions, Extensions, then Data
+const logVersion = 1
+
+const logHeaderSize = 18
+
+// RaftStore is a raft.LogStore backed by a WAL. The WAL's indices are the
+// Raft indices, so the store must be the WAL's only writer.
+type RaftStore struct {
+	wal *wal.WAL
+}
+
+var _ raft.LogStore = (*RaftStore)(nil)
+
+// NewRaftStore returns a store that keeps its logs in w. Closing w is left
+// to the caller.
+func NewRaftStore(w *wal.WAL) *RaftStore {
+	return &RaftStore{wal: w}
+}
+
+// FirstIndex returns the first index in the log, or 0 if it is empty.
+func (s *RaftStore) FirstIndex() (uint64, error) {
+	return s.wal.FirstIndex(), nil
+}
+
+// LastIndex returns the last index in the log, or 0 if it is empty.
+func (s *RaftStore) LastIndex() (uint64, error) {
+	return s.wal.LastIndex(), nil
+}
+
+// GetLog reads the log at index into log, returning raft.ErrLogNotFound if
+// it is not in the store.
+func (s *RaftStore) GetLog(index uint64, log *raft.Log) error {
+	if first := s.wal.FirstIndex(); first == 0 || index < first || index > s.wal.LastIndex() {
+		return raft.ErrLogNotFound
+	}
+	data, err := s.wal.GetEntry(index)
+	if err != nil {
+		return err
+	}
+	if err := decodeLog(data, log); err != nil {
+		return fmt.Errorf("log %d: %w", index, err)
+	}
+	log.Index = index
+	return nil
+}
+
+// StoreLog stores a single log.
+func (s *RaftStore) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+// StoreLogs appends logs, which must have consecutive indices, and syncs
+// them before returning. The first may follow the last stored log, or
+// replace stored logs from its index on, overwriting a conflicting suffix
+// the way AppendEntries does. Logs starting past LastIndex()+1 come from a
+// leader after this node installed a snapshot beyond its log: whatever the
+// store held is dropped and it continues from the first of them. An empty
+// store accepts any starting index. One below where it was emptied resets
+// the WAL, which also drops any snapshot installed on it directly. A
+// failed call stores none of logs.
+func (s *RaftStore) StoreLogs(logs []*raft.Log) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	entries := make([][]byte, len(logs))
+	for i, log := range logs {
+		if log.Index != logs[0].Index+uint64(i) {
+			return fmt.Errorf("logs are not consecutive: index %d follows %d", log.Index, logs[i-1].Index)
+		}
+		entries[i] = encodeLog(log)
+	}
+
+	first := logs[0].Index
+	switch {
+	case s.wal.FirstIndex() == 0:
+		// An emptied log continues past the logs it held, which may be
+		// beyond first; only then is it started over.
+		if first < s.wal.NextIndex() {
+			if err := s.wal.Reset(); err != nil {
+				return err
+			}
+		}
+		if err := s.wal.TruncateBefore(first); err != nil {
+			return err
+		}
+	case first > s.wal.LastIndex()+1:
+		// Raft keeps TrailingLogs logs when installing a snapshot, which
+		// can leave all of ours behind it, and the leader's logs start
+		// after it. Empty the log, then move its start up to theirs.
+		if err := s.wal.TruncateBefore(s.wal.LastIndex() + 1); err != nil {
+			return err
+		}
+		if err := s.wal.TruncateBefore(first); err != nil {
+			return err
+		}
+	}
+	// AppendAt checks the position and truncates a conflicting suffix;
+	// the rest follows in one write.
+	if err := s.wal.AppendAt(first, wal.EntryTypeData, entries[0]); err != nil {
+		return err
+	}
+	if _, err := s.wal.BatchAppend(entries[1:]); err != nil {
+		// Take logs[0] back out, so the call stores all or nothing.
+		if terr := s.wal.TruncateFromIndex(first); terr != nil {
+			return errors.Join(err, terr)
+		}
+		return err
+	}
+	return s.wal.Sync()
+}
+
+// DeleteRange removes the logs from min to max, inclusive. Raft only ever
+// deletes a prefix, when compacting behind a snapshot, or a suffix, when
+// resolving a conflict; a range strictly inside the log is an error.
+func (s *RaftStore) DeleteRange(min, max uint64) error {
+	first, last := s.wal.FirstIndex(), s.wal.LastIndex()
+	if first == 0 || max < first || min > last || min > max {
+		return nil
+	}
+	switch {
+	case min <= first:
+		// Deleting past the end empties the log; the next StoreLogs may
+		// then start anywhere.
+		if max > last {
+			max = last
+		}
+		return s.wal.TruncateBefore(max + 1)
+	case max >= last:
+		return s.wal.TruncateFromIndex(min)
+	default:
+		return fmt.Errorf("cannot delete logs %d-%d from the middle of [%d, %d]", min, max, first, last)
+	}
+}
+
+func encodeLog(log *raft.Log) []byte {
+	buf := make([]byte, logHeaderSize, logHeaderSize+binary.MaxVarintLen64+len(log.Extensions)+len(log.Data))
+	buf[0] = logVersion
+	binary.BigEndian.PutUint64(buf[1:9], log.Term)
+	buf[9] = byte(log.Type)
+	if !log.AppendedAt.IsZero() {
+		binary.BigEndian.PutUint64(buf[10:18], uint64(log.AppendedAt.UnixNano()))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(log.Extensions)))
+	buf = append(buf, log.Extensions...)
+	return append(buf, log.Data...)
+}
+
+var errBadLog = errors.New("not a Raft log entry")
+
+func decodeLog(buf []byte, log *raft.Log) error {
+	if len(buf) < logHeaderSize || buf[0] != logVersion {
+		return errBadLog
+	}
+	ext, n := binary.Uvarint(buf[logHeaderSize:])
+	rest := buf[logHeaderSize:]
+	if n <= 0 || ext > uint64(len(rest)-n) {
+		return errBadLog
+	}
+	rest = rest[n:]
+
+	*log = raft.Log{
+		Term: binary.BigEndian.Uint64(buf[1:9]),
+		Type: raft.LogType(buf[9]),
+	}
+	if ns := int64(binary.BigEndian.Uint64(buf[10:18])); ns != 0 {
+		log.AppendedAt = time.Unix(0, ns)
+	}
+	if ext > 0 {
+		log.Extensions = rest[:ext]
+	}
+	if len(rest) > int(ext) {
+		log.Data = rest[ext:]
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package walraft
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"wal_project/wal"
+)
+
+func newTestStore(t *testing.T) (*RaftStore, string) {
+	t.Helper()
+	walPath := filepath.Join(t.TempDir(), "raft.wal")
+	w, err := wal.New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return NewRaftStore(w), walPath
+}
+
+func testLogs(from, to, term uint64) []*raft.Log {
+	var logs []*raft.Log
+	for i := from; i <= to; i++ {
+		logs = append(logs, &raft.Log{Index: i, Term: term, Type: raft.LogCommand, Data: []byte(fmt.Sprintf("cmd-%d-%d", term, i))})
+	}
+	return logs
+}
+
+func TestStoreLogs(t *testing.T) {
+	s, walPath := newTestStore(t)
+
+	if first, _ := s.FirstIndex(); first != 0 {
+		t.Errorf("Expected FirstIndex 0 for an empty store, got %d", first)
+	}
+	var log raft.Log
+	if err := s.GetLog(1, &log); err != raft.ErrLogNotFound {
+		t.Errorf("Expected ErrLogNotFound, got %v", err)
+	}
+
+	config := &raft.Log{
+		Index:      1,
+		Term:       1,
+		Type:       raft.LogConfiguration,
+		Data:       []byte("peers"),
+		Extensions: []byte("ext"),
+		AppendedAt: time.Unix(0, 1700000000123456789),
+	}
+	if err := s.StoreLog(config); err != nil {
+		t.Fatalf("Failed to store log: %v", err)
+	}
+	if err := s.StoreLogs(testLogs(2, 5, 1)); err != nil {
+		t.Fatalf("Failed to store logs: %v", err)
+	}
+
+	if err := s.GetLog(1, &log); err != nil {
+		t.Fatalf("Failed to get log: %v", err)
+	}
+	if !reflect.DeepEqual(&log, config) {
+		t.Errorf("Expected %+v, got %+v", config, &log)
+	}
+
+	// A new leader's logs replace the conflicting suffix from 4.
+	if err := s.StoreLogs(testLogs(4, 6, 2)); err != nil {
+		t.Fatalf("Failed to overwrite logs: %v", err)
+	}
+	if last, _ := s.LastIndex(); last != 6 {
+		t.Fatalf("Expected LastIndex 6, got %d", last)
+	}
+	s.wal.Close()
+
+	w, err := wal.New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	defer w.Close()
+	s = NewRaftStore(w)
+	for i, term := range []uint64{1, 1, 1, 2, 2, 2} {
+		index := uint64(i) + 1
+		if err := s.GetLog(index, &log); err != nil {
+			t.Fatalf("Failed to get log %d: %v", index, err)
+		}
+		if log.Index != index || log.Term != term {
+			t.Errorf("Log %d: expected term %d, got index %d term %d", index, term, log.Index, log.Term)
+		}
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	s, _ := newTestStore(t)
+	if err := s.StoreLogs(testLogs(1, 10, 1)); err != nil {
+		t.Fatalf("Failed to store logs: %v", err)
+	}
+
+	if err := s.DeleteRange(4, 6); err == nil {
+		t.Error("Expected error deleting from the middle")
+	}
+	if err := s.DeleteRange(8, 10); err != nil {
+		t.Fatalf("Failed to delete suffix: %v", err)
+	}
+	if err := s.DeleteRange(1, 3); err != nil {
+		t.Fatalf("Failed to delete prefix: %v", err)
+	}
+	first, _ := s.FirstIndex()
+	last, _ := s.LastIndex()
+	if first != 4 || last != 7 {
+		t.Fatalf("Expected [4, 7], got [%d, %d]", first, last)
+	}
+
+	// Compacting behind a snapshot past the end of the log empties it, and
+	// the leader's next logs start after the snapshot.
+	if err := s.DeleteRange(4, 20); err != nil {
+		t.Fatalf("Failed to delete everything: %v", err)
+	}
+	if first, _ := s.FirstIndex(); first != 0 {
+		t.Errorf("Expected an empty store, got FirstIndex %d", first)
+	}
+	if err := s.StoreLogs(testLogs(21, 22, 3)); err != nil {
+		t.Fatalf("Failed to store logs after a snapshot: %v", err)
+	}
+	var log raft.Log
+	if err := s.GetLog(21, &log); err != nil || string(log.Data) != "cmd-3-21" {
+		t.Errorf("Expected cmd-3-21, got %q, %v", log.Data, err)
+	}
+}
+
+func TestStoreLogsPastSnapshot(t *testing.T) {
+	s, walPath := newTestStore(t)
+	if err := s.StoreLogs(testLogs(1, 10, 1)); err != nil {
+		t.Fatalf("Failed to store logs: %v", err)
+	}
+
+	// After installing a snapshot at 1000 the store still holds its
+	// trailing logs, and the leader continues from 1001.
+	if err := s.StoreLogs(testLogs(1001, 1003, 2)); err != nil {
+		t.Fatalf("Failed to store logs past the snapshot: %v", err)
+	}
+	first, _ := s.FirstIndex()
+	last, _ := s.LastIndex()
+	if first != 1001 || last != 1003 {
+		t.Fatalf("Expected [1001, 1003], got [%d, %d]", first, last)
+	}
+	var log raft.Log
+	if err := s.GetLog(5, &log); err != raft.ErrLogNotFound {
+		t.Errorf("Expected ErrLogNotFound for a log behind the snapshot, got %v", err)
+	}
+	s.wal.Close()
+
+	w, err := wal.New(walPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer w.Close()
+	s = NewRaftStore(w)
+	if err := s.GetLog(1001, &log); err != nil || string(log.Data) != "cmd-2-1001" {
+		t.Errorf("Expected cmd-2-1001, got %q, %v", log.Data, err)
+	}
+}
+
+func TestStoreLogsBelowEmptiedStore(t *testing.T) {
+	s, _ := newTestStore(t)
+	if err := s.StoreLogs(testLogs(1, 10, 1)); err != nil {
+		t.Fatalf("Failed to store logs: %v", err)
+	}
+	if err := s.DeleteRange(1, 10); err != nil {
+		t.Fatalf("Failed to delete everything: %v", err)
+	}
+
+	// The emptied WAL would continue at 11; the store starts where told.
+	if err := s.StoreLogs(testLogs(4, 6, 2)); err != nil {
+		t.Fatalf("Failed to store logs in an emptied store: %v", err)
+	}
+	first, _ := s.FirstIndex()
+	last, _ := s.LastIndex()
+	if first != 4 || last != 6 {
+		t.Fatalf("Expected [4, 6], got [%d, %d]", first, last)
+	}
+	var log raft.Log
+	if err := s.GetLog(4, &log); err != nil || string(log.Data) != "cmd-2-4" {
+		t.Errorf("Expected cmd-2-4, got %q, %v", log.Data, err)
+	}
+}
+
+func TestStoreLogsAfterDeleteAll(t *testing.T) {
+	s, walPath := newTestStore(t)
+
+	// Continuing where an emptied store left off neither starts a new
+	// segment nor drops the WAL's snapshot.
+	for cycle := uint64(0); cycle < 3; cycle++ {
+		if err := s.StoreLogs(testLogs(cycle*10+1, cycle*10+10, 1)); err != nil {
+			t.Fatalf("Failed to store logs: %v", err)
+		}
+		if err := s.DeleteRange(cycle*10+1, cycle*10+10); err != nil {
+			t.Fatalf("Failed to delete logs: %v", err)
+		}
+	}
+	if err := s.wal.InstallSnapshot(40, []byte("snap")); err != nil {
+		t.Fatalf("Failed to install snapshot: %v", err)
+	}
+	if err := s.StoreLogs(testLogs(41, 42, 2)); err != nil {
+		t.Fatalf("Failed to store logs after the snapshot: %v", err)
+	}
+	if path, err := s.wal.EntryPath(41); err != nil || path != walPath {
+		t.Errorf("Expected log 41 in the first segment %s, got %s (%v)", walPath, path, err)
+	}
+	if index, _, err := s.wal.Snapshot(); err != nil || index != 40 {
+		t.Errorf("Expected the snapshot at 40 kept, got %d, %v", index, err)
+	}
+}
+
+func TestStoreLogsFailure(t *testing.T) {
+	s, _ := newTestStore(t)
+	if err := s.StoreLogs(testLogs(1, 3, 1)); err != nil {
+		t.Fatalf("Failed to store logs: %v", err)
+	}
+
+	// The second log is too large, so neither is kept.
+	logs := testLogs(4, 5, 1)
+	logs[1].Data = make([]byte, wal.DefaultMaxEntrySize)
+	if err := s.StoreLogs(logs); err == nil {
+		t.Fatal("Expected error storing a log too large for the WAL")
+	}
+	if last, _ := s.LastIndex(); last != 3 {
+		t.Errorf("Expected last index 3 after the failed call, got %d", last)
+	}
+	if err := s.StoreLogs(testLogs(4, 5, 2)); err != nil {
+		t.Errorf("Failed to store logs after the failed call: %v", err)
+	}
+}